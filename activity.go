@@ -0,0 +1,83 @@
+package entropy
+
+import (
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+type ActivityKind string
+
+const (
+	ActivityPost     ActivityKind = "post" // including replies
+	ActivityReaction ActivityKind = "reaction"
+	ActivityFollow   ActivityKind = "follow"
+)
+
+// Something a user did. We only say which post it was, not what the post says, so
+// there's nothing here to distort.
+type ActivityItem struct {
+	Kind             ActivityKind
+	At               time.Time
+	PostID           int64  // the post they wrote, or reacted to
+	Emoji            string // for reactions
+	FollowedUserName string // for follows
+}
+
+func (a *ActivityItem) PostURL() string {
+	return PostURL(a.PostID)
+}
+
+func (a *ActivityItem) FollowedUserURL() string {
+	return UserURL(a.FollowedUserName)
+}
+
+// Get the (up to) limit most recent things the user did from before the given time:
+// their posts, reactions, and follows, all merged together, newest first.
+//
+// Reactions and follows only have their times to the second, so a page that ends partway
+// through a second will skip the rest of that second's reactions and follows.
+//
+// TODO: there's no blocking or private accounts yet. When there are, they need to be
+// respected here.
+func GetUserActivity(conn *sqlite.Conn, userID int64, before time.Time, limit int) ([]ActivityItem, error) {
+	var items []ActivityItem
+	// Everything's in milliseconds here, like post.created_at
+	query := `
+		select 'post', created_at, post_id, null, null
+		from post
+		where user_id = :userID and created_at < :before
+
+		union all
+
+		select 'reaction', reacted_at * 1000, post_id, emoji, null
+		from reaction
+		where user_id = :userID and reacted_at * 1000 < :before
+
+		union all
+
+		select 'follow', user_follow.followed_at * 1000, null, null, user.user_name
+		from user_follow
+		join user on user.user_id = user_follow.followed_user_id
+		where user_follow.user_id = :userID and user_follow.followed_at * 1000 < :before
+
+		order by 2 desc
+		limit :limit`
+	collect := func(stmt *sqlite.Stmt) error {
+		items = append(items, ActivityItem{
+			Kind:             ActivityKind(stmt.ColumnText(0)),
+			At:               time.UnixMilli(stmt.ColumnInt64(1)).UTC(),
+			PostID:           stmt.ColumnInt64(2),
+			Emoji:            stmt.ColumnText(3),
+			FollowedUserName: stmt.ColumnText(4),
+		})
+		return nil
+	}
+	err := exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetInt64(":before", before.UnixMilli())
+		stmt.SetInt64(":limit", int64(limit))
+		return nil
+	})
+	return items, err
+}
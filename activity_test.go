@@ -0,0 +1,69 @@
+package entropy
+
+import (
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUserActivity(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	otherPostID, err := CreatePost(conn, other.UserID, "hi")
+	assert.Nil(t, err)
+	firstPostID, err := CreatePost(conn, me.UserID, "first")
+	assert.Nil(t, err)
+	secondPostID, err := CreatePost(conn, me.UserID, "second")
+	assert.Nil(t, err)
+	_, err = ReactToPostIfExists(conn, me.UserID, otherPostID, "🔥")
+	assert.Nil(t, err)
+	follow(t, conn, me.UserID, other.UserID)
+	// Other people's activity isn't in there
+	follow(t, conn, other.UserID, me.UserID)
+	_, err = ReactToPostIfExists(conn, other.UserID, firstPostID, "🔥")
+	assert.Nil(t, err)
+
+	// Spread everything out: first post, follow, reaction, second post
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	script := []struct {
+		query string
+		args  []any
+	}{
+		{"update post set created_at = ? where post_id = ?", []any{at(0).UnixMilli(), firstPostID}},
+		{"update user_follow set followed_at = ? where user_id = ?", []any{at(1).Unix(), me.UserID}},
+		{"update reaction set reacted_at = ? where user_id = ?", []any{at(2).Unix(), me.UserID}},
+		{"update post set created_at = ? where post_id = ?", []any{at(3).UnixMilli(), secondPostID}},
+	}
+	for _, step := range script {
+		assert.Nil(t, sqlitex.Exec(conn, step.query, nil, step.args...))
+	}
+
+	items, err := GetUserActivity(conn, me.UserID, at(10), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []ActivityItem{
+		{Kind: ActivityPost, At: at(3), PostID: secondPostID},
+		{Kind: ActivityReaction, At: at(2), PostID: otherPostID, Emoji: "🔥"},
+		{Kind: ActivityFollow, At: at(1), FollowedUserName: "other"},
+		{Kind: ActivityPost, At: at(0), PostID: firstPostID},
+	}, items)
+
+	// Paging through it
+	items, err = GetUserActivity(conn, me.UserID, at(10), 2)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	items, err = GetUserActivity(conn, me.UserID, items[1].At, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []ActivityKind{ActivityFollow, ActivityPost}, []ActivityKind{items[0].Kind, items[1].Kind})
+}
@@ -0,0 +1,184 @@
+package entropy
+
+import (
+	"html/template"
+	"strings"
+	"time"
+)
+
+// A read-only ActivityPub (https://www.w3.org/TR/activitypub/) view of users and their
+// posts: an Actor for each user, and an outbox of their posts as Create activities. Nothing
+// is delivered to other servers yet, and there's no inbox, so this is only enough for
+// other software to look people up and read what they've posted.
+//
+// All of the IDs are absolute URLs, built from baseURL (e.g.
+// "https://entropych.maxhully.net"), so they have to use the site's canonical host.
+
+// The content type of ActivityPub documents
+const ActivityPubContentType = "application/activity+json"
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	activityStreamsPublic  = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+type ActivityPubImage struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type ActivityPubActor struct {
+	Context           string            `json:"@context"`
+	ID                string            `json:"id"`
+	Type              string            `json:"type"`
+	PreferredUsername string            `json:"preferredUsername"`
+	Name              string            `json:"name"`
+	Summary           template.HTML     `json:"summary"`
+	URL               string            `json:"url"`
+	Outbox            string            `json:"outbox"`
+	Icon              *ActivityPubImage `json:"icon,omitempty"`
+}
+
+type ActivityPubNote struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	AttributedTo string    `json:"attributedTo"`
+	Content      string    `json:"content"`
+	Published    time.Time `json:"published"`
+	URL          string    `json:"url"`
+	To           []string  `json:"to"`
+	InReplyTo    string    `json:"inReplyTo,omitempty"`
+}
+
+type ActivityPubCreate struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     string          `json:"actor"`
+	Published time.Time       `json:"published"`
+	To        []string        `json:"to"`
+	Object    ActivityPubNote `json:"object"`
+}
+
+// A user's outbox. The posts themselves are on its pages, starting with First.
+type ActivityPubOutbox struct {
+	Context string `json:"@context"`
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	First   string `json:"first"`
+}
+
+type ActivityPubOutboxPage struct {
+	Context      string              `json:"@context"`
+	ID           string              `json:"id"`
+	Type         string              `json:"type"`
+	PartOf       string              `json:"partOf"`
+	OrderedItems []ActivityPubCreate `json:"orderedItems"`
+	Next         string              `json:"next,omitempty"`
+}
+
+func absoluteURL(baseURL string, path string) string {
+	return strings.TrimSuffix(baseURL, "/") + path
+}
+
+// The ID of the user's Actor, which is their profile's URL
+func (u *User) ActivityPubID(baseURL string) string {
+	return u.AbsoluteURL(baseURL)
+}
+
+// The URL of the user's outbox
+func (u *User) ActivityPubOutboxURL(baseURL string) string {
+	return u.AbsoluteURL(baseURL) + "outbox"
+}
+
+func NewActivityPubActor(user *User, baseURL string) *ActivityPubActor {
+	return &ActivityPubActor{
+		Context:           activityStreamsContext,
+		ID:                user.ActivityPubID(baseURL),
+		Type:              "Person",
+		PreferredUsername: user.Name,
+		Name:              authorLabel(user.Name, user.DisplayName),
+		Summary:           RenderBio(user.Bio),
+		URL:               user.AbsoluteURL(baseURL),
+		Outbox:            user.ActivityPubOutboxURL(baseURL),
+		Icon:              &ActivityPubImage{Type: "Image", URL: absoluteURL(baseURL, user.AvatarURL())},
+	}
+}
+
+func NewActivityPubOutbox(user *User, firstPageURL string, baseURL string) *ActivityPubOutbox {
+	return &ActivityPubOutbox{
+		Context: activityStreamsContext,
+		ID:      user.ActivityPubOutboxURL(baseURL),
+		Type:    "OrderedCollection",
+		First:   firstPageURL,
+	}
+}
+
+// A page of the user's outbox, with their posts (newest first) as Create activities.
+// pageURL and nextPageURL are this page's URL and the next one's ("" if it's the last).
+//
+// The note's content is the post's text, escaped, rather than its rendered HTML: the
+// links in that are relative to this site, which wouldn't work anywhere else.
+func NewActivityPubOutboxPage(user *User, posts []Post, baseURL string, pageURL string, nextPageURL string) *ActivityPubOutboxPage {
+	actorID := user.ActivityPubID(baseURL)
+	to := []string{activityStreamsPublic}
+	items := make([]ActivityPubCreate, 0, len(posts))
+	for i := range posts {
+		post := &posts[i]
+		note := ActivityPubNote{
+			ID:           post.AbsoluteURL(baseURL),
+			Type:         "Note",
+			AttributedTo: actorID,
+			Content:      "<p>" + template.HTMLEscapeString(post.Content) + "</p>",
+			Published:    post.CreatedAt,
+			URL:          post.AbsoluteURL(baseURL),
+			To:           to,
+		}
+		if replyingTo := post.ReplyingToPostURL(); replyingTo != "" {
+			note.InReplyTo = absoluteURL(baseURL, replyingTo)
+		}
+		items = append(items, ActivityPubCreate{
+			ID:        note.ID + "#create",
+			Type:      "Create",
+			Actor:     actorID,
+			Published: note.Published,
+			To:        to,
+			Object:    note,
+		})
+	}
+	return &ActivityPubOutboxPage{
+		Context:      activityStreamsContext,
+		ID:           pageURL,
+		Type:         "OrderedCollectionPage",
+		PartOf:       user.ActivityPubOutboxURL(baseURL),
+		OrderedItems: items,
+		Next:         nextPageURL,
+	}
+}
+
+// The content type of WebFinger (RFC 7033) responses
+const WebFingerContentType = "application/jrd+json"
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// The WebFinger response for a user, which is how other servers get from their handle
+// (like acct:max@entropych.maxhully.net) to their Actor
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+func NewWebFinger(user *User, host string, baseURL string) *WebFinger {
+	return &WebFinger{
+		Subject: "acct:" + user.Name + "@" + host,
+		Aliases: []string{user.ActivityPubID(baseURL)},
+		Links: []WebFingerLink{
+			{Rel: "self", Type: ActivityPubContentType, Href: user.ActivityPubID(baseURL)},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: user.AbsoluteURL(baseURL)},
+		},
+	}
+}
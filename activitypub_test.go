@@ -0,0 +1,93 @@
+package entropy
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Marshal and unmarshal v, so we're checking the JSON that other servers would see
+func toJSONObject(t *testing.T, v any) map[string]any {
+	body, err := json.Marshal(v)
+	assert.Nil(t, err)
+	var object map[string]any
+	assert.Nil(t, json.Unmarshal(body, &object))
+	return object
+}
+
+func TestActivityPubActor(t *testing.T) {
+	user := &User{UserID: 1, Name: "max", DisplayName: "Max", Bio: "**hi**", AvatarUploadID: 7}
+	actor := toJSONObject(t, NewActivityPubActor(user, "https://entropych.example.com/"))
+	assert.Equal(t, map[string]any{
+		"@context":          "https://www.w3.org/ns/activitystreams",
+		"id":                "https://entropych.example.com/u/max/",
+		"type":              "Person",
+		"preferredUsername": "max",
+		"name":              "Max",
+		"summary":           "<strong>hi</strong>",
+		"url":               "https://entropych.example.com/u/max/",
+		"outbox":            "https://entropych.example.com/u/max/outbox",
+		"icon": map[string]any{
+			"type": "Image",
+			"url":  "https://entropych.example.com/uploads/7.png",
+		},
+	}, actor)
+}
+
+func TestActivityPubOutboxPage(t *testing.T) {
+	baseURL := "https://entropych.example.com"
+	user := &User{UserID: 1, Name: "max"}
+	createdAt := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	posts := []Post{
+		{PostID: 2, UserID: 1, UserName: "max", CreatedAt: createdAt, Content: "<b>re</b>", ReplyingToPostID: 1},
+		{PostID: 1, UserID: 1, UserName: "max", CreatedAt: createdAt.Add(-time.Hour), Content: "hi"},
+	}
+	pageURL := baseURL + "/u/max/outbox?page=true"
+	nextPageURL := baseURL + "/u/max/outbox?page=true&before=123"
+	page := toJSONObject(t, NewActivityPubOutboxPage(user, posts, baseURL, pageURL, nextPageURL))
+
+	assert.Equal(t, "https://www.w3.org/ns/activitystreams", page["@context"])
+	assert.Equal(t, "OrderedCollectionPage", page["type"])
+	assert.Equal(t, pageURL, page["id"])
+	assert.Equal(t, baseURL+"/u/max/outbox", page["partOf"])
+	assert.Equal(t, nextPageURL, page["next"])
+	items := page["orderedItems"].([]any)
+	assert.Len(t, items, 2)
+
+	public := []any{"https://www.w3.org/ns/activitystreams#Public"}
+	assert.Equal(t, map[string]any{
+		"id":        baseURL + "/p/2/#create",
+		"type":      "Create",
+		"actor":     baseURL + "/u/max/",
+		"published": "2025-03-04T05:06:07Z",
+		"to":        public,
+		"object": map[string]any{
+			"id":           baseURL + "/p/2/",
+			"type":         "Note",
+			"attributedTo": baseURL + "/u/max/",
+			"content":      "<p>&lt;b&gt;re&lt;/b&gt;</p>",
+			"published":    "2025-03-04T05:06:07Z",
+			"url":          baseURL + "/p/2/",
+			"to":           public,
+			"inReplyTo":    baseURL + "/p/1/",
+		},
+	}, items[0])
+	note := items[1].(map[string]any)["object"].(map[string]any)
+	assert.NotContains(t, note, "inReplyTo")
+
+	// The last page doesn't have a next one
+	page = toJSONObject(t, NewActivityPubOutboxPage(user, nil, baseURL, pageURL, ""))
+	assert.NotContains(t, page, "next")
+	assert.Equal(t, []any{}, page["orderedItems"])
+
+	outbox := toJSONObject(t, NewActivityPubOutbox(user, pageURL, baseURL))
+	assert.Equal(t, map[string]any{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"id":       fmt.Sprintf("%s/u/max/outbox", baseURL),
+		"type":     "OrderedCollection",
+		"first":    pageURL,
+	}, outbox)
+}
@@ -0,0 +1,122 @@
+package entropy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // so that image.Decode can read JPEGs
+	"image/png"
+
+	"crawshaw.io/sqlite"
+)
+
+// Returned by SaveAvatarUpload when the contents aren't an image we can decode
+var ErrInvalidImage = errors.New("not a valid image")
+
+// Avatars wider or taller than this are rejected, since decoding them could take a lot of
+// memory (a tiny PNG can claim to be enormous)
+const maxAvatarDimension = 4096
+
+// Decode the image and encode it again as a PNG. Only the pixels survive: EXIF data
+// (which can have GPS coordinates in it), comments, and any other metadata in the
+// original are all thrown away.
+func reencodeAsPNG(contents []byte) ([]byte, error) {
+	img, err := decodeAvatar(contents)
+	if err != nil {
+		return nil, err
+	}
+	return encodePNG(img)
+}
+
+// Decode the image, if it's one we can decode and it isn't too big
+func decodeAvatar(contents []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+	if config.Width > maxAvatarDimension || config.Height > maxAvatarDimension {
+		return nil, fmt.Errorf("%w: %dx%d is too big", ErrInvalidImage, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+	return img, nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Save an uploaded avatar (a PNG or JPEG) in the store as a PNG, re-encoding it so that
+// none of the original's metadata is kept. Returns ErrInvalidImage if it can't be decoded.
+func SaveAvatarUpload(conn *sqlite.Conn, store UploadStore, contents []byte) (int64, error) {
+	reencoded, err := reencodeAsPNG(contents)
+	if err != nil {
+		return 0, err
+	}
+	return store.Put(conn, "image/png", reencoded)
+}
+
+// The blurriest an avatar gets. Followed users' avatars aren't blurred at all, so this is
+// one less than the most distorted a post gets.
+const MaxAvatarBlur = MaxDistortionLevel - 1
+
+// Blur an avatar (a PNG or JPEG), returning it as a PNG. The "blur" is really a
+// pixelation: the image is split into square blocks and each one is filled with its
+// average color. The blocks get bigger with the level, which goes from 1 to
+// MaxAvatarBlur. (Level 0 returns the image re-encoded as it is.)
+func BlurAvatarPNG(contents []byte, level int) ([]byte, error) {
+	if level < 0 || level > MaxAvatarBlur {
+		return nil, fmt.Errorf("blur level %d is out of range", level)
+	}
+	img, err := decodeAvatar(contents)
+	if err != nil {
+		return nil, err
+	}
+	if level == 0 {
+		return encodePNG(img)
+	}
+	return encodePNG(pixelate(img, avatarBlurBlockSize(img.Bounds(), level)))
+}
+
+// How many pixels across the blocks are at the given blur level. For a 192px avatar,
+// that's 12px at level 1, up to 48px at level 4.
+func avatarBlurBlockSize(bounds image.Rectangle, level int) int {
+	return max(2, max(bounds.Dx(), bounds.Dy())*level/16)
+}
+
+func pixelate(img image.Image, blockSize int) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(bounds)
+	for y0 := bounds.Min.Y; y0 < bounds.Max.Y; y0 += blockSize {
+		for x0 := bounds.Min.X; x0 < bounds.Max.X; x0 += blockSize {
+			block := image.Rect(x0, y0, x0+blockSize, y0+blockSize).Intersect(bounds)
+			var r, g, b, a, n uint64
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					c := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			// (Premultiplied, so averaging the channels separately is fine)
+			average := color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)}
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					out.Set(x, y, average)
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+package entropy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A JPEG with an EXIF block (an APP1 segment) right after the start-of-image marker,
+// where cameras put it
+func jpegWithEXIF(t *testing.T, exif []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := range 8 {
+		img.Set(x, x, color.RGBA{R: 255, A: 255})
+	}
+	buf := new(bytes.Buffer)
+	assert.Nil(t, jpeg.Encode(buf, img, nil))
+	encoded := buf.Bytes()
+
+	payload := append([]byte("Exif\x00\x00"), exif...)
+	segmentLength := len(payload) + 2
+	segment := append([]byte{0xff, 0xe1, byte(segmentLength >> 8), byte(segmentLength)}, payload...)
+	withEXIF := append([]byte{}, encoded[:2]...)
+	withEXIF = append(withEXIF, segment...)
+	return append(withEXIF, encoded[2:]...)
+}
+
+func TestSaveAvatarUploadStripsEXIF(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	original := jpegWithEXIF(t, []byte("GPSLatitude=40.7128N GPSLongitude=74.0060W"))
+	// Make sure the EXIF block really is in there, and that it's still a valid JPEG
+	assert.True(t, bytes.Contains(original, []byte("GPSLatitude")))
+	_, err := jpeg.Decode(bytes.NewReader(original))
+	assert.Nil(t, err)
+
+	uploadID, err := SaveAvatarUpload(conn, SQLiteStore{}, original)
+	assert.Nil(t, err)
+	contents, info, err := SQLiteStore{}.Open(conn, uploadID)
+	assert.Nil(t, err)
+	defer contents.Close()
+	assert.Equal(t, "image/png", info.ContentType)
+	stored, err := io.ReadAll(contents)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(stored, []byte("Exif")))
+	assert.False(t, bytes.Contains(stored, []byte("GPS")))
+
+	img, err := png.Decode(bytes.NewReader(stored))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 8, 8), img.Bounds())
+}
+
+func TestSaveAvatarUploadRejectsInvalidImages(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	_, err := SaveAvatarUpload(conn, SQLiteStore{}, []byte("\x89PNG\r\n\x1a\nbut not really"))
+	assert.ErrorIs(t, err, ErrInvalidImage)
+
+	huge := new(bytes.Buffer)
+	assert.Nil(t, png.Encode(huge, image.NewGray(image.Rect(0, 0, maxAvatarDimension+1, 1))))
+	_, err = SaveAvatarUpload(conn, SQLiteStore{}, huge.Bytes())
+	assert.ErrorIs(t, err, ErrInvalidImage)
+}
+
+func TestBlurAvatarPNG(t *testing.T) {
+	// A checkerboard, which blurs into a flat gray
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for x := range 64 {
+		for y := range 64 {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	assert.Nil(t, png.Encode(buf, img))
+	original := buf.Bytes()
+
+	blurred, err := BlurAvatarPNG(original, 3)
+	assert.Nil(t, err)
+	assert.NotEqual(t, original, blurred)
+	decoded, err := png.Decode(bytes.NewReader(blurred))
+	assert.Nil(t, err)
+	assert.Equal(t, img.Bounds(), decoded.Bounds())
+	r0, g0, b0, _ := decoded.At(0, 0).RGBA()
+	r1, g1, b1, _ := decoded.At(1, 0).RGBA()
+	assert.Equal(t, [3]uint32{r0, g0, b0}, [3]uint32{r1, g1, b1})
+	assert.InDelta(t, 0x7fff, r0, 0x100)
+
+	// Level 0 leaves the pixels alone
+	unblurred, err := BlurAvatarPNG(original, 0)
+	assert.Nil(t, err)
+	decoded, err = png.Decode(bytes.NewReader(unblurred))
+	assert.Nil(t, err)
+	assert.Equal(t, color.Gray{Y: 255}, color.GrayModel.Convert(decoded.At(0, 0)))
+	assert.Equal(t, color.Gray{Y: 0}, color.GrayModel.Convert(decoded.At(1, 0)))
+
+	_, err = BlurAvatarPNG(original, MaxAvatarBlur+1)
+	assert.NotNil(t, err)
+	_, err = BlurAvatarPNG([]byte("not an image"), 1)
+	assert.ErrorIs(t, err, ErrInvalidImage)
+}
+
+func TestPostUserAvatarURL(t *testing.T) {
+	post := Post{UserAvatarUploadID: 12, DistanceFromUser: 1}
+	assert.Equal(t, "/uploads/12.png", post.UserAvatarURL())
+	post.DistanceFromUser = 3
+	assert.Equal(t, "/uploads/12.png?blur=2", post.UserAvatarURL())
+	post.PeekLevel = 1
+	assert.Equal(t, "/uploads/12.png?blur=1", post.UserAvatarURL())
+	post = Post{DistanceFromUser: MaxDistortionLevel}
+	assert.Equal(t, DefaultAvatarURL, post.UserAvatarURL())
+}
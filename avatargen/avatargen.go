@@ -79,8 +79,8 @@ type face struct {
 	mouthY        float64
 }
 
-func randInRange(min float64, max float64) float64 {
-	return rand.Float64()*(max-min) + min
+func randInRange(rng *rand.Rand, min float64, max float64) float64 {
+	return rng.Float64()*(max-min) + min
 }
 
 const (
@@ -89,9 +89,9 @@ const (
 	frown  = 2
 )
 
-func randArc(rx, ry float64) ellipticalArc {
+func randArc(rng *rand.Rand, rx, ry float64) ellipticalArc {
 	var theta1 float64
-	switch face := rand.IntN(3); face {
+	switch face := rng.IntN(3); face {
 	case circle:
 		theta1 = 360.0
 	case smile:
@@ -104,11 +104,11 @@ func randArc(rx, ry float64) ellipticalArc {
 	return ellipticalArc{rx, ry, 0.0, 0.0, theta1}
 }
 
-func randomFace(width, height float64) face {
-	l := rand.Float64()*0.7 + 0.2
+func randomFace(rng *rand.Rand, width, height float64) face {
+	l := rng.Float64()*0.7 + 0.2
 	bg := hsl{
-		rand.Float64(),
-		rand.Float64()*0.2 + 0.8,
+		rng.Float64(),
+		rng.Float64()*0.2 + 0.8,
 		math.Pow(l, 1.0/3.0),
 	}
 	fg := hsl{
@@ -116,19 +116,19 @@ func randomFace(width, height float64) face {
 		0.95,
 		math.Pow(l, 3.0),
 	}
-	eyeShape := randArc(randInRange(0.025, 0.2)*width, randInRange(0.025, 0.15)*height)
+	eyeShape := randArc(rng, randInRange(rng, 0.025, 0.2)*width, randInRange(rng, 0.025, 0.15)*height)
 	// TODO: do I need to consider eyeShape.ry when chooosing mouth.ry?
-	mouth := randArc(randInRange(0.025, 0.6)*width, randInRange(0.025, 0.4)*height)
+	mouth := randArc(rng, randInRange(rng, 0.025, 0.6)*width, randInRange(rng, 0.025, 0.4)*height)
 
 	// TODO: gotta work on padding and eyeSeparation. A debug visualization showing the
 	// rectangle of possible values would be good
 	// TODO: I think I want the mouth to overflow more often
-	leftEyeX := rand.Float64()*(width-eyeShape.rx*2) + eyeShape.rx
-	eyeSeparation := rand.Float64()*(width-leftEyeX-4*eyeShape.rx) + 2*eyeShape.rx
-	eyeY := (width+eyeShape.ry)*0.2 + rand.Float64()*0.8*(width-eyeShape.ry)
+	leftEyeX := rng.Float64()*(width-eyeShape.rx*2) + eyeShape.rx
+	eyeSeparation := rng.Float64()*(width-leftEyeX-4*eyeShape.rx) + 2*eyeShape.rx
+	eyeY := (width+eyeShape.ry)*0.2 + rng.Float64()*0.8*(width-eyeShape.ry)
 	// TODO: reserve enough space for the case when the mouth is a circle
 	ySpace := eyeY - eyeShape.ry - mouth.ry
-	mouthY := rand.Float64()*(ySpace-mouth.ry) + mouth.ry
+	mouthY := rng.Float64()*(ySpace-mouth.ry) + mouth.ry
 	return face{
 		bg:            hslToRGB(bg),
 		fg:            hslToRGB(fg),
@@ -137,7 +137,7 @@ func randomFace(width, height float64) face {
 		leftEyeX:      leftEyeX,
 		eyeSeparation: eyeSeparation,
 		eyeY:          eyeY,
-		mouthX:        width * rand.Float64(),
+		mouthX:        width * rng.Float64(),
 		mouthY:        mouthY,
 	}
 }
@@ -149,11 +149,18 @@ func (a *ellipticalArc) Path() *canvas.Path {
 	)
 }
 
+// Generate a random avatar
 func GenerateAvatar() *canvas.Canvas {
+	return GenerateAvatarFromRand(rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+}
+
+// Generate an avatar using the given source of randomness. The same seed always gives
+// you the same face.
+func GenerateAvatarFromRand(rng *rand.Rand) *canvas.Canvas {
 	c := canvas.New(256, 256)
 	ctx := canvas.NewContext(c)
 
-	face := randomFace(256, 256)
+	face := randomFace(rng, 256, 256)
 	// fmt.Printf("face: %#v\n", face)
 
 	ctx.SetFillColor(face.bg)
@@ -176,3 +183,10 @@ func GenerateAvatarPNG(w io.Writer) error {
 	pngWriter := renderers.PNG()
 	return pngWriter(w, c)
 }
+
+// Like GenerateAvatarPNG, but deterministic: the same seed always gives the same PNG.
+func GenerateAvatarPNGFromSeed(w io.Writer, seed uint64) error {
+	c := GenerateAvatarFromRand(rand.New(rand.NewPCG(seed, seed)))
+	pngWriter := renderers.PNG()
+	return pngWriter(w, c)
+}
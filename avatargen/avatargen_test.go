@@ -1,6 +1,7 @@
 package avatargen
 
 import (
+	"bytes"
 	"math"
 	"testing"
 
@@ -15,3 +16,12 @@ func TestGenerateAvatar(t *testing.T) {
 func TestMod(t *testing.T) {
 	assert.Equal(t, 0.5, math.Mod(1.5, 1.0))
 }
+
+func TestGenerateAvatarPNGFromSeed(t *testing.T) {
+	var a, b, c bytes.Buffer
+	assert.Nil(t, GenerateAvatarPNGFromSeed(&a, 1))
+	assert.Nil(t, GenerateAvatarPNGFromSeed(&b, 1))
+	assert.Nil(t, GenerateAvatarPNGFromSeed(&c, 2))
+	assert.Equal(t, a.Bytes(), b.Bytes())
+	assert.NotEqual(t, a.Bytes(), c.Bytes())
+}
@@ -12,9 +12,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"runtime"
+	"sync"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -22,10 +25,24 @@ import (
 	"github.com/maxhully/entropy/avatargen"
 )
 
+// How many users get their avatars in each savepoint, unless the -batch-size flag says
+// otherwise
+const defaultBatchSize = 100
+
 func main() {
 	var dbFilename string
+	var batchSize int
+	var workers int
 	flag.StringVar(&dbFilename, "db", "test.db", "Filename of the SQLite database to connect to")
+	flag.IntVar(&batchSize, "batch-size", defaultBatchSize, "How many users to backfill (and commit) at a time")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(), "How many avatars to generate at once")
 	flag.Parse()
+	if batchSize <= 0 {
+		log.Fatal("-batch-size must be positive")
+	}
+	if workers <= 0 {
+		log.Fatal("-workers must be positive")
+	}
 
 	db, err := entropy.NewDB(dbFilename, 10)
 	if err != nil {
@@ -34,18 +51,55 @@ func main() {
 	defer db.Close()
 	conn := db.Get(context.Background())
 	defer db.Put(conn)
-	err = backfillEmptyAvatars(conn)
+	err = backfillEmptyAvatars(conn, batchSize, workers)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func backfillEmptyAvatars(conn *sqlite.Conn) error {
+// Give every user without an avatar a generated one. Each batch of users is committed
+// separately, so if this gets interrupted, running it again picks up where it left off
+// (the users who got avatars aren't avatar-less anymore).
+//
+// Generating the avatars is the slow part, so each batch's are generated by up to workers
+// goroutines at once. Only the writes go through conn, one at a time.
+func backfillEmptyAvatars(conn *sqlite.Conn, batchSize int, workers int) error {
+	total, err := sqlitex.ResultInt(conn.Prep("select count(*) from user where avatar_upload_id is null"))
+	if err != nil {
+		return err
+	}
+	done := 0
+	var afterUserID int64
+	for {
+		users, err := getUsersWithoutAvatars(conn, afterUserID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		avatars, err := generateAvatarPNGs(len(users), workers)
+		if err != nil {
+			return err
+		}
+		if err := saveAvatars(conn, users, avatars); err != nil {
+			return err
+		}
+		done += len(users)
+		log.Printf("backfilled %d/%d avatars", done, total)
+		afterUserID = users[len(users)-1].UserID
+	}
+}
+
+// Get up to limit users without avatars, in order of user_id, starting after afterUserID
+func getUsersWithoutAvatars(conn *sqlite.Conn, afterUserID int64, limit int) ([]entropy.User, error) {
 	query := `
 	select user_id, user.user_name, user.display_name, user.bio, user.avatar_upload_id
 	from user
-	where user.avatar_upload_id is null`
-	users := make([]entropy.User, 0, 0)
+	where user.avatar_upload_id is null and user_id > ?
+	order by user_id
+	limit ?`
+	users := make([]entropy.User, 0, limit)
 	collect := func(stmt *sqlite.Stmt) error {
 		users = append(users, entropy.User{
 			UserID:         stmt.ColumnInt64(0),
@@ -56,22 +110,47 @@ func backfillEmptyAvatars(conn *sqlite.Conn) error {
 		})
 		return nil
 	}
-	if err := sqlitex.Exec(conn, query, collect); err != nil {
-		return err
+	err := sqlitex.Exec(conn, query, collect, afterUserID, limit)
+	return users, err
+}
+
+// Generate count avatars (as PNGs), with up to workers goroutines at a time. Each
+// avatar gets its own freshly seeded source of randomness (see avatargen.GenerateAvatar),
+// so the goroutines don't share any state.
+func generateAvatarPNGs(count int, workers int) ([][]byte, error) {
+	avatars := make([][]byte, count)
+	errs := make([]error, count)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				buf := new(bytes.Buffer)
+				errs[i] = avatargen.GenerateAvatarPNG(buf)
+				avatars[i] = buf.Bytes()
+			}
+		}()
+	}
+	for i := range count {
+		indexes <- i
 	}
-	var err error
+	close(indexes)
+	wg.Wait()
+	return avatars, errors.Join(errs...)
+}
+
+// Save the avatars and give them to the users (avatars[i] goes to users[i]), all in one
+// savepoint
+func saveAvatars(conn *sqlite.Conn, users []entropy.User, avatars [][]byte) (err error) {
 	defer sqlitex.Save(conn)(&err)
-	buf := new(bytes.Buffer)
 	for i := range users {
 		fmt.Printf("backfilling avatar for %s\n", users[i].Name)
-		if err := avatargen.GenerateAvatarPNG(buf); err != nil {
-			return err
-		}
-		uploadID, err := entropy.SaveUpload(conn, "image/png", buf.Bytes())
+		uploadID, err := entropy.SaveUpload(conn, "image/png", avatars[i])
 		if err != nil {
 			return err
 		}
-		buf.Reset()
 		err = entropy.UpdateUserProfile(conn, users[i].Name, users[i].DisplayName, users[i].Bio, uploadID)
 		if err != nil {
 			return err
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"path"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/maxhully/entropy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillEmptyAvatarsInBatches(t *testing.T) {
+	db, err := entropy.NewDB(path.Join(t.TempDir(), "test.db"), 1)
+	assert.Nil(t, err)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	for i := range 5 {
+		_, err := entropy.CreateUser(conn, fmt.Sprintf("user%d", i), "pass")
+		assert.Nil(t, err)
+	}
+	// One of them already has an avatar, which is left alone
+	uploadID, err := entropy.SaveUpload(conn, "image/png", []byte("not really a png"))
+	assert.Nil(t, err)
+	assert.Nil(t, entropy.UpdateUserProfile(conn, "user2", "", "", uploadID))
+
+	assert.Nil(t, backfillEmptyAvatars(conn, 2, 3))
+	missing, err := sqlitex.ResultInt(conn.Prep("select count(*) from user where avatar_upload_id is null"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, missing)
+	user, err := entropy.GetUserByName(conn, "user2")
+	assert.Nil(t, err)
+	assert.Equal(t, uploadID, user.AvatarUploadID)
+	distinct, err := sqlitex.ResultInt(conn.Prep("select count(distinct avatar_upload_id) from user"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, distinct)
+
+	// Running it again has nothing to do
+	assert.Nil(t, backfillEmptyAvatars(conn, 2, 3))
+	uploads, err := sqlitex.ResultInt(conn.Prep("select count(*) from upload"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, uploads)
+}
+
+func TestGenerateAvatarPNGs(t *testing.T) {
+	avatars, err := generateAvatarPNGs(20, 4)
+	assert.Nil(t, err)
+	assert.Len(t, avatars, 20)
+	for _, avatar := range avatars {
+		_, err := png.Decode(bytes.NewReader(avatar))
+		assert.Nil(t, err)
+	}
+	// They're random, so they shouldn't be the same as each other
+	assert.NotEqual(t, avatars[0], avatars[1])
+}
+
+func BenchmarkBackfillEmptyAvatars(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			db, err := entropy.NewDB(path.Join(b.TempDir(), "bench.db"), 1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			conn := db.Get(b.Context())
+			defer db.Put(conn)
+			for i := range 50 {
+				if _, err := entropy.CreateUser(conn, fmt.Sprintf("user%d", i), "pass"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for b.Loop() {
+				if err := sqlitex.ExecScript(conn, "update user set avatar_upload_id = null"); err != nil {
+					b.Fatal(err)
+				}
+				if err := backfillEmptyAvatars(conn, 25, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
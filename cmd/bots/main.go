@@ -18,12 +18,14 @@ import (
 	"io"
 	"log"
 	"math/rand"
+	"mime"
 	"net/http"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -37,10 +39,16 @@ type dialogueLine struct {
 	scene     string
 	character string
 	dialogue  string
-	lineNum   int // zero if the cell in the CSV is "NA"
+	lineNum   int       // zero if the cell in the CSV is "NA"
+	postAt    time.Time // when to backdate the post to (see timeline); now if it's zero
 }
 
-// Reads and parses CSV lines of Shakespeare dialogue.
+// The header row of the CSVs in the nrennie/shakespeare repo
+var playCSVColumns = []string{"act", "scene", "character", "dialogue", "line_number"}
+
+// Reads and parses CSV lines of Shakespeare dialogue. The first row has to be the
+// header (see playCSVColumns), so that if the repo ever changes its format, we find out
+// instead of posting the wrong columns.
 //
 // Returns two channels---one for the parsed lines, one for the errors.
 func streamDialogueLines(reader io.Reader, fromLine int) (<-chan dialogueLine, <-chan error) {
@@ -52,9 +60,22 @@ func streamDialogueLines(reader io.Reader, fromLine int) (<-chan dialogueLine, <
 		defer close(errChan)
 
 		csvReader := csv.NewReader(reader)
-		csvReader.FieldsPerRecord = 5
+		// Every row needs as many fields as the header has
+		csvReader.FieldsPerRecord = 0
 
-		sawHeader := false
+		header, err := csvReader.Read()
+		if err == io.EOF {
+			errChan <- fmt.Errorf("the CSV is empty (expected a header row %q)", playCSVColumns)
+			return
+		}
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if !slices.Equal(header, playCSVColumns) {
+			errChan <- fmt.Errorf("unexpected CSV header %q (expected %q)", header, playCSVColumns)
+			return
+		}
 		for {
 			rawLine, err := csvReader.Read()
 			if err == io.EOF {
@@ -65,16 +86,12 @@ func streamDialogueLines(reader io.Reader, fromLine int) (<-chan dialogueLine, <
 				return
 			}
 
-			if !sawHeader && rawLine[0] == "act" {
-				sawHeader = true
-				continue
-			}
-
 			lineNum := 0
 			if rawLine[4] != "NA" {
 				lineNum, err = strconv.Atoi(rawLine[4])
-				// Probably should just ignore these errors, actually
 				if err != nil {
+					row, _ := csvReader.FieldPos(4)
+					errChan <- fmt.Errorf("line %d: line_number %q isn't a number or NA", row, rawLine[4])
 					return
 				}
 			}
@@ -99,12 +116,81 @@ func streamDialogueLines(reader io.Reader, fromLine int) (<-chan dialogueLine, <
 	return lines, errChan
 }
 
+// Rows whose "character" is really a stage direction: names without any lowercase
+// letters (like "STAGE DIRECTION" or "ALL"), and things like "Enter Viola" or "[Aside]"
+const defaultStageDirectionPattern = `^(\P{Ll}+|(Enter|Re-enter|Exit|Exeunt)\b.*|\[.*\])$`
+
+// Returns a function saying whether a row's character is someone who should get a bot
+// account. Empty and "NA" characters never are, and neither is anything matching
+// stageDirections (unless it's nil).
+func characterFilter(stageDirections *regexp.Regexp) func(character string) bool {
+	return func(character string) bool {
+		character = strings.TrimSpace(character)
+		if character == "" || character == "NA" {
+			return false
+		}
+		return stageDirections == nil || !stageDirections.MatchString(character)
+	}
+}
+
 var whitespace = regexp.MustCompile(`\s+`)
 
-// Also cleans the username so that it's lowercase with underscores for whitespace
+// The character's name as a username: lowercase, with underscores for whitespace
+func cleanUserName(name string) string {
+	return strings.ToLower(whitespace.ReplaceAllString(name, "_"))
+}
+
+// Writes the users, follows, and posts for the play to the database. In a dry run, it
+// only logs what it would have written.
+type importer struct {
+	conn   *sqlite.Conn
+	dryRun bool
+	// The users a dry run would have created, with made-up (negative) IDs so that they
+	// can be told apart
+	dryRunUsers map[string]*entropy.User
+}
+
+func newImporter(conn *sqlite.Conn, dryRun bool) *importer {
+	return &importer{conn: conn, dryRun: dryRun, dryRunUsers: make(map[string]*entropy.User)}
+}
+
+func (imp *importer) getOrCreateUser(name string) (*entropy.User, error) {
+	if !imp.dryRun {
+		return getOrCreateUser(imp.conn, name)
+	}
+	cleanName := cleanUserName(name)
+	user, err := entropy.GetUserByName(imp.conn, cleanName)
+	if err != nil || user != nil {
+		return user, err
+	}
+	if user = imp.dryRunUsers[cleanName]; user == nil {
+		user = &entropy.User{UserID: -int64(len(imp.dryRunUsers) + 1), Name: cleanName, DisplayName: strings.TrimSpace(name)}
+		imp.dryRunUsers[cleanName] = user
+		fmt.Printf("would create user %s (%q)\n", user.Name, user.DisplayName)
+	}
+	return user, nil
+}
+
+func (imp *importer) follow(user *entropy.User, followedUserID int64) {
+	if imp.dryRun {
+		fmt.Printf("would have %s follow user %d\n", user.Name, followedUserID)
+		return
+	}
+	entropy.FollowUser(imp.conn, user.UserID, followedUserID)
+}
+
+func (imp *importer) createPosts(posts []entropy.NewPost) error {
+	if imp.dryRun {
+		fmt.Printf("would create %d posts\n", len(posts))
+		return nil
+	}
+	_, err := entropy.CreatePostsBulk(imp.conn, posts)
+	return err
+}
+
 func getOrCreateUser(conn *sqlite.Conn, name string) (user *entropy.User, err error) {
 	defer sqlitex.Save(conn)(&err)
-	cleanName := strings.ToLower(whitespace.ReplaceAllString(name, "_"))
+	cleanName := cleanUserName(name)
 	user, err = entropy.GetUserByName(conn, cleanName)
 	if err != nil {
 		return nil, err
@@ -123,7 +209,9 @@ func getOrCreateUser(conn *sqlite.Conn, name string) (user *entropy.User, err er
 		if err != nil {
 			return nil, err
 		}
-		if err = entropy.UpdateUserProfile(conn, user.Name, "", "", uploadID); err != nil {
+		// Keep the character's name as it's written in the play for the display name
+		user.DisplayName = strings.TrimSpace(name)
+		if err = entropy.UpdateUserProfile(conn, user.Name, user.DisplayName, "", uploadID); err != nil {
 			return nil, err
 		}
 	}
@@ -132,35 +220,129 @@ func getOrCreateUser(conn *sqlite.Conn, name string) (user *entropy.User, err er
 
 const csvURLPrefix = "https://raw.githubusercontent.com/nrennie/shakespeare/refs/heads/main/data/"
 
+// How long one try at fetching a play gets, including reading the body. They're only a
+// few hundred KB.
+const fetchTimeout = 30 * time.Second
+
+// How many times to try fetching the play, and how long to wait after the first failed
+// try. The wait doubles after each one after that.
+const (
+	fetchAttempts = 3
+	fetchBackoff  = 2 * time.Second
+)
+
+// Fetch the whole CSV at url, trying again (after backoff, then twice that, ...) if the
+// server has a 5xx or the connection fails partway. Other errors, like a 404 for a play
+// that doesn't exist, are returned right away.
+func fetchPlayCSV(client *http.Client, url string, backoff time.Duration) ([]byte, error) {
+	var err error
+	for attempt := range fetchAttempts {
+		if attempt > 0 {
+			log.Printf("%v (trying again in %s)", err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var contents []byte
+		var retryable bool
+		contents, retryable, err = fetchPlayCSVOnce(client, url)
+		if err == nil || !retryable {
+			return contents, err
+		}
+	}
+	return nil, err
+}
+
+// Like fetchPlayCSV, but only tries once. The bool is whether an error is worth trying
+// again for.
+func fetchPlayCSVOnce(client *http.Client, url string) ([]byte, bool, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		// Timeouts, refused or reset connections, and so on
+		return nil, true, fmt.Errorf("GET %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	if err := checkPlayContentType(resp.Header.Get("Content-Type")); err != nil {
+		return nil, false, fmt.Errorf("GET %s: %w", url, err)
+	}
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("reading %s failed: %w", url, err)
+	}
+	if !utf8.Valid(contents) {
+		return nil, false, fmt.Errorf("GET %s: the CSV isn't valid UTF-8", url)
+	}
+	return contents, false, nil
+}
+
+// GitHub serves the raw CSVs as text/plain, but text/csv would be fine too. Anything
+// else (like an HTML error page from a proxy) isn't a play.
+func checkPlayContentType(contentType string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("bad Content-Type %q: %w", contentType, err)
+	}
+	if mediaType != "text/plain" && mediaType != "text/csv" {
+		return fmt.Errorf("expected a CSV, got Content-Type %q", contentType)
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return fmt.Errorf("expected UTF-8, got Content-Type %q", contentType)
+	}
+	return nil
+}
+
 func main() {
 	var shouldPost bool
 	var playCSVName string
 	var dbFilename string
 	var fromLine int
 	var maxSleep int
+	var spread time.Duration
+	var dryRun bool
+	var stageDirections string
 
 	flag.StringVar(&dbFilename, "db", "test.db", "Filename of the SQLite database to connect to")
 	flag.BoolVar(&shouldPost, "posts", false, "Create Posts using the dialogue lines (not idempotent!)")
 	flag.IntVar(&maxSleep, "sleep", 10, "Max. random sleep between posts (to imitate humans)")
 	flag.StringVar(&playCSVName, "play", "", "Filename of the CSV in the nrennie/shakespeare repo (e.g. 'twelfth_night.csv')")
 	flag.IntVar(&fromLine, "from-line", 0, "Start processing lines this line_number")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only log the users, follows, and posts that would be created, without writing anything")
+	flag.StringVar(&stageDirections, "stage-directions", defaultStageDirectionPattern, "Skip rows whose character matches this regexp, as stage directions (empty to only skip empty and NA characters)")
+	flag.DurationVar(&spread, "spread", 0, "Backdate the posts, spreading them out in order over this long before now (e.g. '24h'), instead of sleeping between them")
 
 	flag.Parse()
 
 	if playCSVName == "" {
 		log.Fatalf("--play is required")
 	}
+	var stageDirectionPattern *regexp.Regexp
+	if stageDirections != "" {
+		var err error
+		if stageDirectionPattern, err = regexp.Compile(stageDirections); err != nil {
+			log.Fatalf("bad --stage-directions pattern: %v", err)
+		}
+	}
 	csvURL := csvURLPrefix + playCSVName
 
-	resp, err := http.Get(csvURL)
+	client := &http.Client{Timeout: fetchTimeout}
+	contents, err := fetchPlayCSV(client, csvURL, fetchBackoff)
 	if err != nil {
-		log.Fatalf("GET %s failed: %v", csvURL, err)
+		log.Fatal(err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("GET %s returned %s", csvURL, resp.Status)
+	lineCount, err := countDialogueLines(contents, fromLine)
+	if err != nil {
+		log.Fatalf("could not parse %s: %v", csvURL, err)
 	}
-	defer resp.Body.Close()
-	lines, errChan := streamDialogueLines(resp.Body, fromLine)
+	var postTimes *timeline
+	if spread > 0 {
+		// To spread the lines out evenly we need to know how many there are
+		postTimes = newTimeline(time.Now(), spread, lineCount)
+		// The posts are backdated, so there's no point waiting between them
+		maxSleep = 0
+	}
+	lines, errChan := streamDialogueLines(bytes.NewReader(contents), fromLine)
 
 	db, err := entropy.NewDB(dbFilename, 10)
 	if err != nil {
@@ -170,14 +352,49 @@ func main() {
 	conn := db.Get(context.Background())
 	defer db.Put(conn)
 
-	processDialogueLines(lines, conn, maxSleep, shouldPost)
+	if dryRun {
+		// Nothing to imitate
+		maxSleep = 0
+	}
+	processDialogueLines(lines, newImporter(conn, dryRun), characterFilter(stageDirectionPattern), maxSleep, postTimes, shouldPost)
 
 	for err := range errChan {
 		fmt.Printf("error: %v\n", err)
 	}
 }
 
-func processDialogueLines(lines <-chan dialogueLine, conn *sqlite.Conn, maxSleep int, shouldPost bool) {
+// How many lines streamDialogueLines will give us. This reads the whole play, so it's
+// also how we check that it parses before writing anything.
+func countDialogueLines(contents []byte, fromLine int) (int, error) {
+	lines, errChan := streamDialogueLines(bytes.NewReader(contents), fromLine)
+	count := 0
+	for range lines {
+		count++
+	}
+	return count, <-errChan
+}
+
+// Spreads lineCount lines out evenly over the window that ends at end, in order, so that
+// an imported play reads from top to bottom (well, bottom to top) on the site
+type timeline struct {
+	start time.Time
+	step  time.Duration
+}
+
+func newTimeline(end time.Time, window time.Duration, lineCount int) *timeline {
+	return &timeline{
+		start: end.Add(-window),
+		step:  window / time.Duration(max(lineCount, 1)),
+	}
+}
+
+// When the i-th line (counting from zero) gets posted
+func (t *timeline) at(i int) time.Time {
+	return t.start.Add(t.step * time.Duration(i))
+}
+
+// postTimes can be nil, in which case everything is posted now.
+func processDialogueLines(lines <-chan dialogueLine, imp *importer, isCharacter func(string) bool, maxSleep int, postTimes *timeline, shouldPost bool) {
 	linesByCharacter := make(map[string]int)
 	var prevLineUserID int64
 	var currentScene []string // (act, scene) pair
@@ -186,7 +403,17 @@ func processDialogueLines(lines <-chan dialogueLine, conn *sqlite.Conn, maxSleep
 	// channels to get all the lines we parsed and all the errors (one or zero) that we
 	// hit.
 	var lineToPost dialogueLine
+	var batch sceneBatch
+	lineIndex := 0
 	for line := range lines {
+		if !isCharacter(line.character) {
+			fmt.Printf("skipping line that isn't a character's: %v\n", line)
+			continue
+		}
+		if postTimes != nil {
+			line.postAt = postTimes.at(lineIndex)
+		}
+		lineIndex++
 		// Random pause
 		if maxSleep > 0 {
 			time.Sleep(time.Second * time.Duration(float32(maxSleep)*rand.Float32()))
@@ -201,7 +428,7 @@ func processDialogueLines(lines <-chan dialogueLine, conn *sqlite.Conn, maxSleep
 		}
 
 		linesByCharacter[line.character]++
-		user, err := getOrCreateUser(conn, line.character)
+		user, err := imp.getOrCreateUser(line.character)
 		if err != nil {
 			log.Fatalf("could not get or create user %v: %v", line.character, err)
 		}
@@ -209,7 +436,7 @@ func processDialogueLines(lines <-chan dialogueLine, conn *sqlite.Conn, maxSleep
 		// Have this user follow the character who last spoke
 		for prevLineUserID != user.UserID {
 			if prevLineUserID != 0 {
-				entropy.FollowUser(conn, user.UserID, prevLineUserID)
+				imp.follow(user, prevLineUserID)
 			}
 			prevLineUserID = user.UserID
 		}
@@ -230,26 +457,53 @@ func processDialogueLines(lines <-chan dialogueLine, conn *sqlite.Conn, maxSleep
 			lineToPost.dialogue += " " + line.dialogue
 		} else {
 			// Post the accumulated line, because line is not a continuation of it (or the accumulated line has gotten too long)
-			postDialogueLine(conn, &lineToPost)
+			batch.add(imp, &lineToPost)
 			lineToPost = line
 		}
 	}
 	if lineToPost.dialogue != "" {
-		postDialogueLine(conn, &lineToPost)
+		batch.add(imp, &lineToPost)
 	}
+	batch.flush(imp)
 	for k, v := range linesByCharacter {
 		fmt.Printf("%s: %d\n", k, v)
 	}
 }
 
-func postDialogueLine(conn *sqlite.Conn, line *dialogueLine) {
-	user, err := getOrCreateUser(conn, line.character)
+// The lines from the scene we're in, which get posted all at once (with
+// entropy.CreatePostsBulk) when the scene ends
+type sceneBatch struct {
+	act   string
+	scene string
+	lines []dialogueLine
+	posts []entropy.NewPost
+}
+
+// Add the line to the batch, posting the batch first if the line is from a new scene
+func (b *sceneBatch) add(imp *importer, line *dialogueLine) {
+	if line.act != b.act || line.scene != b.scene {
+		b.flush(imp)
+		b.act = line.act
+		b.scene = line.scene
+	}
+	user, err := imp.getOrCreateUser(line.character)
 	if err != nil {
 		log.Fatalf("could not get or create user %v: %v", line.character, err)
 	}
-	_, err = entropy.CreatePost(conn, user.UserID, line.dialogue)
-	if err != nil {
+	b.lines = append(b.lines, *line)
+	b.posts = append(b.posts, entropy.NewPost{UserID: user.UserID, Content: line.dialogue, CreatedAt: line.postAt})
+}
+
+func (b *sceneBatch) flush(imp *importer) {
+	if len(b.posts) == 0 {
+		return
+	}
+	if err := imp.createPosts(b.posts); err != nil {
 		log.Fatalf("could not post: %v", err)
 	}
-	fmt.Printf("[%v]: %v", line.character, line.dialogue)
+	for _, line := range b.lines {
+		fmt.Printf("[%v]: %v\n", line.character, line.dialogue)
+	}
+	b.lines = nil
+	b.posts = nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/maxhully/entropy"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPlayCSV = `act,scene,character,dialogue,line_number
+Act 1,Scene 1,Orsino,"If music be the food of love, play on.",1
+Act 1,Scene 1,Orsino,"Give me excess of it, that, surfeiting,",2
+Act 1,Scene 1,Curio,"Will you go hunt, my lord?",3
+Act 1,Scene 2,Viola,"What country, friends, is this?",4
+Act 1,Scene 2,Captain,"This is Illyria, lady.",5
+`
+
+func countRows(t *testing.T, conn *sqlite.Conn, table string) int {
+	count, err := sqlitex.ResultInt(conn.Prep("select count(*) from " + table))
+	assert.Nil(t, err)
+	return count
+}
+
+func importTestPlay(t *testing.T, playCSV string, dryRun bool) (rowCounts map[string]int) {
+	db, err := entropy.NewDB(path.Join(t.TempDir(), "test.db"), 1)
+	assert.Nil(t, err)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	lines, errChan := streamDialogueLines(strings.NewReader(playCSV), 0)
+	isCharacter := characterFilter(regexp.MustCompile(defaultStageDirectionPattern))
+	processDialogueLines(lines, newImporter(conn, dryRun), isCharacter, 0, nil, true)
+	assert.Nil(t, <-errChan)
+	rowCounts = make(map[string]int)
+	for _, table := range []string{"user", "user_follow", "post", "upload"} {
+		rowCounts[table] = countRows(t, conn, table)
+	}
+	return rowCounts
+}
+
+func TestImport(t *testing.T) {
+	rowCounts := importTestPlay(t, testPlayCSV, false)
+	assert.Equal(t, map[string]int{"user": 4, "user_follow": 2, "post": 4, "upload": 4}, rowCounts)
+}
+
+func TestImportDryRun(t *testing.T) {
+	rowCounts := importTestPlay(t, testPlayCSV, true)
+	assert.Equal(t, map[string]int{"user": 0, "user_follow": 0, "post": 0, "upload": 0}, rowCounts)
+}
+
+func TestCharacterFilter(t *testing.T) {
+	isCharacter := characterFilter(regexp.MustCompile(defaultStageDirectionPattern))
+	for _, name := range []string{"Orsino", "Sir Toby Belch", "First Officer", "All"} {
+		assert.True(t, isCharacter(name), name)
+	}
+	for _, name := range []string{"", " ", "NA", "STAGE DIRECTION", "ALL", "Enter Viola", "Exeunt", "[Aside]"} {
+		assert.False(t, isCharacter(name), name)
+	}
+	// Without a pattern, only the empty ones are skipped
+	isCharacter = characterFilter(nil)
+	assert.True(t, isCharacter("STAGE DIRECTION"))
+	assert.False(t, isCharacter("NA"))
+}
+
+func TestImportSkipsStageDirections(t *testing.T) {
+	playCSV := testPlayCSV +
+		"Act 1,Scene 3,NA,\"Enter SIR TOBY BELCH and MARIA\",NA\n" +
+		"Act 1,Scene 3,STAGE DIRECTION,Exeunt,NA\n" +
+		"Act 1,Scene 3,Sir Toby Belch,\"What a plague means my niece?\",6\n" +
+		"Act 1,Scene 3,,Flourish,NA\n" +
+		"Act 1,Scene 3,Maria,\"By my troth, Sir Toby.\",7\n"
+	rowCounts := importTestPlay(t, playCSV, false)
+	// Sir Toby and Maria join the four from the test play, and each follows whoever
+	// spoke before them in the scene (skipping the stage directions)
+	assert.Equal(t, map[string]int{"user": 6, "user_follow": 3, "post": 6, "upload": 6}, rowCounts)
+}
+
+func TestFetchPlayCSVRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			// Hang until the client gives up
+			<-r.Context().Done()
+		case 2:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(testPlayCSV))
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	contents, err := fetchPlayCSV(client, server.URL, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, testPlayCSV, string(contents))
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestFetchPlayCSVGivesUp(t *testing.T) {
+	var requests atomic.Int32
+	status := http.StatusBadGateway
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	_, err := fetchPlayCSV(server.Client(), server.URL, time.Millisecond)
+	assert.ErrorContains(t, err, "502 Bad Gateway")
+	assert.Equal(t, int32(fetchAttempts), requests.Load())
+
+	// There's no point trying again for a play that isn't there
+	requests.Store(0)
+	status = http.StatusNotFound
+	_, err = fetchPlayCSV(server.Client(), server.URL, time.Millisecond)
+	assert.ErrorContains(t, err, "404 Not Found")
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestStreamDialogueLinesChecksTheFormat(t *testing.T) {
+	var testCases = []struct {
+		csv      string
+		expected string
+	}{
+		{"", "the CSV is empty"},
+		{"act,scene,speaker,line,line_number\nAct 1,Scene 1,Orsino,\"If music be the food of love, play on.\",1\n",
+			`unexpected CSV header ["act" "scene" "speaker" "line" "line_number"]`},
+		{"act,scene,character,dialogue\nAct 1,Scene 1,Orsino,\"If music be the food of love, play on.\"\n",
+			`unexpected CSV header ["act" "scene" "character" "dialogue"]`},
+		{testPlayCSV + "Act 1,Scene 2,Viola,\"And what should I do in Illyria?\"\n", "wrong number of fields"},
+		{testPlayCSV + "Act 1,Scene 2,Viola,\"And what should I do in Illyria?\",six\n", `line 7: line_number "six" isn't a number or NA`},
+	}
+	for _, testCase := range testCases {
+		_, err := countDialogueLines([]byte(testCase.csv), 0)
+		assert.ErrorContains(t, err, testCase.expected)
+	}
+	count, err := countDialogueLines([]byte(testPlayCSV), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+}
+
+func TestFetchPlayCSVChecksContentType(t *testing.T) {
+	contentType := "text/html; charset=utf-8"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(testPlayCSV))
+	}))
+	defer server.Close()
+
+	_, err := fetchPlayCSV(server.Client(), server.URL, time.Millisecond)
+	assert.ErrorContains(t, err, `expected a CSV, got Content-Type "text/html; charset=utf-8"`)
+	contentType = "text/plain; charset=latin1"
+	_, err = fetchPlayCSV(server.Client(), server.URL, time.Millisecond)
+	assert.ErrorContains(t, err, "expected UTF-8")
+	contentType = "text/csv"
+	contents, err := fetchPlayCSV(server.Client(), server.URL, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, testPlayCSV, string(contents))
+}
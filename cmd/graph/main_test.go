@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/maxhully/entropy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintDistancesNonContiguousIDs(t *testing.T) {
+	db, err := entropy.NewDB(path.Join(t.TempDir(), "temptest.db"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	var ids []int64
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		user, err := entropy.CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	// Leave gaps in the user IDs
+	err = sqlitex.Exec(conn, "delete from user where user_id in (?, ?)", nil, ids[1], ids[3])
+	assert.Nil(t, err)
+	a, c, e := ids[0], ids[2], ids[4]
+	_, err = entropy.FollowUser(conn, a, c)
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, c, e)
+	assert.Nil(t, err)
+
+	distances, err := entropy.ComputeAllPairsDistances(conn, 3)
+	assert.Nil(t, err)
+	var out strings.Builder
+	printDistances(&out, distances, a)
+	expected := fmt.Sprintf(
+		"from user %[1]d:\ndepth: 1\nn: %[2]d\ndepth: 2\nn: %[3]d\n"+
+			"d=1 | %2[1]d -> %2[2]d\nd=1 | %2[2]d -> %2[3]d\nd=2 | %2[1]d -> %2[3]d\n",
+		a, c, e,
+	)
+	assert.Equal(t, expected, out.String())
+}
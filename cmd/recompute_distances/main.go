@@ -0,0 +1,34 @@
+// recompute_distances: precomputes the distances between users in the follower graph,
+// and stores them in the user_distance table so that the server doesn't have to run
+// the big distance query on every request.
+//
+// Meant to run periodically (e.g. nightly from cron). See entropy.RecomputeUserDistances
+// for how stale the results can get in between runs.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/maxhully/entropy"
+)
+
+func main() {
+	var dbFilename string
+	flag.StringVar(&dbFilename, "db", "test.db", "Filename of the SQLite database to connect to")
+	flag.Parse()
+
+	db, err := entropy.NewDB(dbFilename, 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	conn := db.Get(context.Background())
+	defer db.Put(conn)
+	if err = entropy.RecomputeUserDistances(conn); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("recomputed user distances")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pick the encoding to compress the response with, from the request's Accept-Encoding:
+// "gzip", "deflate", or "" to leave it alone. (We don't bother ranking them by q-value,
+// but q=0 still means no.)
+func negotiateEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted["gzip"] || accepted["*"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// Whether a response with this Content-Type is worth compressing. Images, audio, video,
+// and web fonts are compressed already, so doing it again only wastes CPU.
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, prefix := range []string{"image/", "audio/", "video/", "font/woff"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Holds off on the response's headers until the first write, when we know its
+// Content-Type (set by the handler, or sniffed from the first bytes, like net/http does),
+// and then compresses the body or not.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string
+	status     int  // what the handler passed to WriteHeader, if it has
+	decided    bool // whether the headers have gone out
+	compressor io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// Informational responses (like 103 Early Hints) go right out, and don't count
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) decide(firstBytes []byte) {
+	cw.decided = true
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := cw.Header()
+	contentType := header.Get("Content-Type")
+	if contentType == "" && len(firstBytes) > 0 {
+		contentType = http.DetectContentType(firstBytes)
+		header.Set("Content-Type", contentType)
+	}
+	// No partial content (the range is of the uncompressed body), nothing that's
+	// encoded already, and nothing without a body
+	compress := len(firstBytes) > 0 &&
+		status != http.StatusPartialContent &&
+		header.Get("Content-Encoding") == "" &&
+		compressibleType(contentType)
+	if compress {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "gzip" {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			// This only fails for a bad level
+			cw.compressor, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.decide(b)
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(nil)
+	}
+	if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Send the headers, if nothing was written, and finish the compressed body
+func (cw *compressWriter) close() error {
+	if !cw.decided {
+		cw.decide(nil)
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Compress responses with gzip or deflate, when the client accepts them and the response
+// is something that compresses (see compressibleType). This replaces gorilla's
+// CompressHandler, which compressed everything, since it decided before it knew what the
+// response was.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Addresses like "unix:/run/entropych/entropych.sock" are Unix sockets
+const unixAddrPrefix = "unix:"
+
+// Check that addr is something that listen can listen on
+func validateListenAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("the socket path in %q should be absolute", addr)
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// Listen on addr, which is either a TCP address (like ":7777", "127.0.0.1:7777", or
+// "[::1]:7777") or a Unix socket (like "unix:/run/entropych/entropych.sock"), which is
+// handy for sitting behind nginx.
+//
+// A socket file left over from a server that didn't shut down cleanly is removed first,
+// unless something is still listening on it. The socket is made group-writable, so that
+// a proxy in the same group can connect to it, and closing the listener removes it.
+func listen(addr string) (net.Listener, error) {
+	if err := validateListenAddr(addr); err != nil {
+		return nil, err
+	}
+	path, ok := strings.CutPrefix(addr, unixAddrPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s already exists, and it isn't a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("something is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
+
+// How long the requests that are still going get to finish, once we're told to stop
+const shutdownTimeout = 10 * time.Second
+
+// Serve until we get SIGINT or SIGTERM, and then shut down gracefully. Shutting down
+// closes the listener, which removes its socket file if it's a Unix socket.
+func serveUntilSignal(server *http.Server, listener net.Listener) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
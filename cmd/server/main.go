@@ -10,20 +10,30 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode"
 
@@ -41,25 +51,78 @@ import (
 type App struct {
 	renderer *entropy.Renderer
 	db       *entropy.DB
+	baseURL  string // e.g. "https://entropych.maxhully.net", for building absolute URLs
+	mailer   entropy.Mailer
+	uploads  entropy.UploadStore
+	// How long people stay logged in for
+	sessionDuration time.Duration
+	// How many posts a page of a timeline shows, unless it asks for a different ?limit=
+	postsPerPage int
+	// The names of the users who can see the /admin/ pages
+	admins map[string]bool
+	// Writes that requests don't wait for, like counting views (see recordPostView)
+	backgroundWrites sync.WaitGroup
+	// One slot per background write that's allowed to be waiting at once
+	backgroundWriteSlots chan struct{}
+	// Blurred avatars that ServeUpload already made
+	blurredAvatars *blurredAvatarCache
+	// The files under /static/ (see useStaticAssets)
+	staticAssets *entropy.StaticAssets
+	// Whether cookies are marked Secure, which is everywhere but dev mode (where we serve
+	// plain HTTP)
+	secureCookies bool
 }
 
 func timer(name string) func() {
 	start := time.Now()
 	return func() {
 		duration := time.Since(start)
-		log.Printf("%s took %s", name, duration)
+		slog.Info("timer", "name", name, "duration", duration)
 	}
 }
 
-func NewApp(db *entropy.DB) *App {
+// Everything that depends on how the server is configured comes from conf, so that
+// there are no defaults here for a caller to forget to override.
+func NewApp(db *entropy.DB, conf *Config) *App {
 	renderer, err := entropy.NewRenderer()
 	if err != nil {
-		log.Fatalf("error from NewRenderer: %s", err)
+		fatal("error from NewRenderer", "err", err)
+	}
+	admins := make(map[string]bool)
+	for _, name := range conf.admins {
+		admins[name] = true
 	}
 	return &App{
-		renderer: renderer,
-		db:       db,
+		renderer:        renderer,
+		db:              db,
+		baseURL:         conf.baseURL(),
+		mailer:          newMailer(conf),
+		uploads:         entropy.SQLiteStore{},
+		sessionDuration: conf.sessionDuration,
+		postsPerPage:    conf.postsPerPage,
+		admins:          admins,
+		blurredAvatars:  newBlurredAvatarCache(blurredAvatarCacheSize),
+		staticAssets:    &entropy.StaticAssets{},
+		secureCookies:   !conf.devMode,
+
+		backgroundWriteSlots: make(chan struct{}, maxBackgroundWrites),
+	}
+}
+
+// There's no real email provider yet, so outside of dev mode the emails go nowhere.
+// (LogMailer would put the verification links in the logs.)
+func newMailer(conf *Config) entropy.Mailer {
+	if conf.devMode {
+		return entropy.LogMailer{}
 	}
+	return entropy.DiscardMailer{}
+}
+
+// Serve these files under /static/, and link to them by their fingerprinted URLs. This
+// has to happen before newMux. (In dev mode, newMux serves ./static from the disk instead.)
+func (app *App) useStaticAssets(assets *entropy.StaticAssets) {
+	app.staticAssets = assets
+	app.renderer.UseStaticAssets(assets)
 }
 
 // It occurs to me that if I had this do nothing when err == nil, then I could do
@@ -68,117 +131,388 @@ func NewApp(db *entropy.DB) *App {
 // ```
 // to return 500 on any errors. But that feels like a real invitation to confusion.
 func errorResponse(w http.ResponseWriter, err error) {
-	log.Printf("sending 500 error: %s", err)
+	slog.Error("sending 500 error", "err", err)
 	http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
 }
 
 func badRequest(w http.ResponseWriter, err error) {
-	log.Printf("sending 400 error: %s", err)
+	slog.Warn("sending 400 error", "err", err)
 	http.Error(w, "400 Bad Request", http.StatusBadRequest)
 }
 
-func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+// Send a 429, telling the client to try again after retryAfter
+func tooManyRequests(w http.ResponseWriter, err error, retryAfter time.Duration) {
+	slog.Warn("sending 429 error", "err", err)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+}
+
+func serviceUnavailable(w http.ResponseWriter) {
+	slog.Warn("sending 503 error: couldn't get a database connection")
+	http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+}
+
+// Get a read-write connection for the request. The pool gives us nil if the request is
+// cancelled (or the pool is closed) before a connection frees up, in which case this
+// sends a 503 and returns false. Otherwise, put the connection back with app.db.Put.
+func (app *App) conn(w http.ResponseWriter, r *http.Request) (*sqlite.Conn, bool) {
+	conn := app.db.Get(r.Context())
+	if conn == nil {
+		serviceUnavailable(w)
+		return nil, false
+	}
+	return conn, true
+}
+
+// Like app.conn, but for a read-only connection (put it back with app.db.PutReadOnly)
+func (app *App) readOnlyConn(w http.ResponseWriter, r *http.Request) (*sqlite.Conn, bool) {
+	conn := app.db.GetReadOnly(r.Context())
+	if conn == nil {
+		serviceUnavailable(w)
+		return nil, false
+	}
+	return conn, true
+}
+
+// Parse the request body into r.PostForm (and r.MultipartForm, for multipart bodies).
+//
+// Handlers should call this instead of r.ParseForm/r.ParseMultipartForm, so that
+// urlencoded and multipart bodies are handled the same way everywhere. It's fine to call
+// it more than once, and fine if the CSRF middleware already parsed the body: the
+// net/http parsing functions do nothing if the form has already been parsed.
+func parseForm(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		return r.ParseMultipartForm(maxRequestBytes)
+	}
+	return r.ParseForm()
+}
+
+// Respond to an error from parseForm
+func formParseError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		slog.Warn("sending 413 error", "err", err)
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	badRequest(w, err)
+}
+
+func (app *App) redirectToLogin(w http.ResponseWriter, r *http.Request) {
 	// Clear the session cookie in case it has expired
-	entropy.ClearSessionCookie(w)
+	entropy.ClearSessionCookie(w, app.secureCookies)
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
+// The data that every page needs for the layout and nav. Page structs embed this, and
+// RenderTemplate fills it in, so that handlers don't have to remember to.
+//
+// TODO: a notification count for the nav, once there's anything to notify people about.
+type basePageData struct {
+	User    *entropy.User // the logged-in user, or nil
+	BaseURL string        // e.g. "https://entropych.maxhully.net", for absolute URLs
+}
+
+func (p *basePageData) setBasePageData(base basePageData) {
+	*p = base
+}
+
+// Implemented by (pointers to) the page structs that embed basePageData
+type pageWithBaseData interface {
+	setBasePageData(base basePageData)
+}
+
+func (app *App) fillBasePageData(r *http.Request, data any) {
+	if page, ok := data.(pageWithBaseData); ok {
+		page.setBasePageData(basePageData{
+			User:    entropy.GetCurrentUser(r.Context()),
+			BaseURL: app.baseURL,
+		})
+	}
+}
+
 func (app *App) RenderTemplate(w http.ResponseWriter, r *http.Request, name string, data any) {
+	app.fillBasePageData(r, data)
 	err := app.renderer.ExecuteTemplate(w, r, name, data)
 	if err != nil {
 		errorResponse(w, err)
 	}
 }
 
+// Render just the {{define}} block called defineName from the template, rather than the
+// whole page.
+func (app *App) RenderFragment(w http.ResponseWriter, r *http.Request, name string, defineName string, data any) {
+	app.fillBasePageData(r, data)
+	err := app.renderer.ExecuteNamed(w, r, name, defineName, data)
+	if err != nil {
+		errorResponse(w, err)
+	}
+}
+
+// Whether the client only wants the fragment of the page that changed (like when
+// <h-infinite-scroll> loads the next page of posts), rather than the whole page. Pages
+// that check this have to send Vary: HX-Request, so that caches don't mix the two up.
+func wantsFragment(r *http.Request) bool {
+	return r.Header.Get("HX-Request") != "" || r.URL.Query().Get("fragment") == "1"
+}
+
+// Whether the client wants a JSON response from a form post (like reacting to a post),
+// rather than being redirected.
+func wantsJSON(r *http.Request) bool {
+	return r.Header.Get("HX-Request") != "" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, data any) {
+	writeJSONAs(w, "application/json", data)
+}
+
+func writeJSONAs(w http.ResponseWriter, contentType string, data any) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// Whether the client asked for the ActivityPub version of a page (see activitypub.go),
+// with either of the content types that the spec allows
+func wantsActivityPub(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, entropy.ActivityPubContentType) ||
+		(strings.Contains(accept, "application/ld+json") && strings.Contains(accept, "activitystreams"))
+}
+
 type homepage struct {
-	User        *entropy.User
-	Posts       []entropy.Post
-	NextPageURL string
+	basePageData
+	Posts         []entropy.Post
+	ChaosLevel    float64 // the fraction of Posts from people the user doesn't follow
+	FollowingOnly bool    // whether ?filter=following is on
+	NextPageURL   string
+	FirstPageURL  string
 }
 
-const timeQueryParamLayout = "20060102T150405"
+func (p *homepage) ChaosPercent() int {
+	return int(math.Round(p.ChaosLevel * 100))
+}
+
+// Cursors are formatted with milliseconds, since that's how precise post timestamps are.
+// time.Parse accepts fractional seconds even though the layout doesn't have them, so links
+// from before we had milliseconds still work.
+const (
+	timeQueryParamLayout       = "20060102T150405"
+	timeQueryParamFormatLayout = "20060102T150405.000"
+)
 
 // A time in the future, so that we don't filter on time at all
-func defaultBefore() time.Time {
-	return time.Now().UTC().Add(time.Hour)
+func defaultBefore() entropy.PostCursor {
+	return entropy.PostCursor{CreatedAt: time.Now().UTC().Add(time.Hour)}
 }
 
-// Parse the "before" time query parameter from the given request. If we can't parse it
-// (either because it's missing or malformed), we return defaultBefore() instead
-func parseBefore(r *http.Request) time.Time {
-	beforeRaw := r.URL.Query().Get("before")
-	var err error
-	if beforeRaw == "" {
-		return defaultBefore()
+// Parse a cursor from the query parameters name (the time) and name+"_id" (the post ID,
+// to break ties between posts created in the same second). ok is false if the time is
+// missing or malformed.
+//
+// If the ID is missing, we use missingID. (Links from before the IDs were added only
+// had the time in them.)
+func parseCursor(r *http.Request, name string, missingID int64) (cursor entropy.PostCursor, ok bool) {
+	query := r.URL.Query()
+	createdAt, err := time.Parse(timeQueryParamLayout, query.Get(name))
+	if err != nil {
+		return cursor, false
 	}
-	// Just ignore errors here
-	before, err := time.Parse(timeQueryParamLayout, beforeRaw)
+	postID, err := strconv.ParseInt(query.Get(name+"_id"), 10, 64)
 	if err != nil {
+		postID = missingID
+	}
+	return entropy.PostCursor{CreatedAt: createdAt, PostID: postID}, true
+}
+
+// Format the cursor as query parameters for parseCursor
+func cursorQuery(name string, cursor entropy.PostCursor) string {
+	createdAt := cursor.CreatedAt.UTC().Format(timeQueryParamFormatLayout)
+	return fmt.Sprintf("%s=%s&%s_id=%d", name, url.QueryEscape(createdAt), name, cursor.PostID)
+}
+
+// Parse the "before" cursor from the given request. If we can't parse it (either
+// because it's missing or malformed), we return defaultBefore() instead
+func parseBefore(r *http.Request) entropy.PostCursor {
+	// Without an ID, skip everything from that second (which is how it used to work)
+	before, ok := parseCursor(r, "before", 0)
+	if !ok {
 		return defaultBefore()
 	}
 	return before
 }
 
-// Parse the "after" time query parameter from the given request. If we can't parse it
-// (either because it's missing or malformed), we return defaultBefore() instead
-func parseAfter(r *http.Request) time.Time {
-	afterRaw := r.URL.Query().Get("after")
-	var err error
-	if afterRaw == "" {
-		return time.Time{}
-	}
-	// Just ignore errors here
-	after, err := time.Parse(timeQueryParamLayout, afterRaw)
-	if err != nil {
-		return time.Time{}
+// Parse the "after" cursor from the given request. If we can't parse it (either because
+// it's missing or malformed), we return the zero cursor (before every post) instead
+func parseAfter(r *http.Request) entropy.PostCursor {
+	after, ok := parseCursor(r, "after", math.MaxInt64)
+	if !ok {
+		return entropy.PostCursor{}
 	}
 	return after
 }
 
-// Default limit when paginating posts
-const postsLimit = 50
+// Default limit when paginating posts, and the most posts that a page can ask for with
+// ?limit=
+const (
+	postsLimit    = 50
+	maxPostsLimit = 100
+)
+
+// Which page of a timeline to show: limit posts from before the cursor
+type postsPagination struct {
+	before entropy.PostCursor
+	limit  int
+	// Whether the page asked for its own limit, which its links then have to keep
+	customLimit bool
+}
+
+// Parse the "before" cursor and the "limit" from the request. The limit is clamped to
+// 1..maxPostsLimit, and if it's missing or malformed we use the configured default.
+func (app *App) parsePostsPagination(r *http.Request) postsPagination {
+	pagination := postsPagination{before: parseBefore(r), limit: app.postsPerPage}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		pagination.limit = min(max(limit, 1), maxPostsLimit)
+		pagination.customLimit = true
+	}
+	return pagination
+}
+
+// The URL of the first page, with the limit in it if the page asked for one
+func (p postsPagination) firstPageURL(pageURL string) string {
+	if !p.customLimit {
+		return pageURL
+	}
+	return addQuery(pageURL, fmt.Sprintf("limit=%d", p.limit))
+}
 
 func (app *App) Homepage(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.GetReadOnly(r.Context())
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.PutReadOnly(conn)
-	before := parseBefore(r)
+	pagination := app.parsePostsPagination(r)
+	before := pagination.before
 	user := entropy.GetCurrentUser(r.Context())
-	posts, err := entropy.GetRecommendedPosts(conn, user, before, postsLimit)
+	// ?filter=following shows only the people you follow, without changing your setting
+	var config entropy.RecommendConfig
+	firstPageURL := "/"
+	if user != nil && r.URL.Query().Get("filter") == "following" {
+		config.FeedMode = entropy.FeedModeChronological
+		firstPageURL = "/?filter=following"
+	}
+	firstPageURL = pagination.firstPageURL(firstPageURL)
+	posts, hasMore, err := entropy.GetRecommendedPosts(conn, user, before, pagination.limit, config)
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
+	if user != nil {
+		lastVisit, err := entropy.GetLastHomepageVisit(conn, user.UserID)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		// Pages after the first one are below whatever was new on the first one
+		isFirstPage := !r.URL.Query().Has("before")
+		entropy.MarkLastHomepageVisit(posts, lastVisit, !isFirstPage && before.CreatedAt.After(lastVisit))
+		if isFirstPage && entropy.ShouldRecordHomepageVisit(lastVisit) {
+			app.recordHomepageVisit(r, user)
+		}
+	}
 	page := &homepage{
-		User:        user,
-		Posts:       posts,
-		NextPageURL: getNextPageURL(posts, "/", postsLimit),
+		Posts:         posts,
+		ChaosLevel:    entropy.ChaosLevel(posts),
+		NextPageURL:   getNextPageURL(posts, firstPageURL, hasMore),
+		FirstPageURL:  firstPageURL,
+		FollowingOnly: config.FeedMode == entropy.FeedModeChronological,
+	}
+	w.Header().Add("Vary", "HX-Request")
+	if wantsFragment(r) {
+		app.RenderFragment(w, r, "index.html", "posts", page)
+		return
 	}
 	app.RenderTemplate(w, r, "index.html", page)
 }
 
-func getNextPageURL(posts []entropy.Post, urlPath string, limit int) string {
-	if len(posts) == limit {
-		lastPostCreatedAt := posts[len(posts)-1].CreatedAt.UTC().Format(timeQueryParamLayout)
-		return fmt.Sprintf("%s?before=%s", urlPath, url.QueryEscape(lastPostCreatedAt))
+// Not being able to record the visit isn't worth failing the page over, so this only logs
+// errors.
+func (app *App) recordHomepageVisit(r *http.Request, user *entropy.User) {
+	conn := app.db.Get(r.Context())
+	if conn == nil {
+		slog.Warn("couldn't record homepage visit: no database connection")
+		return
+	}
+	defer app.db.Put(conn)
+	if err := entropy.RecordHomepageVisit(conn, user.UserID); err != nil {
+		slog.Error("couldn't record homepage visit", "err", err)
+	}
+}
+
+// The URL for the page of posts after these ones, or "" if there are no more. pageURL
+// can have a query string of its own, which is kept.
+func getNextPageURL(posts []entropy.Post, pageURL string, hasMore bool) string {
+	if !hasMore || len(posts) == 0 {
+		return ""
+	}
+	return addQuery(pageURL, cursorQuery("before", posts[len(posts)-1].Cursor()))
+}
+
+// Add query parameters to a URL that might have a query string already
+func addQuery(pageURL string, query string) string {
+	if strings.Contains(pageURL, "?") {
+		return pageURL + "&" + query
 	}
-	return ""
+	return pageURL + "?" + query
 }
 
 func (app *App) About(w http.ResponseWriter, r *http.Request) {
 	app.RenderTemplate(w, r, "about.html", nil)
 }
 
+// How many users the discover page lists
+const discoverLimit = 50
+
+type discoverPage struct {
+	basePageData
+	Users []entropy.FollowedUser
+}
+
+// A list of the most-followed users, so that people who don't follow anyone yet (or
+// aren't logged in) have somewhere to start
+func (app *App) Discover(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	users, err := entropy.GetMostFollowedUsers(conn, discoverLimit)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	app.RenderTemplate(w, r, "discover.html", &discoverPage{Users: users})
+}
+
 type userPostsPage struct {
-	LoggedInUser           *entropy.User
+	basePageData
 	PostingUser            *entropy.User
 	Posts                  []entropy.Post
 	IsFollowingPostingUser bool
 	PostingUserFollowStats *entropy.UserFollowStats
 	DistanceFromUser       int
+	PinnedPost             *entropy.Post // nil if they haven't pinned anything
 	NextPageURL            string
+	FirstPageURL           string
 }
 
-func getUserPostsPage(conn *sqlite.Conn, user *entropy.User, postingUser *entropy.User, before time.Time) (*userPostsPage, error) {
+func getUserPostsPage(conn *sqlite.Conn, user *entropy.User, postingUser *entropy.User, pagination postsPagination) (*userPostsPage, error) {
 	isFollowing := false
 	distanceFromUser := entropy.MaxDistortionLevel
 	var err error
@@ -193,30 +527,63 @@ func getUserPostsPage(conn *sqlite.Conn, user *entropy.User, postingUser *entrop
 	if user != nil && postingUser.UserID == user.UserID {
 		distanceFromUser = 0
 	}
-	posts, err := entropy.GetRecentPostsFromUser(conn, postingUser.UserID, before, postsLimit)
+	// Fetch one extra post, to tell if there's a next page
+	posts, err := entropy.GetRecentPostsFromUser(conn, postingUser.UserID, pagination.before, pagination.limit+1, true)
 	if err != nil {
 		return nil, err
 	}
+	hasMore := len(posts) > pagination.limit
+	if hasMore {
+		posts = posts[:pagination.limit]
+	}
+	pinnedPostID, err := entropy.GetPinnedPostID(conn, postingUser.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var pinnedPost *entropy.Post
+	if pinnedPostID != 0 {
+		if pinnedPost, err = entropy.GetPost(conn, pinnedPostID); err != nil {
+			return nil, err
+		}
+	}
 	if err := entropy.DecoratePosts(conn, user, posts); err != nil {
 		return nil, err
 	}
+	for i := range posts {
+		posts[i].Pinned = posts[i].PostID == pinnedPostID
+	}
+	// The pinned post gets decorated on its own, since it can be on the page twice and
+	// DecoratePosts only fills in one copy of each post
+	if pinnedPost != nil {
+		pinned := []entropy.Post{*pinnedPost}
+		if err := entropy.DecoratePosts(conn, user, pinned); err != nil {
+			return nil, err
+		}
+		pinnedPost = &pinned[0]
+		pinnedPost.Pinned = true
+	}
 	stats, err := entropy.GetUserFollowStats(conn, postingUser.UserID)
 	if err != nil {
 		return nil, err
 	}
+	firstPageURL := pagination.firstPageURL(postingUser.URL())
 	return &userPostsPage{
-		LoggedInUser:           user,
 		PostingUser:            postingUser,
 		Posts:                  posts,
 		IsFollowingPostingUser: isFollowing,
 		PostingUserFollowStats: stats,
 		DistanceFromUser:       distanceFromUser,
-		NextPageURL:            getNextPageURL(posts, postingUser.URL(), postsLimit),
+		PinnedPost:             pinnedPost,
+		NextPageURL:            getNextPageURL(posts, firstPageURL, hasMore),
+		FirstPageURL:           firstPageURL,
 	}, nil
 }
 
 func (app *App) ShowUserPosts(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.GetReadOnly(r.Context())
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.PutReadOnly(conn)
 
 	postingUserName := r.PathValue("username")
@@ -229,16 +596,246 @@ func (app *App) ShowUserPosts(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	w.Header().Add("Vary", "Accept")
+	if wantsActivityPub(r) {
+		writeJSONAs(w, entropy.ActivityPubContentType, entropy.NewActivityPubActor(postingUser, app.baseURL))
+		return
+	}
 	user := entropy.GetCurrentUser(r.Context())
-	before := parseBefore(r)
-	page, err := getUserPostsPage(conn, user, postingUser, before)
+	page, err := getUserPostsPage(conn, user, postingUser, app.parsePostsPagination(r))
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
+	w.Header().Add("Vary", "HX-Request")
+	if wantsFragment(r) {
+		app.RenderFragment(w, r, "user_posts.html", "posts", page)
+		return
+	}
 	app.RenderTemplate(w, r, "user_posts.html", page)
 }
 
+// The user's ActivityPub outbox. Without ?page=true (or a cursor), it's just the
+// collection, which points at the first page. The posts are distorted like they are
+// everywhere else, so whoever fetches this from elsewhere sees them as garbled as anyone
+// else who isn't logged in.
+func (app *App) ShowUserOutbox(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+
+	postingUser, err := entropy.GetUserByName(conn, r.PathValue("username"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if postingUser == nil {
+		http.NotFound(w, r)
+		return
+	}
+	outboxURL := postingUser.ActivityPubOutboxURL(app.baseURL)
+	firstPageURL := outboxURL + "?page=true"
+	query := r.URL.Query()
+	if !query.Has("page") && !query.Has("before") {
+		writeJSONAs(w, entropy.ActivityPubContentType, entropy.NewActivityPubOutbox(postingUser, firstPageURL, app.baseURL))
+		return
+	}
+	// Fetch one extra post, to tell if there's a next page
+	posts, err := entropy.GetRecentPostsFromUser(conn, postingUser.UserID, parseBefore(r), postsLimit+1, true)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	hasMore := len(posts) > postsLimit
+	if hasMore {
+		posts = posts[:postsLimit]
+	}
+	if err := entropy.DecoratePosts(conn, entropy.GetCurrentUser(r.Context()), posts); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	pageURL := outboxURL + "?" + r.URL.RawQuery
+	nextPageURL := getNextPageURL(posts, firstPageURL, hasMore)
+	writeJSONAs(w, entropy.ActivityPubContentType, entropy.NewActivityPubOutboxPage(postingUser, posts, app.baseURL, pageURL, nextPageURL))
+}
+
+// Look up a user's ActivityPub actor by their handle, like
+// /.well-known/webfinger?resource=acct:max@entropych.maxhully.net. Only handles on our own
+// host are found.
+func (app *App) WebFinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	account, ok := strings.CutPrefix(resource, "acct:")
+	// Names can't have "@" in them, but split at the last one anyway
+	at := strings.LastIndex(account, "@")
+	if !ok || at <= 0 {
+		badRequest(w, fmt.Errorf("resource should look like acct:name@host, not %q", resource))
+		return
+	}
+	userName, host := account[:at], account[at+1:]
+	base, err := url.Parse(app.baseURL)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if !strings.EqualFold(host, base.Host) {
+		http.NotFound(w, r)
+		return
+	}
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	user, err := entropy.GetUserByName(conn, userName)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if user == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// RFC 7033 says WebFinger should be readable from other sites' scripts
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSONAs(w, entropy.WebFingerContentType, entropy.NewWebFinger(user, base.Host, app.baseURL))
+}
+
+type userActivityPage struct {
+	basePageData
+	ActivityUser *entropy.User
+	Items        []entropy.ActivityItem
+	NextPageURL  string
+}
+
+// Everything a user has done (posted, reacted, and followed), newest first
+func (app *App) ShowUserActivity(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+
+	activityUser, err := entropy.GetUserByName(conn, r.PathValue("username"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if activityUser == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// Fetch one extra item, to tell if there's a next page
+	items, err := entropy.GetUserActivity(conn, activityUser.UserID, parseBefore(r).CreatedAt, app.postsPerPage+1)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	page := &userActivityPage{ActivityUser: activityUser, Items: items}
+	if len(items) > app.postsPerPage {
+		page.Items = items[:app.postsPerPage]
+		last := page.Items[len(page.Items)-1]
+		page.NextPageURL = activityUser.URL() + "activity?" + cursorQuery("before", entropy.PostCursor{CreatedAt: last.At})
+	}
+	app.RenderTemplate(w, r, "user_activity.html", page)
+}
+
+type mentionsPage struct {
+	basePageData
+	Posts        []entropy.Post
+	NextPageURL  string
+	FirstPageURL string
+}
+
+// The posts that @-mention the logged in user
+func (app *App) Mentions(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	pagination := app.parsePostsPagination(r)
+	// Fetch one extra post, to tell if there's a next page
+	posts, err := entropy.GetMentions(conn, user.UserID, pagination.before, pagination.limit+1)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	hasMore := len(posts) > pagination.limit
+	if hasMore {
+		posts = posts[:pagination.limit]
+	}
+	if err := entropy.DecoratePosts(conn, user, posts); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	firstPageURL := pagination.firstPageURL("/mentions")
+	page := &mentionsPage{
+		Posts:        posts,
+		NextPageURL:  getNextPageURL(posts, firstPageURL, hasMore),
+		FirstPageURL: firstPageURL,
+	}
+	w.Header().Add("Vary", "HX-Request")
+	if wantsFragment(r) {
+		app.RenderFragment(w, r, "mentions.html", "posts", page)
+		return
+	}
+	app.RenderTemplate(w, r, "mentions.html", page)
+}
+
+type hashtagPage struct {
+	basePageData
+	Hashtag      string
+	Posts        []entropy.Post
+	NextPageURL  string
+	FirstPageURL string
+}
+
+// The posts with a #hashtag
+func (app *App) ShowHashtag(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	hashtag := r.PathValue("hashtag")
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	pagination := app.parsePostsPagination(r)
+	// Fetch one extra post, to tell if there's a next page
+	posts, err := entropy.GetPostsWithHashtag(conn, hashtag, pagination.before, pagination.limit+1)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	hasMore := len(posts) > pagination.limit
+	if hasMore {
+		posts = posts[:pagination.limit]
+	}
+	if err := entropy.DecoratePosts(conn, user, posts); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	firstPageURL := pagination.firstPageURL(entropy.TagURL(hashtag))
+	page := &hashtagPage{
+		Hashtag:      hashtag,
+		Posts:        posts,
+		NextPageURL:  getNextPageURL(posts, firstPageURL, hasMore),
+		FirstPageURL: firstPageURL,
+	}
+	w.Header().Add("Vary", "HX-Request")
+	if wantsFragment(r) {
+		app.RenderFragment(w, r, "hashtag.html", "posts", page)
+		return
+	}
+	app.RenderTemplate(w, r, "hashtag.html", page)
+}
+
 type nameAndPasswordForm struct {
 	Name     string
 	Password string
@@ -247,9 +844,9 @@ type nameAndPasswordForm struct {
 }
 
 func (f *nameAndPasswordForm) ParseFromBody(r *http.Request) error {
-	// TODO: this should never error, because the CSRF middleware should already have
-	// parsed the body. So I should be able to move this into newSignUpForm, etc.
-	r.ParseForm()
+	if err := parseForm(r); err != nil {
+		return err
+	}
 	f.Name = r.PostForm.Get("name")
 	f.Password = r.PostForm.Get("password")
 	return nil
@@ -257,10 +854,21 @@ func (f *nameAndPasswordForm) ParseFromBody(r *http.Request) error {
 
 type SignUpForm struct {
 	nameAndPasswordForm
+	Email string // optional
+}
+
+func (f *SignUpForm) ParseFromBody(r *http.Request) error {
+	if err := f.nameAndPasswordForm.ParseFromBody(r); err != nil {
+		return err
+	}
+	f.Email = strings.TrimSpace(r.PostForm.Get("email"))
+	return nil
 }
 
+const duplicateNameError = "A user with this name already exists"
+
 func newSignUpForm() *SignUpForm {
-	return &SignUpForm{nameAndPasswordForm{
+	return &SignUpForm{nameAndPasswordForm: nameAndPasswordForm{
 		Errors: make(map[string]string),
 	}}
 }
@@ -275,13 +883,16 @@ func (f *SignUpForm) Validate(conn *sqlite.Conn) error {
 		f.Errors["name"] = fmt.Sprintf("Name is too long (max %d characters)", maxLength)
 	} else if strings.ContainsFunc(f.Name, unicode.IsSpace) {
 		f.Errors["name"] = "Name must not have any spaces in it"
+	} else if f.Name == "." || f.Name == ".." {
+		// Their profile URLs would get cleaned into some other path
+		f.Errors["name"] = "Name must be more than dots"
 	} else {
 		existingUserWithName, err := entropy.GetUserByName(conn, f.Name)
 		if err != nil {
 			return err
 		}
 		if existingUserWithName != nil {
-			f.Errors["name"] = "A user with this name already exists"
+			f.Errors["name"] = duplicateNameError
 		}
 	}
 
@@ -290,23 +901,49 @@ func (f *SignUpForm) Validate(conn *sqlite.Conn) error {
 	} else if len(f.Password) > maxLength {
 		f.Errors["password"] = fmt.Sprintf("Password is too long (max %d characters)", maxLength)
 	}
+
+	if len(f.Email) > 0 {
+		// This only checks that it looks like an email address. Whether it works is up
+		// to the verification email.
+		address, err := mail.ParseAddress(f.Email)
+		if err != nil || address.Address != f.Email {
+			f.Errors["email"] = "This doesn't look like an email address"
+		}
+	}
 	return nil
 }
 
 func (app *App) SignUpUser(w http.ResponseWriter, r *http.Request) {
 	// TODO: handle when user is already logged in
-	conn := app.db.Get(r.Context())
-	defer app.db.Put(conn)
 	var err error
-	defer sqlitex.Save(conn)(&err)
-
-	form := newSignUpForm()
-	if r.Method != http.MethodPost {
+	// The verification email goes out once the user is committed and the connection is
+	// back in the pool (this is deferred first, so it runs last), so that nobody else's
+	// writes wait on the mail server
+	var verificationToken, verificationEmail string
+	defer func() {
+		if err != nil || verificationToken == "" {
+			return
+		}
+		err := entropy.SendVerificationEmail(r.Context(), app.mailer, verificationEmail, verificationToken, app.baseURL)
+		// Not being able to send the email shouldn't stop anyone from signing up
+		if err != nil {
+			slog.Error("couldn't send verification email", "err", err)
+		}
+	}()
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	form := newSignUpForm()
+	if r.Method != http.MethodPost {
 		app.RenderTemplate(w, r, "signup.html", form)
 		return
 	}
 	if err := form.ParseFromBody(r); err != nil {
-		badRequest(w, err)
+		formParseError(w, err)
 		return
 	}
 	if err := form.Validate(conn); err != nil {
@@ -318,6 +955,12 @@ func (app *App) SignUpUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user, err := entropy.CreateUser(conn, form.Name, form.Password)
+	if errors.Is(err, entropy.ErrDuplicateUsername) {
+		// Someone else took the name since we checked in Validate
+		form.Errors["name"] = duplicateNameError
+		app.RenderTemplate(w, r, "signup.html", form)
+		return
+	}
 	if err != nil {
 		errorResponse(w, err)
 		return
@@ -327,25 +970,52 @@ func (app *App) SignUpUser(w http.ResponseWriter, r *http.Request) {
 		errorResponse(w, err)
 		return
 	}
-	uploadID, err := entropy.SaveUpload(conn, "image/png", buf.Bytes())
+	uploadID, err := app.uploads.Put(conn, "image/png", buf.Bytes())
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-	if err = entropy.UpdateUserProfile(conn, user.Name, "", "", uploadID); err != nil {
+	if err = entropy.UpdateUserProfile(conn, user.Name, user.DisplayName, "", uploadID); err != nil {
 		errorResponse(w, err)
 		return
 	}
-	session, err := entropy.CreateUserSession(conn, user.UserID)
+	if form.Email != "" {
+		if err = entropy.SetUserEmail(conn, user.UserID, form.Email); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		verificationToken, err = entropy.CreateEmailVerification(conn, user.UserID, form.Email)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		verificationEmail = form.Email
+	}
+	session, err := entropy.CreateUserSessionWithDuration(conn, user.UserID, app.sessionDuration)
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-	http.SetCookie(w, session.ToCookie())
+	http.SetCookie(w, session.ToCookie(app.secureCookies))
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// Where the link in the verification email goes
+func (app *App) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	verified, err := entropy.VerifyEmail(conn, r.URL.Query().Get("token"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	app.RenderTemplate(w, r, "verify_email.html", struct{ Verified bool }{verified})
+}
+
 type LogInForm struct {
 	nameAndPasswordForm
 }
@@ -401,7 +1071,10 @@ func newLogInForm() LogInForm {
 }
 
 func (app *App) LogIn(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 	form := newLogInForm()
 	if r.Method != http.MethodPost {
@@ -409,7 +1082,7 @@ func (app *App) LogIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := form.ParseFromBody(r); err != nil {
-		badRequest(w, err)
+		formParseError(w, err)
 		return
 	}
 	user, err := checkLogInForm(conn, &form)
@@ -421,12 +1094,12 @@ func (app *App) LogIn(w http.ResponseWriter, r *http.Request) {
 		app.RenderTemplate(w, r, "login.html", form)
 		return
 	}
-	session, err := entropy.CreateUserSession(conn, user.UserID)
+	session, err := entropy.CreateUserSessionWithDuration(conn, user.UserID, app.sessionDuration)
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-	http.SetCookie(w, session.ToCookie())
+	http.SetCookie(w, session.ToCookie(app.secureCookies))
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -441,9 +1114,12 @@ func (app *App) LogOut(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
-	entropy.ClearSessionCookie(w)
+	entropy.ClearSessionCookie(w, app.secureCookies)
 	if err = entropy.ExpireSession(conn, sessionPublicID); err != nil {
 		errorResponse(w, err)
 		return
@@ -452,15 +1128,21 @@ func (app *App) LogOut(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) NewPost(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
+		return
+	}
+	if err := parseForm(r); err != nil {
+		formParseError(w, err)
 		return
 	}
-	r.ParseForm()
 	content := r.PostForm.Get("content")
 	// should empty posts be allowed?
 	_, err := entropy.CreatePost(conn, user.UserID, content)
@@ -472,76 +1154,247 @@ func (app *App) NewPost(w http.ResponseWriter, r *http.Request) {
 }
 
 type postPage struct {
+	basePageData
 	Post           *entropy.Post
-	User           *entropy.User // the logged-in user
 	Replies        []entropy.Post
 	ReplyingToPost *entropy.Post
+	NewestFirst    bool   // whether the replies are sorted newest-first
 	NextPageURL    string // The URL for the next page of replies, if there are any
+	// For the link preview (Open Graph) tags. Link previews are generated by crawlers,
+	// which are never logged in, so we use the post's original (undistorted) content.
+	ShareDescription string
 }
 
-func getPostPage(conn *sqlite.Conn, user *entropy.User, postID int64, repliesAfter time.Time) (*postPage, error) {
-	page := postPage{User: user}
-	var err error
-	{
-		post, err := entropy.GetPost(conn, postID)
+// Which way to page through a post's replies. Oldest-first pages forward in time with
+// an "after" cursor; newest-first pages backward in time with a "before" cursor.
+type repliesPagination struct {
+	newestFirst bool
+	cursor      entropy.PostCursor
+}
+
+func parseRepliesPagination(r *http.Request) repliesPagination {
+	if r.URL.Query().Get("replies") == "newest" {
+		return repliesPagination{newestFirst: true, cursor: parseBefore(r)}
+	}
+	return repliesPagination{newestFirst: false, cursor: parseAfter(r)}
+}
+
+func getPostPage(conn *sqlite.Conn, user *entropy.User, postID int64, pagination repliesPagination) (*postPage, error) {
+	page := postPage{NewestFirst: pagination.newestFirst}
+	post, err := entropy.GetPost(conn, postID)
+	if err != nil {
+		return nil, err
+	}
+	if post == nil {
+		return nil, nil
+	}
+	page.ShareDescription = post.Content
+	// The post, then its parent (if it has one), then the replies. We put them all in one
+	// slice so that we only decorate once, rather than working out the distances to the
+	// same people three times over.
+	posts := []entropy.Post{*post}
+	if post.ReplyingToPostID != 0 {
+		parent, err := entropy.GetPost(conn, post.ReplyingToPostID)
 		if err != nil {
 			return nil, err
 		}
-		if post == nil {
-			return nil, nil
-		}
-		// is there a better way to transmute a pointer into a length-1 slice?
-		postSlice := []entropy.Post{*post}
-		// TODO: could I consolidate these three DecoratePosts calls?
-		if err := entropy.DecoratePosts(conn, user, postSlice); err != nil {
-			return nil, err
+		if parent != nil {
+			posts = append(posts, *parent)
 		}
-		// I'm curious about whether this is actually still the original address of `post`
-		page.Post = &postSlice[0]
 	}
+	repliesStart := len(posts)
 	// TODO: better abstraction around pagination...
-	if page.Replies, err = entropy.GetPostReplies(conn, postID, repliesAfter, postsLimit); err != nil {
-		return nil, err
+	var replies []entropy.Post
+	if pagination.newestFirst {
+		replies, err = entropy.GetPostRepliesDesc(conn, postID, pagination.cursor, postsLimit)
+	} else {
+		replies, err = entropy.GetPostReplies(conn, postID, pagination.cursor, postsLimit)
 	}
-	if len(page.Replies) == postsLimit {
-		lastPostCreatedAt := page.Replies[len(page.Replies)-1].CreatedAt.UTC().Format(timeQueryParamLayout)
-		page.NextPageURL = fmt.Sprintf("%s?after=%s", page.Post.PostURL(), url.QueryEscape(lastPostCreatedAt))
+	if err != nil {
+		return nil, err
 	}
-	if err := entropy.DecoratePosts(conn, user, page.Replies); err != nil {
+	posts = append(posts, replies...)
+	if err := entropy.DecoratePosts(conn, user, posts); err != nil {
 		return nil, err
 	}
-	if page.Post.ReplyingToPostID != 0 {
-		if page.ReplyingToPost, err = entropy.GetPost(conn, page.Post.ReplyingToPostID); err != nil {
-			return nil, err
-		}
-		parentPostSlice := []entropy.Post{*page.ReplyingToPost}
-		if err := entropy.DecoratePosts(conn, user, parentPostSlice); err != nil {
-			return nil, err
+	page.Post = &posts[0]
+	if repliesStart > 1 {
+		page.ReplyingToPost = &posts[1]
+	}
+	page.Replies = posts[repliesStart:]
+	if len(page.Replies) == postsLimit {
+		lastPost := page.Replies[len(page.Replies)-1].Cursor()
+		if pagination.newestFirst {
+			page.NextPageURL = page.Post.PostURL() + "?replies=newest&" + cursorQuery("before", lastPost)
+		} else {
+			page.NextPageURL = page.Post.PostURL() + "?" + cursorQuery("after", lastPost)
 		}
-		page.ReplyingToPost = &parentPostSlice[0]
 	}
-	return &page, err
+	return &page, nil
 }
 
 func (app *App) ShowPost(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
-	defer app.db.Put(conn)
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
 	postID, err := strconv.Atoi(r.PathValue("post_id"))
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
-	page, err := getPostPage(conn, entropy.GetCurrentUser(r.Context()), int64(postID), parseAfter(r))
+	user := entropy.GetCurrentUser(r.Context())
+	page, err := getPostPage(conn, user, int64(postID), parseRepliesPagination(r))
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-	// TODO: this template
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if user != nil {
+		app.recordPostView(int64(postID), user.UserID)
+	}
 	app.RenderTemplate(w, r, "show_post.html", page)
 }
 
+// A post as the API returns it. The content is distorted the same way it would be on
+// the site, by how far the requesting user is from the author.
+type postJSON struct {
+	PostID           int64               `json:"post_id"`
+	URL              string              `json:"url"`
+	UserName         string              `json:"user_name"`
+	DisplayName      string              `json:"display_name"`
+	CreatedAt        time.Time           `json:"created_at"`
+	Content          string              `json:"content"`
+	DistanceFromUser int                 `json:"distance_from_user"`
+	ReplyingToPostID int64               `json:"replying_to_post_id,omitempty"`
+	Reactions        []reactionCountJSON `json:"reactions"`
+	TotalReactions   int                 `json:"total_reactions"`
+	ReplyCount       int                 `json:"reply_count"`
+}
+
+// post has to be decorated already (see DecoratePosts)
+func newPostJSON(post *entropy.Post) postJSON {
+	data := postJSON{
+		PostID:           post.PostID,
+		URL:              post.PostURL(),
+		UserName:         post.UserName,
+		DisplayName:      post.UserDisplayName,
+		CreatedAt:        post.CreatedAt,
+		Content:          post.Content,
+		DistanceFromUser: post.DistanceFromUser,
+		ReplyingToPostID: post.ReplyingToPostID,
+		Reactions:        []reactionCountJSON{},
+		TotalReactions:   post.TotalReactions,
+		ReplyCount:       post.ReplyCount,
+	}
+	for _, reaction := range post.Reactions {
+		data.Reactions = append(data.Reactions, reactionCountJSON(reaction))
+	}
+	return data
+}
+
+type postPageJSON struct {
+	Post           postJSON   `json:"post"`
+	ReplyingToPost *postJSON  `json:"replying_to_post,omitempty"`
+	Replies        []postJSON `json:"replies"`
+	NextPageURL    string     `json:"next_page_url,omitempty"` // the next page of replies, if there are any
+}
+
+// The post page for GET /api/p/{post_id}. Its links to more replies stay in the API.
+func (page *postPage) MarshalJSON() ([]byte, error) {
+	data := postPageJSON{Post: newPostJSON(page.Post), Replies: []postJSON{}}
+	if page.ReplyingToPost != nil {
+		parent := newPostJSON(page.ReplyingToPost)
+		data.ReplyingToPost = &parent
+	}
+	for i := range page.Replies {
+		data.Replies = append(data.Replies, newPostJSON(&page.Replies[i]))
+	}
+	if page.NextPageURL != "" {
+		nextPageURL, err := url.Parse(page.NextPageURL)
+		if err != nil {
+			return nil, err
+		}
+		data.NextPageURL = apiPostURL(page.Post.PostID) + "?" + nextPageURL.RawQuery
+	}
+	return json.Marshal(data)
+}
+
+func apiPostURL(postID int64) string {
+	return fmt.Sprintf("/api/p/%d", postID)
+}
+
+// ShowPost for API clients: the post, its parent, and a page of its replies, as JSON.
+// It takes the same ?replies= and cursor parameters.
+func (app *App) ShowPostJSON(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	postID, err := strconv.Atoi(r.PathValue("post_id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	user := entropy.GetCurrentUser(r.Context())
+	page, err := getPostPage(conn, user, int64(postID), parseRepliesPagination(r))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, page)
+}
+
+// How long counting a view can take, including waiting for a connection, before we give
+// up on it
+const postViewTimeout = 5 * time.Second
+
+// There's only one read-write connection, so there's no point in lining up more than a
+// few writes for it
+const maxBackgroundWrites = 8
+
+// Count a view of the post in the background, so that the page never waits on a write
+// (or on the one read-write connection). Views are best-effort, so this only logs errors,
+// and drops the view if there are already maxBackgroundWrites waiting.
+func (app *App) recordPostView(postID int64, viewerUserID int64) {
+	select {
+	case app.backgroundWriteSlots <- struct{}{}:
+	default:
+		slog.Warn("couldn't record post view: too many background writes")
+		return
+	}
+	app.backgroundWrites.Add(1)
+	go func() {
+		defer app.backgroundWrites.Done()
+		defer func() { <-app.backgroundWriteSlots }()
+		ctx, cancel := context.WithTimeout(context.Background(), postViewTimeout)
+		defer cancel()
+		conn := app.db.Get(ctx)
+		if conn == nil {
+			slog.Warn("couldn't record post view: no database connection")
+			return
+		}
+		defer app.db.Put(conn)
+		if _, err := entropy.RecordPostView(conn, postID, viewerUserID); err != nil {
+			slog.Error("couldn't record post view", "err", err)
+		}
+	}()
+}
+
 func (app *App) ReplyToPost(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 	postID, err := strconv.Atoi(r.PathValue("post_id"))
 	if err != nil {
@@ -550,25 +1403,222 @@ func (app *App) ReplyToPost(w http.ResponseWriter, r *http.Request) {
 	}
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
+		return
+	}
+	if err := parseForm(r); err != nil {
+		formParseError(w, err)
 		return
 	}
-	r.ParseForm()
 	content := r.PostForm.Get("content")
 	replyPostID, err := entropy.ReplyToPost(conn, int64(postID), user.UserID, content)
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-	http.Redirect(w, r, fmt.Sprintf("/p/%d/", replyPostID), http.StatusSeeOther)
+	if wantsJSON(r) {
+		app.writeReplyJSON(w, r, conn, user, replyPostID)
+		return
+	}
+	http.Redirect(w, r, entropy.PostURL(replyPostID), http.StatusSeeOther)
+}
+
+type replyJSON struct {
+	PostID int64  `json:"post_id"`
+	URL    string `json:"url"`
+	HTML   string `json:"html"` // the reply, rendered like it is in the list of replies
+}
+
+func (app *App) writeReplyJSON(w http.ResponseWriter, r *http.Request, conn *sqlite.Conn, user *entropy.User, replyPostID int64) {
+	reply, err := entropy.GetPost(conn, replyPostID)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	replies := []entropy.Post{*reply}
+	if err := entropy.DecoratePosts(conn, user, replies); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	var html strings.Builder
+	if err := app.renderer.ExecuteNamed(&html, r, "show_post.html", "post", &replies[0]); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	writeJSON(w, replyJSON{PostID: replyPostID, URL: replies[0].PostURL(), HTML: html.String()})
+}
+
+type reactionCountJSON struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	UserReacted bool   `json:"user_reacted"`
+}
+
+type reactionsJSON struct {
+	PostID         int64               `json:"post_id"`
+	Reactions      []reactionCountJSON `json:"reactions"`
+	TotalReactions int                 `json:"total_reactions"`
+}
+
+// Respond with the post's reaction counts after the user reacted (or unreacted) to it
+func writeReactionsJSON(w http.ResponseWriter, conn *sqlite.Conn, user *entropy.User, postID int64) {
+	post, err := entropy.GetPost(conn, postID)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	posts := []entropy.Post{*post}
+	if err := entropy.DecoratePosts(conn, user, posts); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	data := reactionsJSON{
+		PostID:         postID,
+		Reactions:      []reactionCountJSON{},
+		TotalReactions: posts[0].TotalReactions,
+	}
+	for _, reaction := range posts[0].Reactions {
+		data.Reactions = append(data.Reactions, reactionCountJSON(reaction))
+	}
+	writeJSON(w, data)
+}
+
+// The emoji you react with when the form doesn't say
+var defaultReactionEmoji = entropy.AllowedReactions[0]
+
+// The emoji in a react/unreact form. Some emojis are made of several code points, but none
+// are this long.
+const maxReactionEmojiBytes = 32
+
+func getReactionEmoji(r *http.Request) (string, error) {
+	if err := parseForm(r); err != nil {
+		return "", err
+	}
+	emoji := strings.TrimSpace(r.PostForm.Get("emoji"))
+	if emoji == "" {
+		return defaultReactionEmoji, nil
+	}
+	if len(emoji) > maxReactionEmojiBytes {
+		return "", fmt.Errorf("reaction emoji is too long (%d bytes)", len(emoji))
+	}
+	return emoji, nil
 }
 
 func (app *App) ReactToPost(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	postID, err := strconv.Atoi(r.PathValue("post_id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	emoji, err := getReactionEmoji(r)
+	if err != nil {
+		formParseError(w, err)
+		return
+	}
+	foundPost, err := entropy.ReactToPostIfExists(conn, user.UserID, int64(postID), emoji)
+	if errors.Is(err, entropy.ErrReactionNotAllowed) {
+		badRequest(w, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if !foundPost {
+		http.NotFound(w, r)
+		return
+	}
+	if wantsJSON(r) {
+		writeReactionsJSON(w, conn, user, int64(postID))
+		return
+	}
+	http.Redirect(w, r, entropy.PostURL(int64(postID)), http.StatusSeeOther)
+}
+
+// The body of PUT and DELETE /api/p/{post_id}/reaction
+type reactionRequestJSON struct {
+	Emoji string `json:"emoji"`
+}
+
+// Set (PUT) or remove (DELETE) the user's reaction to a post, for API clients. The body is
+// like {"emoji": "👍"}, and the response is the post's reaction counts afterwards (the same
+// JSON that the react and unreact forms send back). Both are idempotent: putting a
+// reaction that's there already, or deleting one that isn't, changes nothing. Deleting is
+// still subject to ReactionCooldown, though.
+func (app *App) SetReactionJSON(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		// Not a redirect, since there's no one to follow it to the login page
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	postID, err := strconv.ParseInt(r.PathValue("post_id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var body reactionRequestJSON
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		badRequest(w, fmt.Errorf("couldn't parse reaction: %w", err))
+		return
+	}
+	emoji := strings.TrimSpace(body.Emoji)
+	if emoji == "" || len(emoji) > maxReactionEmojiBytes {
+		badRequest(w, fmt.Errorf("bad reaction emoji %q", body.Emoji))
+		return
+	}
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	var foundPost bool
+	if r.Method == http.MethodDelete {
+		foundPost, err = entropy.UnreactToPostIfExists(conn, user.UserID, postID, emoji)
+	} else {
+		foundPost, err = entropy.ReactToPostIfExists(conn, user.UserID, postID, emoji)
+	}
+	if errors.Is(err, entropy.ErrReactionNotAllowed) {
+		badRequest(w, err)
+		return
+	}
+	if errors.Is(err, entropy.ErrReactionCooldown) {
+		tooManyRequests(w, err, entropy.ReactionCooldown)
+		return
+	}
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if !foundPost {
+		http.NotFound(w, r)
+		return
+	}
+	writeReactionsJSON(w, conn, user, postID)
+}
+
+// Take a closer look at a post from far away in the follower graph
+func (app *App) PeekAtPost(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
 		return
 	}
 	postID, err := strconv.Atoi(r.PathValue("post_id"))
@@ -576,7 +1626,7 @@ func (app *App) ReactToPost(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	foundPost, err := entropy.ReactToPostIfExists(conn, user.UserID, int64(postID), "❤️")
+	foundPost, err := entropy.GrantPeek(conn, user.UserID, int64(postID), entropy.DefaultPeekDuration)
 	if err != nil {
 		errorResponse(w, err)
 		return
@@ -585,15 +1635,71 @@ func (app *App) ReactToPost(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	http.Redirect(w, r, fmt.Sprintf("/p/%d/", postID), http.StatusSeeOther)
+	http.Redirect(w, r, entropy.PostURL(int64(postID)), http.StatusSeeOther)
+}
+
+// Pin one of your own posts to the top of your profile
+func (app *App) PinPost(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	postID, err := strconv.Atoi(r.PathValue("post_id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	pinned, err := entropy.PinPost(conn, user.UserID, int64(postID))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if !pinned {
+		// Either there's no such post, or it's someone else's
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, user.URL(), http.StatusSeeOther)
+}
+
+func (app *App) UnpinPost(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	postID, err := strconv.Atoi(r.PathValue("post_id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := entropy.UnpinPost(conn, user.UserID, int64(postID)); err != nil {
+		errorResponse(w, err)
+		return
+	}
+	http.Redirect(w, r, user.URL(), http.StatusSeeOther)
 }
 
 func (app *App) UnreactToPost(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
 		return
 	}
 	postID, err := strconv.Atoi(r.PathValue("post_id"))
@@ -601,7 +1707,16 @@ func (app *App) UnreactToPost(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	foundPost, err := entropy.UnreactToPostIfExists(conn, user.UserID, int64(postID))
+	emoji, err := getReactionEmoji(r)
+	if err != nil {
+		formParseError(w, err)
+		return
+	}
+	foundPost, err := entropy.UnreactToPostIfExists(conn, user.UserID, int64(postID), emoji)
+	if errors.Is(err, entropy.ErrReactionCooldown) {
+		tooManyRequests(w, err, entropy.ReactionCooldown)
+		return
+	}
 	if err != nil {
 		errorResponse(w, err)
 		return
@@ -610,16 +1725,28 @@ func (app *App) UnreactToPost(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	http.Redirect(w, r, fmt.Sprintf("/p/%d/", postID), http.StatusSeeOther)
+	if wantsJSON(r) {
+		writeReactionsJSON(w, conn, user, int64(postID))
+		return
+	}
+	http.Redirect(w, r, entropy.PostURL(int64(postID)), http.StatusSeeOther)
+}
+
+type followJSON struct {
+	Following bool `json:"following"`
+	Changed   bool `json:"changed"` // false if they were already (not) following
 }
 
 func (app *App) FollowUser(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
 		return
 	}
 
@@ -634,23 +1761,29 @@ func (app *App) FollowUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = entropy.FollowUser(conn, user.UserID, followedUser.UserID)
+	changed, err := entropy.FollowUser(conn, user.UserID, followedUser.UserID)
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-
+	if wantsJSON(r) {
+		writeJSON(w, followJSON{Following: true, Changed: changed})
+		return
+	}
 	http.Redirect(w, r, followedUser.URL(), http.StatusSeeOther)
 }
 
 // lol, a lot of duplication here
 func (app *App) UnfollowUser(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
 		return
 	}
 
@@ -665,25 +1798,193 @@ func (app *App) UnfollowUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = entropy.UnfollowUser(conn, user.UserID, followedUser.UserID)
+	changed, err := entropy.UnfollowUser(conn, user.UserID, followedUser.UserID)
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
-
+	if wantsJSON(r) {
+		writeJSON(w, followJSON{Following: false, Changed: changed})
+		return
+	}
 	http.Redirect(w, r, followedUser.URL(), http.StatusSeeOther)
 }
 
+// The most names that one import can follow
+const maxImportFollows = 1000
+
+// Split a list of user names, one per line or separated by commas (or both, like a CSV
+// file with one column). Each name can have an @ in front of it. Blank names are dropped.
+func parseNameList(text string) []string {
+	var names []string
+	for _, line := range strings.Split(text, "\n") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+type importFollowsPage struct {
+	basePageData
+	Names  string
+	Result *entropy.FollowUsersResult // nil until they've imported something
+	Errors map[string]string
+}
+
+// Follow a whole list of people at once
+func (app *App) ImportFollows(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	page := &importFollowsPage{Errors: make(map[string]string)}
+	if r.Method == http.MethodGet {
+		app.RenderTemplate(w, r, "import_follows.html", page)
+		return
+	}
+	if err := parseForm(r); err != nil {
+		formParseError(w, err)
+		return
+	}
+	page.Names = r.PostForm.Get("names")
+	names := parseNameList(page.Names)
+	if len(names) == 0 {
+		page.Errors["names"] = "Add at least one name"
+	} else if len(names) > maxImportFollows {
+		page.Errors["names"] = fmt.Sprintf("That's too many names (max %d at a time)", maxImportFollows)
+	}
+	if len(page.Errors) > 0 {
+		app.RenderTemplate(w, r, "import_follows.html", page)
+		return
+	}
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	result, err := entropy.FollowUsersByName(conn, user.UserID, names)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	page.Result = result
+	page.Names = ""
+	app.RenderTemplate(w, r, "import_follows.html", page)
+}
+
+type webhooksPage struct {
+	basePageData
+	Webhooks []entropy.Webhook
+	URL      string
+	Errors   map[string]string
+}
+
+// List the user's webhooks, and add new ones
+func (app *App) Webhooks(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	page := &webhooksPage{Errors: make(map[string]string)}
+	if r.Method == http.MethodPost {
+		if err := parseForm(r); err != nil {
+			formParseError(w, err)
+			return
+		}
+		page.URL = strings.TrimSpace(r.PostForm.Get("url"))
+		_, err := entropy.RegisterWebhook(conn, user.UserID, page.URL)
+		if errors.Is(err, entropy.ErrBadWebhookURL) || errors.Is(err, entropy.ErrTooManyWebhooks) {
+			page.Errors["url"] = err.Error()
+		} else if err != nil {
+			errorResponse(w, err)
+			return
+		} else {
+			page.URL = ""
+		}
+	}
+	webhooks, err := entropy.GetWebhooks(conn, user.UserID)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	page.Webhooks = webhooks
+	app.RenderTemplate(w, r, "webhooks.html", page)
+}
+
+func (app *App) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	webhookID, err := strconv.ParseInt(r.PathValue("webhook_id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.Put(conn)
+	deleted, err := entropy.DeleteWebhook(conn, user.UserID, webhookID)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	if !deleted {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/profile/webhooks", http.StatusSeeOther)
+}
+
+// Everyone the user follows, one name per line, in the format that ImportFollows takes
+func (app *App) ExportFollows(w http.ResponseWriter, r *http.Request) {
+	user := entropy.GetCurrentUser(r.Context())
+	if user == nil {
+		app.redirectToLogin(w, r)
+		return
+	}
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	names, err := entropy.GetFollowedUserNames(conn, user.UserID)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="follows.txt"`)
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
 // TODO: reset password and stuff
 type updateProfileForm struct {
 	DisplayName string
 	Bio         string
+	FeedMode    entropy.FeedMode
 	Errors      map[string]string
 }
 
 type updateProfilePage struct {
+	basePageData
 	Form updateProfileForm
-	User *entropy.User
 }
 
 func (f *updateProfileForm) Validate() {
@@ -693,49 +1994,102 @@ func (f *updateProfileForm) Validate() {
 	if len(f.Bio) > 256 {
 		f.Errors["bio"] = fmt.Sprintf("Bio is too long (max %d characters)", 256)
 	}
-}
+	if !f.FeedMode.Valid() {
+		f.Errors["feed_mode"] = "Pick one of the feeds."
+	}
+}
+
+// The content types we accept for avatar uploads, and what to call them when telling
+// people. (They all get re-encoded as PNGs by SaveAvatarUpload.)
+var allowedAvatarContentTypes = []string{"image/png", "image/jpeg"}
+var avatarContentTypeNames = map[string]string{"image/png": "PNG", "image/jpeg": "JPEG"}
+
+// Check the headers of an uploaded avatar. Returns the upload's content type if it's
+// acceptable, and otherwise a problem to show the user (for the form's Errors).
+func validateAvatarUpload(header *multipart.FileHeader) (contentType string, problem string) {
+	var names []string
+	for _, allowed := range allowedAvatarContentTypes {
+		names = append(names, avatarContentTypeNames[allowed])
+	}
+	problem = fmt.Sprintf("Avatar must be a %s image.", strings.Join(names, " or "))
 
-func validateUpload(header *multipart.FileHeader) error {
 	contentTypes := header.Header["Content-Type"]
 	if len(contentTypes) != 1 {
-		return fmt.Errorf("unexpected mime header (zero or >1 content types?): %+v", header)
+		return "", problem
 	}
-	contentType := contentTypes[0]
-	if contentType != "image/png" {
-		return fmt.Errorf("expected contentType to be image/png, got %q", contentType)
+	contentType, _, err := mime.ParseMediaType(contentTypes[0])
+	if err != nil || !slices.Contains(allowedAvatarContentTypes, contentType) {
+		return "", problem
 	}
-	return nil
+	return contentType, ""
+}
+
+// The biggest avatar we'll take, which is less than the limit on the request as a whole
+// (maxRequestBytes)
+const maxAvatarBytes = 512 * 1024
+
+// Read an uploaded avatar, after checking that its first few bytes look like the content
+// type it claims to be. (The client can say whatever it wants in the Content-Type.) Like
+// validateAvatarUpload, this returns a problem to show the user if it isn't acceptable.
+func readAvatarUpload(file multipart.File, header *multipart.FileHeader, contentType string) (contents []byte, problem string, err error) {
+	tooBig := fmt.Sprintf("Avatar is too big (max %d KB).", maxAvatarBytes/1024)
+	if header.Size > maxAvatarBytes {
+		return nil, tooBig, nil
+	}
+	// http.DetectContentType only looks at the first 512 bytes
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, "", err
+	}
+	sniff = sniff[:n]
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(sniff))
+	if detected != contentType {
+		return nil, fmt.Sprintf("Avatar doesn't look like a %s image.", avatarContentTypeNames[contentType]), nil
+	}
+	// Don't go past the limit, whatever the header said the size was
+	rest := io.LimitReader(file, maxAvatarBytes+1-int64(n))
+	contents, err = io.ReadAll(io.MultiReader(bytes.NewReader(sniff), rest))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(contents) > maxAvatarBytes {
+		return nil, tooBig, nil
+	}
+	return contents, "", nil
 }
 
 func (app *App) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 	var err error
-	conn := app.db.Get(r.Context())
+	conn, ok := app.conn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.Put(conn)
 	// Save so that if the update fails we don't create the upload
 	defer sqlitex.Save(conn)(&err)
 
 	user := entropy.GetCurrentUser(r.Context())
 	if user == nil {
-		redirectToLogin(w, r)
+		app.redirectToLogin(w, r)
 		return
 	}
 	var page updateProfilePage
-	page.User = user
 	page.Form.Errors = make(map[string]string)
 	page.Form.DisplayName = user.DisplayName
 	page.Form.Bio = user.Bio
+	if page.Form.FeedMode, err = entropy.GetFeedMode(conn, user.UserID); err != nil {
+		errorResponse(w, err)
+		return
+	}
 	if r.Method == http.MethodGet {
-		app.RenderTemplate(w, r, "user_profile.html", page)
+		app.RenderTemplate(w, r, "user_profile.html", &page)
 		return
 	}
 
 	// Handling POST now
-	if err := r.ParseMultipartForm(maxRequestBytes); err != nil {
-		if _, ok := err.(*http.MaxBytesError); ok {
-			http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
-			return
-		}
-		errorResponse(w, err)
+	if err := parseForm(r); err != nil {
+		formParseError(w, err)
 		return
 	}
 	if v := r.PostForm.Get("display_name"); v != "" {
@@ -745,15 +2099,23 @@ func (app *App) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 	if r.PostForm.Has("bio") {
 		page.Form.Bio = r.PostForm.Get("bio")
 	}
-	// TODO: validate avatar upload (must be .png)
+	if r.PostForm.Has("feed_mode") {
+		page.Form.FeedMode = entropy.FeedMode(r.PostForm.Get("feed_mode"))
+	}
 	if page.Form.Validate(); len(page.Form.Errors) > 0 {
-		app.RenderTemplate(w, r, "user_profile.html", page)
+		app.RenderTemplate(w, r, "user_profile.html", &page)
 		return
 	}
 
 	var uploadID int64
 	file, header, err := r.FormFile("avatar")
-	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+	if r.PostForm.Get("remove_avatar") != "" {
+		// Removing the avatar wins over uploading a new one
+		if file != nil {
+			file.Close()
+		}
+		uploadID = entropy.RemoveAvatar
+	} else if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
 		uploadID = 0
 	} else if err != nil {
 		badRequest(w, err)
@@ -766,23 +2128,31 @@ func (app *App) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 			}
 		}()
 		// Handle uploaded file in this else block.
-		if err = validateUpload(header); err != nil {
-			page.Form.Errors["avatar"] = "Avatar must be a .png image."
-			app.RenderTemplate(w, r, "user_profile.html", page)
+		contentType, problem := validateAvatarUpload(header)
+		if problem != "" {
+			page.Form.Errors["avatar"] = problem
+			app.RenderTemplate(w, r, "user_profile.html", &page)
 			return
 		}
 		var contents []byte
-		if contents, err = io.ReadAll(file); err != nil {
+		contents, problem, err = readAvatarUpload(file, header, contentType)
+		if err != nil {
 			errorResponse(w, err)
 			return
 		}
-		contentTypes := header.Header["Content-Type"]
-		if len(contentTypes) != 1 {
-			badRequest(w, fmt.Errorf("unexpected mime header (zero or >1 content types?): %+v", header))
+		if problem != "" {
+			page.Form.Errors["avatar"] = problem
+			app.RenderTemplate(w, r, "user_profile.html", &page)
 			return
 		}
-		contentType := contentTypes[0]
-		if uploadID, err = entropy.SaveUpload(conn, contentType, contents); err != nil {
+		uploadID, err = entropy.SaveAvatarUpload(conn, app.uploads, contents)
+		if errors.Is(err, entropy.ErrInvalidImage) {
+			page.Form.Errors["avatar"] = "Avatar couldn't be read as an image."
+			app.RenderTemplate(w, r, "user_profile.html", &page)
+			err = nil
+			return
+		}
+		if err != nil {
 			errorResponse(w, err)
 			return
 		}
@@ -792,11 +2162,18 @@ func (app *App) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 		errorResponse(w, err)
 		return
 	}
+	if err = entropy.SetFeedMode(conn, user.UserID, page.Form.FeedMode); err != nil {
+		errorResponse(w, err)
+		return
+	}
 	http.Redirect(w, r, user.URL(), http.StatusSeeOther)
 }
 
 func (app *App) ServeUpload(w http.ResponseWriter, r *http.Request) {
-	conn := app.db.GetReadOnly(r.Context())
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
 	defer app.db.PutReadOnly(conn)
 	parts := strings.SplitN(r.PathValue("upload_id"), ".", 2)
 	if len(parts) != 2 || strings.ToLower(parts[1]) != "png" {
@@ -808,22 +2185,270 @@ func (app *App) ServeUpload(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	blob, contentType, err := entropy.OpenUploadContents(conn, int64(uploadID))
+	// ?blur=N serves a blurred version, for avatars of far-away users (see
+	// entropy.Post.UserAvatarURL)
+	var blur int
+	if blurParam := r.URL.Query().Get("blur"); blurParam != "" {
+		blur, err = strconv.Atoi(blurParam)
+		if err != nil || blur < 0 || blur > entropy.MaxAvatarBlur {
+			badRequest(w, fmt.Errorf("invalid blur level %q", blurParam))
+			return
+		}
+	}
+	blob, info, err := app.uploads.Open(conn, int64(uploadID))
+	if errors.Is(err, entropy.ErrUploadNotFound) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		errorResponse(w, err)
 		return
 	}
 	defer blob.Close()
-	w.Header().Set("Content-Type", contentType)
-	// Set a 1-year expiration for the PNGs, because they're immutable
+	// Set a 1-year expiration for the PNGs, because they're immutable (and so are their
+	// blurred versions)
+	w.Header().Set("Cache-Control", "max-age=31536000, public, immutable")
+	if blur == 0 {
+		w.Header().Set("Content-Type", info.ContentType)
+		w.Header().Set("ETag", info.ETag())
+		// ServeContent handles If-None-Match/If-Modified-Since (with a 304) and range
+		// requests for us.
+		http.ServeContent(w, r, "", info.CreatedAt, blob)
+		return
+	}
+	key := blurredAvatarKey{uploadID: info.UploadID, blur: blur}
+	contents, ok := app.blurredAvatars.get(key)
+	if !ok {
+		original, err := io.ReadAll(blob)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		contents, err = entropy.BlurAvatarPNG(original, blur)
+		if errors.Is(err, entropy.ErrInvalidImage) {
+			// Only avatars can be blurred
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		app.blurredAvatars.put(key, contents)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%d-blur%d"`, info.UploadID, info.CreatedAt.Unix(), blur))
+	http.ServeContent(w, r, "", info.CreatedAt, bytes.NewReader(contents))
+}
+
+// How many blurred avatars we keep around. They're small PNGs, so this is only a few MB.
+const blurredAvatarCacheSize = 1000
+
+type blurredAvatarKey struct {
+	uploadID int64
+	blur     int
+}
+
+// A cache of blurred avatars (see entropy.BlurAvatarPNG), so that we don't blur the same
+// avatar for every post on every page. When it's full, an arbitrary entry is evicted to
+// make room, which is good enough for a cache this small.
+type blurredAvatarCache struct {
+	mu       sync.Mutex
+	size     int
+	contents map[blurredAvatarKey][]byte
+}
+
+func newBlurredAvatarCache(size int) *blurredAvatarCache {
+	return &blurredAvatarCache{size: size, contents: make(map[blurredAvatarKey][]byte)}
+}
+
+func (c *blurredAvatarCache) get(key blurredAvatarKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	contents, ok := c.contents[key]
+	return contents, ok
+}
+
+func (c *blurredAvatarCache) put(key blurredAvatarKey, contents []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.contents[key]; !ok && len(c.contents) >= c.size {
+		for evicted := range c.contents {
+			delete(c.contents, evicted)
+			break
+		}
+	}
+	c.contents[key] = contents
+}
+
+// The seed for the default avatar. Any number would do, but this one has a nice face.
+const defaultAvatarSeed = 7777
+
+// The default avatar (for users without one) never changes, so we only generate it once
+var defaultAvatarPNG = sync.OnceValues(func() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := avatargen.GenerateAvatarPNGFromSeed(buf, defaultAvatarSeed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+})
+
+func (app *App) DefaultAvatar(w http.ResponseWriter, r *http.Request) {
+	contents, err := defaultAvatarPNG()
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	// It's deterministic, so it can be cached forever (until we change the seed)
 	w.Header().Set("Cache-Control", "max-age=31536000, public, immutable")
-	// TODO: should probably buffer this and handle errors?
-	io.Copy(w, blob)
+	w.Header().Set("ETag", fmt.Sprintf(`"default-%d"`, defaultAvatarSeed))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+}
+
+func (app *App) Sitemap(w http.ResponseWriter, r *http.Request) {
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	// This streams straight into the response, so by the time we hit an error it's too
+	// late to send a 500. The best we can do is log it.
+	if err := entropy.WriteSitemap(conn, w, app.baseURL); err != nil {
+		slog.Error("error writing sitemap", "err", err)
+	}
+}
+
+// Whether the user can see the /admin/ pages
+func (app *App) isAdmin(user *entropy.User) bool {
+	return user != nil && app.admins[user.Name]
+}
+
+// The most users that GET /admin/graph.json returns, so that it stays small enough to draw.
+// (With ?around, it's entropy.MaxNeighborhoodUsers instead.)
+const (
+	graphJSONMaxUsers     = 500
+	graphJSONDefaultDepth = 2
+)
+
+// The follower graph as JSON, for drawing with D3. By default, that's the most-followed
+// users and the follows between them; with ?around=username (and optionally &depth=N),
+// it's that user and the people within depth hops of them instead.
+func (app *App) AdminGraphJSON(w http.ResponseWriter, r *http.Request) {
+	// No need to let anyone else know that this exists
+	if !app.isAdmin(entropy.GetCurrentUser(r.Context())) {
+		http.NotFound(w, r)
+		return
+	}
+	conn, ok := app.readOnlyConn(w, r)
+	if !ok {
+		return
+	}
+	defer app.db.PutReadOnly(conn)
+
+	query := r.URL.Query()
+	if around := query.Get("around"); around != "" {
+		depth := graphJSONDefaultDepth
+		if query.Has("depth") {
+			parsed, err := strconv.Atoi(query.Get("depth"))
+			if err != nil || parsed < 0 {
+				badRequest(w, fmt.Errorf("invalid depth %q", query.Get("depth")))
+				return
+			}
+			depth = parsed
+		}
+		user, err := entropy.GetUserByName(conn, around)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		if user == nil {
+			http.NotFound(w, r)
+			return
+		}
+		subgraph, err := entropy.GetNeighborhood(conn, user.UserID, depth)
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		writeJSON(w, subgraph)
+		return
+	}
+	users, err := entropy.GetMostFollowedUsers(conn, graphJSONMaxUsers)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	userIDs := make([]int64, len(users))
+	for i, user := range users {
+		userIDs[i] = user.UserID
+	}
+	subgraph, err := entropy.GetFollowSubgraph(conn, userIDs)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	writeJSON(w, subgraph)
+}
+
+// Forms send the CSRF token in the csrf_token field. Clients that post JSON or use fetch
+// can send it in this header instead, after getting it from GET /csrf.
+const csrfHeaderName = "X-CSRF-Token"
+
+func csrfProtect(secretKey []byte, trustedOrigins []string, secure bool) func(http.Handler) http.Handler {
+	return csrf.Protect(
+		secretKey,
+		csrf.FieldName("csrf_token"),
+		csrf.RequestHeader(csrfHeaderName),
+		csrf.TrustedOrigins(trustedOrigins),
+		csrf.Path("/"),
+		csrf.SameSite(csrf.SameSiteStrictMode),
+		csrf.HttpOnly(true),
+		csrf.Secure(secure),
+	)
+}
+
+type csrfTokenJSON struct {
+	Token  string `json:"token"`
+	Header string `json:"header"` // the header to send the token back in
+}
+
+// Hand out a CSRF token for clients that don't have a form to get one from. This doesn't
+// need a logged in user: the token is only good along with the CSRF cookie that csrf.Protect
+// sets on this response, which other sites can't read.
+func CSRFToken(w http.ResponseWriter, r *http.Request) {
+	// Every response has a different (masked) token, so there's no point caching them
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, csrfTokenJSON{Token: csrf.Token(r), Header: csrfHeaderName})
+}
+
+// The scheme that the client used: "https" if the request came in over TLS, or (behind a
+// proxy, which terminates TLS for us) if the proxy says it did in X-Forwarded-Proto.
+//
+// Server requests don't have a URL.Scheme of their own. ProxyHeaders fills it in from
+// X-Forwarded-Proto, but only if it goes around the handler that's asking, so we don't
+// count on it here.
+func requestScheme(r *http.Request, behindProxy bool) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if behindProxy {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" || proto == "http" {
+			return proto
+		}
+		if r.URL.Scheme != "" {
+			return r.URL.Scheme
+		}
+	}
+	return "http"
 }
 
-func withSafeHeaders(h http.Handler) http.Handler {
+func withSafeHeaders(h http.Handler, behindProxy bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Scheme == "https" {
+		if requestScheme(r, behindProxy) == "https" {
 			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
 		}
 		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'; form-action 'self'; base-uri 'self'; block-all-mixed-content; object-src 'none'")
@@ -839,12 +2464,46 @@ const maxRequestBytes = 1024 * 1024
 
 // TODO: could convert devMode/behindProxy/listenTLS to a "mode" enum with 3 options
 type Config struct {
-	secretKey   []byte
-	dbUri       string
-	devMode     bool
-	behindProxy bool
-	listenTLS   bool   // listen on ports 80 and 443 and serve TLS using autocert
-	addr        string // address to listen on, if not in devMode and not serving TLS
+	secretKey        []byte
+	dbUri            string
+	devMode          bool
+	behindProxy      bool
+	listenTLS        bool          // listen on ports 80 and 443 and serve TLS using autocert
+	addr             string        // address to listen on, if not serving TLS
+	host             string        // the canonical host name (and port, in dev mode) of the site
+	uploadsDir       string        // where to keep uploaded files; in the database if empty
+	dbAcquireTimeout time.Duration // how long a request waits for a database connection before a 503
+	sessionDuration  time.Duration // how long people stay logged in for
+	postsPerPage     int           // how many posts a page of a timeline shows by default
+	admins           []string      // the names of the users who can see the /admin/ pages
+	// whether far-away authors' display names are distorted along with their posts
+	distortDisplayNames bool
+	logFormat           string // "text" or "json"
+}
+
+// The scheme and host to use when building absolute URLs
+func (conf *Config) baseURL() string {
+	if conf.devMode {
+		return "http://" + conf.host
+	}
+	return "https://" + conf.host
+}
+
+const defaultDevAddr = ":7777"
+
+const defaultDBAcquireTimeout = 5 * time.Second
+
+// The origin that the CSRF middleware should trust in dev mode, where we're serving
+// plain HTTP on localhost.
+func devTrustedOrigin(addr string) string {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "localhost"
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		return "localhost"
+	}
+	return "localhost:" + port
 }
 
 func parseConfig() Config {
@@ -852,7 +2511,49 @@ func parseConfig() Config {
 	dbUri := os.Getenv("ENTROPYCH_DB")
 	// The address to listen on
 	addr := os.Getenv("ENTROPYCH_ADDR")
+	// The canonical host name of the site (e.g. entropych.maxhully.net)
+	host := os.Getenv("ENTROPYCH_HOST")
 	_, behindProxy := os.LookupEnv("ENTROPYCH_BEHIND_PROXY")
+	_, distortDisplayNames := os.LookupEnv("ENTROPYCH_DISTORT_DISPLAY_NAMES")
+	// Store uploads as files in this directory, instead of in the database
+	uploadsDir := os.Getenv("ENTROPYCH_UPLOADS_DIR")
+	// How long a request waits for a database connection, e.g. "5s"
+	dbAcquireTimeout := defaultDBAcquireTimeout
+	if timeout, ok := os.LookupEnv("ENTROPYCH_DB_ACQUIRE_TIMEOUT"); ok {
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("ENTROPYCH_DB_ACQUIRE_TIMEOUT must be a duration like \"5s\" (got %q)", timeout)
+		}
+		dbAcquireTimeout = parsed
+	}
+	// How long people stay logged in for, e.g. "168h"
+	sessionDuration := entropy.DefaultSessionDuration
+	if duration, ok := os.LookupEnv("ENTROPYCH_SESSION_DURATION"); ok {
+		parsed, err := time.ParseDuration(duration)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("ENTROPYCH_SESSION_DURATION must be a positive duration like \"168h\" (got %q)", duration)
+		}
+		sessionDuration = parsed
+	}
+	// How many posts a page shows, unless it asks for a different ?limit=
+	postsPerPage := postsLimit
+	if perPage, ok := os.LookupEnv("ENTROPYCH_POSTS_PER_PAGE"); ok {
+		parsed, err := strconv.Atoi(perPage)
+		if err != nil || parsed < 1 || parsed > maxPostsLimit {
+			log.Fatalf("ENTROPYCH_POSTS_PER_PAGE must be a number from 1 to %d (got %q)", maxPostsLimit, perPage)
+		}
+		postsPerPage = parsed
+	}
+	// "text" or "json" (see newLogger). The default depends on whether we're in dev mode,
+	// which we don't know until the flags are parsed.
+	logFormat := os.Getenv("ENTROPYCH_LOG_FORMAT")
+	// Comma-separated user names, e.g. "max,someone"
+	var admins []string
+	for _, name := range strings.Split(os.Getenv("ENTROPYCH_ADMINS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins = append(admins, name)
+		}
+	}
 	if secretKeyHex == "" {
 		log.Fatal("ENTROPYCH_SECRET_KEY is required")
 	}
@@ -868,104 +2569,353 @@ func parseConfig() Config {
 	}
 
 	devMode := flag.Bool("dev", false, "Run in dev mode (listen on localhost, with plain HTTP)")
+	addrFlag := flag.String("addr", "", "Address to listen on (overrides ENTROPYCH_ADDR)")
 	flag.Parse()
 
+	if *addrFlag != "" {
+		addr = *addrFlag
+	}
+	if (*devMode) && addr == "" {
+		addr = defaultDevAddr
+	}
 	if !(*devMode) && addr == "" {
 		log.Fatal("ENTROPYCH_ADDR is required when not in dev mode")
 	}
+	if (*devMode) && host == "" {
+		host = devTrustedOrigin(addr)
+	}
+	if !(*devMode) && host == "" {
+		log.Fatal("ENTROPYCH_HOST is required when not in dev mode")
+	}
+	if strings.Contains(host, "/") {
+		log.Fatalf("ENTROPYCH_HOST should be a bare host name, without a scheme or path (got %q)", host)
+	}
 	if behindProxy && addr == ":443" {
 		log.Fatalf("ENTROPYCH_BEHIND_PROXY cannot be true when ENTROPYCH_ADDR=%q", addr)
 	}
+	if err := validateListenAddr(addr); err != nil {
+		log.Fatalf("ENTROPYCH_ADDR should be host:port or unix:/path/to.sock (got %q): %s", addr, err)
+	}
 	if (*devMode) && addr == ":443" {
 		log.Fatalf("Cannot run in dev mode and serve TLS (ENTROPYCH_ADDR=%q)", addr)
 	}
+	if logFormat == "" && *devMode {
+		logFormat = logFormatText
+	} else if logFormat == "" {
+		logFormat = logFormatJSON
+	}
+	if logFormat != logFormatText && logFormat != logFormatJSON {
+		log.Fatalf("ENTROPYCH_LOG_FORMAT must be %q or %q (got %q)", logFormatText, logFormatJSON, logFormat)
+	}
 
 	return Config{
-		secretKey:   secretKey,
-		dbUri:       dbUri,
-		addr:        addr,
-		devMode:     *devMode,
-		behindProxy: behindProxy,
-		listenTLS:   addr == ":443",
+		secretKey:           secretKey,
+		dbUri:               dbUri,
+		addr:                addr,
+		host:                host,
+		devMode:             *devMode,
+		behindProxy:         behindProxy,
+		listenTLS:           addr == ":443",
+		uploadsDir:          uploadsDir,
+		dbAcquireTimeout:    dbAcquireTimeout,
+		sessionDuration:     sessionDuration,
+		postsPerPage:        postsPerPage,
+		admins:              admins,
+		distortDisplayNames: distortDisplayNames,
+		logFormat:           logFormat,
 	}
 }
 
-func main() {
-	t := timer("startup")
-
-	conf := parseConfig()
+// How often the server cleans up expired sessions, verification tokens, and uploads
+// that nothing refers to anymore
+const cleanupInterval = time.Hour
 
-	db, err := entropy.NewDB(conf.dbUri, 10)
+// Delete the things that have expired or been orphaned, so they don't pile up forever
+func cleanUp(ctx context.Context, db *entropy.DB, uploads entropy.UploadStore) error {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return errors.New("couldn't get a connection")
+	}
+	defer db.Put(conn)
+	sessions, err := entropy.DeleteExpiredSessions(conn)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer db.Close()
-	app := NewApp(db)
+	verifications, err := entropy.DeleteExpiredEmailVerifications(conn)
+	if err != nil {
+		return err
+	}
+	orphanedUploads, err := uploads.DeleteOrphans(conn)
+	if err != nil {
+		return err
+	}
+	peeks, err := entropy.DeleteExpiredPeeks(conn)
+	if err != nil {
+		return err
+	}
+	postViews, err := entropy.CompactPostViews(conn)
+	if err != nil {
+		return err
+	}
+	slog.Info("cleanup",
+		"expired_sessions", sessions,
+		"expired_email_verifications", verifications,
+		"orphaned_uploads", orphanedUploads,
+		"expired_peeks", peeks,
+		"compacted_post_views", postViews,
+	)
+	return nil
+}
+
+// Run cleanUp now and then every interval, until ctx is done
+func cleanUpPeriodically(ctx context.Context, db *entropy.DB, uploads entropy.UploadStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := cleanUp(ctx, db, uploads); err != nil {
+			slog.Error("cleanup failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// How often the server sends the webhook deliveries that are due, how many it sends per
+// tick, how many of those it's waiting on at once, and how long each one gets
+const (
+	webhookInterval    = 10 * time.Second
+	webhookBatchSize   = 100
+	webhookSenders     = 8
+	webhookSendTimeout = 10 * time.Second
+)
+
+// Send the webhook deliveries that are due, webhookSenders at a time. The connection is
+// only held to read the deliveries and record how they went, not while we wait on other
+// people's servers.
+func deliverWebhooks(ctx context.Context, db *entropy.DB, client *http.Client, baseURL string) error {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return errors.New("couldn't get a connection")
+	}
+	deliveries, err := entropy.GetDueWebhookDeliveries(conn, webhookBatchSize)
+	db.Put(conn)
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+	sendErrs := make([]error, len(deliveries))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(webhookSenders, len(deliveries)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				sendErrs[i] = entropy.SendWebhookDelivery(ctx, client, &deliveries[i], baseURL)
+			}
+		}()
+	}
+	for i := range deliveries {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	conn = db.Get(ctx)
+	if conn == nil {
+		return errors.New("couldn't get a connection")
+	}
+	defer db.Put(conn)
+	for i := range deliveries {
+		gaveUp, err := entropy.FinishWebhookDelivery(conn, &deliveries[i], sendErrs[i])
+		if err != nil {
+			return err
+		}
+		if gaveUp {
+			slog.Warn("webhooks: giving up on delivery", "webhook_delivery_id", deliveries[i].WebhookDeliveryID, "err", sendErrs[i])
+		} else if sendErrs[i] != nil {
+			slog.Info("webhooks: delivery failed, will try again", "webhook_delivery_id", deliveries[i].WebhookDeliveryID, "err", sendErrs[i])
+		}
+	}
+	return nil
+}
+
+// Run deliverWebhooks every interval, until ctx is done
+func deliverWebhooksPeriodically(ctx context.Context, db *entropy.DB, client *http.Client, baseURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := deliverWebhooks(ctx, db, client, baseURL); err != nil {
+			slog.Error("webhooks: sending deliveries failed", "err", err)
+		}
+	}
+}
+
+// The HTTP client for sending webhooks. People can point webhooks wherever they like, so
+// unless allowPrivate is true (in dev mode), it won't connect to loopback or private
+// addresses, so that nobody can use a webhook to poke at things on our own network.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookSendTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+				return fmt.Errorf("webhooks can't be sent to %s", ip)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would do the dialing for us, and skip the check above
+	transport.Proxy = nil
+	return &http.Client{Transport: transport, Timeout: webhookSendTimeout}
+}
 
+// All of the app's routes. (The middleware goes around this in main.)
+func (app *App) newMux(devMode bool) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/static/", http.StripPrefix("/static", http.FileServer(http.Dir("./static"))))
+	if devMode {
+		// Straight from the disk, so that changes show up without restarting the server
+		mux.Handle("GET /static/", http.StripPrefix("/static", http.FileServer(http.Dir("./static"))))
+	} else {
+		mux.Handle("GET /static/", http.StripPrefix("/static", app.staticAssets))
+	}
 
 	mux.HandleFunc("GET /{$}", app.Homepage)
 	mux.HandleFunc("GET /about", app.About)
+	mux.HandleFunc("GET /discover", app.Discover)
+	mux.HandleFunc("GET /sitemap.xml", app.Sitemap)
+	mux.HandleFunc("GET /robots.txt", RobotsHandler(devMode, app.baseURL))
+	mux.HandleFunc("GET /.well-known/webfinger", app.WebFinger)
+	mux.HandleFunc("GET /csrf", CSRFToken)
+	mux.HandleFunc("GET /version", VersionHandler)
 
 	mux.HandleFunc("GET /signup", app.SignUpUser)
 	mux.HandleFunc("POST /signup", app.SignUpUser)
 	mux.HandleFunc("GET /login", app.LogIn)
 	mux.HandleFunc("POST /login", app.LogIn)
 	mux.HandleFunc("POST /logout", app.LogOut)
+	mux.HandleFunc("GET /verify", app.VerifyEmail)
 	mux.HandleFunc("GET /profile", app.UpdateProfile)
 	mux.HandleFunc("POST /profile", app.UpdateProfile)
+	mux.HandleFunc("GET /profile/import-follows", app.ImportFollows)
+	mux.HandleFunc("POST /profile/import-follows", app.ImportFollows)
+	mux.HandleFunc("GET /profile/follows.txt", app.ExportFollows)
+	mux.HandleFunc("GET /profile/webhooks", app.Webhooks)
+	mux.HandleFunc("POST /profile/webhooks", app.Webhooks)
+	mux.HandleFunc("POST /profile/webhooks/{webhook_id}/delete", app.DeleteWebhook)
 
 	mux.HandleFunc("POST /posts/new", app.NewPost)
 	mux.HandleFunc("GET /p/{post_id}/{$}", app.ShowPost)
 	mux.HandleFunc("POST /p/{post_id}/react", app.ReactToPost)
 	mux.HandleFunc("POST /p/{post_id}/unreact", app.UnreactToPost)
+	mux.HandleFunc("POST /p/{post_id}/peek", app.PeekAtPost)
+	mux.HandleFunc("POST /p/{post_id}/pin", app.PinPost)
+	mux.HandleFunc("POST /p/{post_id}/unpin", app.UnpinPost)
 	mux.HandleFunc("POST /p/{post_id}/reply", app.ReplyToPost)
+	mux.HandleFunc("GET /api/p/{post_id}", app.ShowPostJSON)
+	mux.HandleFunc("PUT /api/p/{post_id}/reaction", app.SetReactionJSON)
+	mux.HandleFunc("DELETE /api/p/{post_id}/reaction", app.SetReactionJSON)
 
 	mux.HandleFunc("/u/{username}/{$}", app.ShowUserPosts)
+	mux.HandleFunc("GET /u/{username}/activity", app.ShowUserActivity)
+	mux.HandleFunc("GET /u/{username}/outbox", app.ShowUserOutbox)
 	mux.HandleFunc("POST /u/{username}/follow", app.FollowUser)
 	mux.HandleFunc("POST /u/{username}/unfollow", app.UnfollowUser)
 
+	mux.HandleFunc("GET /mentions", app.Mentions)
+	mux.HandleFunc("GET /tags/{hashtag}/", app.ShowHashtag)
 	mux.HandleFunc("GET /uploads/{upload_id}", app.ServeUpload)
+	mux.HandleFunc("GET "+entropy.DefaultAvatarURL, app.DefaultAvatar)
 
-	trustedOrigins := []string{"entropych.maxhully.net"}
-	if conf.devMode {
-		trustedOrigins = []string{"localhost:7777"}
+	mux.HandleFunc("GET /admin/graph.json", app.AdminGraphJSON)
+	return mux
+}
+
+func main() {
+	t := timer("startup")
+
+	conf := parseConfig()
+	logger, err := newLogger(os.Stdout, conf.logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// This sends the log package's output (including from the entropy package) through
+	// the logger too
+	slog.SetDefault(logger)
+
+	build := getBuildInfo()
+	slog.Info("starting entropych", "version", build.Version, "commit", build.Commit, "go_version", build.GoVersion)
+
+	db, err := entropy.NewDB(conf.dbUri, 10)
+	if err != nil {
+		fatal("couldn't open the database", "err", err)
+	}
+	defer db.Close()
+	db.AcquireTimeout = conf.dbAcquireTimeout
+	app := NewApp(db, &conf)
+	if conf.distortDisplayNames {
+		distortionConfig := entropy.DefaultDistortionConfig
+		distortionConfig.DistortDisplayNames = true
+		if err := entropy.SetDistortionConfig(distortionConfig); err != nil {
+			fatal("bad distortion config", "err", err)
+		}
+	}
+	if conf.uploadsDir != "" {
+		if err := os.MkdirAll(conf.uploadsDir, 0755); err != nil {
+			fatal("couldn't make the uploads directory", "err", err)
+		}
+		app.uploads = &entropy.DirStore{Dir: conf.uploadsDir}
+	}
+	// In dev mode the files are served live instead (see newMux), and templates link to
+	// their plain URLs
+	if !conf.devMode {
+		assets, err := entropy.LoadStaticAssets(os.DirFS("./static"))
+		if err != nil {
+			fatal("couldn't load the static files", "err", err)
+		}
+		app.useStaticAssets(assets)
 	}
+	go cleanUpPeriodically(context.Background(), db, app.uploads, cleanupInterval)
+	go deliverWebhooksPeriodically(context.Background(), db, newWebhookClient(conf.devMode), app.baseURL, webhookInterval)
+
+	mux := app.newMux(conf.devMode)
+
+	trustedOrigins := []string{conf.host}
 
 	var handler http.Handler
 	handler = entropy.WithUserContextMiddleware(app.db, mux)
-	csrfProtect := csrf.Protect(
-		conf.secretKey,
-		csrf.FieldName("csrf_token"),
-		csrf.TrustedOrigins(trustedOrigins),
-		csrf.Path("/"),
-		csrf.SameSite(csrf.SameSiteStrictMode),
-		csrf.HttpOnly(true),
-		csrf.Secure(true),
-	)
-	handler = csrfProtect(handler)
-	handler = handlers.CompressHandler(handler)
-	handler = withSafeHeaders(handler)
+	handler = csrfProtect(conf.secretKey, trustedOrigins, app.secureCookies)(handler)
+	handler = withCompression(handler)
+	handler = withSafeHeaders(handler, conf.behindProxy)
 	handler = http.MaxBytesHandler(handler, maxRequestBytes)
-	handler = handlers.LoggingHandler(os.Stdout, handler)
+	handler = withRequestLogging(logger, handler)
 	if conf.behindProxy {
 		handler = handlers.ProxyHeaders(handler)
 	}
 	t()
 
-	if conf.devMode {
-		log.Fatal(http.ListenAndServe(":7777", handler))
-	} else if conf.listenTLS {
+	if conf.listenTLS {
 		cacheDir := filepath.Join(os.Getenv("HOME"), ".cache", "golang-autocert")
 		if err := os.MkdirAll(cacheDir, 0700); err != nil {
-			log.Printf("warning: autocert.NewListener not using a cache: %v", err)
+			slog.Warn("autocert.NewListener not using a cache", "err", err)
 		}
 		// Based on https://www.reddit.com/r/golang/comments/91qznj/cannot_get_autocert_to_work/
 		certManager := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
 			Cache:      autocert.DirCache(cacheDir),
-			HostPolicy: autocert.HostWhitelist("entropych.maxhully.net"),
+			HostPolicy: autocert.HostWhitelist(conf.host),
 		}
 		go http.ListenAndServe(":80", certManager.HTTPHandler(nil))
 		server := &http.Server{
@@ -975,8 +2925,17 @@ func main() {
 				GetCertificate: certManager.GetCertificate,
 			},
 		}
-		log.Fatal(server.ListenAndServeTLS("", ""))
-	} else {
-		log.Fatal(http.ListenAndServe(conf.addr, handler))
+		fatal("server stopped", "err", server.ListenAndServeTLS("", ""))
+	}
+
+	listener, err := listen(conf.addr)
+	if err != nil {
+		fatal("couldn't listen", "addr", conf.addr, "err", err)
+	}
+	slog.Info("listening", "addr", conf.addr)
+	if err := serveUntilSignal(&http.Server{Handler: handler}, listener); err != nil {
+		fatal("server stopped", "err", err)
 	}
+	// Let the writes that requests left behind (like view counts) finish
+	app.backgroundWrites.Wait()
 }
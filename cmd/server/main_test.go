@@ -2,29 +2,68 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/gorilla/csrf"
 	"github.com/maxhully/entropy"
 	"github.com/stretchr/testify/assert"
 )
 
+// A config like the one parseConfig gives you in production
+func testConfig() Config {
+	return Config{
+		host:            "entropych.example.com",
+		sessionDuration: entropy.DefaultSessionDuration,
+		postsPerPage:    postsLimit,
+	}
+}
+
 func setUpTestApp(t *testing.T) (*App, error) {
+	conf := testConfig()
+	return setUpTestAppWithConfig(t, &conf)
+}
+
+func setUpTestAppWithConfig(t *testing.T, conf *Config) (*App, error) {
 	dir := t.TempDir()
 	uri := path.Join(dir, "temptest.db")
 	db, err := entropy.NewDB(uri, 10)
 	if err != nil {
 		return nil, err
 	}
-	app := NewApp(db)
+	app := NewApp(db, conf)
 	return app, err
 }
 
@@ -95,6 +134,7 @@ func TestSignUpUser(t *testing.T) {
 	user, err := entropy.GetUserByName(conn, "Max")
 	assert.Nil(t, err)
 	assert.Equal(t, user.Name, "Max")
+	assert.Equal(t, "Max", user.DisplayName, "Expected display name to start out as the handle")
 	assert.NotEqual(t, user.AvatarUploadID, 0, "Expected default avatar to be generated")
 }
 
@@ -108,6 +148,7 @@ func TestSignUpUserValidation(t *testing.T) {
 		{"", "pass", "Name is required"},
 		{"maxh", "", "Password is required"},
 		{"max hully", "pass", "Name must not have any spaces in it"},
+		{"..", "pass", "Name must be more than dots"},
 		{"max", "pass", "A user with this name already exists"},
 		{longString, "pass", "Name is too long"},
 		{"maxh", longString, "Password is too long"},
@@ -143,6 +184,40 @@ func TestSignUpUserValidation(t *testing.T) {
 	}
 }
 
+func TestSignUpUserNameTakenAfterValidation(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+
+	// Someone else signs up as "max" in between validating the form and creating the
+	// user: the trigger inserts them right before our insert.
+	conn := app.db.Get(t.Context())
+	script := `
+		create temp trigger sign_up_race before insert on user
+		when new.user_name = 'max'
+		begin
+			insert into user (user_name, display_name) values ('max', 'max');
+		end;`
+	err = sqlitex.ExecScript(conn, script)
+	app.db.Put(conn)
+	assert.Nil(t, err)
+
+	form := url.Values{}
+	form.Add("name", "max")
+	form.Add("password", "pass123")
+	r, _ := http.NewRequest(http.MethodPost, "/signup", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.SignUpUser(w, r)
+
+	result := w.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	checkBodyContains(t, result, "A user with this name already exists")
+	assert.Empty(t, result.Cookies())
+}
+
 func TestLogInUser(t *testing.T) {
 	var testCases = []struct {
 		name                 string
@@ -204,6 +279,41 @@ func TestLogInUser(t *testing.T) {
 	}
 }
 
+func TestSessionCookiesFollowDevMode(t *testing.T) {
+	for _, secure := range []bool{true, false} {
+		conf := testConfig()
+		conf.devMode = !secure
+		app, err := setUpTestAppWithConfig(t, &conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := app.db.Get(t.Context())
+		_, err = entropy.CreateUser(conn, "max", "secretpassword123")
+		app.db.Put(conn)
+		assert.Nil(t, err)
+
+		form := url.Values{"name": {"max"}, "password": {"secretpassword123"}}
+		r, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		app.LogIn(w, r)
+		cookies := w.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, secure, cookies[0].Secure)
+
+		// Logging out clears it the same way
+		r, _ = http.NewRequest(http.MethodPost, "/logout", nil)
+		r.AddCookie(cookies[0])
+		w = httptest.NewRecorder()
+		entropy.WithUserContextMiddleware(app.db, app.newMux(false)).ServeHTTP(w, r)
+		cookies = w.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, -1, cookies[0].MaxAge)
+		assert.Equal(t, secure, cookies[0].Secure)
+		app.db.Close()
+	}
+}
+
 func TestLogOut(t *testing.T) {
 	app, err := setUpTestApp(t)
 	if err != nil {
@@ -278,13 +388,14 @@ func TestUpdateProfile(t *testing.T) {
 	body := new(bytes.Buffer)
 	mw := multipart.NewWriter(body)
 	mw.WriteField("bio", "Hello!")
+	mw.WriteField("feed_mode", "chronological")
 	mw.Close()
 
 	h := entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.UpdateProfile))
 
 	// First do a GET
 	r, _ := http.NewRequest(http.MethodGet, "/profile", nil)
-	r.AddCookie(sess.ToCookie())
+	r.AddCookie(sess.ToCookie(true))
 	w := httptest.NewRecorder()
 
 	h.ServeHTTP(w, r)
@@ -293,7 +404,7 @@ func TestUpdateProfile(t *testing.T) {
 	// Then POST
 	r, _ = http.NewRequest(http.MethodPost, "/profile", body)
 	r.Header.Set("Content-Type", mw.FormDataContentType())
-	r.AddCookie(sess.ToCookie())
+	r.AddCookie(sess.ToCookie(true))
 	w = httptest.NewRecorder()
 
 	h.ServeHTTP(w, r)
@@ -306,6 +417,2404 @@ func TestUpdateProfile(t *testing.T) {
 	assert.Equal(t, user.Bio, "Hello!")
 	// We shouldn't change the avatar, since we didn't upload anything
 	assert.Equal(t, user.AvatarUploadID, originalAvatarUploadID)
+	mode, err := entropy.GetFeedMode(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, entropy.FeedModeChronological, mode)
+}
+
+func postAvatar(t *testing.T, app *App, sess *entropy.UserSession, filename string, contentType string, contents []byte) *http.Response {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="avatar"; filename=%q`, filename))
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	assert.Nil(t, err)
+	part.Write(contents)
+	mw.Close()
+
+	h := entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.UpdateProfile))
+	r, _ := http.NewRequest(http.MethodPost, "/profile", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Result()
+}
+
+// A small, real PNG
+func testPNG(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 4, 4))))
+	return buf.Bytes()
+}
+
+func TestUpdateProfileAvatarUpload(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	var sess *entropy.UserSession
+	{
+		conn := app.db.Get(t.Context())
+		user, err := entropy.CreateUser(conn, "max", "pass123")
+		assert.Nil(t, err)
+		sess, err = entropy.CreateUserSession(conn, user.UserID)
+		assert.Nil(t, err)
+		app.db.Put(conn)
+	}
+
+	// A text file re-renders the form with an error
+	result := postAvatar(t, app, sess, "avatar.txt", "text/plain", []byte("hello"))
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	checkBodyContains(t, result, "Avatar must be a PNG or JPEG image.")
+
+	// So does a file that says it's a PNG, but isn't
+	result = postAvatar(t, app, sess, "avatar.png", "image/png", []byte("<html>definitely not a png</html>"))
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	checkBodyContains(t, result, "Avatar doesn&#39;t look like a PNG image.")
+
+	// And so does one that's too big
+	tooBig := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, maxAvatarBytes)...)
+	result = postAvatar(t, app, sess, "avatar.png", "image/png", tooBig)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	checkBodyContains(t, result, "Avatar is too big")
+
+	// Or one that starts like a PNG, but isn't one
+	result = postAvatar(t, app, sess, "avatar.png", "image/png", []byte("\x89PNG\r\n\x1a\n"))
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	checkBodyContains(t, result, "Avatar couldn&#39;t be read as an image.")
+
+	result = postAvatar(t, app, sess, "avatar.png", "image/png", testPNG(t))
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.GetUserByName(conn, "max")
+	assert.Nil(t, err)
+	assert.NotEqual(t, int64(0), user.AvatarUploadID)
+}
+
+func TestPostRepliesPagination(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, "hello")
+	assert.Nil(t, err)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range postsLimit + 1 {
+		replyID, err := entropy.ReplyToPost(conn, postID, user.UserID, fmt.Sprintf("reply %d", i))
+		assert.Nil(t, err)
+		createdAt := base.Add(time.Duration(i) * time.Minute).UnixMilli()
+		err = sqlitex.Exec(conn, "update post set created_at = ? where post_id = ?", nil, createdAt, replyID)
+		assert.Nil(t, err)
+	}
+
+	page, err := getPostPage(conn, user, postID, repliesPagination{newestFirst: false})
+	assert.Nil(t, err)
+	assert.Equal(t, postsLimit, len(page.Replies))
+	assert.Equal(t, "reply 0", page.Replies[0].Content)
+	lastID := page.Replies[postsLimit-1].PostID
+	assert.Equal(t, fmt.Sprintf("/p/%d/?after=20250101T004900.000&after_id=%d", postID, lastID), page.NextPageURL)
+
+	page, err = getPostPage(conn, user, postID, repliesPagination{newestFirst: true, cursor: defaultBefore()})
+	assert.Nil(t, err)
+	assert.Equal(t, postsLimit, len(page.Replies))
+	assert.Equal(t, fmt.Sprintf("reply %d", postsLimit), page.Replies[0].Content)
+	lastID = page.Replies[postsLimit-1].PostID
+	assert.Equal(t, fmt.Sprintf("/p/%d/?replies=newest&before=20250101T000100.000&before_id=%d", postID, lastID), page.NextPageURL)
+
+	// Following the newest-first cursor gets the oldest reply
+	r, _ := http.NewRequest(http.MethodGet, page.NextPageURL, nil)
+	page, err = getPostPage(conn, user, postID, parseRepliesPagination(r))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page.Replies))
+	assert.Equal(t, "reply 0", page.Replies[0].Content)
+	assert.Equal(t, "", page.NextPageURL)
+}
+
+func TestServeUploadConditional(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	var uploadID int64
+	{
+		conn := app.db.Get(t.Context())
+		uploadID, err = entropy.SaveUpload(conn, "image/png", []byte("not really a png"))
+		app.db.Put(conn)
+		assert.Nil(t, err)
+	}
+
+	uploadPath := fmt.Sprintf("%d.png", uploadID)
+	r, _ := http.NewRequest(http.MethodGet, "/uploads/"+uploadPath, nil)
+	r.SetPathValue("upload_id", uploadPath)
+	w := httptest.NewRecorder()
+	app.ServeUpload(w, r)
+
+	result := w.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "image/png", result.Header.Get("Content-Type"))
+	etag := result.Header.Get("ETag")
+	assert.NotEqual(t, "", etag)
+	assert.NotEqual(t, "", result.Header.Get("Last-Modified"))
+	checkBodyContains(t, result, "not really a png")
+
+	r, _ = http.NewRequest(http.MethodGet, "/uploads/"+uploadPath, nil)
+	r.SetPathValue("upload_id", uploadPath)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	app.ServeUpload(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	r, _ = http.NewRequest(http.MethodGet, "/uploads/"+uploadPath, nil)
+	r.SetPathValue("upload_id", uploadPath)
+	r.Header.Set("Range", "bytes=0-2")
+	w = httptest.NewRecorder()
+	app.ServeUpload(w, r)
+	assert.Equal(t, http.StatusPartialContent, w.Result().StatusCode)
+	assert.Equal(t, "not", w.Body.String())
+
+	missingPath := fmt.Sprintf("%d.png", uploadID+1)
+	r, _ = http.NewRequest(http.MethodGet, "/uploads/"+missingPath, nil)
+	r.SetPathValue("upload_id", missingPath)
+	w = httptest.NewRecorder()
+	app.ServeUpload(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestServeUploadBlurred(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	// Stripes, so that blurring them makes a difference
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 32; x += 2 {
+		for y := range 32 {
+			img.Set(x, y, color.White)
+		}
+	}
+	buf := new(bytes.Buffer)
+	assert.Nil(t, png.Encode(buf, img))
+	var avatarID, notAnImageID int64
+	{
+		conn := app.db.Get(t.Context())
+		avatarID, err = entropy.SaveAvatarUpload(conn, app.uploads, buf.Bytes())
+		assert.Nil(t, err)
+		notAnImageID, err = entropy.SaveUpload(conn, "image/png", []byte("not really a png"))
+		assert.Nil(t, err)
+		app.db.Put(conn)
+	}
+	get := func(uploadID int64, query string) *httptest.ResponseRecorder {
+		uploadPath := fmt.Sprintf("%d.png", uploadID)
+		r, _ := http.NewRequest(http.MethodGet, "/uploads/"+uploadPath+query, nil)
+		r.SetPathValue("upload_id", uploadPath)
+		w := httptest.NewRecorder()
+		app.ServeUpload(w, r)
+		return w
+	}
+
+	original := get(avatarID, "")
+	assert.Equal(t, http.StatusOK, original.Code)
+	blurred := get(avatarID, "?blur=3")
+	assert.Equal(t, http.StatusOK, blurred.Code)
+	assert.Equal(t, "image/png", blurred.Header().Get("Content-Type"))
+	assert.NotEqual(t, original.Body.Bytes(), blurred.Body.Bytes())
+	assert.NotEqual(t, original.Header().Get("ETag"), blurred.Header().Get("ETag"))
+	decoded, err := png.Decode(bytes.NewReader(blurred.Body.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, img.Bounds(), decoded.Bounds())
+	assert.Equal(t, decoded.At(0, 0), decoded.At(1, 0))
+
+	// The second time comes from the cache, and is the same
+	_, cached := app.blurredAvatars.get(blurredAvatarKey{uploadID: avatarID, blur: 3})
+	assert.True(t, cached)
+	assert.Equal(t, blurred.Body.Bytes(), get(avatarID, "?blur=3").Body.Bytes())
+	assert.Equal(t, http.StatusOK, get(avatarID, "?blur=1").Code)
+	assert.Len(t, app.blurredAvatars.contents, 2)
+
+	assert.Equal(t, http.StatusBadRequest, get(avatarID, "?blur=lots").Code)
+	assert.Equal(t, http.StatusBadRequest, get(avatarID, fmt.Sprintf("?blur=%d", entropy.MaxAvatarBlur+1)).Code)
+	assert.Equal(t, http.StatusNotFound, get(notAnImageID, "?blur=1").Code)
 }
 
-// TODO: test with upload
+func TestBlurredAvatarCacheEvicts(t *testing.T) {
+	cache := newBlurredAvatarCache(2)
+	for i := range 3 {
+		cache.put(blurredAvatarKey{uploadID: int64(i), blur: 1}, []byte("png"))
+	}
+	assert.Len(t, cache.contents, 2)
+	_, ok := cache.get(blurredAvatarKey{uploadID: 2, blur: 1})
+	assert.True(t, ok)
+}
+
+func TestDevTrustedOrigin(t *testing.T) {
+	assert.Equal(t, "localhost:7777", devTrustedOrigin(defaultDevAddr))
+	assert.Equal(t, "localhost:8080", devTrustedOrigin("127.0.0.1:8080"))
+	assert.Equal(t, "localhost:9000", devTrustedOrigin("[::1]:9000"))
+	assert.Equal(t, "localhost", devTrustedOrigin("nonsense"))
+	assert.Equal(t, "localhost", devTrustedOrigin("unix:/tmp/entropych.sock"))
+}
+
+func TestSafeHeadersHSTS(t *testing.T) {
+	hsts := func(behindProxy bool, r *http.Request) string {
+		w := httptest.NewRecorder()
+		withSafeHeaders(http.NotFoundHandler(), behindProxy).ServeHTTP(w, r)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		return w.Header().Get("Strict-Transport-Security")
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, "", hsts(false, r))
+	assert.Equal(t, "", hsts(true, r))
+
+	// Behind a proxy, the proxy tells us whether the request was HTTPS
+	r.Header.Set("X-Forwarded-Proto", "https")
+	assert.Equal(t, "max-age=63072000; includeSubDomains", hsts(true, r))
+	// But if there's no proxy, anyone could've set that
+	assert.Equal(t, "", hsts(false, r))
+	r.Header.Set("X-Forwarded-Proto", "http")
+	assert.Equal(t, "", hsts(true, r))
+
+	// Serving TLS ourselves
+	r, _ = http.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	assert.Equal(t, "max-age=63072000; includeSubDomains", hsts(false, r))
+}
+
+func TestConfigBaseURL(t *testing.T) {
+	conf := Config{host: "entropych.example.com"}
+	assert.Equal(t, "https://entropych.example.com", conf.baseURL())
+	conf = Config{host: "localhost:7777", devMode: true}
+	assert.Equal(t, "http://localhost:7777", conf.baseURL())
+}
+
+func TestSignUpUserMultipart(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("name", "max")
+	mw.WriteField("password", "secretpassword123")
+	mw.Close()
+
+	r, _ := http.NewRequest(http.MethodPost, "/signup", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	app.SignUpUser(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.GetUserByName(conn, "max")
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+}
+
+func TestUpdateProfileRemoveAvatar(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	var sess *entropy.UserSession
+	{
+		conn := app.db.Get(t.Context())
+		user, err := entropy.CreateUser(conn, "max", "pass123")
+		assert.Nil(t, err)
+		uploadID, err := entropy.SaveUpload(conn, "image/png", []byte("avatar"))
+		assert.Nil(t, err)
+		assert.Nil(t, entropy.UpdateUserProfile(conn, user.Name, "", "", uploadID))
+		sess, err = entropy.CreateUserSession(conn, user.UserID)
+		assert.Nil(t, err)
+		app.db.Put(conn)
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("bio", "no more avatar")
+	mw.WriteField("remove_avatar", "yes")
+	mw.Close()
+
+	h := entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.UpdateProfile))
+	r, _ := http.NewRequest(http.MethodPost, "/profile", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.GetUserByName(conn, "max")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), user.AvatarUploadID)
+	assert.Equal(t, "no more avatar", user.Bio)
+	assert.Equal(t, entropy.DefaultAvatarURL, user.AvatarURL())
+}
+
+func TestDefaultAvatar(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	r, _ := http.NewRequest(http.MethodGet, entropy.DefaultAvatarURL, nil)
+	w := httptest.NewRecorder()
+	app.DefaultAvatar(w, r)
+	result := w.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "image/png", result.Header.Get("Content-Type"))
+	assert.Contains(t, result.Header.Get("Cache-Control"), "immutable")
+	etag := result.Header.Get("ETag")
+	assert.NotEqual(t, "", etag)
+
+	r, _ = http.NewRequest(http.MethodGet, entropy.DefaultAvatarURL, nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	app.DefaultAvatar(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+}
+
+func TestShowPostOpenGraphTags(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	var postID int64
+	{
+		conn := app.db.Get(t.Context())
+		user, err := entropy.CreateUser(conn, "max", "pass123")
+		assert.Nil(t, err)
+		postID, err = entropy.CreatePost(conn, user.UserID, "a perfectly clear post")
+		assert.Nil(t, err)
+		app.db.Put(conn)
+	}
+
+	// Logged out, so the post itself is distorted, but the preview shouldn't be
+	r, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/p/%d/", postID), nil)
+	r.SetPathValue("post_id", fmt.Sprint(postID))
+	w := httptest.NewRecorder()
+	app.ShowPost(w, r)
+	result := w.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	body := w.Body.String()
+	assert.Contains(t, body, `<meta property="og:description" content="a perfectly clear post">`)
+	assert.Contains(t, body, fmt.Sprintf(`<meta property="og:url" content="https://entropych.example.com/p/%d/">`, postID))
+	assert.Contains(t, body, `<meta property="og:title" content="max on entropych.social">`)
+	assert.Contains(t, body, `<meta property="og:image" content="https://entropych.example.com/`)
+
+	r, _ = http.NewRequest(http.MethodGet, "/p/12345/", nil)
+	r.SetPathValue("post_id", "12345")
+	w = httptest.NewRecorder()
+	app.ShowPost(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestRobotsHandler(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/robots.txt", nil)
+	w := httptest.NewRecorder()
+	RobotsHandler(true, "http://localhost:7777")(w, r)
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", w.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", w.Result().Header.Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	RobotsHandler(false, "https://entropych.example.com")(w, r)
+	assert.NotContains(t, w.Body.String(), "Disallow")
+	assert.Contains(t, w.Body.String(), "Sitemap: https://entropych.example.com/sitemap.xml\n")
+}
+
+func TestDevModeServesStaticFilesLive(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "static"), 0755))
+	t.Chdir(dir)
+	mux := app.newMux(true)
+
+	get := func() string {
+		r, _ := http.NewRequest(http.MethodGet, "/static/style.css", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	assert.Nil(t, os.WriteFile("static/style.css", []byte("body { color: red; }"), 0644))
+	assert.Equal(t, "body { color: red; }", get())
+	assert.Nil(t, os.WriteFile("static/style.css", []byte("body { color: blue; }"), 0644))
+	assert.Equal(t, "body { color: blue; }", get())
+}
+
+func TestVersionHandler(t *testing.T) {
+	get := func() map[string]string {
+		r, _ := http.NewRequest(http.MethodGet, "/version", nil)
+		w := httptest.NewRecorder()
+		VersionHandler(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var info map[string]string
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+		return info
+	}
+	// Test binaries don't get much stamped into them, but there's always a Go version
+	info := get()
+	assert.ElementsMatch(t, []string{"version", "commit", "go_version"}, slices.Collect(maps.Keys(info)))
+	assert.Equal(t, runtime.Version(), info["go_version"])
+
+	defer func(oldVersion, oldCommit string) { version, commit = oldVersion, oldCommit }(version, commit)
+	version, commit = "v1.2.3", "abc123"
+	info = get()
+	assert.Equal(t, "v1.2.3", info["version"])
+	assert.Equal(t, "abc123", info["commit"])
+}
+
+// Send the default logger's records to a buffer, as JSON, until the test is done
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, logFormatJSON)
+	assert.Nil(t, err)
+	oldLogger := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(oldLogger) })
+	return &buf
+}
+
+func TestErrorResponseLogsAnError(t *testing.T) {
+	logs := captureLogs(t)
+	handler := withRequestLogging(slog.Default(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errorResponse(w, errors.New("something broke"))
+	}))
+	r, _ := http.NewRequest(http.MethodGet, "/broken?a=1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var records []map[string]any
+	decoder := json.NewDecoder(logs)
+	for decoder.More() {
+		var record map[string]any
+		assert.Nil(t, decoder.Decode(&record))
+		records = append(records, record)
+	}
+	assert.Len(t, records, 2)
+	assert.Equal(t, "ERROR", records[0]["level"])
+	assert.Equal(t, "sending 500 error", records[0]["msg"])
+	assert.Equal(t, "something broke", records[0]["err"])
+	// And then the request itself
+	assert.Equal(t, "INFO", records[1]["level"])
+	assert.Equal(t, "request", records[1]["msg"])
+	assert.Equal(t, "/broken?a=1", records[1]["path"])
+	assert.Equal(t, float64(http.StatusInternalServerError), records[1]["status"])
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, logFormatText)
+	assert.Nil(t, err)
+	logger.Warn("hello", "name", "max")
+	assert.Contains(t, buf.String(), `level=WARN msg=hello name=max`)
+	_, err = newLogger(&buf, "xml")
+	assert.NotNil(t, err)
+}
+
+func TestHomepageFragment(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	{
+		conn := app.db.Get(t.Context())
+		user, err := entropy.CreateUser(conn, "max", "pass123")
+		assert.Nil(t, err)
+		_, err = entropy.CreatePost(conn, user.UserID, "hello")
+		assert.Nil(t, err)
+		app.db.Put(conn)
+	}
+
+	for _, fragmentRequest := range []func(r *http.Request){
+		func(r *http.Request) { r.Header.Set("HX-Request", "true") },
+		func(r *http.Request) { r.URL.RawQuery = "fragment=1" },
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		fragmentRequest(r)
+		w := httptest.NewRecorder()
+		app.Homepage(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		body := strings.TrimSpace(w.Body.String())
+		assert.True(t, strings.HasPrefix(body, `<ul class="posts" id="posts">`), body)
+		assert.Contains(t, body, `class="post"`)
+		assert.NotContains(t, body, "Hello, stranger!")
+		assert.NotContains(t, body, "<html")
+		assert.Contains(t, w.Header().Values("Vary"), "HX-Request")
+	}
+
+	// The whole page varies on HX-Request too, so that a cache can't hand out the fragment
+	// in its place
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	app.Homepage(w, r)
+	assert.Contains(t, w.Body.String(), "<html")
+	assert.Contains(t, w.Header().Values("Vary"), "HX-Request")
+}
+
+func TestSignUpWithEmailAndVerify(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	mailer := &entropy.RecordingMailer{}
+	app.mailer = mailer
+
+	form := url.Values{}
+	form.Add("name", "max")
+	form.Add("password", "secretpassword123")
+	form.Add("email", "max@example.com")
+	r, _ := http.NewRequest(http.MethodPost, "/signup", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.SignUpUser(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+
+	sent := mailer.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "max@example.com", sent[0].To)
+	link := regexp.MustCompile(`https?://\S+/verify\?token=\w+`).FindString(sent[0].Body)
+	assert.NotEqual(t, "", link)
+
+	r, _ = http.NewRequest(http.MethodGet, "/verify?token=nonsense", nil)
+	w = httptest.NewRecorder()
+	app.VerifyEmail(w, r)
+	checkBodyContains(t, w.Result(), "This link doesn't work")
+
+	r, _ = http.NewRequest(http.MethodGet, link, nil)
+	w = httptest.NewRecorder()
+	app.VerifyEmail(w, r)
+	checkBodyContains(t, w.Result(), "Your email address is verified")
+
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.GetUserByName(conn, "max")
+	assert.Nil(t, err)
+	email, verified, err := entropy.GetUserEmail(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "max@example.com", email)
+	assert.True(t, verified)
+}
+
+// A Mailer that checks whether it can get the read-write connection while it sends
+type connCheckingMailer struct {
+	db      *entropy.DB
+	gotConn bool
+}
+
+func (m *connCheckingMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if conn := m.db.Get(ctx); conn != nil {
+		m.gotConn = true
+		m.db.Put(conn)
+	}
+	return nil
+}
+
+func TestSignUpSendsEmailAfterCommitting(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	mailer := &connCheckingMailer{db: app.db}
+	app.mailer = mailer
+
+	form := url.Values{}
+	form.Add("name", "max")
+	form.Add("password", "secretpassword123")
+	form.Add("email", "max@example.com")
+	r, _ := http.NewRequest(http.MethodPost, "/signup", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.SignUpUser(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+	assert.True(t, mailer.gotConn)
+}
+
+func TestNewAppMailer(t *testing.T) {
+	conf := testConfig()
+	assert.Equal(t, entropy.DiscardMailer{}, newMailer(&conf))
+	conf.devMode = true
+	assert.Equal(t, entropy.LogMailer{}, newMailer(&conf))
+}
+
+func TestSignUpWithInvalidEmail(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+
+	form := url.Values{}
+	form.Add("name", "max")
+	form.Add("password", "secretpassword123")
+	form.Add("email", "not an email")
+	r, _ := http.NewRequest(http.MethodPost, "/signup", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.SignUpUser(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	checkBodyContains(t, w.Result(), "This doesn&#39;t look like an email address")
+}
+
+func TestServeUploadFromDirStore(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+	app.uploads = &entropy.DirStore{Dir: t.TempDir()}
+
+	var uploadID int64
+	{
+		conn := app.db.Get(t.Context())
+		uploadID, err = app.uploads.Put(conn, "image/png", []byte("not really a png"))
+		app.db.Put(conn)
+		assert.Nil(t, err)
+	}
+
+	uploadPath := fmt.Sprintf("%d.png", uploadID)
+	r, _ := http.NewRequest(http.MethodGet, "/uploads/"+uploadPath, nil)
+	r.SetPathValue("upload_id", uploadPath)
+	w := httptest.NewRecorder()
+	app.ServeUpload(w, r)
+	result := w.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "image/png", result.Header.Get("Content-Type"))
+	checkBodyContains(t, result, "not really a png")
+}
+
+func TestPeekAtPost(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	stranger, err := entropy.CreateUser(conn, "stranger", "pass")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, stranger.UserID, "hello from far away")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	h := entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.PeekAtPost))
+	path := fmt.Sprintf("/p/%d/peek", postID)
+	r, _ := http.NewRequest(http.MethodPost, path, nil)
+	r.SetPathValue("post_id", fmt.Sprint(postID))
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+	assert.Equal(t, fmt.Sprintf("/p/%d/", postID), w.Result().Header.Get("Location"))
+
+	// Have to be logged in to peek
+	r, _ = http.NewRequest(http.MethodPost, path, nil)
+	r.SetPathValue("post_id", fmt.Sprint(postID))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "/login", w.Result().Header.Get("Location"))
+}
+
+func TestHomepageNextPageBoundary(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	for i := range postsLimit {
+		_, err = entropy.CreatePost(conn, user.UserID, fmt.Sprintf("post %d", i))
+		assert.Nil(t, err)
+	}
+	app.db.Put(conn)
+
+	// Exactly postsLimit posts means there's no next page
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	app.Homepage(w, r)
+	assert.NotContains(t, w.Body.String(), `data-rel="next"`)
+	assert.Contains(t, w.Body.String(), "(The end.)")
+
+	conn = app.db.Get(t.Context())
+	_, err = entropy.CreatePost(conn, user.UserID, "one more")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	r, _ = http.NewRequest(http.MethodGet, "/", nil)
+	w = httptest.NewRecorder()
+	app.Homepage(w, r)
+	assert.Contains(t, w.Body.String(), `data-rel="next"`)
+}
+
+func TestUserPostsPaginationWithinOneSecond(t *testing.T) {
+	app, err := setUpTestApp(t)
+	assert.Nil(t, err)
+	defer app.db.Close()
+
+	// More than a page of posts, all created in the same second
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	for i := range postsLimit + 5 {
+		_, err = entropy.CreatePost(conn, user.UserID, fmt.Sprintf("post %d", i))
+		assert.Nil(t, err)
+	}
+	err = sqlitex.Exec(conn, "update post set created_at = ?", nil, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli())
+	assert.Nil(t, err)
+
+	seen := make(map[int64]bool)
+	before := defaultBefore()
+	for pages := 0; ; pages++ {
+		assert.Less(t, pages, 3, "too many pages")
+		page, err := getUserPostsPage(conn, user, user, postsPagination{before: before, limit: postsLimit})
+		assert.Nil(t, err)
+		for _, post := range page.Posts {
+			assert.False(t, seen[post.PostID], "post %d showed up twice", post.PostID)
+			seen[post.PostID] = true
+		}
+		if page.NextPageURL == "" {
+			break
+		}
+		r, _ := http.NewRequest(http.MethodGet, page.NextPageURL, nil)
+		before = parseBefore(r)
+	}
+	assert.Len(t, seen, postsLimit+5)
+}
+
+func TestParseBeforeWithAndWithoutMilliseconds(t *testing.T) {
+	createdAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cursor := entropy.PostCursor{CreatedAt: createdAt.Add(250 * time.Millisecond), PostID: 7}
+	r, _ := http.NewRequest(http.MethodGet, "/?"+cursorQuery("before", cursor), nil)
+	assert.Equal(t, cursor, parseBefore(r))
+
+	// Links from before we had milliseconds
+	r, _ = http.NewRequest(http.MethodGet, "/?before=20250101T000000&before_id=7", nil)
+	assert.Equal(t, entropy.PostCursor{CreatedAt: createdAt, PostID: 7}, parseBefore(r))
+}
+
+func TestNoConnectionAvailable(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+
+	// Someone else has the only read-write connection, and the request gets cancelled
+	// while it's waiting for it
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/post", strings.NewReader("content=hi"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	app.NewPost(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+}
+
+func TestConnectionAcquireTimeout(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	app.db.AcquireTimeout = 50 * time.Millisecond
+
+	// A long-running write is hogging the only read-write connection
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+
+	r, _ := http.NewRequest(http.MethodPost, "/post", strings.NewReader("content=hi"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	app.NewPost(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// A sqlite.Tracer that remembers the text of every query that was run
+type queryLog struct {
+	queries []string
+}
+
+func (l *queryLog) NewTask(query string) sqlite.TracerTask {
+	l.queries = append(l.queries, query)
+	return noopTracerTask{}
+}
+func (l *queryLog) Push(name string) {}
+func (l *queryLog) Pop()             {}
+
+// How many of the queries had substr in them
+func (l *queryLog) count(substr string) int {
+	n := 0
+	for _, query := range l.queries {
+		if strings.Contains(query, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+type noopTracerTask struct{}
+
+func (noopTracerTask) StartRegion(regionType string) {}
+func (noopTracerTask) EndRegion()                    {}
+func (noopTracerTask) End()                          {}
+
+func TestPostPageDecoratesOnce(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+
+	viewer, err := entropy.CreateUser(conn, "viewer", "pass123")
+	assert.Nil(t, err)
+	alice, err := entropy.CreateUser(conn, "alice", "pass123")
+	assert.Nil(t, err)
+	bob, err := entropy.CreateUser(conn, "bob", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, viewer.UserID, alice.UserID)
+	assert.Nil(t, err)
+	parentID, err := entropy.CreatePost(conn, alice.UserID, "parent")
+	assert.Nil(t, err)
+	postID, err := entropy.ReplyToPost(conn, parentID, bob.UserID, "post")
+	assert.Nil(t, err)
+	for i := range 3 {
+		_, err = entropy.ReplyToPost(conn, postID, alice.UserID, fmt.Sprintf("reply %d", i))
+		assert.Nil(t, err)
+	}
+
+	log := &queryLog{}
+	conn.SetTracer(log)
+	page, err := getPostPage(conn, viewer, postID, repliesPagination{cursor: entropy.PostCursor{}})
+	conn.SetTracer(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, postID, page.Post.PostID)
+	assert.Equal(t, parentID, page.ReplyingToPost.PostID)
+	assert.Len(t, page.Replies, 3)
+	assert.Equal(t, 1, page.ReplyingToPost.DistanceFromUser)
+	assert.Equal(t, 1, page.Replies[0].DistanceFromUser)
+	assert.Equal(t, 1, log.count("from user_distance"))
+	assert.Equal(t, 1, log.count("with follows as"))
+}
+
+func TestPinPostToProfile(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	pinnedID, err := entropy.CreatePost(conn, user.UserID, "the pinned one")
+	assert.Nil(t, err)
+	_, err = entropy.CreatePost(conn, user.UserID, "a newer one")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	r, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/p/%d/pin", pinnedID), nil)
+	r.SetPathValue("post_id", fmt.Sprint(pinnedID))
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.PinPost)).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+	assert.Equal(t, "/u/max/", w.Result().Header.Get("Location"))
+
+	conn = app.db.Get(t.Context())
+	page, err := getUserPostsPage(conn, nil, user, postsPagination{before: defaultBefore(), limit: postsLimit})
+	app.db.Put(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, pinnedID, page.PinnedPost.PostID)
+	assert.True(t, page.PinnedPost.Pinned)
+	// It's decorated like any other post
+	assert.Equal(t, entropy.MaxDistortionLevel, page.PinnedPost.DistanceFromUser)
+	// And it's still in the timeline where it always was
+	assert.Len(t, page.Posts, 2)
+	assert.False(t, page.Posts[0].Pinned)
+	assert.Equal(t, pinnedID, page.Posts[1].PostID)
+	assert.True(t, page.Posts[1].Pinned)
+
+	r, _ = http.NewRequest(http.MethodGet, "/u/max/", nil)
+	r.SetPathValue("username", "max")
+	r.AddCookie(sess.ToCookie(true))
+	w = httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.ShowUserPosts)).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	checkBodyContains(t, w.Result(), fmt.Sprintf(`action="/p/%d/unpin"`, pinnedID))
+
+	r, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("/p/%d/unpin", pinnedID), nil)
+	r.SetPathValue("post_id", fmt.Sprint(pinnedID))
+	r.AddCookie(sess.ToCookie(true))
+	w = httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.UnpinPost)).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+
+	conn = app.db.Get(t.Context())
+	page, err = getUserPostsPage(conn, nil, user, postsPagination{before: defaultBefore(), limit: postsLimit})
+	app.db.Put(conn)
+	assert.Nil(t, err)
+	assert.Nil(t, page.PinnedPost)
+}
+
+func TestPinnedPostIsDecoratedWhenItsAlsoInTheTimeline(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	fan, err := entropy.CreateUser(conn, "fan", "pass123")
+	assert.Nil(t, err)
+	pinnedID, err := entropy.CreatePost(conn, user.UserID, "the pinned one")
+	assert.Nil(t, err)
+	_, err = entropy.PinPost(conn, user.UserID, pinnedID)
+	assert.Nil(t, err)
+	_, err = entropy.ReactToPostIfExists(conn, fan.UserID, pinnedID, "👍")
+	assert.Nil(t, err)
+	_, err = entropy.ReplyToPost(conn, pinnedID, fan.UserID, "nice")
+	assert.Nil(t, err)
+	_, err = entropy.RecordPostView(conn, pinnedID, fan.UserID)
+	assert.Nil(t, err)
+
+	page, err := getUserPostsPage(conn, user, user, postsPagination{before: defaultBefore(), limit: postsLimit})
+	assert.Nil(t, err)
+	assert.Len(t, page.Posts, 1)
+	for _, post := range []*entropy.Post{page.PinnedPost, &page.Posts[0]} {
+		assert.Equal(t, pinnedID, post.PostID)
+		assert.True(t, post.Pinned)
+		assert.Equal(t, 1, post.TotalReactions)
+		assert.Equal(t, 1, post.ReplyCount)
+		assert.Equal(t, 1, post.ViewCount)
+	}
+}
+
+func TestConfiguredSessionDuration(t *testing.T) {
+	conf := testConfig()
+	conf.sessionDuration = 7 * 24 * time.Hour
+	app, err := setUpTestAppWithConfig(t, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	_, err = entropy.CreateUser(conn, "max", "secretpassword123")
+	app.db.Put(conn)
+	assert.Nil(t, err)
+
+	form := url.Values{}
+	form.Add("name", "max")
+	form.Add("password", "secretpassword123")
+	r, _ := http.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	app.LogIn(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode)
+
+	conn = app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	var expiresAt time.Time
+	collect := func(stmt *sqlite.Stmt) error {
+		expiresAt = time.Unix(stmt.ColumnInt64(0), 0)
+		return nil
+	}
+	assert.Nil(t, sqlitex.Exec(conn, "select expiration_time from user_session", collect))
+	assert.WithinDuration(t, start.Add(app.sessionDuration), expiresAt, 5*time.Second)
+}
+
+func TestCleanUp(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.CreateUserSessionWithDuration(conn, user.UserID, -time.Hour)
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, "peek at this")
+	assert.Nil(t, err)
+	_, err = entropy.GrantPeek(conn, user.UserID, postID, -time.Hour)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	assert.Nil(t, cleanUp(t.Context(), app.db, app.uploads))
+
+	conn = app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	deleted, err := entropy.DeleteExpiredSessions(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted, "expected cleanUp to have deleted the expired session already")
+	deleted, err = entropy.DeleteExpiredPeeks(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted, "expected cleanUp to have deleted the expired peek already")
+}
+
+func postForm(app *App, sess *entropy.UserSession, handler http.HandlerFunc, path string, postID int64, form url.Values, header http.Header) *http.Response {
+	r, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	r.SetPathValue("post_id", fmt.Sprint(postID))
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, handler).ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestReactJSONResponse(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, "react to me")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	// A plain form post gets redirected back to the post
+	path := fmt.Sprintf("/p/%d/react", postID)
+	resp := postForm(app, sess, app.ReactToPost, path, postID, url.Values{"emoji": {"👍"}}, nil)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("/p/%d/", postID), resp.Header.Get("Location"))
+
+	jsonHeader := http.Header{"Accept": {"application/json"}}
+	resp = postForm(app, sess, app.ReactToPost, path, postID, url.Values{"emoji": {"❤️"}}, jsonHeader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var reactions reactionsJSON
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&reactions))
+	assert.Equal(t, postID, reactions.PostID)
+	assert.Equal(t, 2, reactions.TotalReactions)
+	assert.Len(t, reactions.Reactions, 2)
+	assert.True(t, reactions.Reactions[0].UserReacted)
+
+	// Unreacting right away is too fast
+	path = fmt.Sprintf("/p/%d/unreact", postID)
+	resp = postForm(app, sess, app.UnreactToPost, path, postID, url.Values{"emoji": {"👍"}}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("Retry-After"))
+	conn = app.db.Get(t.Context())
+	assert.Nil(t, sqlitex.Exec(conn, "update reaction set reacted_at = reacted_at - 60", nil))
+	app.db.Put(conn)
+
+	// htmx requests get JSON too
+	htmxHeader := http.Header{"Hx-Request": {"true"}}
+	resp = postForm(app, sess, app.UnreactToPost, path, postID, url.Values{"emoji": {"👍"}}, htmxHeader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	reactions = reactionsJSON{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&reactions))
+	assert.Equal(t, []reactionCountJSON{{Emoji: "❤️", Count: 1, UserReacted: true}}, reactions.Reactions)
+	assert.Equal(t, 1, reactions.TotalReactions)
+
+	resp = postForm(app, sess, app.UnreactToPost, path, postID, url.Values{"emoji": {"❤️"}}, nil)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+}
+
+func TestReactWithDisallowedEmoji(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, "react to me")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	path := fmt.Sprintf("/p/%d/react", postID)
+	resp := postForm(app, sess, app.ReactToPost, path, postID, url.Values{"emoji": {"🦆"}}, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = postForm(app, sess, app.ReactToPost, path, postID, url.Values{"emoji": {"🔥"}}, nil)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	// A form that doesn't parse is a bad request too
+	r, _ := http.NewRequest(http.MethodPost, path, strings.NewReader("emoji=%zz"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetPathValue("post_id", fmt.Sprint(postID))
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.ReactToPost)).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The picker offers all of the allowed reactions
+	r, _ = http.NewRequest(http.MethodGet, entropy.PostURL(postID), nil)
+	r.AddCookie(sess.ToCookie(true))
+	w = httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, app.newMux(false)).ServeHTTP(w, r)
+	for _, emoji := range entropy.AllowedReactions {
+		assert.Contains(t, w.Body.String(), fmt.Sprintf(`name="emoji" value="%s"`, emoji))
+	}
+}
+
+func TestReplyJSONResponse(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, "reply to me")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	path := fmt.Sprintf("/p/%d/reply", postID)
+	resp := postForm(app, sess, app.ReplyToPost, path, postID, url.Values{"content": {"first reply"}}, nil)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("/p/%d/", postID+1), resp.Header.Get("Location"))
+
+	jsonHeader := http.Header{"Accept": {"application/json"}}
+	resp = postForm(app, sess, app.ReplyToPost, path, postID, url.Values{"content": {"second reply"}}, jsonHeader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var reply replyJSON
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&reply))
+	assert.Equal(t, postID+2, reply.PostID)
+	assert.Equal(t, fmt.Sprintf("/p/%d/", postID+2), reply.URL)
+	assert.Contains(t, reply.HTML, `<li class="post`)
+	assert.Contains(t, reply.HTML, "second reply")
+	assert.Contains(t, reply.HTML, fmt.Sprintf(`id="post_%d"`, postID+2))
+}
+
+func TestCSRFToken(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /csrf", CSRFToken)
+	mux.HandleFunc("POST /submit", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := csrfProtect(make([]byte, 32), nil, true)(mux)
+
+	// No session needed
+	r, _ := http.NewRequest(http.MethodGet, "/csrf", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "no-store", w.Result().Header.Get("Cache-Control"))
+	var token csrfTokenJSON
+	assert.Nil(t, json.NewDecoder(w.Result().Body).Decode(&token))
+	assert.NotEmpty(t, token.Token)
+	assert.Equal(t, "X-CSRF-Token", token.Header)
+	cookies := w.Result().Cookies()
+	assert.NotEmpty(t, cookies)
+
+	post := func(header string) int {
+		r, _ := http.NewRequest(http.MethodPost, "/submit", nil)
+		// Otherwise csrf.Protect assumes HTTPS and wants a Referer too
+		r = csrf.PlaintextHTTPRequest(r)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		if header != "" {
+			r.Header.Set(token.Header, header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, post(token.Token))
+	assert.Equal(t, http.StatusForbidden, post(""))
+	assert.Equal(t, http.StatusForbidden, post("not the token"))
+}
+
+func TestHomepageChaosLevel(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	rando, err := entropy.CreateUser(conn, "rando", "pass123")
+	assert.Nil(t, err)
+	for _, author := range []*entropy.User{me, me, me, rando} {
+		_, err = entropy.CreatePost(conn, author.UserID, "hello")
+		assert.Nil(t, err)
+	}
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.Homepage)).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	checkBodyContains(t, w.Result(), `<meter min="0" max="1" value="0.25"></meter> 25%`)
+}
+
+func TestHomepageLastVisitDivider(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.CreatePost(conn, me.UserID, "old news")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	getHomepage := func() *http.Response {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(sess.ToCookie(true))
+		w := httptest.NewRecorder()
+		entropy.WithUserContextMiddleware(app.db, http.HandlerFunc(app.Homepage)).ServeHTTP(w, r)
+		return w.Result()
+	}
+	lastVisit := func() time.Time {
+		conn := app.db.Get(t.Context())
+		defer app.db.Put(conn)
+		visit, err := entropy.GetLastHomepageVisit(conn, me.UserID)
+		assert.Nil(t, err)
+		return visit
+	}
+
+	// The first visit gets recorded, but there's nothing to compare it to yet
+	resp := getHomepage()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.NotContains(t, string(body), "posts__divider")
+	firstVisit := lastVisit()
+	assert.False(t, firstVisit.IsZero())
+
+	// Pretend that was a while ago, and then somebody posted something
+	conn = app.db.Get(t.Context())
+	err = sqlitex.Exec(conn, "update user set homepage_visited_at = homepage_visited_at - 120", nil)
+	assert.Nil(t, err)
+	err = sqlitex.Exec(conn, "update post set created_at = created_at - 240000", nil)
+	assert.Nil(t, err)
+	_, err = entropy.CreatePost(conn, me.UserID, "breaking news")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	resp = getHomepage()
+	checkBodyContains(t, resp, `<li class="posts__divider">`)
+	secondVisit := lastVisit()
+	assert.True(t, secondVisit.After(firstVisit.Add(-120*time.Second)))
+
+	// Reloading right away doesn't write the visit down again
+	conn = app.db.Get(t.Context())
+	err = sqlitex.Exec(conn, "update user set homepage_visited_at = homepage_visited_at - 30", nil)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	getHomepage()
+	assert.Equal(t, secondVisit.Add(-30*time.Second), lastVisit())
+}
+
+func TestUnusualUserNamesRoundTrip(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	for _, name := range []string{"a/b", "100%", "%2F", "what?", "#1", "a&b", "ünï"} {
+		conn := app.db.Get(t.Context())
+		user, err := entropy.CreateUser(conn, name, "pass123")
+		assert.Nil(t, err)
+		postID, err := entropy.CreatePost(conn, user.UserID, "hello")
+		assert.Nil(t, err)
+		app.db.Put(conn)
+		profileURL := entropy.UserURL(name)
+
+		r, _ := http.NewRequest(http.MethodGet, profileURL, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, name)
+		checkBodyContains(t, w.Result(), fmt.Sprintf(`action="%sfollow"`, html.EscapeString(profileURL)))
+
+		r, _ = http.NewRequest(http.MethodPost, profileURL+"follow", nil)
+		r.AddCookie(sess.ToCookie(true))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusSeeOther, w.Result().StatusCode, name)
+		assert.Equal(t, profileURL, w.Result().Header.Get("Location"))
+
+		// And the post links back to the profile
+		r, _ = http.NewRequest(http.MethodGet, entropy.PostURL(postID), nil)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, name)
+		checkBodyContains(t, w.Result(), fmt.Sprintf(`href="%s"`, html.EscapeString(profileURL)))
+	}
+}
+
+func TestFollowReportsChanged(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.CreateUser(conn, "luna", "pass123")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	post := func(path string, header http.Header) *http.Response {
+		r, _ := http.NewRequest(http.MethodPost, path, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		r.AddCookie(sess.ToCookie(true))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	jsonHeader := http.Header{"Accept": {"application/json"}}
+	var testCases = []struct {
+		path     string
+		expected followJSON
+	}{
+		{"/u/luna/follow", followJSON{Following: true, Changed: true}},
+		{"/u/luna/follow", followJSON{Following: true, Changed: false}},
+		{"/u/luna/unfollow", followJSON{Following: false, Changed: true}},
+		{"/u/luna/unfollow", followJSON{Following: false, Changed: false}},
+	}
+	for _, testCase := range testCases {
+		resp := post(testCase.path, jsonHeader)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var result followJSON
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, testCase.expected, result, testCase.path)
+	}
+
+	// Plain form posts still get redirected to the profile
+	resp := post("/u/luna/follow", nil)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/u/luna/", resp.Header.Get("Location"))
+}
+
+func TestPagesGetBasePageData(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, me.UserID, "hello")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	// None of these handlers set the user (or the base URL) on their pages themselves
+	for _, path := range []string{"/", "/about", me.URL(), entropy.PostURL(postID), "/profile"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.AddCookie(sess.ToCookie(true))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, path)
+		checkBodyContains(t, w.Result(), "Hello, me!")
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	checkBodyContains(t, w.Result(), `action="/posts/new"`)
+
+	r, _ = http.NewRequest(http.MethodGet, entropy.PostURL(postID), nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Contains(t, w.Body.String(), "Hello, stranger!")
+	assert.Contains(t, w.Body.String(), `<meta property="og:url" content="https://entropych.example.com/p/1/">`)
+}
+
+func TestAdminGraphJSON(t *testing.T) {
+	conf := testConfig()
+	conf.admins = []string{"admin"}
+	app, err := setUpTestAppWithConfig(t, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	conn := app.db.Get(t.Context())
+	admin, err := entropy.CreateUser(conn, "admin", "pass123")
+	assert.Nil(t, err)
+	rando, err := entropy.CreateUser(conn, "rando", "pass123")
+	assert.Nil(t, err)
+	loner, err := entropy.CreateUser(conn, "loner", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, admin.UserID, rando.UserID)
+	assert.Nil(t, err)
+	adminSess, err := entropy.CreateUserSession(conn, admin.UserID)
+	assert.Nil(t, err)
+	randoSess, err := entropy.CreateUserSession(conn, rando.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	get := func(sess *entropy.UserSession, path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		if sess != nil {
+			r.AddCookie(sess.ToCookie(true))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusNotFound, get(nil, "/admin/graph.json").Code)
+	assert.Equal(t, http.StatusNotFound, get(randoSess, "/admin/graph.json").Code)
+
+	var subgraph entropy.FollowSubgraph
+	w := get(adminSess, "/admin/graph.json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &subgraph))
+	assert.Len(t, subgraph.Users, 3)
+	assert.Equal(t, []entropy.GraphFollow{{Source: admin.UserID, Target: rando.UserID}}, subgraph.Follows)
+
+	w = get(adminSess, "/admin/graph.json?around=admin&depth=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &subgraph))
+	assert.Equal(t, []entropy.GraphUser{{UserID: admin.UserID, UserName: "admin"}, {UserID: rando.UserID, UserName: "rando"}}, subgraph.Users)
+	assert.Contains(t, w.Body.String(), `"nodes":[{"id":`)
+	assert.Contains(t, w.Body.String(), `"links":[{"source":`)
+
+	w = get(adminSess, "/admin/graph.json?around="+loner.Name)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &subgraph))
+	assert.Len(t, subgraph.Users, 1)
+	assert.Empty(t, subgraph.Follows)
+
+	assert.Equal(t, http.StatusNotFound, get(adminSess, "/admin/graph.json?around=nobody").Code)
+	assert.Equal(t, http.StatusBadRequest, get(adminSess, "/admin/graph.json?around=admin&depth=x").Code)
+}
+
+func TestDiscover(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	popular, err := entropy.CreateUser(conn, "popular", "pass123")
+	assert.Nil(t, err)
+	for _, name := range []string{"fan1", "fan2"} {
+		fan, err := entropy.CreateUser(conn, name, "pass123")
+		assert.Nil(t, err)
+		_, err = entropy.FollowUser(conn, fan.UserID, popular.UserID)
+		assert.Nil(t, err)
+	}
+	app.db.Put(conn)
+
+	r, _ := http.NewRequest(http.MethodGet, "/discover", nil)
+	w := httptest.NewRecorder()
+	entropy.WithUserContextMiddleware(app.db, app.newMux(false)).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `<a href="/u/popular/">popular</a>`)
+	assert.Contains(t, body, "followers: 2")
+	assert.Less(t, strings.Index(body, "/u/popular/"), strings.Index(body, "/u/fan1/"))
+}
+
+func TestShowPostCountsViews(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	conn := app.db.Get(t.Context())
+	author, err := entropy.CreateUser(conn, "author", "pass123")
+	assert.Nil(t, err)
+	viewer, err := entropy.CreateUser(conn, "viewer", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, author.UserID, "hello")
+	assert.Nil(t, err)
+	authorSess, err := entropy.CreateUserSession(conn, author.UserID)
+	assert.Nil(t, err)
+	viewerSess, err := entropy.CreateUserSession(conn, viewer.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	view := func(sess *entropy.UserSession) string {
+		r, _ := http.NewRequest(http.MethodGet, entropy.PostURL(postID), nil)
+		if sess != nil {
+			r.AddCookie(sess.ToCookie(true))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		app.backgroundWrites.Wait()
+		return w.Body.String()
+	}
+	view(viewerSess)
+	view(viewerSess)
+	view(authorSess)
+	view(nil)
+	body := view(authorSess)
+	assert.Contains(t, body, `<span class="emoji">👀</span> 1`)
+}
+
+func TestRecordPostViewDropsViewsWhenBusy(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+
+	conn := app.db.Get(t.Context())
+	author, err := entropy.CreateUser(conn, "author", "pass123")
+	assert.Nil(t, err)
+	viewer, err := entropy.CreateUser(conn, "viewer", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, author.UserID, "hello")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	// Pretend the other writes are all still waiting
+	for range maxBackgroundWrites {
+		app.backgroundWriteSlots <- struct{}{}
+	}
+	app.recordPostView(postID, viewer.UserID)
+	app.backgroundWrites.Wait()
+
+	conn = app.db.Get(t.Context())
+	defer app.db.Put(conn)
+	counted, err := entropy.RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	assert.True(t, counted, "expected the busy recordPostView to have dropped its view")
+}
+
+func TestShowUserActivity(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	other, err := entropy.CreateUser(conn, "other", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, other.UserID, "hello")
+	assert.Nil(t, err)
+	_, err = entropy.ReactToPostIfExists(conn, me.UserID, postID, "🔥")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, me.UserID, other.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+	r, _ := http.NewRequest(http.MethodGet, "/u/me/activity", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `followed <a href="/u/other/">@other</a>`)
+	assert.Contains(t, w.Body.String(), `reacted <span class="emoji">🔥</span> to <a href="/p/1/">a post</a>`)
+
+	r, _ = http.NewRequest(http.MethodGet, "/u/nobody/activity", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestParseNameList(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, parseNameList("a\n@b, c\r\n\n d ,,e,"))
+	assert.Empty(t, parseNameList(" \n, "))
+}
+
+func TestImportAndExportFollows(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	for _, name := range []string{"a", "b"} {
+		_, err := entropy.CreateUser(conn, name, "pass123")
+		assert.Nil(t, err)
+	}
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	form := url.Values{"names": {"a\n@b\nnobody\na"}}
+	r, _ := http.NewRequest(http.MethodPost, "/profile/import-follows", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Followed 2 people.")
+	assert.Contains(t, w.Body.String(), "nobody")
+
+	r, _ = http.NewRequest(http.MethodGet, "/profile/follows.txt", nil)
+	r.AddCookie(sess.ToCookie(true))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.ElementsMatch(t, []string{"a", "b"}, strings.Fields(w.Body.String()))
+
+	// Logged out, there's nobody to import follows for
+	r, _ = http.NewRequest(http.MethodPost, "/profile/import-follows", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestHomepageFollowingFilter(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	friend, err := entropy.CreateUser(conn, "friend", "pass123")
+	assert.Nil(t, err)
+	rando, err := entropy.CreateUser(conn, "rando", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+	randoPostID, err := entropy.CreatePost(conn, rando.UserID, "who am i")
+	assert.Nil(t, err)
+	var friendPostID int64
+	for range postsLimit + 1 {
+		friendPostID, err = entropy.CreatePost(conn, friend.UserID, "hi friend")
+		assert.Nil(t, err)
+	}
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	get := func(path string) string {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.AddCookie(sess.ToCookie(true))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	randoPostLink := fmt.Sprintf(`href="%s"`, entropy.PostURL(randoPostID))
+
+	body := get("/?filter=following")
+	assert.Contains(t, body, fmt.Sprintf(`href="%s"`, entropy.PostURL(friendPostID)))
+	assert.NotContains(t, body, randoPostLink)
+	assert.Contains(t, body, "<strong>following</strong>")
+	// The next page is filtered too
+	match := regexp.MustCompile(`<a href="([^"]+)" data-rel="next">`).FindStringSubmatch(body)
+	assert.NotNil(t, match)
+	nextPageURL := html.UnescapeString(match[1])
+	assert.True(t, strings.HasPrefix(nextPageURL, "/?filter=following&before="), nextPageURL)
+	body = get(nextPageURL)
+	assert.NotContains(t, body, randoPostLink)
+	assert.Contains(t, body, `<a href="/?filter=following">Back to top</a>`)
+
+	// Without the filter (and without changing the setting), randos are back
+	body = get("/")
+	assert.Contains(t, body, randoPostLink)
+	conn = app.db.Get(t.Context())
+	mode, err := entropy.GetFeedMode(conn, me.UserID)
+	app.db.Put(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, entropy.FeedModeChaos, mode)
+}
+
+func TestMentions(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	other, err := entropy.CreateUser(conn, "other", "pass123")
+	assert.Nil(t, err)
+	mentionID, err := entropy.CreatePost(conn, other.UserID, "hi @me")
+	assert.Nil(t, err)
+	otherPostID, err := entropy.CreatePost(conn, other.UserID, "hi everyone")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	r, _ := http.NewRequest(http.MethodGet, "/mentions", nil)
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, fmt.Sprintf(`href="%s"`, entropy.PostURL(mentionID)))
+	assert.NotContains(t, body, fmt.Sprintf(`href="%s"`, entropy.PostURL(otherPostID)))
+
+	// You have to be logged in
+	r, _ = http.NewRequest(http.MethodGet, "/mentions", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestShowHashtag(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	taggedID, err := entropy.CreatePost(conn, me.UserID, "hello #café")
+	assert.Nil(t, err)
+	otherPostID, err := entropy.CreatePost(conn, me.UserID, "hello #news")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	// The post links to the page, and the page has the post (even logged out)
+	r, _ := http.NewRequest(http.MethodGet, entropy.TagURL("café"), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, fmt.Sprintf(`href="%s"`, entropy.PostURL(taggedID)))
+	assert.NotContains(t, body, fmt.Sprintf(`href="%s"`, entropy.PostURL(otherPostID)))
+}
+
+func TestHomepageShowsWhoRepliesAreTo(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	friend, err := entropy.CreateUser(conn, "friend", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, me.UserID, "anyone there?")
+	assert.Nil(t, err)
+	_, err = entropy.ReplyToPost(conn, postID, friend.UserID, "yes")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(sess.ToCookie(true))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, fmt.Sprintf(`replying to <a href="%s"\s+title="me">@me</a>`, regexp.QuoteMeta(entropy.PostURL(postID))), w.Body.String())
+}
+
+func TestPostsLimitQueryParam(t *testing.T) {
+	conf := testConfig()
+	conf.postsPerPage = 10
+	app, err := setUpTestAppWithConfig(t, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	for i := range 12 {
+		_, err = entropy.CreatePost(conn, user.UserID, fmt.Sprintf("post %d", i))
+		assert.Nil(t, err)
+	}
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+	postLink := regexp.MustCompile(`class="post__time"`)
+	nextPageLink := regexp.MustCompile(`<a href="([^"]+)" data-rel="next">`)
+
+	get := func(path string) string {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	for _, pageURL := range []string{"/", user.URL()} {
+		body := get(addQuery(pageURL, "limit=5"))
+		assert.Len(t, postLink.FindAllString(body, -1), 5)
+		match := nextPageLink.FindStringSubmatch(body)
+		assert.NotNil(t, match)
+		nextPageURL := html.UnescapeString(match[1])
+		assert.True(t, strings.HasPrefix(nextPageURL, addQuery(pageURL, "limit=5&before=")), nextPageURL)
+		assert.Len(t, postLink.FindAllString(get(nextPageURL), -1), 5)
+	}
+
+	// Limits out of range are clamped, and ones that aren't numbers are ignored
+	assert.Len(t, postLink.FindAllString(get("/?limit=0"), -1), 1)
+	assert.Len(t, postLink.FindAllString(get("/?limit=1000"), -1), 12)
+	assert.Len(t, postLink.FindAllString(get("/?limit=lots"), -1), 10)
+	assert.NotContains(t, get("/"), "limit=")
+}
+
+func TestShowPostJSON(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	author, err := entropy.CreateUser(conn, "author", "pass123")
+	assert.Nil(t, err)
+	follower, err := entropy.CreateUser(conn, "follower", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, follower.UserID, author.UserID)
+	assert.Nil(t, err)
+	content := "the quick brown fox jumps over the lazy dog, again and again and again"
+	postID, err := entropy.CreatePost(conn, author.UserID, content)
+	assert.Nil(t, err)
+	_, err = entropy.ReactToPostIfExists(conn, follower.UserID, postID, "👍")
+	assert.Nil(t, err)
+	for i := range postsLimit + 1 {
+		_, err = entropy.ReplyToPost(conn, postID, author.UserID, fmt.Sprintf("reply %d", i))
+		assert.Nil(t, err)
+	}
+	sess, err := entropy.CreateUserSession(conn, follower.UserID)
+	assert.Nil(t, err)
+	authorSess, err := entropy.CreateUserSession(conn, author.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	get := func(path string, sess *entropy.UserSession) postPageJSON {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		if sess != nil {
+			r.AddCookie(sess.ToCookie(true))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var page postPageJSON
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &page))
+		return page
+	}
+
+	// The author sees their own post as it is
+	page := get(fmt.Sprintf("/api/p/%d", postID), authorSess)
+	assert.Equal(t, content, page.Post.Content)
+	assert.Equal(t, 0, page.Post.DistanceFromUser)
+
+	// The follower sees it (nearly) as it is
+	page = get(fmt.Sprintf("/api/p/%d", postID), sess)
+	assert.Equal(t, postID, page.Post.PostID)
+	assert.Equal(t, "author", page.Post.UserName)
+	assert.Equal(t, 1, page.Post.DistanceFromUser)
+	assert.Equal(t, []reactionCountJSON{{Emoji: "👍", Count: 1, UserReacted: true}}, page.Post.Reactions)
+	assert.Equal(t, postsLimit+1, page.Post.ReplyCount)
+	assert.Nil(t, page.ReplyingToPost)
+	assert.Len(t, page.Replies, postsLimit)
+	assert.Equal(t, postID, page.Replies[0].ReplyingToPostID)
+	assert.True(t, strings.HasPrefix(page.NextPageURL, fmt.Sprintf("/api/p/%d?after=", postID)), page.NextPageURL)
+	// (From the author's view, so that the reply's content is exact)
+	nextPage := get(page.NextPageURL, authorSess)
+	assert.Len(t, nextPage.Replies, 1)
+	assert.Equal(t, fmt.Sprintf("reply %d", postsLimit), nextPage.Replies[0].Content)
+
+	// Someone who isn't logged in gets it as garbled as it gets
+	page = get(fmt.Sprintf("/api/p/%d", postID), nil)
+	assert.Equal(t, entropy.MaxDistortionLevel, page.Post.DistanceFromUser)
+	assert.NotEqual(t, content, page.Post.Content)
+	assert.Equal(t, []reactionCountJSON{{Emoji: "👍", Count: 1, UserReacted: false}}, page.Post.Reactions)
+
+	r, _ := http.NewRequest(http.MethodGet, "/api/p/12345", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebhooksPage(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, me.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	add := func(webhookURL string) *httptest.ResponseRecorder {
+		form := url.Values{"url": {webhookURL}}
+		r, _ := http.NewRequest(http.MethodPost, "/profile/webhooks", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(sess.ToCookie(true))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	w := add("javascript:alert(1)")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), html.EscapeString(entropy.ErrBadWebhookURL.Error()))
+	w = add("https://example.com/hook")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://example.com/hook")
+
+	conn = app.db.Get(t.Context())
+	webhooks, err := entropy.GetWebhooks(conn, me.UserID)
+	app.db.Put(conn)
+	assert.Nil(t, err)
+	assert.Len(t, webhooks, 1)
+	assert.Contains(t, w.Body.String(), webhooks[0].Secret)
+
+	path := fmt.Sprintf("/profile/webhooks/%d/delete", webhooks[0].WebhookID)
+	r, _ := http.NewRequest(http.MethodPost, path, nil)
+	r.AddCookie(sess.ToCookie(true))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	// It's gone now
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	r, _ = http.NewRequest(http.MethodGet, "/profile/webhooks", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+
+	var received [][]byte
+	var signatures []string
+	status := http.StatusInternalServerError
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, body)
+		signatures = append(signatures, r.Header.Get(entropy.WebhookSignatureHeader))
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	conn := app.db.Get(t.Context())
+	author, err := entropy.CreateUser(conn, "author", "pass123")
+	assert.Nil(t, err)
+	me, err := entropy.CreateUser(conn, "me", "pass123")
+	assert.Nil(t, err)
+	_, err = entropy.FollowUser(conn, me.UserID, author.UserID)
+	assert.Nil(t, err)
+	webhook, err := entropy.RegisterWebhook(conn, me.UserID, receiver.URL+"/hook")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, author.UserID, "hello, webhooks")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+
+	countDeliveries := func() int {
+		conn := app.db.Get(t.Context())
+		defer app.db.Put(conn)
+		count, err := sqlitex.ResultInt(conn.Prep("select count(*) from webhook_delivery"))
+		assert.Nil(t, err)
+		return count
+	}
+
+	// The first try fails, so it's put off until later
+	assert.Nil(t, deliverWebhooks(t.Context(), app.db, receiver.Client(), "https://example.com"))
+	assert.Len(t, received, 1)
+	assert.Equal(t, 1, countDeliveries())
+	assert.Nil(t, deliverWebhooks(t.Context(), app.db, receiver.Client(), "https://example.com"))
+	assert.Len(t, received, 1)
+
+	// Make it due again, and this time it works
+	conn = app.db.Get(t.Context())
+	assert.Nil(t, sqlitex.Exec(conn, "update webhook_delivery set next_attempt_at = 0", nil))
+	app.db.Put(conn)
+	status = http.StatusNoContent
+	assert.Nil(t, deliverWebhooks(t.Context(), app.db, receiver.Client(), "https://example.com"))
+	assert.Len(t, received, 2)
+	assert.Equal(t, 0, countDeliveries())
+
+	assert.True(t, entropy.VerifyWebhookSignature(webhook.Secret, received[1], signatures[1]))
+	var payload entropy.WebhookPayload
+	assert.Nil(t, json.Unmarshal(received[1], &payload))
+	assert.Equal(t, postID, payload.PostID)
+	assert.Equal(t, fmt.Sprintf("https://example.com/p/%d/", postID), payload.URL)
+	assert.Equal(t, "author", payload.UserName)
+	// Distorted a little, since I'm one hop from the author
+	assert.Equal(t, utf8.RuneCountInString("hello, webhooks"), utf8.RuneCountInString(payload.Content))
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	_, err := newWebhookClient(false).Get(receiver.URL)
+	assert.NotNil(t, err)
+	resp, err := newWebhookClient(true).Get(receiver.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+}
+
+func TestActivityPubActorAndOutbox(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	for i := range postsLimit + 1 {
+		_, err = entropy.CreatePost(conn, user.UserID, fmt.Sprintf("post %d", i))
+		assert.Nil(t, err)
+	}
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	get := func(path string, accept string) (*httptest.ResponseRecorder, map[string]any) {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var object map[string]any
+		if w.Code == http.StatusOK && w.Header().Get("Content-Type") == entropy.ActivityPubContentType {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &object))
+		}
+		return w, object
+	}
+
+	// Browsers still get the profile page
+	w, _ := get("/u/max/", "text/html")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+	for _, accept := range []string{entropy.ActivityPubContentType, `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`} {
+		w, actor := get("/u/max/", accept)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Person", actor["type"])
+		assert.Equal(t, "https://entropych.example.com/u/max/", actor["id"])
+	}
+
+	_, outbox := get("/u/max/outbox", entropy.ActivityPubContentType)
+	assert.Equal(t, "OrderedCollection", outbox["type"])
+	firstPageURL := outbox["first"].(string)
+	assert.Equal(t, "https://entropych.example.com/u/max/outbox?page=true", firstPageURL)
+
+	_, page := get(strings.TrimPrefix(firstPageURL, app.baseURL), entropy.ActivityPubContentType)
+	assert.Equal(t, "OrderedCollectionPage", page["type"])
+	assert.Equal(t, firstPageURL, page["id"])
+	assert.Len(t, page["orderedItems"], postsLimit)
+	nextPageURL := page["next"].(string)
+	assert.True(t, strings.HasPrefix(nextPageURL, firstPageURL+"&before="), nextPageURL)
+
+	_, page = get(strings.TrimPrefix(nextPageURL, app.baseURL), entropy.ActivityPubContentType)
+	assert.Len(t, page["orderedItems"], 1)
+	assert.NotContains(t, page, "next")
+
+	w, _ = get("/u/nobody/outbox", entropy.ActivityPubContentType)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebFinger(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	_, err = entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	get := func(resource string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(http.MethodGet, "/.well-known/webfinger?"+url.Values{"resource": {resource}}.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("acct:max@entropych.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, entropy.WebFingerContentType, w.Header().Get("Content-Type"))
+	var jrd entropy.WebFinger
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &jrd))
+	assert.Equal(t, "acct:max@entropych.example.com", jrd.Subject)
+	assert.Contains(t, jrd.Links, entropy.WebFingerLink{
+		Rel:  "self",
+		Type: entropy.ActivityPubContentType,
+		Href: "https://entropych.example.com/u/max/",
+	})
+
+	assert.Equal(t, http.StatusNotFound, get("acct:nobody@entropych.example.com").Code)
+	assert.Equal(t, http.StatusNotFound, get("acct:max@somewhere.else").Code)
+	for _, resource := range []string{"", "max", "acct:max", "acct:@entropych.example.com", "https://entropych.example.com/u/max/"} {
+		assert.Equal(t, http.StatusBadRequest, get(resource).Code, resource)
+	}
+}
+
+func TestSetReactionJSON(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, "react to me")
+	assert.Nil(t, err)
+	sess, err := entropy.CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := entropy.WithUserContextMiddleware(app.db, app.newMux(false))
+
+	path := fmt.Sprintf("/api/p/%d/reaction", postID)
+	send := func(method string, path string, body string, sess *entropy.UserSession) (*httptest.ResponseRecorder, reactionsJSON) {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if sess != nil {
+			r.AddCookie(sess.ToCookie(true))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var reactions reactionsJSON
+		if w.Code == http.StatusOK {
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reactions))
+		}
+		return w, reactions
+	}
+
+	// Setting it twice is the same as setting it once
+	for range 2 {
+		w, reactions := send(http.MethodPut, path, `{"emoji": "👍"}`, sess)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, postID, reactions.PostID)
+		assert.Equal(t, []reactionCountJSON{{Emoji: "👍", Count: 1, UserReacted: true}}, reactions.Reactions)
+		assert.Equal(t, 1, reactions.TotalReactions)
+	}
+
+	// Deleting it right away is too fast
+	w, _ := send(http.MethodDelete, path, `{"emoji": "👍"}`, sess)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	conn = app.db.Get(t.Context())
+	assert.Nil(t, sqlitex.Exec(conn, "update reaction set reacted_at = reacted_at - 60", nil))
+	app.db.Put(conn)
+
+	// Deleting it twice is the same as deleting it once
+	for range 2 {
+		w, reactions := send(http.MethodDelete, path, `{"emoji": "👍"}`, sess)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []reactionCountJSON{}, reactions.Reactions)
+		assert.Equal(t, 0, reactions.TotalReactions)
+	}
+
+	for _, body := range []string{"", "not json", `{}`, `{"emoji": "🦖"}`, `{"emoji": "👍", "extra": 1}`} {
+		w, _ := send(http.MethodPut, path, body, sess)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	w, _ = send(http.MethodPut, "/api/p/12345/reaction", `{"emoji": "👍"}`, sess)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = send(http.MethodPut, path, `{"emoji": "👍"}`, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCompressionSkipsImages(t *testing.T) {
+	app, err := setUpTestApp(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.db.Close()
+	conn := app.db.Get(t.Context())
+	user, err := entropy.CreateUser(conn, "max", "pass123")
+	assert.Nil(t, err)
+	postID, err := entropy.CreatePost(conn, user.UserID, strings.Repeat("compress me ", 20))
+	assert.Nil(t, err)
+	png := testPNG(t)
+	uploadID, err := entropy.SaveUpload(conn, "image/png", png)
+	assert.Nil(t, err)
+	app.db.Put(conn)
+	handler := withCompression(entropy.WithUserContextMiddleware(app.db, app.newMux(false)))
+
+	get := func(path string, acceptEncoding string) *http.Response {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Header().Values("Vary"), "Accept-Encoding")
+		return w.Result()
+	}
+	gunzip := func(resp *http.Response) string {
+		reader, err := gzip.NewReader(resp.Body)
+		assert.Nil(t, err)
+		body, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		return string(body)
+	}
+
+	resp := get(fmt.Sprintf("/uploads/%d.png", uploadID), "gzip, deflate")
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, png, body)
+
+	resp = get("/", "gzip, deflate")
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", resp.Header.Get("Content-Length"))
+	assert.Contains(t, gunzip(resp), "<html")
+
+	resp = get(fmt.Sprintf("/api/p/%d", postID), "gzip")
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Contains(t, gunzip(resp), `"post_id"`)
+
+	resp = get(fmt.Sprintf("/api/p/%d", postID), "deflate")
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	body, err = io.ReadAll(flate.NewReader(resp.Body))
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"post_id"`)
+
+	// Unless the client doesn't want it compressed
+	for _, acceptEncoding := range []string{"", "identity", "gzip;q=0, br"} {
+		resp = get("/", acceptEncoding)
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"), acceptEncoding)
+	}
+}
+
+func TestListen(t *testing.T) {
+	// Socket paths can't be very long, and t.TempDir's can be
+	dir, err := os.MkdirTemp("", "entropych")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "test.sock")
+
+	listener, err := listen("unix:" + socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "unix", listener.Addr().Network())
+	info, err := os.Stat(socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.ModeSocket, info.Mode().Type())
+	assert.Equal(t, fs.FileMode(0660), info.Mode().Perm())
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello over a socket")
+	})}
+	go server.Serve(listener)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://entropych/")
+	assert.Nil(t, err)
+	checkBodyContains(t, resp, "hello over a socket")
+
+	// It's in use, so a second server can't take it over
+	_, err = listen("unix:" + socketPath)
+	assert.NotNil(t, err)
+
+	// Shutting down removes the socket
+	assert.Nil(t, server.Shutdown(t.Context()))
+	_, err = os.Stat(socketPath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// A socket that was left behind gets replaced
+	stale, err := net.Listen("unix", socketPath)
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = listen("unix:" + socketPath)
+	assert.Nil(t, err)
+	listener.Close()
+
+	// But other files don't
+	notASocket := filepath.Join(dir, "file")
+	assert.Nil(t, os.WriteFile(notASocket, nil, 0600))
+	_, err = listen("unix:" + notASocket)
+	assert.NotNil(t, err)
+
+	listener, err = listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp", listener.Addr().Network())
+	listener.Close()
+
+	assert.Nil(t, validateListenAddr("[::1]:7777"))
+	assert.Nil(t, validateListenAddr(":7777"))
+	assert.NotNil(t, validateListenAddr("unix:relative.sock"))
+	assert.NotNil(t, validateListenAddr("unix:"))
+	assert.NotNil(t, validateListenAddr("nonsense"))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Serves /robots.txt. In dev mode we ask crawlers to stay out entirely (in case a dev
+// server ends up reachable from the internet); in production we let them in and point
+// them at the sitemap.
+//
+// The Sitemap line has to be an absolute URL, which is why this needs the baseURL.
+func RobotsHandler(devMode bool, baseURL string) http.HandlerFunc {
+	var body string
+	if devMode {
+		body = "User-agent: *\nDisallow: /\n"
+	} else {
+		body = fmt.Sprintf("User-agent: *\nAllow: /\n\nSitemap: %s/sitemap.xml\n", baseURL)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		fmt.Fprint(w, body)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set when building, like
+//
+//	go build -ldflags "-X main.version=$(git describe --always) -X main.commit=$(git rev-parse HEAD)" ./cmd/server
+//
+// (see ops/build.sh). When they aren't set, we use what the Go toolchain stamped into the
+// binary instead, if anything.
+var (
+	version string
+	commit  string
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+func getBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}
+	if stamped, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && stamped.Main.Version != "(devel)" {
+			info.Version = stamped.Main.Version
+		}
+		for _, setting := range stamped.Settings {
+			if info.Commit == "" && setting.Key == "vcs.revision" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
+
+// Serves /version, so that we can check what's deployed
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, getBuildInfo())
+}
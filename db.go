@@ -14,9 +14,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	mathrand "math/rand/v2"
 	"mime"
 	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"crawshaw.io/sqlite"
@@ -38,13 +42,137 @@ var schemaSQL string
 type DB struct {
 	roPool *sqlitex.Pool
 	rwPool *sqlitex.Pool
+	// How long Get and GetReadOnly wait for a free connection before giving up and
+	// returning nil. There's only one read-write connection, so without this a burst of
+	// writes can leave requests waiting forever. Zero means wait as long as the context
+	// allows.
+	AcquireTimeout time.Duration
+}
+
+// A change to an existing database (see migrations)
+type migration func(conn *sqlite.Conn) error
+
+func migrationScript(script string) migration {
+	return func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, script)
+	}
+}
+
+// Add a column that was added to the table in schema.sql. SQLite doesn't have `add column
+// if not exists`, so this checks whether it's there first, which means it's safe to run
+// on a database that already has it.
+func addColumn(table string, column string, definition string) migration {
+	return func(conn *sqlite.Conn) error {
+		exists := false
+		query := "select 1 from pragma_table_info(?) where name = ?"
+		collect := func(stmt *sqlite.Stmt) error {
+			exists = true
+			return nil
+		}
+		if err := sqlitex.Exec(conn, query, collect, table, column); err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		query = fmt.Sprintf("alter table %s add column %s %s", table, column, definition)
+		return sqlitex.ExecTransient(conn, query, nil)
+	}
+}
+
+// Changes to existing databases that `create table if not exists` can't make, in
+// order. A database's user_version is the number of these it has had run on it. Brand new
+// databases start out with the latest schema, so they skip all of them.
+var migrations = []migration{
+	// 1: post.created_at went from seconds to milliseconds
+	migrationScript("update post set created_at = created_at * 1000;"),
+	// 2: post_user_id_created_at_idx does everything post_user_id_idx did
+	migrationScript("drop index if exists post_user_id_idx;"),
+	// 3: a user can react to a post with more than one emoji, so the emoji is part of the
+	// reaction's primary key. SQLite can't change a table's primary key in place.
+	migrationScript(`
+	create table reaction_with_emoji_key (
+		post_id integer not null,
+		user_id integer not null,
+		reacted_at integer not null,
+		emoji text not null,
+		primary key (post_id, user_id, emoji)
+	);
+	insert into reaction_with_emoji_key (post_id, user_id, reacted_at, emoji)
+	select post_id, user_id, reacted_at, emoji from reaction;
+	drop table reaction;
+	alter table reaction_with_emoji_key rename to reaction;`),
+	// 4: index the posts from before there was search
+	migrationScript("insert into post_fts (post_fts) values ('rebuild');"),
+	// 5: the schema creates this index too, but migration 3 drops it along with the old
+	// reaction table
+	migrationScript("create index if not exists reaction_user_id_reacted_at_idx on reaction (user_id, reacted_at);"),
+	// 6-7: optional email addresses (see email.go)
+	addColumn("user", "email", "text"),
+	addColumn("user", "email_verified_at", "integer"),
+	// 8: pinned posts
+	addColumn("user", "pinned_post_id", "integer references post(post_id)"),
+	// 9: the chronological feed (see FeedMode)
+	addColumn("user", "feed_mode", "text"),
+	// 10: where the new posts since your last visit end (see RecordHomepageVisit)
+	addColumn("user", "homepage_visited_at", "integer"),
+}
+
+func getUserVersion(conn *sqlite.Conn) (int, error) {
+	version := 0
+	collect := func(stmt *sqlite.Stmt) error {
+		version = stmt.ColumnInt(0)
+		return nil
+	}
+	err := sqlitex.Exec(conn, "pragma user_version", collect)
+	return version, err
+}
+
+func setUserVersion(conn *sqlite.Conn, version int) error {
+	// Pragmas can't have bound parameters
+	return sqlitex.ExecTransient(conn, fmt.Sprintf("pragma user_version = %d", version), nil)
+}
+
+func runMigrations(conn *sqlite.Conn) (err error) {
+	defer sqlitex.Save(conn)(&err)
+	version, err := getUserVersion(conn)
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		if err = migrations[version](conn); err != nil {
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+	}
+	return setUserVersion(conn, version)
 }
 
 func setUpDb(conn *sqlite.Conn) error {
-	return sqlitex.ExecScript(conn, schemaSQL)
+	// It's a brand new database if the schema hasn't been set up yet
+	isNew := true
+	collect := func(stmt *sqlite.Stmt) error {
+		isNew = false
+		return nil
+	}
+	if err := sqlitex.Exec(conn, "select 1 from sqlite_master where type = 'table' and name = 'post'", collect); err != nil {
+		return err
+	}
+	if err := sqlitex.ExecScript(conn, schemaSQL); err != nil {
+		return err
+	}
+	if isNew {
+		return setUserVersion(conn, len(migrations))
+	}
+	return runMigrations(conn)
 }
 
-// Like sqlitex.Exec but you pass a function that binds the parameters of the function, instead of
+// Like sqlitex.Exec but you pass a function that binds the parameters of the statement, instead of
+// passing them positionally.
+//
+// Like sqlitex.Exec, this uses conn.Prepare, which keeps the prepared statement around on the
+// connection (keyed by the query text) and reuses it next time. So every query is only prepared once
+// per connection, as long as the query text doesn't change between calls: bind parameters, rather
+// than formatting values into the query.
 func exec(conn *sqlite.Conn, query string, resultFn func(stmt *sqlite.Stmt) error, bindFn func(stmt *sqlite.Stmt) error) error {
 	stmt, err := conn.Prepare(query)
 	if err != nil {
@@ -117,8 +245,25 @@ func NewDB(uri string, poolSize int) (*DB, error) {
 	return &DB{roPool: roPool, rwPool: rwPool}, nil
 }
 
+// Get a connection from the pool, waiting at most timeout for one to be free
+func getConn(pool *sqlitex.Pool, ctx context.Context, timeout time.Duration) *sqlite.Conn {
+	if timeout <= 0 {
+		return pool.Get(ctx)
+	}
+	acquireCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn := pool.Get(acquireCtx)
+	if conn != nil {
+		// Pool.Get makes the context it's given interrupt queries on the connection, but
+		// the timeout is only for getting the connection, not for using it
+		conn.SetInterrupt(ctx.Done())
+	}
+	return conn
+}
+
+// Returns nil if no connection is free before ctx is done or db.AcquireTimeout passes
 func (db *DB) Get(ctx context.Context) *sqlite.Conn {
-	return db.rwPool.Get(ctx)
+	return getConn(db.rwPool, ctx, db.AcquireTimeout)
 }
 
 func (db *DB) Put(conn *sqlite.Conn) {
@@ -126,7 +271,7 @@ func (db *DB) Put(conn *sqlite.Conn) {
 }
 
 func (db *DB) GetReadOnly(ctx context.Context) *sqlite.Conn {
-	return db.roPool.Get(ctx)
+	return getConn(db.roPool, ctx, db.AcquireTimeout)
 }
 
 func (db *DB) PutReadOnly(conn *sqlite.Conn) {
@@ -153,14 +298,22 @@ func (u *User) Exists() bool {
 }
 
 func (u *User) URL() string {
-	return userURL(u.Name)
+	return UserURL(u.Name)
+}
+
+// Like Post.AbsoluteURL, but for the user's profile
+func (u *User) AbsoluteURL(baseURL string) string {
+	return strings.TrimSuffix(baseURL, "/") + u.URL()
 }
 
 func (u *User) AvatarURL() string {
 	return getUploadURL(u.AvatarUploadID)
 }
 
-func userURL(userName string) string {
+// The path of a user's profile. This (or User.URL, or Post.UserURL) is the only place that
+// these paths should be built: the name is path-escaped, since names can have slashes and
+// percent signs in them, and the /u/{username}/ route unescapes it again.
+func UserURL(userName string) string {
 	return fmt.Sprintf("/u/%s/", url.PathEscape(userName))
 }
 
@@ -171,50 +324,161 @@ type PostReactionCount struct {
 }
 
 type Post struct {
-	PostID                 int64
-	UserID                 int64
-	UserName               string
-	UserDisplayName        string
-	UserAvatarUploadID     int64 // TODO: get the upload filename instead
-	CreatedAt              time.Time
-	Content                string
-	Reactions              []PostReactionCount
-	ReplyCount             int // the number of replies this post got
-	ReplyingToPostID       int64
-	ReplyingToPostUserName string
-	DistanceFromUser       int // whether the logged in user follows the author of this post
+	PostID                        int64
+	UserID                        int64
+	UserName                      string
+	UserDisplayName               string
+	UserAvatarUploadID            int64 // TODO: get the upload filename instead
+	CreatedAt                     time.Time
+	Content                       string
+	RenderedContent               template.HTML       // Content with its formatting, once it's been through DecoratePosts (see ContentHTML)
+	Reactions                     []PostReactionCount // the most popular emojis first
+	TotalReactions                int                 // the sum of Reactions' counts
+	ReplyCount                    int                 // the number of replies this post got
+	ViewCount                     int                 // how many times people viewed the post's page (see RecordPostView)
+	ReplyingToPostID              int64
+	ReplyingToPostUserName        string
+	ReplyingToPostUserDisplayName string
+	DistanceFromUser              int  // how far the author is from the logged in user in the follower graph (0 for their own posts)
+	PeekLevel                     int  // how many levels of distortion the user's peek took off (see GrantPeek)
+	RecentlyFollowed              bool // whether the logged in user followed the author recently
+	Pinned                        bool // whether the author pinned this post to their profile (only set on profiles)
+	LastVisitDivider              bool // whether the "new posts" divider goes above this post (only set on the homepage; see MarkLastHomepageVisit)
+}
+
+// The post's content, with its formatting. Decorated posts were rendered (and distorted)
+// already; anything else is rendered as it is.
+func (p *Post) ContentHTML() template.HTML {
+	if p.RenderedContent != "" {
+		return p.RenderedContent
+	}
+	return RenderPostContent(p.Content, nil)
 }
 
 func (p *Post) UserURL() string {
-	return userURL(p.UserName)
+	return UserURL(p.UserName)
+}
+
+// What to call the author: their display name, or their handle if they don't have one
+func (p *Post) AuthorLabel() string {
+	return authorLabel(p.UserName, p.UserDisplayName)
+}
+
+// Like AuthorLabel, but for the author of the post this is replying to
+func (p *Post) ReplyingToPostAuthorLabel() string {
+	return authorLabel(p.ReplyingToPostUserName, p.ReplyingToPostUserDisplayName)
+}
+
+func authorLabel(userName string, displayName string) string {
+	if displayName := strings.TrimSpace(displayName); displayName != "" {
+		return displayName
+	}
+	return userName
+}
+
+// The path of a post's page. The post's actions (like react/) are under it.
+func PostURL(postID int64) string {
+	return fmt.Sprintf("/p/%d/", postID)
 }
 
 func (p *Post) PostURL() string {
-	return fmt.Sprintf("/p/%d/", p.PostID)
+	return PostURL(p.PostID)
 }
 
+// The page of the post this is replying to, or "" if it isn't a reply
+func (p *Post) ReplyingToPostURL() string {
+	if p.ReplyingToPostID == 0 {
+		return ""
+	}
+	return PostURL(p.ReplyingToPostID)
+}
+
+// The post's URL with the scheme and host in front, for links that get copied off the site
+// (sharing, the sitemap, and so on). baseURL is like "https://entropych.maxhully.net".
+func (p *Post) AbsoluteURL(baseURL string) string {
+	return strings.TrimSuffix(baseURL, "/") + p.PostURL()
+}
+
+// Where the avatar for users without one is served from (see cmd/server)
+const DefaultAvatarURL = "/avatar/default.png"
+
 func getUploadURL(uploadID int64) string {
 	if uploadID == 0 {
-		return "/static/Prospero_and_miranda.jpg"
+		return DefaultAvatarURL
 	}
 	return fmt.Sprintf("/uploads/%d.png", uploadID)
 }
 
+// The author's avatar, blurred by how far they are from the logged in user (see
+// AvatarBlurLevel). The default avatar isn't blurred, since there's nothing to recognize
+// in it anyway.
 func (p *Post) UserAvatarURL() string {
-	return getUploadURL(p.UserAvatarUploadID)
+	avatarURL := getUploadURL(p.UserAvatarUploadID)
+	if blur := p.AvatarBlurLevel(); blur > 0 && p.UserAvatarUploadID != 0 {
+		avatarURL += fmt.Sprintf("?blur=%d", blur)
+	}
+	return avatarURL
 }
 
-func (p *Post) LoggedInUserIsFollowing() bool {
+// How blurred the author's avatar should be, from 0 (for yourself and the people you
+// follow) up to MaxAvatarBlur. Like the content, peeking makes it clearer.
+func (p *Post) AvatarBlurLevel() int {
+	return min(max(p.DistanceFromUser-p.PeekLevel-1, 0), MaxAvatarBlur)
+}
+
+// Whether the logged in user follows the author
+func (p *Post) IsFollowing() bool {
 	return p.DistanceFromUser == 1
 }
 
+// Whether the logged in user follows someone who follows the author
+func (p *Post) IsFriendOfFriend() bool {
+	return p.DistanceFromUser == 2
+}
+
+// A short description of how far the author is from the logged in user in the follower
+// graph, so that the UI can say why the post is as distorted as it is.
+func (p *Post) DistanceLabel() string {
+	switch d := p.DistanceFromUser; {
+	case d <= 0:
+		return "you"
+	case d == 1:
+		return "following"
+	case d >= MaxDistortionLevel:
+		return "out of network"
+	default:
+		return fmt.Sprintf("%d%s degree", d, ordinalSuffix(d))
+	}
+}
+
+// The "nd" in "2nd" (for the small numbers we need, anyway)
+func ordinalSuffix(n int) string {
+	switch n {
+	case 1:
+		return "st"
+	case 2:
+		return "nd"
+	case 3:
+		return "rd"
+	default:
+		return "th"
+	}
+}
+
+// Whether peeking at the post would make it any less distorted
+func (p *Post) CanPeek() bool {
+	return p.DistanceFromUser-p.PeekLevel > 1
+}
+
 type UserSession struct {
 	UserID          int64
 	SessionPublicID []byte
 	ExpirationTime  time.Time
 }
 
-const defaultSessionDuration time.Duration = time.Hour * 48
+// How long sessions last unless the server is configured otherwise (see
+// CreateUserSessionWithDuration)
+const DefaultSessionDuration time.Duration = time.Hour * 48
 
 func utcNow() time.Time {
 	return time.Now().UTC()
@@ -222,32 +486,83 @@ func utcNow() time.Time {
 
 // Return a map mapping each of the otherUserIDs to their distance from userID (capped
 // at MaxDistortionLevel).
+//
+// If userID is in otherUserIDs, it doesn't get an entry. A user's distance from
+// themselves would be 0, but it's not a distance in the follower graph (you can't follow
+// yourself), so callers handle the user's own posts themselves, like distortPostsForUser
+// does.
 func GetDistanceFromUser(conn *sqlite.Conn, userID int64, otherUserIDs []int64) (map[int64]int, error) {
+	// Sorted, without duplicates (and without changing the caller's slice)
+	otherUserIDs = slices.Clone(otherUserIDs)
+	slices.Sort(otherUserIDs)
+	otherUserIDs = slices.Compact(otherUserIDs)
+
+	result := make(map[int64]int)
+	for chunk := range slices.Chunk(otherUserIDs, distanceLookupChunkSize) {
+		if err := getDistanceFromUserChunk(conn, userID, chunk, result); err != nil {
+			return nil, err
+		}
+	}
+	for _, otherUserID := range otherUserIDs {
+		_, ok := result[otherUserID]
+		if !ok && otherUserID != userID {
+			result[otherUserID] = MaxDistortionLevel
+		}
+	}
+	return result, nil
+}
+
+// How many user IDs GetDistanceFromUser looks up per query. They're passed in as a JSON
+// array, and SQLite has a limit on how long a string parameter can be, so the lookups for
+// really long timelines are split up.
+const distanceLookupChunkSize = 1000
+
+// The most users that the distance query goes through at each hop. A hop joins everyone
+// reached by the previous one against user_follow, so without a cap, following a few
+// heavily-followed people would pull in a big chunk of the graph two hops later.
+//
+// Past the cap, it's arbitrary which users the next hop goes through. So once a hop is
+// capped, the distances after it are only upper bounds: someone who's really 2 hops away
+// might only be reachable through the users that got left out, and then they come back
+// as 3, 4 or MaxDistortionLevel. The distances precomputed by RecomputeUserDistances
+// (which lookUpDistancesFromUser prefers) aren't capped.
+const distanceFrontierLimit = 2000
+
+// Adds the distances from userID to otherUserIDs to result, for the ones that are within
+// 4 hops. otherUserIDs can't have any duplicates.
+func getDistanceFromUserChunk(conn *sqlite.Conn, userID int64, otherUserIDs []int64, result map[int64]int) error {
 	// This could **almost** be a recursive CTE, but since our graph has cycles we need
 	// to exclude everything from the previous iteration with a `not in ( ... )` clause
 	// over the current set of rows (and that's not allowed).
 	//
 	// I still feel like there must be a better way to do this.
 	//
-	// Could also add some limit clauses if heavily-followed users become an issue
+	// Each hop only goes through the first distanceFrontierLimit users of the one before
+	// it (see above). The cross joins tell SQLite to start from those users and look up
+	// who they follow, rather than scanning all of user_follow. Nobody goes through
+	// follows4, so it only needs the users we're looking for.
 	query := `
 		with follows as (
 			select followed_user_id as user_id, 1 as distance
 			from user_follow
 			where user_id = :userID
 		),
+		other_users as (
+			/* dumb hack to pass an array through. */
+			select value as user_id from json_each(:otherUserIDsJSON)
+		),
 		follows2 as (
 			select distinct user_follow.followed_user_id as user_id, 2 as distance
-			from follows
-			join user_follow using (user_id)
+			from (select user_id from follows limit :frontierLimit) as frontier
+			cross join user_follow on user_follow.user_id = frontier.user_id
 			where
 				user_follow.followed_user_id not in (select user_id from follows)
 				and user_follow.followed_user_id != :userID
 		),
 		follows3 as (
 			select distinct user_follow.followed_user_id as user_id, 3 as distance
-			from follows2
-			join user_follow using (user_id)
+			from (select user_id from follows2 limit :frontierLimit) as frontier
+			cross join user_follow on user_follow.user_id = frontier.user_id
 			where
 				user_follow.followed_user_id not in (select user_id from follows)
 				and user_follow.followed_user_id not in (select user_id from follows2)
@@ -255,17 +570,14 @@ func GetDistanceFromUser(conn *sqlite.Conn, userID int64, otherUserIDs []int64)
 		),
 		follows4 as (
 			select distinct user_follow.followed_user_id as user_id, 4 as distance
-			from follows3
-			join user_follow using (user_id)
+			from (select user_id from follows3 limit :frontierLimit) as frontier
+			cross join user_follow on user_follow.user_id = frontier.user_id
 			where
-				user_follow.followed_user_id not in (select user_id from follows)
+				user_follow.followed_user_id in (select user_id from other_users)
+				and user_follow.followed_user_id not in (select user_id from follows)
 				and user_follow.followed_user_id not in (select user_id from follows2)
 				and user_follow.followed_user_id not in (select user_id from follows3)
 				and user_follow.followed_user_id != :userID
-		),
-		other_users as (
-			/* dumb hack to pass an array through. */
-			select value as user_id from json_each(:otherUserIDsJSON)
 		)
 		select * from follows
 		where user_id in (select user_id from other_users)
@@ -277,13 +589,11 @@ func GetDistanceFromUser(conn *sqlite.Conn, userID int64, otherUserIDs []int64)
 		where user_id in (select user_id from other_users)
 		union all
 		select * from follows4
-		where user_id in (select user_id from other_users)
 	`
 	otherUserIDsJSON, err := json.Marshal(otherUserIDs)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	result := make(map[int64]int)
 	collect := func(stmt *sqlite.Stmt) error {
 		u := stmt.ColumnInt64(0)
 		if _, in := result[u]; in {
@@ -292,21 +602,12 @@ func GetDistanceFromUser(conn *sqlite.Conn, userID int64, otherUserIDs []int64)
 		result[u] = stmt.ColumnInt(1)
 		return nil
 	}
-	err = exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+	return exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
 		stmt.SetInt64(":userID", userID)
 		stmt.SetText(":otherUserIDsJSON", string(otherUserIDsJSON))
+		stmt.SetInt64(":frontierLimit", distanceFrontierLimit)
 		return nil
 	})
-	if err != nil {
-		return nil, err
-	}
-	for _, otherUserID := range otherUserIDs {
-		_, ok := result[otherUserID]
-		if !ok {
-			result[otherUserID] = MaxDistortionLevel
-		}
-	}
-	return result, err
 }
 
 func collectPosts(posts *[]Post) func(stmt *sqlite.Stmt) error {
@@ -316,7 +617,7 @@ func collectPosts(posts *[]Post) func(stmt *sqlite.Stmt) error {
 			UserID:             stmt.ColumnInt64(1),
 			UserName:           stmt.ColumnText(2),
 			UserDisplayName:    stmt.ColumnText(3),
-			CreatedAt:          time.Unix(stmt.ColumnInt64(4), 0).UTC(),
+			CreatedAt:          time.UnixMilli(stmt.ColumnInt64(4)).UTC(),
 			Content:            stmt.ColumnText(5),
 			UserAvatarUploadID: stmt.ColumnInt64(6),
 		}
@@ -326,9 +627,20 @@ func collectPosts(posts *[]Post) func(stmt *sqlite.Stmt) error {
 	}
 }
 
-// TODO: I feel like the `< :before` clauses should be <=. But we want to skip the last
-// ID from the previous page. This is drifting into "opaque pagination keys" territory.
-func GetRecentPosts(conn *sqlite.Conn, before time.Time, limit int) ([]Post, error) {
+// A position in a list of posts, which are ordered by (created_at, post_id). Paging by
+// the timestamp alone would skip (or repeat) posts created in the same second as the last
+// post on the page, so the post ID breaks ties.
+type PostCursor struct {
+	CreatedAt time.Time
+	PostID    int64
+}
+
+// The cursor for the page of posts after this one
+func (p *Post) Cursor() PostCursor {
+	return PostCursor{CreatedAt: p.CreatedAt, PostID: p.PostID}
+}
+
+func GetRecentPosts(conn *sqlite.Conn, before PostCursor, limit int) ([]Post, error) {
 	posts := make([]Post, 0, limit)
 	query := `
 		select
@@ -341,14 +653,14 @@ func GetRecentPosts(conn *sqlite.Conn, before time.Time, limit int) ([]Post, err
 			user.avatar_upload_id
 		from post
 		join user using (user_id)
-		where post.created_at < ?
-		order by created_at desc
+		where (post.created_at, post.post_id) < (?, ?)
+		order by post.created_at desc, post.post_id desc
 		limit ?`
-	err := sqlitex.Exec(conn, query, collectPosts(&posts), before.UTC().Unix(), limit)
+	err := sqlitex.Exec(conn, query, collectPosts(&posts), before.CreatedAt.UnixMilli(), before.PostID, limit)
 	return posts, err
 }
 
-func GetRecentPostsFromFollowedUsers(conn *sqlite.Conn, userID int64, before time.Time, limit int) ([]Post, error) {
+func GetRecentPostsFromFollowedUsers(conn *sqlite.Conn, userID int64, before PostCursor, limit int) ([]Post, error) {
 	posts := make([]Post, 0, limit)
 	query := `
 		with followed_users as (
@@ -369,13 +681,14 @@ func GetRecentPostsFromFollowedUsers(conn *sqlite.Conn, userID int64, before tim
 		where (
 			user.user_id in (select followed_user_id from followed_users)
 			or user.user_id = :userID
-		) and post.created_at < :before
-		order by created_at desc
+		) and (post.created_at, post.post_id) < (:before, :beforeID)
+		order by post.created_at desc, post.post_id desc
 		limit :limit
 		`
 	err := exec(conn, query, collectPosts(&posts), func(stmt *sqlite.Stmt) error {
 		stmt.SetInt64(":userID", userID)
-		stmt.SetInt64(":before", before.UTC().Unix())
+		stmt.SetInt64(":before", before.CreatedAt.UnixMilli())
+		stmt.SetInt64(":beforeID", before.PostID)
 		stmt.SetInt64(":limit", int64(limit))
 		return nil
 	})
@@ -383,7 +696,7 @@ func GetRecentPostsFromFollowedUsers(conn *sqlite.Conn, userID int64, before tim
 }
 
 // Get recent posts from users that userID does not follow
-func GetRecentPostsFromRandos(conn *sqlite.Conn, userID int64, before time.Time, limit int) ([]Post, error) {
+func GetRecentPostsFromRandos(conn *sqlite.Conn, userID int64, before PostCursor, limit int) ([]Post, error) {
 	posts := make([]Post, 0, limit)
 	query := `
 		with followed_users as (
@@ -401,26 +714,29 @@ func GetRecentPostsFromRandos(conn *sqlite.Conn, userID int64, before time.Time,
 			user.avatar_upload_id
 		from post
 		join user using (user_id)
-		where post.created_at < :before
+		where (post.created_at, post.post_id) < (:before, :beforeID)
 			and user.user_id not in (select followed_user_id from followed_users)
 			and user.user_id != :userID
-		order by created_at desc
+		order by post.created_at desc, post.post_id desc
 		limit :limit`
 	err := exec(conn, query, collectPosts(&posts), func(stmt *sqlite.Stmt) error {
 		stmt.SetInt64(":userID",
 			userID)
-		stmt.SetInt64(":before", before.UTC().Unix())
+		stmt.SetInt64(":before", before.CreatedAt.UnixMilli())
+		stmt.SetInt64(":beforeID", before.PostID)
 		stmt.SetInt64(":limit", int64(limit))
 		return nil
 	})
 	return posts, err
 }
 
-func GetRecentPostsFromUser(conn *sqlite.Conn, userID int64, before time.Time, limit int) ([]Post, error) {
+// Get the user's posts, newest first. Replies to other posts are left out unless
+// includeReplies is true, e.g. for a "Posts & replies" view of their profile.
+func GetRecentPostsFromUser(conn *sqlite.Conn, userID int64, before PostCursor, limit int, includeReplies bool) ([]Post, error) {
 	var posts []Post
 	query := `
 		select
-			post_id,
+			post.post_id,
 			user.user_id,
 			user.user_name,
 			user.display_name,
@@ -429,11 +745,20 @@ func GetRecentPostsFromUser(conn *sqlite.Conn, userID int64, before time.Time, l
 			user.avatar_upload_id
 		from post
 		join user using (user_id)
-		where user_id = ?
-			and created_at < ?
-		order by created_at desc
-		limit ?`
-	err := sqlitex.Exec(conn, query, collectPosts(&posts), userID, before.UTC().Unix(), limit)
+		left join post_reply on post_reply.reply_post_id = post.post_id
+		where user.user_id = :userID
+			and (post.created_at, post.post_id) < (:before, :beforeID)
+			and (:includeReplies or post_reply.reply_post_id is null)
+		order by post.created_at desc, post.post_id desc
+		limit :limit`
+	err := exec(conn, query, collectPosts(&posts), func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetInt64(":before", before.CreatedAt.UnixMilli())
+		stmt.SetInt64(":beforeID", before.PostID)
+		stmt.SetInt64(":limit", int64(limit))
+		stmt.SetBool(":includeReplies", includeReplies)
+		return nil
+	})
 	return posts, err
 }
 
@@ -457,10 +782,14 @@ func GetPost(conn *sqlite.Conn, postID int64) (*Post, error) {
 	if len(posts) == 0 {
 		return nil, nil
 	}
+	// So that callers can get the parent post (if there is one) without decorating first
+	if err := getParentsForPosts(conn, posts); err != nil {
+		return nil, err
+	}
 	return &posts[0], nil
 }
 
-func GetPostReplies(conn *sqlite.Conn, postID int64, after time.Time, limit int) ([]Post, error) {
+func GetPostReplies(conn *sqlite.Conn, postID int64, after PostCursor, limit int) ([]Post, error) {
 	var posts []Post
 	query := `
 		select
@@ -475,10 +804,35 @@ func GetPostReplies(conn *sqlite.Conn, postID int64, after time.Time, limit int)
 		join post on post_reply.reply_post_id = post.post_id
 		join user using (user_id)
 		where post_reply.post_id = ?
-			and post.created_at > ?
-		order by post.created_at asc
+			and (post.created_at, post.post_id) > (?, ?)
+		order by post.created_at asc, post.post_id asc
 		limit ?`
-	err := sqlitex.Exec(conn, query, collectPosts(&posts), postID, after.UTC().Unix(), limit)
+	err := sqlitex.Exec(conn, query, collectPosts(&posts), postID, after.CreatedAt.UnixMilli(), after.PostID, limit)
+	return posts, err
+}
+
+// Like GetPostReplies, but newest-first: gets the replies created before `before`, so
+// that you page backwards in time (for busy posts, where the latest replies are the
+// interesting ones).
+func GetPostRepliesDesc(conn *sqlite.Conn, postID int64, before PostCursor, limit int) ([]Post, error) {
+	var posts []Post
+	query := `
+		select
+			post.post_id,
+			user.user_id,
+			user.user_name,
+			user.display_name,
+			post.created_at,
+			post.content,
+			user.avatar_upload_id
+		from post_reply
+		join post on post_reply.reply_post_id = post.post_id
+		join user using (user_id)
+		where post_reply.post_id = ?
+			and (post.created_at, post.post_id) < (?, ?)
+		order by post.created_at desc, post.post_id desc
+		limit ?`
+	err := sqlitex.Exec(conn, query, collectPosts(&posts), postID, before.CreatedAt.UnixMilli(), before.PostID, limit)
 	return posts, err
 }
 
@@ -505,21 +859,95 @@ func GetUserByName(conn *sqlite.Conn, name string) (*User, error) {
 
 const MaxPostLength = 256
 
-func CreatePost(conn *sqlite.Conn, userID int64, content string) (int64, error) {
-	// Being kinda lame and just truncating when the content is too long. We have a
-	// maxlength on the client side to enforce it there.
+// Being kinda lame and just truncating when the content is too long. We have a
+// maxlength on the client side to enforce it there.
+func truncatePostContent(content string) string {
 	if len(content) > MaxPostLength {
-		content = content[:MaxPostLength]
+		return content[:MaxPostLength]
 	}
-	query := "insert into post (user_id, created_at, content) values (?, ?, ?)"
-	err := sqlitex.Exec(conn, query, nil, userID, utcNow().Unix(), content)
+	return content
+}
+
+const insertPostQuery = "insert into post (user_id, created_at, content) values (?, ?, ?)"
+
+func CreatePost(conn *sqlite.Conn, userID int64, content string) (int64, error) {
+	return CreatePostWithTime(conn, userID, content, utcNow())
+}
+
+// Like CreatePost, but the post says it was posted at createdAt instead of now. This is
+// for importing posts (see cmd/bots), so that they keep their order.
+func CreatePostWithTime(conn *sqlite.Conn, userID int64, content string, createdAt time.Time) (postID int64, err error) {
+	defer sqlitex.Save(conn)(&err)
+	content = truncatePostContent(content)
+	err = sqlitex.Exec(conn, insertPostQuery, nil, userID, createdAt.UnixMilli(), content)
 	if err != nil {
 		return 0, err
 	}
-	postID := conn.LastInsertRowID()
+	postID = conn.LastInsertRowID()
+	if err = recordPostMentions(conn, postID, userID, content); err != nil {
+		return 0, err
+	}
+	if err = recordPostHashtags(conn, postID, content); err != nil {
+		return 0, err
+	}
+	if err = queueWebhookDeliveries(conn, postID, userID); err != nil {
+		return 0, err
+	}
 	return postID, err
 }
 
+// A post for CreatePostsBulk to create
+type NewPost struct {
+	UserID    int64
+	Content   string
+	CreatedAt time.Time // when the post says it was posted; now, if it's zero
+}
+
+// Create all of the posts in one savepoint, reusing one prepared statement, and return
+// their IDs (in the same order). This is for loading lots of posts at once (like
+// cmd/bots does), where committing each post separately is most of the work. Either all
+// of the posts are created or none of them are.
+func CreatePostsBulk(conn *sqlite.Conn, posts []NewPost) (postIDs []int64, err error) {
+	defer sqlitex.Save(conn)(&err)
+	stmt, err := conn.Prepare(insertPostQuery)
+	if err != nil {
+		return nil, err
+	}
+	now := utcNow()
+	postIDs = make([]int64, 0, len(posts))
+	for _, post := range posts {
+		createdAt := post.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = now
+		}
+		content := truncatePostContent(post.Content)
+		stmt.BindInt64(1, post.UserID)
+		stmt.BindInt64(2, createdAt.UnixMilli())
+		stmt.BindText(3, content)
+		_, err = stmt.Step()
+		// Reset even if the step failed, so that the cached statement can be used again
+		if resetErr := stmt.Reset(); err == nil {
+			err = resetErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		postID := conn.LastInsertRowID()
+		if err = recordPostMentions(conn, postID, post.UserID, content); err != nil {
+			return nil, err
+		}
+		if err = recordPostHashtags(conn, postID, content); err != nil {
+			return nil, err
+		}
+		if err = queueWebhookDeliveries(conn, postID, post.UserID); err != nil {
+			return nil, err
+		}
+		postIDs = append(postIDs, postID)
+	}
+	return postIDs, nil
+}
+
+// Reply to the post. You can reply to your own posts (see ReactToPostIfExists).
 func ReplyToPost(conn *sqlite.Conn, postID int64, userID int64, content string) (int64, error) {
 	var err error
 	defer sqlitex.Save(conn)(&err)
@@ -534,7 +962,26 @@ func ReplyToPost(conn *sqlite.Conn, postID int64, userID int64, content string)
 	return postReplyID, err
 }
 
+// The emojis people can react with, in the order the reaction picker shows them. The
+// first one is what you react with if you don't pick one.
+var AllowedReactions = []string{"❤️", "👍", "😂", "🔥", "😮", "😢", "🤔"}
+
+// Returned by ReactToPostIfExists when the emoji isn't one of AllowedReactions
+var ErrReactionNotAllowed = errors.New("that emoji isn't an allowed reaction")
+
+func IsAllowedReaction(emoji string) bool {
+	return slices.Contains(AllowedReactions, emoji)
+}
+
+// React to the post with the emoji, which has to be one of AllowedReactions (or you get
+// ErrReactionNotAllowed). Returns false if there's no such post.
+//
+// Reacting to your own posts is allowed, same as replying to them: it's not like anyone
+// is ranking posts by their reactions.
 func ReactToPostIfExists(conn *sqlite.Conn, userID int64, postID int64, emoji string) (bool, error) {
+	if !IsAllowedReaction(emoji) {
+		return false, fmt.Errorf("%w: %q", ErrReactionNotAllowed, emoji)
+	}
 	query := "select 1 from post where post_id = ?"
 	exists := false
 	collect := func(stmt *sqlite.Stmt) error {
@@ -564,7 +1011,20 @@ func ReactToPostIfExists(conn *sqlite.Conn, userID int64, postID int64, emoji st
 	return exists, err
 }
 
-func UnreactToPostIfExists(conn *sqlite.Conn, userID int64, postID int64) (bool, error) {
+// How long a reaction has to stay before it can be taken back. Reacting twice with the
+// same emoji does nothing, so this is what keeps people from toggling a reaction on and
+// off as fast as they can click.
+const ReactionCooldown = 3 * time.Second
+
+// Returned by UnreactToPostIfExists when the reaction is younger than ReactionCooldown
+var ErrReactionCooldown = errors.New("reacted too recently to unreact")
+
+// Remove the user's reaction to the post with the given emoji. Their reactions with other
+// emojis are left alone. The emoji doesn't have to be one of AllowedReactions, so that
+// reactions from before an emoji was taken off the list can still be removed.
+//
+// Returns ErrReactionCooldown if they reacted less than ReactionCooldown ago.
+func UnreactToPostIfExists(conn *sqlite.Conn, userID int64, postID int64, emoji string) (bool, error) {
 	// Do we even care if it exists?
 	query := "select 1 from post where post_id = ?"
 	exists := false
@@ -578,10 +1038,24 @@ func UnreactToPostIfExists(conn *sqlite.Conn, userID int64, postID int64) (bool,
 	if !exists {
 		return false, nil
 	}
-	query = "delete from reaction where post_id = :postID and user_id = :userID"
+	query = "select 1 from reaction where post_id = ? and user_id = ? and emoji = ? and reacted_at > ?"
+	tooRecent := false
+	collect = func(stmt *sqlite.Stmt) error {
+		tooRecent = true
+		return nil
+	}
+	cutoff := utcNow().Add(-ReactionCooldown).Unix()
+	if err := sqlitex.Exec(conn, query, collect, postID, userID, emoji, cutoff); err != nil {
+		return exists, err
+	}
+	if tooRecent {
+		return exists, ErrReactionCooldown
+	}
+	query = "delete from reaction where post_id = :postID and user_id = :userID and emoji = :emoji"
 	err := exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
 		stmt.SetInt64(":postID", postID)
 		stmt.SetInt64(":userID", userID)
+		stmt.SetText(":emoji", emoji)
 		return nil
 	})
 	if err != nil {
@@ -590,7 +1064,8 @@ func UnreactToPostIfExists(conn *sqlite.Conn, userID int64, postID int64) (bool,
 	return exists, err
 }
 
-// Sets the Reactions field on each post in the given slice.
+// Sets the Reactions and TotalReactions fields on each post in the given slice. Reactions
+// are sorted by count, descending, with ties going to the emoji that was used first.
 func getReactionCountsForPosts(conn *sqlite.Conn, user *User, posts []Post) error {
 	var userID int64
 	if user != nil {
@@ -608,6 +1083,7 @@ func getReactionCountsForPosts(conn *sqlite.Conn, user *User, posts []Post) erro
 		from reaction
 		where post_id in (select value from json_each(:postIDsJSON))
 		group by post_id, emoji
+		order by post_id, count desc, min(reacted_at)
 		`
 	postIDs := make([]int64, len(posts))
 	postsByID := make(map[int64]*Post)
@@ -620,12 +1096,14 @@ func getReactionCountsForPosts(conn *sqlite.Conn, user *User, posts []Post) erro
 		return err
 	}
 	collect := func(stmt *sqlite.Stmt) error {
-		postID := stmt.ColumnInt64(0)
-		postsByID[postID].Reactions = append(postsByID[postID].Reactions, PostReactionCount{
+		post := postsByID[stmt.ColumnInt64(0)]
+		count := stmt.ColumnInt(2)
+		post.Reactions = append(post.Reactions, PostReactionCount{
 			Emoji:       stmt.ColumnText(1),
-			Count:       stmt.ColumnInt(2),
+			Count:       count,
 			UserReacted: stmt.ColumnInt(3) > 0,
 		})
+		post.TotalReactions += count
 		return nil
 	}
 	return exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
@@ -640,7 +1118,8 @@ func getParentsForPosts(conn *sqlite.Conn, posts []Post) error {
 		select
 			post_reply.reply_post_id,
 			post_reply.post_id,
-			user.user_name
+			user.user_name,
+			user.display_name
 		from post_reply
 		join post using (post_id)
 		join user using (user_id)
@@ -659,9 +1138,9 @@ func getParentsForPosts(conn *sqlite.Conn, posts []Post) error {
 	collect := func(stmt *sqlite.Stmt) error {
 		replyPostID := stmt.ColumnInt64(0)
 		originalPostID := stmt.ColumnInt64(1)
-		originalPostUserName := stmt.ColumnText(2)
 		postsByID[replyPostID].ReplyingToPostID = originalPostID
-		postsByID[replyPostID].ReplyingToPostUserName = originalPostUserName
+		postsByID[replyPostID].ReplyingToPostUserName = stmt.ColumnText(2)
+		postsByID[replyPostID].ReplyingToPostUserDisplayName = stmt.ColumnText(3)
 		return nil
 	}
 	return exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
@@ -670,6 +1149,48 @@ func getParentsForPosts(conn *sqlite.Conn, posts []Post) error {
 	})
 }
 
+// How long after following someone their posts count as RecentlyFollowed
+const recentlyFollowedWindow time.Duration = time.Hour * 48
+
+// Set RecentlyFollowed on the posts whose authors the user followed after since
+func getRecentlyFollowedForPosts(conn *sqlite.Conn, user *User, posts []Post, since time.Time) error {
+	if user == nil {
+		return nil
+	}
+	authorIDs := make([]int64, len(posts))
+	for i := range posts {
+		authorIDs[i] = posts[i].UserID
+	}
+	authorIDsJSON, err := json.Marshal(authorIDs)
+	if err != nil {
+		return err
+	}
+	query := `
+		select followed_user_id
+		from user_follow
+		where user_id = :userID
+			and followed_at > :since
+			and followed_user_id in (select value from json_each(:authorIDsJSON))`
+	recentlyFollowed := make(map[int64]bool)
+	collect := func(stmt *sqlite.Stmt) error {
+		recentlyFollowed[stmt.ColumnInt64(0)] = true
+		return nil
+	}
+	err = exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", user.UserID)
+		stmt.SetInt64(":since", since.UTC().Unix())
+		stmt.SetText(":authorIDsJSON", string(authorIDsJSON))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].RecentlyFollowed = recentlyFollowed[posts[i].UserID]
+	}
+	return nil
+}
+
 func getReplyCountsForPosts(conn *sqlite.Conn, posts []Post) error {
 	query := `
 		select
@@ -702,6 +1223,10 @@ func getReplyCountsForPosts(conn *sqlite.Conn, posts []Post) error {
 	})
 }
 
+// Returned by CreateUser when someone else already has the name. Checking first with
+// GetUserByName isn't enough, since two people can sign up with the same name at once.
+var ErrDuplicateUsername = errors.New("a user with this name already exists")
+
 func CreateUser(conn *sqlite.Conn, name string, password string) (*User, error) {
 	hashAndSalt, err := HashAndSaltPassword([]byte(password))
 	if err != nil {
@@ -709,6 +1234,9 @@ func CreateUser(conn *sqlite.Conn, name string, password string) (*User, error)
 	}
 	query := "insert into user (user_name, display_name, password_salt, password_hash) values (?, ?, ?, ?)"
 	err = sqlitex.Exec(conn, query, nil, name, name, hashAndSalt.Salt, hashAndSalt.Hash)
+	if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
+		return nil, ErrDuplicateUsername
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -717,13 +1245,21 @@ func CreateUser(conn *sqlite.Conn, name string, password string) (*User, error)
 	return user, err
 }
 
+// Pass this as the avatarUploadID to UpdateUserProfile to remove the user's avatar (so
+// that they get the default one). Passing 0 keeps their existing avatar.
+const RemoveAvatar int64 = -1
+
 func UpdateUserProfile(conn *sqlite.Conn, name string, displayName string, bio string, avatarUploadID int64) error {
 	query := `
 		update user
 		set
 			display_name = :displayName,
 			bio = :bio,
-			avatar_upload_id = case when :upload_id != 0 then :upload_id else avatar_upload_id end
+			avatar_upload_id = case
+				when :upload_id > 0 then :upload_id
+				when :upload_id = -1 then null
+				else avatar_upload_id
+			end
 		where user_name = :name`
 	return exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
 		stmt.SetText(":displayName", displayName)
@@ -735,12 +1271,18 @@ func UpdateUserProfile(conn *sqlite.Conn, name string, displayName string, bio s
 }
 
 func CreateUserSession(conn *sqlite.Conn, userID int64) (*UserSession, error) {
+	return CreateUserSessionWithDuration(conn, userID, DefaultSessionDuration)
+}
+
+// Like CreateUserSession, but the session expires after duration instead of
+// DefaultSessionDuration
+func CreateUserSessionWithDuration(conn *sqlite.Conn, userID int64, duration time.Duration) (*UserSession, error) {
 	sessionPublicID := make([]byte, 8)
 	if _, err := rand.Read(sessionPublicID); err != nil {
 		return nil, err
 	}
 	now := utcNow()
-	expirationTime := now.Add(defaultSessionDuration)
+	expirationTime := now.Add(duration)
 	query := `
 		insert into user_session (user_id, session_public_id, created_at, expiration_time)
 		values (?, ?, ?, ?)`
@@ -785,20 +1327,134 @@ func ExpireSession(conn *sqlite.Conn, sessionPublicID []byte) error {
 	return sqlitex.Exec(conn, query, nil, utcNow().Unix(), sessionPublicID)
 }
 
-func FollowUser(conn *sqlite.Conn, userID int64, followedUserID int64) error {
+// Delete the sessions that have expired (including the ones people logged out of), since
+// nothing else ever does. Returns how many were deleted.
+func DeleteExpiredSessions(conn *sqlite.Conn) (int, error) {
+	query := "delete from user_session where expiration_time <= ?"
+	if err := sqlitex.Exec(conn, query, nil, utcNow().Unix()); err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
+
+// Returns whether anything changed: following someone you already follow does nothing.
+func FollowUser(conn *sqlite.Conn, userID int64, followedUserID int64) (changed bool, err error) {
 	if userID == followedUserID {
-		return fmt.Errorf("userID %d cannot follow itself", userID)
+		return false, fmt.Errorf("userID %d cannot follow itself", userID)
 	}
+	defer sqlitex.Save(conn)(&err)
 	query := `
 		insert into user_follow (user_id, followed_user_id, followed_at)
 		values (?, ?, ?)
 		on conflict do nothing`
-	return sqlitex.Exec(conn, query, nil, userID, followedUserID, utcNow().Unix())
+	if err = sqlitex.Exec(conn, query, nil, userID, followedUserID, utcNow().Unix()); err != nil {
+		return false, err
+	}
+	if conn.Changes() == 0 {
+		return false, nil
+	}
+	return true, invalidateCachedDistances(conn, userID)
 }
 
-func UnfollowUser(conn *sqlite.Conn, userID int64, followedUserID int64) error {
+// Returns whether anything changed: unfollowing someone you don't follow does nothing.
+func UnfollowUser(conn *sqlite.Conn, userID int64, followedUserID int64) (changed bool, err error) {
+	defer sqlitex.Save(conn)(&err)
 	query := "delete from user_follow where user_id = ? and followed_user_id = ?"
-	return sqlitex.Exec(conn, query, nil, userID, followedUserID)
+	if err = sqlitex.Exec(conn, query, nil, userID, followedUserID); err != nil {
+		return false, err
+	}
+	if conn.Changes() == 0 {
+		return false, nil
+	}
+	return true, invalidateCachedDistances(conn, userID)
+}
+
+// What FollowUsersByName did with the names it was given
+type FollowUsersResult struct {
+	Followed         []string // newly followed
+	AlreadyFollowing []string
+	Skipped          []string // names that aren't anyone's, or are the user's own
+}
+
+// Follow everyone in names at once (like importing a list of people from somewhere else).
+// Names that don't belong to anyone, and the user's own name, are skipped. Repeated names
+// only count once.
+func FollowUsersByName(conn *sqlite.Conn, userID int64, names []string) (result *FollowUsersResult, err error) {
+	defer sqlitex.Save(conn)(&err)
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	type resolvedUser struct {
+		userID    int64
+		following bool
+	}
+	resolved := make(map[string]resolvedUser)
+	query := `
+		select user.user_id, user.user_name, user_follow.user_id is not null
+		from user
+		left join user_follow
+			on user_follow.followed_user_id = user.user_id
+			and user_follow.user_id = :userID
+		where user.user_name in (select value from json_each(:names))`
+	collect := func(stmt *sqlite.Stmt) error {
+		resolved[stmt.ColumnText(1)] = resolvedUser{userID: stmt.ColumnInt64(0), following: stmt.ColumnInt(2) != 0}
+		return nil
+	}
+	err = exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetText(":names", string(namesJSON))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result = &FollowUsersResult{}
+	seen := make(map[string]bool)
+	now := utcNow().Unix()
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		user, ok := resolved[name]
+		switch {
+		case !ok || user.userID == userID:
+			result.Skipped = append(result.Skipped, name)
+		case user.following:
+			result.AlreadyFollowing = append(result.AlreadyFollowing, name)
+		default:
+			query := "insert into user_follow (user_id, followed_user_id, followed_at) values (?, ?, ?)"
+			if err = sqlitex.Exec(conn, query, nil, userID, user.userID, now); err != nil {
+				return nil, err
+			}
+			result.Followed = append(result.Followed, name)
+		}
+	}
+	if len(result.Followed) > 0 {
+		if err = invalidateCachedDistances(conn, userID); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// The names of everyone the user follows, in the order they followed them
+func GetFollowedUserNames(conn *sqlite.Conn, userID int64) ([]string, error) {
+	var names []string
+	query := `
+		select user.user_name
+		from user_follow
+		join user on user.user_id = user_follow.followed_user_id
+		where user_follow.user_id = ?
+		order by user_follow.followed_at, user.user_id`
+	collect := func(stmt *sqlite.Stmt) error {
+		names = append(names, stmt.ColumnText(0))
+		return nil
+	}
+	err := sqlitex.Exec(conn, query, collect, userID)
+	return names, err
 }
 
 type UserFollowStats struct {
@@ -848,11 +1504,23 @@ func GetUserFollowStats(conn *sqlite.Conn, userID int64) (*UserFollowStats, erro
 	return stats, err
 }
 
+// Distort the post's content (and rendered content) as if the author were distance away.
+// If the DistortionConfig says so, their display name is distorted too (but not their
+// UserName, which the links to their profile are built from).
+func distortPost(rng *mathrand.Rand, post *Post, distance int) {
+	post.Content, post.RenderedContent = distortPostContent(post.Content, func(text string) string {
+		return DistortContentFromRand(rng, text, distance, DefaultDistortOptions)
+	})
+	if distortDisplayNames {
+		post.UserDisplayName = DistortContentFromRand(rng, post.UserDisplayName, distance, DefaultDistortOptions)
+	}
+}
+
 // Maybe take the distances as an argument, instead of looking them up here
-func distortPostsForUser(conn *sqlite.Conn, user *User, posts []Post) error {
+func distortPostsForUser(conn *sqlite.Conn, rng *mathrand.Rand, user *User, posts []Post) error {
 	if user == nil {
 		for i := range posts {
-			posts[i].Content = DistortContent(posts[i].Content, MaxDistortionLevel)
+			distortPost(rng, &posts[i], MaxDistortionLevel)
 			posts[i].DistanceFromUser = MaxDistortionLevel
 		}
 		return nil
@@ -869,17 +1537,28 @@ func distortPostsForUser(conn *sqlite.Conn, user *User, posts []Post) error {
 	for k := range userIDSet {
 		otherUserIDs = append(otherUserIDs, k)
 	}
-	distances, err := GetDistanceFromUser(conn, user.UserID, otherUserIDs)
+	distances, err := lookUpDistancesFromUser(conn, user.UserID, otherUserIDs)
+	if err != nil {
+		return err
+	}
+	peeks, err := getActivePeeks(conn, user.UserID, posts)
 	if err != nil {
 		return err
 	}
 	for i := range posts {
 		// No distortion for your own posts
 		if posts[i].UserID == user.UserID {
+			distortPost(rng, &posts[i], 0)
 			continue
 		}
-		posts[i].Content = DistortContent(posts[i].Content, distances[posts[i].UserID])
-		posts[i].DistanceFromUser = distances[posts[i].UserID]
+		distance := distances[posts[i].UserID]
+		posts[i].DistanceFromUser = distance
+		// Peeking gets you closer, but never as close as your own posts
+		if peekLevel := peeks[posts[i].PostID]; peekLevel > 0 {
+			posts[i].PeekLevel = min(peekLevel, distance-1)
+			distance -= posts[i].PeekLevel
+		}
+		distortPost(rng, &posts[i], distance)
 	}
 	return nil
 }
@@ -887,6 +1566,11 @@ func distortPostsForUser(conn *sqlite.Conn, user *User, posts []Post) error {
 // Decorate posts with the usual extra metadata, and distort them based on the distance
 // between the given user and the post's author.
 func DecoratePosts(conn *sqlite.Conn, user *User, posts []Post) error {
+	return decoratePosts(conn, newRand(), user, posts)
+}
+
+// Like DecoratePosts, but distorting the posts using the given source of randomness
+func decoratePosts(conn *sqlite.Conn, rng *mathrand.Rand, user *User, posts []Post) error {
 	if len(posts) == 0 {
 		return nil
 	}
@@ -896,7 +1580,13 @@ func DecoratePosts(conn *sqlite.Conn, user *User, posts []Post) error {
 	if err := getReplyCountsForPosts(conn, posts); err != nil {
 		return err
 	}
-	if err := distortPostsForUser(conn, user, posts); err != nil {
+	if err := getViewCountsForPosts(conn, posts); err != nil {
+		return err
+	}
+	if err := distortPostsForUser(conn, rng, user, posts); err != nil {
+		return err
+	}
+	if err := getRecentlyFollowedForPosts(conn, user, posts, utcNow().Add(-recentlyFollowedWindow)); err != nil {
 		return err
 	}
 	if err := getParentsForPosts(conn, posts); err != nil {
@@ -932,15 +1622,44 @@ func SaveUpload(conn *sqlite.Conn, contentType string, contents []byte) (int64,
 	return conn.LastInsertRowID(), err
 }
 
-func OpenUploadContents(conn *sqlite.Conn, uploadID int64) (blob io.ReadCloser, contentType string, err error) {
-	query := "select content_type from upload where upload_id = ? limit 1"
+var ErrUploadNotFound = errors.New("upload not found")
+
+// Metadata about an upload (everything but the contents)
+type UploadInfo struct {
+	UploadID    int64
+	ContentType string
+	CreatedAt   time.Time
+	Size        int64
+}
+
+// An ETag for the upload. Uploads are never modified once they're saved, so the ID and
+// creation time are enough to identify the contents.
+func (u *UploadInfo) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, u.UploadID, u.CreatedAt.Unix())
+}
+
+// Open the contents of the upload for reading. Returns ErrUploadNotFound if there's no
+// upload with the given ID.
+func OpenUploadContents(conn *sqlite.Conn, uploadID int64) (blob io.ReadSeekCloser, info *UploadInfo, err error) {
+	query := "select content_type, created_at from upload where upload_id = ? limit 1"
 	collect := func(stmt *sqlite.Stmt) error {
-		contentType = stmt.ColumnText(0)
+		info = &UploadInfo{
+			UploadID:    uploadID,
+			ContentType: stmt.ColumnText(0),
+			CreatedAt:   time.Unix(stmt.ColumnInt64(1), 0).UTC(),
+		}
 		return nil
 	}
 	if err := sqlitex.Exec(conn, query, collect, uploadID); err != nil {
-		return nil, "", err
+		return nil, nil, err
+	}
+	if info == nil {
+		return nil, nil, ErrUploadNotFound
+	}
+	b, err := conn.OpenBlob("", "upload", "contents", uploadID, false)
+	if err != nil {
+		return nil, nil, err
 	}
-	blob, err = conn.OpenBlob("", "upload", "contents", uploadID, false)
-	return blob, contentType, err
+	info.Size = b.Size()
+	return b, info, nil
 }
@@ -2,10 +2,17 @@ package entropy
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"math/rand/v2"
 	"path"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,6 +26,19 @@ func setUpTestDB(t *testing.T) *DB {
 	return db
 }
 
+func TestCreateUserDuplicateName(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	_, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	user, err := CreateUser(conn, "max", "otherpass")
+	assert.ErrorIs(t, err, ErrDuplicateUsername)
+	assert.Nil(t, user)
+}
+
 func TestFollowUser(t *testing.T) {
 	db := setUpTestDB(t)
 	defer db.Close()
@@ -30,17 +50,32 @@ func TestFollowUser(t *testing.T) {
 	assert.Nil(t, err)
 	lunaUser, err := CreateUser(conn, "Luna", "lunapass")
 	assert.Nil(t, err)
-	err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
+	changed, err := FollowUser(conn, maxUser.UserID, lunaUser.UserID)
 	assert.Nil(t, err)
-	err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
+	assert.True(t, changed)
+	// Following again is fine, but doesn't change anything
+	changed, err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
 	assert.Nil(t, err)
+	assert.False(t, changed)
 
 	dists, err := GetDistanceFromUser(conn, maxUser.UserID, []int64{lunaUser.UserID})
 	assert.Nil(t, err)
 	assert.Equal(t, dists[lunaUser.UserID], 1)
 
-	err = FollowUser(conn, maxUser.UserID, maxUser.UserID)
+	_, err = FollowUser(conn, maxUser.UserID, maxUser.UserID)
 	assert.NotNil(t, err)
+
+	changed, err = UnfollowUser(conn, maxUser.UserID, lunaUser.UserID)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = UnfollowUser(conn, maxUser.UserID, lunaUser.UserID)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+}
+
+func follow(t *testing.T, conn *sqlite.Conn, userID int64, followedUserID int64) {
+	_, err := FollowUser(conn, userID, followedUserID)
+	assert.Nil(t, err)
 }
 
 func TestFollowerStats(t *testing.T) {
@@ -54,7 +89,7 @@ func TestFollowerStats(t *testing.T) {
 	assert.Nil(t, err)
 	lunaUser, err := CreateUser(conn, "Luna", "lunapass")
 	assert.Nil(t, err)
-	err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
+	_, err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
 	assert.Nil(t, err)
 
 	followerStats, err := GetUserFollowStats(conn, maxUser.UserID)
@@ -79,11 +114,11 @@ func TestGetDistanceFromUser(t *testing.T) {
 	assert.Nil(t, err)
 	lunaUser, err := CreateUser(conn, "Luna", "lunapass")
 	assert.Nil(t, err)
-	err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
+	_, err = FollowUser(conn, maxUser.UserID, lunaUser.UserID)
 	assert.Nil(t, err)
 	birdUser, err := CreateUser(conn, "Bird", "birdpass")
 	assert.Nil(t, err)
-	err = FollowUser(conn, lunaUser.UserID, birdUser.UserID)
+	_, err = FollowUser(conn, lunaUser.UserID, birdUser.UserID)
 	assert.Nil(t, err)
 	strangerUser, err := CreateUser(conn, "Stranger", "strangerpass")
 	assert.Nil(t, err)
@@ -106,10 +141,1031 @@ func TestUploads(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Greater(t, uploadID, int64(0))
 
-	blob, contentType, err := OpenUploadContents(conn, uploadID)
+	blob, info, err := OpenUploadContents(conn, uploadID)
 	assert.Nil(t, err)
-	assert.Equal(t, contentType, "text/plain")
+	defer blob.Close()
+	assert.Equal(t, info.ContentType, "text/plain")
+	assert.EqualValues(t, len("hello, world!"), info.Size)
 	contents, err := io.ReadAll(blob)
 	assert.Nil(t, err)
 	assert.Equal(t, string(contents), "hello, world!")
+
+	_, _, err = OpenUploadContents(conn, uploadID+1)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+func TestGetPostRepliesBothDirections(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+
+	conn := db.Get(context.TODO())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "Max", "maxpass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "original post")
+	assert.Nil(t, err)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var replyIDs []int64
+	for i := range 4 {
+		replyID, err := ReplyToPost(conn, postID, user.UserID, fmt.Sprintf("reply %d", i))
+		assert.Nil(t, err)
+		createdAt := base.Add(time.Duration(i) * time.Minute).UnixMilli()
+		err = sqlitex.Exec(conn, "update post set created_at = ? where post_id = ?", nil, createdAt, replyID)
+		assert.Nil(t, err)
+		replyIDs = append(replyIDs, replyID)
+	}
+	postIDs := func(posts []Post) []int64 {
+		ids := make([]int64, len(posts))
+		for i := range posts {
+			ids[i] = posts[i].PostID
+		}
+		return ids
+	}
+
+	replies, err := GetPostReplies(conn, postID, PostCursor{}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{replyIDs[0], replyIDs[1]}, postIDs(replies))
+	replies, err = GetPostReplies(conn, postID, replies[1].Cursor(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{replyIDs[2], replyIDs[3]}, postIDs(replies))
+
+	replies, err = GetPostRepliesDesc(conn, postID, PostCursor{CreatedAt: base.Add(time.Hour)}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{replyIDs[3], replyIDs[2]}, postIDs(replies))
+	replies, err = GetPostRepliesDesc(conn, postID, replies[1].Cursor(), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{replyIDs[1], replyIDs[0]}, postIDs(replies))
+}
+
+func TestRecentlyFollowed(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	var posts []Post
+	for _, name := range []string{"new", "old", "stranger"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		postID, err := CreatePost(conn, user.UserID, "hi from "+name)
+		assert.Nil(t, err)
+		post, err := GetPost(conn, postID)
+		assert.Nil(t, err)
+		posts = append(posts, *post)
+	}
+	newFriend, oldFriend := posts[0].UserID, posts[1].UserID
+	_, err = FollowUser(conn, me.UserID, newFriend)
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, me.UserID, oldFriend)
+	assert.Nil(t, err)
+
+	// Just inside and just outside of the window
+	now := utcNow()
+	query := "update user_follow set followed_at = ? where followed_user_id = ?"
+	assert.Nil(t, sqlitex.Exec(conn, query, nil, now.Add(-recentlyFollowedWindow+time.Minute).Unix(), newFriend))
+	assert.Nil(t, sqlitex.Exec(conn, query, nil, now.Add(-recentlyFollowedWindow-time.Minute).Unix(), oldFriend))
+
+	assert.Nil(t, DecoratePosts(conn, me, posts))
+	assert.True(t, posts[0].RecentlyFollowed)
+	assert.False(t, posts[1].RecentlyFollowed)
+	assert.False(t, posts[2].RecentlyFollowed)
+
+	// Exactly on the boundary doesn't count
+	err = getRecentlyFollowedForPosts(conn, me, posts, now.Add(-recentlyFollowedWindow+time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, posts[0].RecentlyFollowed)
+
+	// Nothing is recently followed when you're logged out
+	assert.Nil(t, DecoratePosts(conn, nil, posts))
+	assert.False(t, posts[0].RecentlyFollowed)
+}
+
+func TestPaginationWithinOneSecond(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "original post")
+	assert.Nil(t, err)
+	var replyIDs []int64
+	for i := range 7 {
+		replyID, err := ReplyToPost(conn, postID, user.UserID, fmt.Sprintf("reply %d", i))
+		assert.Nil(t, err)
+		replyIDs = append(replyIDs, replyID)
+	}
+	// All in the same second
+	createdAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = sqlitex.Exec(conn, "update post set created_at = ? where post_id != ?", nil, createdAt.UnixMilli(), postID)
+	assert.Nil(t, err)
+
+	// Pages through everything, three at a time
+	pageThrough := func(getPage func(cursor PostCursor) ([]Post, error), cursor PostCursor) []int64 {
+		var ids []int64
+		for range len(replyIDs) {
+			posts, err := getPage(cursor)
+			assert.Nil(t, err)
+			if len(posts) == 0 {
+				break
+			}
+			for _, post := range posts {
+				ids = append(ids, post.PostID)
+			}
+			cursor = posts[len(posts)-1].Cursor()
+		}
+		return ids
+	}
+	ids := pageThrough(func(cursor PostCursor) ([]Post, error) {
+		return GetPostReplies(conn, postID, cursor, 3)
+	}, PostCursor{})
+	assert.Equal(t, replyIDs, ids)
+
+	newestFirst := slices.Clone(replyIDs)
+	slices.Reverse(newestFirst)
+	future := PostCursor{CreatedAt: createdAt.Add(time.Hour)}
+	ids = pageThrough(func(cursor PostCursor) ([]Post, error) {
+		return GetPostRepliesDesc(conn, postID, cursor, 3)
+	}, future)
+	assert.Equal(t, newestFirst, ids)
+	ids = pageThrough(func(cursor PostCursor) ([]Post, error) {
+		return GetRecentPosts(conn, cursor, 3)
+	}, future)
+	assert.Equal(t, newestFirst, ids)
+	ids = pageThrough(func(cursor PostCursor) ([]Post, error) {
+		return GetRecentPostsFromUser(conn, user.UserID, cursor, 3, true)
+	}, future)
+	assert.Equal(t, newestFirst, ids)
+}
+
+func TestPostTimestampsHaveMilliseconds(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	firstID, err := CreatePost(conn, user.UserID, "first")
+	assert.Nil(t, err)
+	secondID, err := CreatePost(conn, user.UserID, "second")
+	assert.Nil(t, err)
+	// Same second, but the first post is later. The post_id tiebreaker shouldn't kick in.
+	createdAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := "update post set created_at = ? where post_id = ?"
+	assert.Nil(t, sqlitex.Exec(conn, query, nil, createdAt.Add(700*time.Millisecond).UnixMilli(), firstID))
+	assert.Nil(t, sqlitex.Exec(conn, query, nil, createdAt.Add(200*time.Millisecond).UnixMilli(), secondID))
+
+	posts, err := GetRecentPostsFromUser(conn, user.UserID, PostCursor{CreatedAt: createdAt.Add(time.Hour)}, 10, true)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 2)
+	assert.Equal(t, firstID, posts[0].PostID)
+	assert.Equal(t, createdAt.Add(700*time.Millisecond), posts[0].CreatedAt)
+	assert.Equal(t, secondID, posts[1].PostID)
+
+	// The cursor has milliseconds in it too
+	posts, err = GetRecentPostsFromUser(conn, user.UserID, posts[0].Cursor(), 10, true)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+	assert.Equal(t, secondID, posts[0].PostID)
+}
+
+func TestMigratePostTimestampsToMilliseconds(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// A brand new database doesn't need any migrations
+	version, err := getUserVersion(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	// Pretend this database is from before post timestamps had milliseconds
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "old post")
+	assert.Nil(t, err)
+	createdAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = sqlitex.Exec(conn, "update post set created_at = ?", nil, createdAt.Unix())
+	assert.Nil(t, err)
+	assert.Nil(t, setUserVersion(conn, 0))
+
+	assert.Nil(t, setUpDb(conn))
+	// Running it again doesn't migrate anything twice
+	assert.Nil(t, setUpDb(conn))
+	version, err = getUserVersion(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), version)
+	post, err := GetPost(conn, postID)
+	assert.Nil(t, err)
+	assert.Equal(t, createdAt, post.CreatedAt)
+}
+
+func getQueryPlan(t *testing.T, conn *sqlite.Conn, query string, args ...any) string {
+	var details []string
+	collect := func(stmt *sqlite.Stmt) error {
+		details = append(details, stmt.ColumnText(3))
+		return nil
+	}
+	assert.Nil(t, sqlitex.Exec(conn, "explain query plan "+query, collect, args...))
+	return strings.Join(details, "\n")
+}
+
+func TestTimelineQueriesUseIndexes(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// The same filtering and ordering as GetRecentPosts and GetRecentPostsFromUser
+	plan := getQueryPlan(t, conn, `
+		select post_id
+		from post
+		join user using (user_id)
+		where (post.created_at, post.post_id) < (?, ?)
+		order by post.created_at desc, post.post_id desc
+		limit 10`, 1, 1)
+	assert.Contains(t, plan, "USING INDEX post_created_at_idx")
+	assert.NotContains(t, plan, "SCAN")
+	assert.NotContains(t, plan, "TEMP B-TREE")
+
+	plan = getQueryPlan(t, conn, `
+		select post_id
+		from post
+		join user using (user_id)
+		where user_id = ?
+			and (post.created_at, post.post_id) < (?, ?)
+		order by post.created_at desc, post.post_id desc
+		limit 10`, 1, 1, 1)
+	assert.Contains(t, plan, "post_user_id_created_at_idx")
+	assert.NotContains(t, plan, "SCAN")
+	assert.NotContains(t, plan, "TEMP B-TREE")
+}
+
+func TestDropRedundantPostUserIDIndex(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// Pretend this database is from before post_user_id_created_at_idx
+	script := `
+		drop index post_user_id_created_at_idx;
+		create index post_user_id_idx on post (user_id);
+		pragma user_version = 1;`
+	assert.Nil(t, sqlitex.ExecScript(conn, script))
+	assert.Nil(t, setUpDb(conn))
+
+	var indexes []string
+	collect := func(stmt *sqlite.Stmt) error {
+		indexes = append(indexes, stmt.ColumnText(0))
+		return nil
+	}
+	query := "select name from sqlite_master where type = 'index' and tbl_name = 'post' order by name"
+	assert.Nil(t, sqlitex.Exec(conn, query, collect))
+	assert.Equal(t, []string{"post_created_at_idx", "post_user_id_created_at_idx"}, indexes)
+}
+
+func TestCreatePostWithTime(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var postIDs []int64
+	for i, content := range []string{"first", "second", "third"} {
+		postID, err := CreatePostWithTime(conn, user.UserID, content, start.Add(time.Duration(i)*time.Minute))
+		assert.Nil(t, err)
+		postIDs = append(postIDs, postID)
+	}
+	// One that's posted now goes on top
+	nowID, err := CreatePost(conn, user.UserID, "now")
+	assert.Nil(t, err)
+
+	post, err := GetPost(conn, postIDs[1])
+	assert.Nil(t, err)
+	assert.Equal(t, start.Add(time.Minute), post.CreatedAt)
+	posts, err := GetRecentPostsFromUser(conn, user.UserID, PostCursor{CreatedAt: time.Now().Add(time.Hour)}, 10, true)
+	assert.Nil(t, err)
+	var gotIDs []int64
+	for _, post := range posts {
+		gotIDs = append(gotIDs, post.PostID)
+	}
+	assert.Equal(t, []int64{nowID, postIDs[2], postIDs[1], postIDs[0]}, gotIDs)
+}
+
+func TestGetRecentPostsFromUserWithoutReplies(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	max, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	firstID, err := CreatePost(conn, max.UserID, "first")
+	assert.Nil(t, err)
+	otherPostID, err := CreatePost(conn, other.UserID, "someone else's")
+	assert.Nil(t, err)
+	replyToOtherID, err := ReplyToPost(conn, otherPostID, max.UserID, "replying to someone else")
+	assert.Nil(t, err)
+	replyToSelfID, err := ReplyToPost(conn, firstID, max.UserID, "replying to myself")
+	assert.Nil(t, err)
+	secondID, err := CreatePost(conn, max.UserID, "second")
+	assert.Nil(t, err)
+
+	postIDs := func(includeReplies bool) []int64 {
+		posts, err := GetRecentPostsFromUser(conn, max.UserID, PostCursor{CreatedAt: time.Now().Add(time.Hour)}, 10, includeReplies)
+		assert.Nil(t, err)
+		var ids []int64
+		for _, post := range posts {
+			ids = append(ids, post.PostID)
+		}
+		return ids
+	}
+	assert.Equal(t, []int64{secondID, replyToSelfID, replyToOtherID, firstID}, postIDs(true))
+	assert.Equal(t, []int64{secondID, firstID}, postIDs(false))
+}
+
+func TestCreatePostsBulk(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	viola, err := CreateUser(conn, "viola", "pass")
+	assert.Nil(t, err)
+	orsino, err := CreateUser(conn, "orsino", "pass")
+	assert.Nil(t, err)
+	createdAt := time.Date(1602, 2, 2, 12, 0, 0, 0, time.UTC)
+	postIDs, err := CreatePostsBulk(conn, []NewPost{
+		{UserID: orsino.UserID, Content: "If music be the food of love, play on", CreatedAt: createdAt},
+		{UserID: viola.UserID, Content: "What country, friends, is this? @orsino"},
+		{UserID: viola.UserID, Content: strings.Repeat("a", MaxPostLength+1)},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, postIDs, 3)
+
+	post, err := GetPost(conn, postIDs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "orsino", post.UserName)
+	assert.Equal(t, createdAt, post.CreatedAt)
+	post, err = GetPost(conn, postIDs[2])
+	assert.Nil(t, err)
+	assert.Len(t, post.Content, MaxPostLength)
+	mentions, err := GetMentions(conn, orsino.UserID, PostCursor{CreatedAt: time.Now().Add(time.Hour)}, 10)
+	assert.Nil(t, err)
+	assert.Len(t, mentions, 1)
+	assert.Equal(t, postIDs[1], mentions[0].PostID)
+}
+
+func BenchmarkCreatePosts(b *testing.B) {
+	dir := b.TempDir()
+	db, err := NewDB(path.Join(dir, "bench.db"), 1)
+	if err != nil {
+		b.Fatalf("NewDB error: %v", err)
+	}
+	defer db.Close()
+	conn := db.Get(b.Context())
+	defer db.Put(conn)
+	user, err := CreateUser(conn, "max", "pass")
+	if err != nil {
+		b.Fatal(err)
+	}
+	posts := make([]NewPost, 1000)
+	for i := range posts {
+		posts[i] = NewPost{UserID: user.UserID, Content: fmt.Sprintf("post %d", i)}
+	}
+
+	b.Run("single", func(b *testing.B) {
+		for b.Loop() {
+			for _, post := range posts {
+				if _, err := CreatePost(conn, post.UserID, post.Content); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("bulk", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := CreatePostsBulk(conn, posts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// A sqlite.Tracer that remembers the text of the last query that was run
+type lastQueryTracer struct {
+	query string
+}
+
+func (t *lastQueryTracer) NewTask(query string) sqlite.TracerTask {
+	t.query = query
+	return noopTracerTask{}
+}
+func (t *lastQueryTracer) Push(name string) {}
+func (t *lastQueryTracer) Pop()             {}
+
+type noopTracerTask struct{}
+
+func (noopTracerTask) StartRegion(regionType string) {}
+func (noopTracerTask) EndRegion()                    {}
+func (noopTracerTask) End()                          {}
+
+// Compares the timeline query with the prepared statement that conn.Prepare keeps around,
+// against preparing it from scratch every time.
+func BenchmarkTimelineQuery(b *testing.B) {
+	dir := b.TempDir()
+	db, err := NewDB(path.Join(dir, "bench.db"), 1)
+	if err != nil {
+		b.Fatalf("NewDB error: %v", err)
+	}
+	defer db.Close()
+	conn := db.Get(b.Context())
+	defer db.Put(conn)
+	for i := range 20 {
+		user, err := CreateUser(conn, fmt.Sprintf("user%d", i), "pass")
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := range 100 {
+			if _, err := CreatePost(conn, user.UserID, fmt.Sprintf("post %d", j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	before := PostCursor{CreatedAt: time.Now().Add(time.Hour)}
+	// Get GetRecentPosts' query, for running it without the cache
+	tracer := &lastQueryTracer{}
+	conn.SetTracer(tracer)
+	if _, err := GetRecentPosts(conn, before, 20); err != nil {
+		b.Fatal(err)
+	}
+	conn.SetTracer(nil)
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := GetRecentPosts(conn, before, 20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("transient", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			posts := make([]Post, 0, 20)
+			err := sqlitex.ExecTransient(conn, tracer.query, collectPosts(&posts), before.CreatedAt.UnixMilli(), before.PostID, 20)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	db.AcquireTimeout = 50 * time.Millisecond
+
+	conn := db.Get(t.Context())
+	assert.NotNil(t, conn)
+	// The only read-write connection is taken, so we give up waiting
+	start := time.Now()
+	assert.Nil(t, db.Get(t.Context()))
+	assert.Less(t, time.Since(start), time.Second)
+	db.Put(conn)
+
+	// The timeout is only for getting the connection: it doesn't interrupt queries later on
+	conn = db.Get(t.Context())
+	defer db.Put(conn)
+	time.Sleep(2 * db.AcquireTimeout)
+	_, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+}
+
+func TestDistanceLabel(t *testing.T) {
+	var testCases = []struct {
+		distance       int
+		label          string
+		following      bool
+		friendOfFriend bool
+	}{
+		{0, "you", false, false},
+		{1, "following", true, false},
+		{2, "2nd degree", false, true},
+		{3, "3rd degree", false, false},
+		{4, "4th degree", false, false},
+		{MaxDistortionLevel, "out of network", false, false},
+	}
+	for _, testCase := range testCases {
+		post := Post{DistanceFromUser: testCase.distance}
+		assert.Equal(t, testCase.label, post.DistanceLabel())
+		assert.Equal(t, testCase.following, post.IsFollowing())
+		assert.Equal(t, testCase.friendOfFriend, post.IsFriendOfFriend())
+	}
+}
+
+func TestAuthorLabel(t *testing.T) {
+	post := Post{UserName: "max", UserDisplayName: "Max Hully"}
+	assert.Equal(t, "Max Hully", post.AuthorLabel())
+	post.UserDisplayName = "  "
+	assert.Equal(t, "max", post.AuthorLabel())
+	post.UserDisplayName = ""
+	assert.Equal(t, "max", post.AuthorLabel())
+	post = Post{ReplyingToPostUserName: "max", ReplyingToPostUserDisplayName: "Max Hully"}
+	assert.Equal(t, "Max Hully", post.ReplyingToPostAuthorLabel())
+}
+
+func TestPostsHaveDisplayNames(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	author, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	assert.Nil(t, UpdateUserProfile(conn, "max", "Max Hully", "", 0))
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, author.UserID, "original post")
+	assert.Nil(t, err)
+	replyID, err := ReplyToPost(conn, postID, other.UserID, "reply")
+	assert.Nil(t, err)
+
+	post, err := GetPost(conn, postID)
+	assert.Nil(t, err)
+	assert.Equal(t, "Max Hully", post.UserDisplayName)
+
+	replies, err := GetPostReplies(conn, postID, PostCursor{}, 10)
+	assert.Nil(t, err)
+	assert.Len(t, replies, 1)
+	assert.Nil(t, DecoratePosts(conn, author, replies))
+	assert.Equal(t, replyID, replies[0].PostID)
+	assert.Equal(t, "other", replies[0].UserDisplayName)
+	assert.Equal(t, "Max Hully", replies[0].ReplyingToPostAuthorLabel())
+
+	posts, err := GetRecentPostsFromUser(conn, author.UserID, PostCursor{CreatedAt: time.Now().Add(time.Hour)}, 10, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "Max Hully", posts[0].AuthorLabel())
+}
+
+func TestCreateUserSessionWithDuration(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	session, err := CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(DefaultSessionDuration), session.ExpirationTime, 5*time.Second)
+
+	session, err = CreateUserSessionWithDuration(conn, user.UserID, time.Hour)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.ExpirationTime, 5*time.Second)
+	loggedIn, err := GetUserFromSessionPublicID(conn, session.SessionPublicID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.UserID, loggedIn.UserID)
+
+	// Sessions stop working once they expire
+	session, err = CreateUserSessionWithDuration(conn, user.UserID, -time.Minute)
+	assert.Nil(t, err)
+	loggedIn, err = GetUserFromSessionPublicID(conn, session.SessionPublicID)
+	assert.Nil(t, err)
+	assert.Nil(t, loggedIn)
+}
+
+func TestDeleteExpiredSessions(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	current, err := CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	_, err = CreateUserSessionWithDuration(conn, user.UserID, -time.Hour)
+	assert.Nil(t, err)
+	loggedOut, err := CreateUserSession(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Nil(t, ExpireSession(conn, loggedOut.SessionPublicID))
+
+	deleted, err := DeleteExpiredSessions(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	count := 0
+	collect := func(stmt *sqlite.Stmt) error {
+		count = stmt.ColumnInt(0)
+		return nil
+	}
+	assert.Nil(t, sqlitex.Exec(conn, "select count(*) from user_session", collect))
+	assert.Equal(t, 1, count)
+	loggedIn, err := GetUserFromSessionPublicID(conn, current.SessionPublicID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.UserID, loggedIn.UserID)
+}
+
+func TestUnreactToPostOnlyRemovesThatEmoji(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "react to me")
+	assert.Nil(t, err)
+	for _, emoji := range []string{"👍", "❤️"} {
+		found, err := ReactToPostIfExists(conn, user.UserID, postID, emoji)
+		assert.Nil(t, err)
+		assert.True(t, found)
+	}
+	// As if they reacted a while ago, so that they can unreact (see ReactionCooldown)
+	assert.Nil(t, sqlitex.Exec(conn, "update reaction set reacted_at = reacted_at - 60", nil))
+
+	found, err := UnreactToPostIfExists(conn, user.UserID, postID, "👍")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	posts := []Post{{PostID: postID}}
+	assert.Nil(t, getReactionCountsForPosts(conn, user, posts))
+	assert.Equal(t, []PostReactionCount{{Emoji: "❤️", Count: 1, UserReacted: true}}, posts[0].Reactions)
+
+	// The post has to exist
+	found, err = UnreactToPostIfExists(conn, user.UserID, postID+1, "❤️")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestMigrateReactionsToPerEmoji(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// Pretend this database is from before you could react with more than one emoji
+	script := `
+		drop table reaction;
+		create table reaction (
+			post_id integer not null,
+			user_id integer not null,
+			reacted_at integer not null,
+			emoji text not null,
+			primary key (post_id, user_id)
+		);
+		insert into reaction (post_id, user_id, reacted_at, emoji) values (1, 1, 0, '❤️');
+		pragma user_version = 2;`
+	assert.Nil(t, sqlitex.ExecScript(conn, script))
+	assert.Nil(t, setUpDb(conn))
+
+	posts := []Post{{PostID: 1}}
+	assert.Nil(t, getReactionCountsForPosts(conn, nil, posts))
+	assert.Equal(t, []PostReactionCount{{Emoji: "❤️", Count: 1}}, posts[0].Reactions)
+	script = "insert into reaction (post_id, user_id, reacted_at, emoji) values (1, 1, 0, '👍')"
+	assert.Nil(t, sqlitex.ExecScript(conn, script))
+}
+
+func TestReactionsSortedByCount(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	author, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, author.UserID, "so popular")
+	assert.Nil(t, err)
+	otherPostID, err := CreatePost(conn, author.UserID, "not so popular")
+	assert.Nil(t, err)
+	reactions := map[string][]string{
+		"alice": {"👍"},
+		"bob":   {"👍", "😂", "❤️"},
+		"carol": {"❤️", "👍"},
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		for _, emoji := range reactions[name] {
+			_, err = ReactToPostIfExists(conn, user.UserID, postID, emoji)
+			assert.Nil(t, err)
+		}
+	}
+
+	posts := []Post{{PostID: postID}, {PostID: otherPostID}}
+	assert.Nil(t, getReactionCountsForPosts(conn, author, posts))
+	assert.Equal(t, []PostReactionCount{
+		{Emoji: "👍", Count: 3},
+		{Emoji: "❤️", Count: 2},
+		{Emoji: "😂", Count: 1},
+	}, posts[0].Reactions)
+	assert.Equal(t, 6, posts[0].TotalReactions)
+	assert.Empty(t, posts[1].Reactions)
+	assert.Equal(t, 0, posts[1].TotalReactions)
+}
+
+func TestAbsoluteURLs(t *testing.T) {
+	post := Post{PostID: 42}
+	assert.Equal(t, "https://entropych.example.com/p/42/", post.AbsoluteURL("https://entropych.example.com"))
+	assert.Equal(t, "https://entropych.example.com/p/42/", post.AbsoluteURL("https://entropych.example.com/"))
+
+	var testCases = []struct {
+		name     string
+		expected string
+	}{
+		{"max", "https://entropych.example.com/u/max/"},
+		{"luna & co", "https://entropych.example.com/u/luna%20&%20co/"},
+		{"a/b?c#d", "https://entropych.example.com/u/a%2Fb%3Fc%23d/"},
+		{"100%", "https://entropych.example.com/u/100%25/"},
+	}
+	for _, testCase := range testCases {
+		user := User{Name: testCase.name}
+		assert.Equal(t, testCase.expected, user.AbsoluteURL("https://entropych.example.com"))
+	}
+}
+
+func TestDistanceFromUserLeavesOutSelf(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// max and luna follow each other, so there's a path from max back to max
+	maxUser, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	lunaUser, err := CreateUser(conn, "luna", "pass")
+	assert.Nil(t, err)
+	follow(t, conn, maxUser.UserID, lunaUser.UserID)
+	follow(t, conn, lunaUser.UserID, maxUser.UserID)
+
+	otherUserIDs := []int64{maxUser.UserID, lunaUser.UserID}
+	dists, err := GetDistanceFromUser(conn, maxUser.UserID, otherUserIDs)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int{lunaUser.UserID: 1}, dists)
+
+	// Same with the precomputed distances
+	assert.Nil(t, RecomputeUserDistances(conn))
+	dists, cached, err := GetCachedDistanceFromUser(conn, maxUser.UserID, otherUserIDs)
+	assert.Nil(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, map[int64]int{lunaUser.UserID: 1}, dists)
+}
+
+func TestInteractingWithYourOwnPosts(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "talking to myself")
+	assert.Nil(t, err)
+	found, err := ReactToPostIfExists(conn, user.UserID, postID, "❤️")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	replyID, err := ReplyToPost(conn, postID, user.UserID, "still talking to myself")
+	assert.Nil(t, err)
+
+	posts := []Post{{PostID: postID, UserID: user.UserID}, {PostID: replyID, UserID: user.UserID}}
+	assert.Nil(t, DecoratePosts(conn, user, posts))
+	assert.Equal(t, 1, posts[0].TotalReactions)
+	assert.Equal(t, 1, posts[0].ReplyCount)
+	// Your own posts are distance 0, and never distorted
+	assert.Equal(t, 0, posts[0].DistanceFromUser)
+	assert.Equal(t, 0, posts[1].DistanceFromUser)
+}
+
+func TestGetDistanceFromUserDuplicatesAndLargeInputs(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	maxUser, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	lunaUser, err := CreateUser(conn, "luna", "pass")
+	assert.Nil(t, err)
+	birdUser, err := CreateUser(conn, "bird", "pass")
+	assert.Nil(t, err)
+	follow(t, conn, maxUser.UserID, lunaUser.UserID)
+	follow(t, conn, lunaUser.UserID, birdUser.UserID)
+
+	otherUserIDs := []int64{birdUser.UserID, lunaUser.UserID, birdUser.UserID, lunaUser.UserID}
+	dists, err := GetDistanceFromUser(conn, maxUser.UserID, otherUserIDs)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int{lunaUser.UserID: 1, birdUser.UserID: 2}, dists)
+	// The caller's slice is left alone
+	assert.Equal(t, []int64{birdUser.UserID, lunaUser.UserID, birdUser.UserID, lunaUser.UserID}, otherUserIDs)
+
+	// Enough IDs to need a few queries
+	otherUserIDs = nil
+	for i := range 2*distanceLookupChunkSize + 10 {
+		otherUserIDs = append(otherUserIDs, int64(1000+i))
+	}
+	otherUserIDs = append(otherUserIDs, birdUser.UserID, lunaUser.UserID)
+	dists, err = GetDistanceFromUser(conn, maxUser.UserID, otherUserIDs)
+	assert.Nil(t, err)
+	assert.Len(t, dists, len(otherUserIDs))
+	assert.Equal(t, 1, dists[lunaUser.UserID])
+	assert.Equal(t, 2, dists[birdUser.UserID])
+	assert.Equal(t, MaxDistortionLevel, dists[1000])
+}
+
+func TestGetDistanceFromUserHighDegree(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	hub, err := CreateUser(conn, "hub", "pass")
+	assert.Nil(t, err)
+	follow(t, conn, me.UserID, hub.UserID)
+	// The hub follows more fans than a hop goes through, and each fan follows one person
+	// that nobody else does
+	fans := distanceFrontierLimit + 1000
+	script := fmt.Sprintf(`
+		with recursive ids(i) as (select 1 union all select i + 1 from ids where i < %[1]d)
+		insert into user (user_id, user_name) select 1000 + i, 'user' || i from ids;
+		insert into user_follow (user_id, followed_user_id, followed_at)
+		select %[2]d, user_id, 0 from user where user_id between 1001 and %[3]d;
+		insert into user_follow (user_id, followed_user_id, followed_at)
+		select user_id, user_id + %[4]d, 0 from user where user_id between 1001 and %[3]d;`,
+		2*fans, hub.UserID, 1000+fans, fans)
+	assert.Nil(t, sqlitex.ExecScript(conn, script))
+
+	var others []int64
+	for i := 1; i <= 2*fans; i++ {
+		others = append(others, int64(1000+i))
+	}
+	dists, err := GetDistanceFromUser(conn, me.UserID, others)
+	assert.Nil(t, err)
+	counts := make(map[int]int)
+	for _, d := range dists {
+		counts[d]++
+	}
+	// Everyone the hub follows is 2 hops away, even past the cap. But the third hop only
+	// goes through distanceFrontierLimit of them, so the rest of their follows are out of
+	// reach.
+	assert.Equal(t, map[int]int{
+		2:                  fans,
+		3:                  distanceFrontierLimit,
+		MaxDistortionLevel: fans - distanceFrontierLimit,
+	}, counts)
+}
+
+func TestFollowUsersByName(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	var ids []int64
+	for _, name := range []string{"a", "b", "c"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	follow(t, conn, me.UserID, ids[2])
+
+	result, err := FollowUsersByName(conn, me.UserID, []string{"b", "nobody", "a", "b", "me", "c", "nobody"})
+	assert.Nil(t, err)
+	assert.Equal(t, &FollowUsersResult{
+		Followed:         []string{"b", "a"},
+		AlreadyFollowing: []string{"c"},
+		Skipped:          []string{"nobody", "me"},
+	}, result)
+
+	names, err := GetFollowedUserNames(conn, me.UserID)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, names)
+	distances, err := GetDistanceFromUser(conn, me.UserID, ids)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int{ids[0]: 1, ids[1]: 1, ids[2]: 1}, distances)
+
+	// Doing it again changes nothing
+	result, err = FollowUsersByName(conn, me.UserID, []string{"a", "b"})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Followed)
+	assert.Equal(t, []string{"a", "b"}, result.AlreadyFollowing)
+}
+
+func TestDistortDisplayNames(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	stranger, err := CreateUser(conn, "stranger_danger", "pass")
+	assert.Nil(t, err)
+	displayName := "A Very Long Display Name Indeed"
+	assert.Nil(t, UpdateUserProfile(conn, "stranger_danger", displayName, "", 0))
+	_, err = CreatePost(conn, stranger.UserID, "hello")
+	assert.Nil(t, err)
+	getPosts := func() []Post {
+		posts, err := GetRecentPostsFromUser(conn, stranger.UserID, PostCursor{CreatedAt: time.Now().Add(time.Hour)}, 10, true)
+		assert.Nil(t, err)
+		assert.Nil(t, decoratePosts(conn, rand.New(rand.NewPCG(1, 2)), me, posts))
+		return posts
+	}
+
+	// Off by default
+	posts := getPosts()
+	assert.Equal(t, displayName, posts[0].UserDisplayName)
+
+	config := DefaultDistortionConfig
+	config.DistortDisplayNames = true
+	assert.Nil(t, SetDistortionConfig(config))
+	t.Cleanup(func() { SetDistortionConfig(DefaultDistortionConfig) })
+	posts = getPosts()
+	assert.Equal(t, MaxDistortionLevel, posts[0].DistanceFromUser)
+	assert.NotEqual(t, displayName, posts[0].UserDisplayName)
+	assert.Equal(t, "stranger_danger", posts[0].UserName)
+	assert.Equal(t, "/u/stranger_danger/", posts[0].UserURL())
+
+	// Your own display name is left alone
+	assert.Nil(t, UpdateUserProfile(conn, "me", displayName, "", 0))
+	_, err = CreatePost(conn, me.UserID, "hi")
+	assert.Nil(t, err)
+	posts, err = GetRecentPostsFromUser(conn, me.UserID, PostCursor{CreatedAt: time.Now().Add(time.Hour)}, 10, true)
+	assert.Nil(t, err)
+	assert.Nil(t, decoratePosts(conn, rand.New(rand.NewPCG(1, 2)), me, posts))
+	assert.Equal(t, displayName, posts[0].UserDisplayName)
+}
+
+func TestReactToPostOnlyAllowsAllowedReactions(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "react to me")
+	assert.Nil(t, err)
+
+	found, err := ReactToPostIfExists(conn, user.UserID, postID, "🦆")
+	assert.ErrorIs(t, err, ErrReactionNotAllowed)
+	assert.False(t, found)
+	for _, emoji := range AllowedReactions {
+		found, err = ReactToPostIfExists(conn, user.UserID, postID, emoji)
+		assert.Nil(t, err)
+		assert.True(t, found)
+	}
+	posts := []Post{{PostID: postID}}
+	assert.Nil(t, getReactionCountsForPosts(conn, user, posts))
+	assert.Equal(t, len(AllowedReactions), posts[0].TotalReactions)
+}
+
+func TestUnreactCooldown(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, user.UserID, "react to me")
+	assert.Nil(t, err)
+	found, err := ReactToPostIfExists(conn, user.UserID, postID, "👍")
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	// Too soon to take it back
+	_, err = UnreactToPostIfExists(conn, user.UserID, postID, "👍")
+	assert.ErrorIs(t, err, ErrReactionCooldown)
+	posts := []Post{{PostID: postID}}
+	assert.Nil(t, getReactionCountsForPosts(conn, user, posts))
+	assert.Equal(t, 1, posts[0].TotalReactions)
+	// Other emojis are fine, and unreacting with one you didn't use is a no-op
+	_, err = ReactToPostIfExists(conn, user.UserID, postID, "❤️")
+	assert.Nil(t, err)
+	_, err = UnreactToPostIfExists(conn, user.UserID, postID, "😂")
+	assert.Nil(t, err)
+
+	cutoff := utcNow().Add(-ReactionCooldown).Unix()
+	assert.Nil(t, sqlitex.Exec(conn, "update reaction set reacted_at = ? where emoji = '👍'", nil, cutoff))
+	found, err = UnreactToPostIfExists(conn, user.UserID, postID, "👍")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	posts = []Post{{PostID: postID}}
+	assert.Nil(t, getReactionCountsForPosts(conn, user, posts))
+	assert.Equal(t, []PostReactionCount{{Emoji: "❤️", Count: 1, UserReacted: true}}, posts[0].Reactions)
 }
@@ -1,54 +1,201 @@
 package entropy
 
 import (
-	mathrand "math/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-func randomContentRune() rune {
-	// TODO: find more fun content ranges to include in the noise
-	// This is the "Basic Latin" range of code points
-	minRune := 0x0020
-	maxRune := 0x007F
+// A new source of randomness, seeded randomly
+func newRand() *rand.Rand {
+	return rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+}
+
+// A range of code points to draw noise from, from Min to Max (inclusive)
+type NoiseRange struct {
+	Min, Max rune
+	// How often to draw from this range, relative to the other ranges' weights
+	Weight float64
+}
+
+// Where the noise in distorted content comes from. Each noise rune picks one of the
+// ranges (weighted by Weight), and then one of the printable runes from within it.
+type DistortionConfig struct {
+	NoiseRanges []NoiseRange
+	// Whether far-away authors' display names get distorted along with their posts.
+	// Their handles never are, since those are in the links to their profiles.
+	DistortDisplayNames bool
+}
+
+var DefaultDistortionConfig = DistortionConfig{
+	NoiseRanges: []NoiseRange{
+		// Basic Latin, minus the control characters
+		{Min: 0x0020, Max: 0x007E, Weight: 0.7},
+		// The "fun zone" of unicode:
+		//
+		// 2580 — 259F	Block Elements
+		// 25A0 — 25FF	Geometric Shapes
+		// 2600 — 26FF	Miscellaneous Symbols
+		// 2700 — 27BF	Dingbats
+		//
+		// Could consider dropping Miscellaneous Symbols in favor of arrows or math symbols.
+		{Min: 0x2580, Max: 0x27BF, Weight: 0.3},
+	},
+}
+
+func (c DistortionConfig) Validate() error {
+	if len(c.NoiseRanges) == 0 {
+		return errors.New("distortion config has no noise ranges")
+	}
+	for _, noiseRange := range c.NoiseRanges {
+		switch {
+		case noiseRange.Min > noiseRange.Max:
+			return fmt.Errorf("noise range %U-%U is empty", noiseRange.Min, noiseRange.Max)
+		case noiseRange.Min < 0 || noiseRange.Max > unicode.MaxRune:
+			return fmt.Errorf("noise range %U-%U is outside of unicode", noiseRange.Min, noiseRange.Max)
+		case noiseRange.Min <= surrogateMax && noiseRange.Max >= surrogateMin:
+			return fmt.Errorf("noise range %U-%U includes surrogates, which aren't valid runes", noiseRange.Min, noiseRange.Max)
+		case !(noiseRange.Weight > 0):
+			return fmt.Errorf("noise range %U-%U needs a positive weight", noiseRange.Min, noiseRange.Max)
+		case len(printableRunes(noiseRange.Min, noiseRange.Max)) == 0:
+			return fmt.Errorf("noise range %U-%U has no printable runes", noiseRange.Min, noiseRange.Max)
+		}
+	}
+	return nil
+}
+
+// The UTF-16 surrogate halves, which utf8 can't encode
+const (
+	surrogateMin = 0xD800
+	surrogateMax = 0xDFFF
+)
+
+// The runes from min to max (inclusive) that will show up as something: ones that are
+// assigned, visible, and not control characters. (Unassigned code points come out as
+// tofu boxes.) Fonts still might not have all of them, but there's only so much we can do.
+func printableRunes(min, max rune) []rune {
+	var runes []rune
+	for r := min; r <= max; r++ {
+		if unicode.IsPrint(r) && !unicode.IsControl(r) {
+			runes = append(runes, r)
+		}
+	}
+	return runes
+}
+
+// One of a DistortionConfig's ranges, with only its printable runes
+type noiseSet struct {
+	runes  []rune
+	weight float64
+}
+
+func (c DistortionConfig) noiseSets() []noiseSet {
+	sets := make([]noiseSet, 0, len(c.NoiseRanges))
+	for _, noiseRange := range c.NoiseRanges {
+		sets = append(sets, noiseSet{
+			runes:  printableRunes(noiseRange.Min, noiseRange.Max),
+			weight: noiseRange.Weight,
+		})
+	}
+	return sets
+}
+
+// The noise that DistortContent uses, and whether DecoratePosts distorts display names.
+// Only change them (with SetDistortionConfig) at startup or in tests, not while posts
+// are being distorted.
+var (
+	noise               = DefaultDistortionConfig.noiseSets()
+	distortDisplayNames = DefaultDistortionConfig.DistortDisplayNames
+)
 
-	// The "fun zone" of unicode:
-	//
-	// 2580 — 259F	Block Elements
-	// 25A0 — 25FF	Geometric Shapes
-	// 2600 — 26FF	Miscellaneous Symbols
-	// 2700 — 27BF	Dingbats
-	//
-	// Could consider dropping Miscellaneous Symbols in favor of arrows or math symbols.
-	if mathrand.Float32() < 0.3 {
-		minRune = 0x2580
-		maxRune = 0x27BF
+func SetDistortionConfig(config DistortionConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
 	}
+	noise = config.noiseSets()
+	distortDisplayNames = config.DistortDisplayNames
+	return nil
+}
 
-	i := mathrand.Intn(maxRune - minRune)
-	return rune(minRune + i)
+func randomContentRune(rng *rand.Rand) rune {
+	var totalWeight float64
+	for _, set := range noise {
+		totalWeight += set.weight
+	}
+	x := rng.Float64() * totalWeight
+	// Falls back to the last set, in case of rounding
+	set := noise[len(noise)-1]
+	for _, s := range noise {
+		if x < s.weight {
+			set = s
+			break
+		}
+		x -= s.weight
+	}
+	return set.runes[rng.IntN(len(set.runes))]
 }
 
 const MaxDistortionLevel = 5
 
+// Which runes DistortContent is allowed to replace with noise
+type DistortOptions struct {
+	// Leave spaces and newlines alone, so that you can still tell where the words are
+	PreserveWhitespace bool
+	// Leave punctuation alone
+	PreservePunctuation bool
+}
+
+// What posts on the site are distorted with: readable but corrupted, rather than total
+// mush.
+var DefaultDistortOptions = DistortOptions{PreserveWhitespace: true}
+
+func (o DistortOptions) canDistort(r rune) bool {
+	if o.PreserveWhitespace && unicode.IsSpace(r) {
+		return false
+	}
+	if o.PreservePunctuation && unicode.IsPunct(r) {
+		return false
+	}
+	return true
+}
+
+// Distort the content, with more noise the farther away graphDistance is.
+//
+// Each call gets its own freshly seeded source of randomness, so concurrent requests
+// don't all contend for a shared (locked) one.
 func DistortContent(content string, graphDistance int) string {
+	return DistortContentFromRand(newRand(), content, graphDistance, DefaultDistortOptions)
+}
+
+// Like DistortContent, but using the given source of randomness (the same seed always
+// gives you the same noise) and options.
+func DistortContentFromRand(rng *rand.Rand, content string, graphDistance int, opts DistortOptions) string {
 	if graphDistance == 0 {
 		return content
 	}
-	var builder strings.Builder
-	builder.Grow(len(content))
-
 	// TODO: I think I need to make this subtler. The jump from 2 to 3 is crazy
 	p := min(float32(graphDistance-1)/float32(2*MaxDistortionLevel), 1.0)
 	if p == 0.0 {
 		p = 0.005
 	}
 
+	// The noise runes can take up more bytes than the runes they replace (the "fun
+	// zone" is 3 bytes each in UTF-8), so make room for that. Each replaced rune grows
+	// by at most 2 bytes, and we expect to replace p of them.
+	expectedReplaced := int(math.Ceil(float64(p) * float64(utf8.RuneCountInString(content))))
+	var builder strings.Builder
+	builder.Grow(len(content) + 2*expectedReplaced)
+
 	// TODO: wrap the noise in <mark> tags in a different style?
 	for _, r := range content {
-		if mathrand.Float32() > p {
+		if !opts.canDistort(r) || rng.Float32() > p {
 			builder.WriteRune(r)
 		} else {
-			builder.WriteRune(randomContentRune())
+			builder.WriteRune(randomContentRune(rng))
 		}
 	}
 	return builder.String()
@@ -0,0 +1,153 @@
+package entropy
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistortContentFromRand(t *testing.T) {
+	content := "the quick brown fox jumps over the lazy dog"
+	distort := func(seed uint64) string {
+		return DistortContentFromRand(rand.New(rand.NewPCG(seed, seed)), content, MaxDistortionLevel, DistortOptions{})
+	}
+	assert.Equal(t, distort(1), distort(1))
+	assert.NotEqual(t, content, distort(1))
+	assert.Equal(t, content, DistortContentFromRand(rand.New(rand.NewPCG(1, 1)), content, 0, DistortOptions{}))
+}
+
+func TestDistortContentPreserveWhitespace(t *testing.T) {
+	content := strings.Repeat("the quick brown fox\njumps over the lazy dog. ", 5)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 20 {
+		distorted := DistortContentFromRand(rng, content, MaxDistortionLevel, DistortOptions{PreserveWhitespace: true})
+		assert.NotEqual(t, content, distorted)
+		contentRunes := []rune(content)
+		for i, r := range []rune(distorted) {
+			if unicode.IsSpace(contentRunes[i]) {
+				assert.Equal(t, contentRunes[i], r)
+			}
+		}
+	}
+}
+
+func TestDistortContentPreservePunctuation(t *testing.T) {
+	content := strings.Repeat("!?.,;:'\"", 20)
+	rng := rand.New(rand.NewPCG(1, 2))
+	distorted := DistortContentFromRand(rng, content, MaxDistortionLevel, DistortOptions{PreservePunctuation: true})
+	assert.Equal(t, content, distorted)
+}
+
+// A source that's shared between goroutines, like the package-level math/rand one
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+// Compares distorting with one shared, locked source of randomness against a fresh
+// source per call (which is what DistortContent does).
+func BenchmarkDistortContentParallel(b *testing.B) {
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog ", 6)[:MaxPostLength]
+	b.Run("shared", func(b *testing.B) {
+		shared := rand.New(&lockedSource{src: rand.NewPCG(1, 2)})
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				DistortContentFromRand(shared, content, MaxDistortionLevel, DefaultDistortOptions)
+			}
+		})
+	})
+	b.Run("per-call", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				DistortContent(content, MaxDistortionLevel)
+			}
+		})
+	})
+}
+
+func BenchmarkDistortContent(b *testing.B) {
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog ", 6)[:MaxPostLength]
+	rng := rand.New(rand.NewPCG(1, 2))
+	b.ReportAllocs()
+	for b.Loop() {
+		DistortContentFromRand(rng, content, MaxDistortionLevel, DefaultDistortOptions)
+	}
+}
+
+func TestDistortionConfigValidate(t *testing.T) {
+	assert.Nil(t, DefaultDistortionConfig.Validate())
+	var testCases = []DistortionConfig{
+		{},
+		{NoiseRanges: []NoiseRange{{Min: 'z', Max: 'a', Weight: 1}}},
+		{NoiseRanges: []NoiseRange{{Min: -1, Max: 'a', Weight: 1}}},
+		{NoiseRanges: []NoiseRange{{Min: 'a', Max: unicode.MaxRune + 1, Weight: 1}}},
+		{NoiseRanges: []NoiseRange{{Min: 0xD000, Max: 0xE000, Weight: 1}}},
+		{NoiseRanges: []NoiseRange{{Min: 'a', Max: 'z', Weight: 0}}},
+		{NoiseRanges: []NoiseRange{{Min: 'a', Max: 'z', Weight: 1}, {Min: 'A', Max: 'Z', Weight: -1}}},
+	}
+	for _, config := range testCases {
+		assert.NotNil(t, config.Validate(), config)
+		assert.NotNil(t, SetDistortionConfig(config), config)
+	}
+}
+
+func TestDistortionConfigNoiseRanges(t *testing.T) {
+	config := DistortionConfig{NoiseRanges: []NoiseRange{
+		{Min: 'a', Max: 'c', Weight: 1},
+		{Min: '♠', Max: '♠', Weight: 2},
+	}}
+	assert.Nil(t, SetDistortionConfig(config))
+	t.Cleanup(func() { SetDistortionConfig(DefaultDistortionConfig) })
+
+	content := strings.Repeat("x", 1000)
+	distorted := DistortContentFromRand(rand.New(rand.NewPCG(1, 2)), content, MaxDistortionLevel*3, DistortOptions{})
+	seen := make(map[rune]int)
+	for _, r := range distorted {
+		seen[r]++
+	}
+	// Every rune got replaced, and all of the noise came from the ranges
+	assert.Zero(t, seen['x'])
+	for r := range seen {
+		assert.True(t, ('a' <= r && r <= 'c') || r == '♠', "%q", r)
+	}
+	// Both ends of the ranges are included, and the weights are roughly followed
+	for _, r := range "abc♠" {
+		assert.Positive(t, seen[r], "%q", r)
+	}
+	assert.InDelta(t, 667, seen['♠'], 60)
+}
+
+func TestDistortionNoiseIsPrintable(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 10000 {
+		r := randomContentRune(rng)
+		assert.True(t, unicode.IsPrint(r), "%U", r)
+		assert.False(t, unicode.IsControl(r), "%U", r)
+	}
+
+	// Ranges with unassigned and control characters in them only give the printable ones
+	config := DistortionConfig{NoiseRanges: []NoiseRange{
+		{Min: 0x0000, Max: 0x0020, Weight: 1}, // controls, and then a space
+		{Min: 0x0378, Max: 0x037A, Weight: 1}, // unassigned, unassigned, ͺ
+	}}
+	assert.Nil(t, SetDistortionConfig(config))
+	t.Cleanup(func() { SetDistortionConfig(DefaultDistortionConfig) })
+	seen := make(map[rune]bool)
+	for range 1000 {
+		seen[randomContentRune(rng)] = true
+	}
+	assert.Equal(t, map[rune]bool{' ': true, 0x037A: true}, seen)
+
+	config = DistortionConfig{NoiseRanges: []NoiseRange{{Min: 0x0000, Max: 0x001F, Weight: 1}}}
+	assert.NotNil(t, config.Validate())
+}
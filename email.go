@@ -0,0 +1,125 @@
+package entropy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// How long the link in a verification email works for
+const emailVerificationDuration time.Duration = time.Hour * 48
+
+// Set the user's email address (or remove it, if email is ""). Changing the address
+// means it has to be verified again.
+func SetUserEmail(conn *sqlite.Conn, userID int64, email string) error {
+	query := `
+		update user
+		set
+			email_verified_at = case
+				when email is nullif(:email, '') then email_verified_at
+				else null
+			end,
+			email = nullif(:email, '')
+		where user_id = :userID`
+	return exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetText(":email", email)
+		stmt.SetInt64(":userID", userID)
+		return nil
+	})
+}
+
+// Returns the user's email address ("" if they haven't given one) and whether they've
+// verified it.
+func GetUserEmail(conn *sqlite.Conn, userID int64) (email string, verified bool, err error) {
+	query := "select email, email_verified_at is not null from user where user_id = ?"
+	collect := func(stmt *sqlite.Stmt) error {
+		email = stmt.ColumnText(0)
+		verified = stmt.ColumnInt(1) != 0
+		return nil
+	}
+	err = sqlitex.Exec(conn, query, collect, userID)
+	return email, verified, err
+}
+
+// Make a token for verifying that email is the user's, to send them with
+// SendVerificationEmail. This only writes to the database, so that the email can be sent
+// after the transaction is over, rather than holding up every other write on the mail
+// server.
+func CreateEmailVerification(conn *sqlite.Conn, userID int64, email string) (token string, err error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(tokenBytes)
+	now := utcNow()
+	query := `
+		insert into email_verification (token, user_id, email, created_at, expiration_time)
+		values (?, ?, ?, ?, ?)`
+	err = sqlitex.Exec(conn, query, nil, token, userID, email, now.Unix(), now.Add(emailVerificationDuration).Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Send an email to email with a link to GET /verify, which marks it as verified when they
+// click it. The token comes from CreateEmailVerification.
+//
+// baseURL is the scheme and host to put in front of the link, e.g.
+// "https://entropych.maxhully.net".
+func SendVerificationEmail(ctx context.Context, mailer Mailer, email string, token string, baseURL string) error {
+	link := baseURL + "/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Click this link to verify your email address on entropych.social:\n\n%s\n\n"+
+			"If you didn't sign up for entropych.social, you can ignore this email.",
+		link,
+	)
+	return mailer.Send(ctx, email, "Verify your email address", body)
+}
+
+// Mark the email address that the token was sent to as verified. Returns false if the
+// token doesn't exist or has expired, or if the user has changed their email address
+// since it was sent.
+func VerifyEmail(conn *sqlite.Conn, token string) (verified bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+	var userID int64
+	var email string
+	query := "select user_id, email from email_verification where token = ? and expiration_time > ?"
+	collect := func(stmt *sqlite.Stmt) error {
+		userID = stmt.ColumnInt64(0)
+		email = stmt.ColumnText(1)
+		return nil
+	}
+	if err = sqlitex.Exec(conn, query, collect, token, utcNow().Unix()); err != nil {
+		return false, err
+	}
+	if userID == 0 {
+		return false, nil
+	}
+	query = "update user set email_verified_at = ? where user_id = ? and email = ?"
+	if err = sqlitex.Exec(conn, query, nil, utcNow().Unix(), userID, email); err != nil {
+		return false, err
+	}
+	verified = conn.Changes() > 0
+	// The token is single-use
+	if err = sqlitex.Exec(conn, "delete from email_verification where token = ?", nil, token); err != nil {
+		return false, err
+	}
+	return verified, nil
+}
+
+// Delete the verification tokens that have expired. (The ones that were used are already
+// gone.) Returns how many were deleted.
+func DeleteExpiredEmailVerifications(conn *sqlite.Conn) (int, error) {
+	query := "delete from email_verification where expiration_time <= ?"
+	if err := sqlitex.Exec(conn, query, nil, utcNow().Unix()); err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
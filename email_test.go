@@ -0,0 +1,158 @@
+package entropy
+
+import (
+	"regexp"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+var verifyTokenPattern = regexp.MustCompile(`/verify\?token=([0-9a-f]+)`)
+
+func TestVerifyEmail(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.com"))
+
+	token, err := CreateEmailVerification(conn, user.UserID, "max@example.com")
+	assert.Nil(t, err)
+	mailer := &RecordingMailer{}
+	err = SendVerificationEmail(t.Context(), mailer, "max@example.com", token, "https://example.com")
+	assert.Nil(t, err)
+	sent := mailer.Sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "max@example.com", sent[0].To)
+	match := verifyTokenPattern.FindStringSubmatch(sent[0].Body)
+	assert.NotNil(t, match)
+	assert.Equal(t, token, match[1])
+	assert.Contains(t, sent[0].Body, "https://example.com/verify?token=")
+
+	email, verified, err := GetUserEmail(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "max@example.com", email)
+	assert.False(t, verified)
+
+	verified, err = VerifyEmail(conn, match[1])
+	assert.Nil(t, err)
+	assert.True(t, verified)
+	_, verified, err = GetUserEmail(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.True(t, verified)
+
+	// Tokens only work once
+	verified, err = VerifyEmail(conn, match[1])
+	assert.Nil(t, err)
+	assert.False(t, verified)
+
+	// Setting the same email again doesn't un-verify it, but changing it does
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.com"))
+	_, verified, _ = GetUserEmail(conn, user.UserID)
+	assert.True(t, verified)
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.org"))
+	_, verified, _ = GetUserEmail(conn, user.UserID)
+	assert.False(t, verified)
+}
+
+func TestVerifyEmailAfterChangingEmail(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.com"))
+	token, err := CreateEmailVerification(conn, user.UserID, "max@example.com")
+	assert.Nil(t, err)
+
+	// The link for the old address shouldn't verify the new one
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.org"))
+	verified, err := VerifyEmail(conn, token)
+	assert.Nil(t, err)
+	assert.False(t, verified)
+}
+
+func TestVerifyEmailExpired(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.com"))
+	token, err := CreateEmailVerification(conn, user.UserID, "max@example.com")
+	assert.Nil(t, err)
+
+	err = sqlitex.Exec(conn, "update email_verification set expiration_time = 0", nil)
+	assert.Nil(t, err)
+	verified, err := VerifyEmail(conn, token)
+	assert.Nil(t, err)
+	assert.False(t, verified)
+}
+
+func TestMigrateEmailColumns(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// Pretend this database is from before the email columns were added
+	script := `
+		drop table user;
+		create table user (
+			user_id integer primary key,
+			user_name text not null,
+			password_hash blob,
+			password_salt blob,
+			display_name text,
+			bio text,
+			avatar_upload_id integer references upload (upload_id)
+		);
+		pragma user_version = 5;`
+	assert.Nil(t, sqlitex.ExecScript(conn, script))
+	assert.Nil(t, setUpDb(conn))
+	// Running it again is fine too
+	assert.Nil(t, setUpDb(conn))
+	version, err := getUserVersion(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.com"))
+	email, _, err := GetUserEmail(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, "max@example.com", email)
+}
+
+func TestDeleteExpiredEmailVerifications(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	assert.Nil(t, SetUserEmail(conn, user.UserID, "max@example.com"))
+	_, err = CreateEmailVerification(conn, user.UserID, "max@example.com")
+	assert.Nil(t, err)
+	token, err := CreateEmailVerification(conn, user.UserID, "max@example.com")
+	assert.Nil(t, err)
+	err = sqlitex.Exec(conn, "update email_verification set expiration_time = 0 where token != ?", nil, token)
+	assert.Nil(t, err)
+
+	deleted, err := DeleteExpiredEmailVerifications(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	// The one that hasn't expired still works
+	verified, err := VerifyEmail(conn, token)
+	assert.Nil(t, err)
+	assert.True(t, verified)
+}
@@ -0,0 +1,389 @@
+package entropy
+
+import (
+	"encoding/json"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/james-bowman/sparse"
+)
+
+// The follower graph, with the user IDs mapped onto a dense [0, N) index space so that
+// we can build matrices out of it.
+//
+// Edges are directed: an edge (i, j) means the user at index i follows the user at
+// index j. That matches GetDistanceFromUser (following someone brings *their* posts
+// closer to you, not the other way around).
+type followGraph struct {
+	userIDs []int64       // userIDs[i] is the user ID for index i
+	index   map[int64]int // index[userID] is the inverse of userIDs
+	edges   [][2]int
+}
+
+func (g *followGraph) indexOf(userID int64) int {
+	i, ok := g.index[userID]
+	if !ok {
+		i = len(g.userIDs)
+		g.index[userID] = i
+		g.userIDs = append(g.userIDs, userID)
+	}
+	return i
+}
+
+func loadFollowGraph(conn *sqlite.Conn) (*followGraph, error) {
+	graph := &followGraph{index: make(map[int64]int)}
+	query := "select user_id, followed_user_id from user_follow order by user_id, followed_user_id"
+	collect := func(stmt *sqlite.Stmt) error {
+		i := graph.indexOf(stmt.ColumnInt64(0))
+		j := graph.indexOf(stmt.ColumnInt64(1))
+		graph.edges = append(graph.edges, [2]int{i, j})
+		return nil
+	}
+	err := sqlitex.Exec(conn, query, collect)
+	return graph, err
+}
+
+// Compute the distance between every pair of users who are within maxDepth hops of
+// each other in the follower graph.
+//
+// The result maps {userID, otherUserID} to the length of the shortest chain of follows
+// from userID to otherUserID. Pairs that are farther apart than maxDepth (or not
+// connected at all) are left out, and so is each user's distance to themselves.
+//
+// This works by taking powers of the adjacency matrix: A^k has a non-zero (i, j) entry
+// exactly when there's a walk of length k from i to j, so the first k where that
+// happens is the distance.
+func ComputeAllPairsDistances(conn *sqlite.Conn, maxDepth int) (map[[2]int64]int, error) {
+	graph, err := loadFollowGraph(conn)
+	if err != nil {
+		return nil, err
+	}
+	distances := make(map[[2]int64]int)
+	N := len(graph.userIDs)
+	if N == 0 {
+		return distances, nil
+	}
+
+	dok := sparse.NewDOK(N, N)
+	for _, edge := range graph.edges {
+		dok.Set(edge[0], edge[1], 1.0)
+	}
+	adjacency := dok.ToCSR()
+	power := dok.ToCSR()
+	for depth := 1; depth <= maxDepth; depth++ {
+		power.DoNonZero(func(i, j int, v float64) {
+			if i == j {
+				return
+			}
+			key := [2]int64{graph.userIDs[i], graph.userIDs[j]}
+			if _, seen := distances[key]; !seen {
+				distances[key] = depth
+			}
+		})
+		if depth == maxDepth {
+			break
+		}
+		next := &sparse.CSR{}
+		next.Mul(power, adjacency)
+		// We only care about which entries are non-zero, not how many walks there
+		// are. So squash everything back down to 1, to keep the numbers from blowing
+		// up on big graphs.
+		raw := next.RawMatrix()
+		for k := range raw.Data {
+			raw.Data[k] = 1.0
+		}
+		power = next
+	}
+	return distances, nil
+}
+
+// Like GetDistanceFromUser, but with the true distances in the follower graph, up to
+// maxDepth hops, instead of capping them at MaxDistortionLevel. How garbled to make a post
+// only depends on the capped distance, but recommendations (and curious people) might
+// care how far away someone really is.
+//
+// Users more than maxDepth hops away are left out of the map, and so are users who can't
+// be reached at all: there's no telling those apart without searching further. userID
+// itself is left out too.
+//
+// This is a breadth-first search (see walkFollows).
+func GetDistanceFromUserWithMaxDepth(conn *sqlite.Conn, userID int64, otherUserIDs []int64, maxDepth int) (map[int64]int, error) {
+	wanted := make(map[int64]bool)
+	for _, otherUserID := range otherUserIDs {
+		if otherUserID != userID {
+			wanted[otherUserID] = true
+		}
+	}
+	result := make(map[int64]int)
+	if len(wanted) == 0 {
+		return result, nil
+	}
+	err := walkFollows(conn, userID, maxDepth, func(otherUserID int64, depth int) bool {
+		if wanted[otherUserID] {
+			result[otherUserID] = depth
+		}
+		// Stop early once we've found everyone we're looking for
+		return len(result) < len(wanted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Walk outwards from userID through the people they follow (and the people those people
+// follow, and so on), breadth-first. visit is called once for each user we reach, other
+// than userID, with how many hops away they are. The walk stops after maxDepth hops, or
+// once visit returns false.
+//
+// Each hop is one query, for everyone that the previous hop reached.
+func walkFollows(conn *sqlite.Conn, userID int64, maxDepth int, visit func(otherUserID int64, depth int) bool) error {
+	seen := map[int64]bool{userID: true}
+	frontier := []int64{userID}
+	query := `
+		select distinct followed_user_id
+		from user_follow
+		where user_id in (select value from json_each(?))`
+	keepGoing := true
+	for depth := 1; depth <= maxDepth && len(frontier) > 0 && keepGoing; depth++ {
+		frontierJSON, err := json.Marshal(frontier)
+		if err != nil {
+			return err
+		}
+		var next []int64
+		collect := func(stmt *sqlite.Stmt) error {
+			followedUserID := stmt.ColumnInt64(0)
+			if seen[followedUserID] || !keepGoing {
+				return nil
+			}
+			seen[followedUserID] = true
+			next = append(next, followedUserID)
+			keepGoing = visit(followedUserID, depth)
+			return nil
+		}
+		if err := sqlitex.Exec(conn, query, collect, string(frontierJSON)); err != nil {
+			return err
+		}
+		frontier = next
+	}
+	return nil
+}
+
+// Recompute the distances between every pair of users and store them in the
+// user_distance table, replacing whatever was there before.
+//
+// Invalidation: FollowUser and UnfollowUser throw away the cached distances *from* the
+// user who (un)followed, so their own timeline goes back to the live query right away.
+// But a follow also changes the distances of everyone upstream of that user (anyone
+// whose shortest path runs through them), and we don't try to chase those down. They
+// stay stale until the next time this runs, which seems fine for a nightly job: being
+// a little wrong about how garbled a stranger's post should look isn't a big deal.
+func RecomputeUserDistances(conn *sqlite.Conn) (err error) {
+	defer sqlitex.Save(conn)(&err)
+	// The live query in GetDistanceFromUser goes 4 hops out, and everything past that
+	// is MaxDistortionLevel.
+	distances, err := ComputeAllPairsDistances(conn, MaxDistortionLevel-1)
+	if err != nil {
+		return err
+	}
+	if err = sqlitex.Exec(conn, "delete from user_distance", nil); err != nil {
+		return err
+	}
+	query := `
+		insert into user_distance (user_id, other_user_id, distance)
+		select user_id, user_id, 0 from user`
+	if err = sqlitex.Exec(conn, query, nil); err != nil {
+		return err
+	}
+	query = "insert into user_distance (user_id, other_user_id, distance) values (?, ?, ?)"
+	for key, distance := range distances {
+		if err = sqlitex.Exec(conn, query, nil, key[0], key[1], distance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Like GetDistanceFromUser, but reads the distances from the user_distance table. The
+// returned bool is false if the distances from userID haven't been computed (in which
+// case the map is nil).
+func GetCachedDistanceFromUser(conn *sqlite.Conn, userID int64, otherUserIDs []int64) (map[int64]int, bool, error) {
+	query := `
+		select other_user_id, distance
+		from user_distance
+		where user_id = :userID
+			and (
+				other_user_id = :userID
+				or other_user_id in (select value from json_each(:otherUserIDsJSON))
+			)`
+	otherUserIDsJSON, err := json.Marshal(otherUserIDs)
+	if err != nil {
+		return nil, false, err
+	}
+	computed := false
+	result := make(map[int64]int)
+	collect := func(stmt *sqlite.Stmt) error {
+		otherUserID := stmt.ColumnInt64(0)
+		if otherUserID == userID {
+			computed = true
+			return nil
+		}
+		result[otherUserID] = stmt.ColumnInt(1)
+		return nil
+	}
+	err = exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetText(":otherUserIDsJSON", string(otherUserIDsJSON))
+		return nil
+	})
+	if err != nil || !computed {
+		return nil, false, err
+	}
+	for _, otherUserID := range otherUserIDs {
+		if _, ok := result[otherUserID]; !ok && otherUserID != userID {
+			result[otherUserID] = MaxDistortionLevel
+		}
+	}
+	return result, true, nil
+}
+
+func invalidateCachedDistances(conn *sqlite.Conn, userID int64) error {
+	return sqlitex.Exec(conn, "delete from user_distance where user_id = ?", nil, userID)
+}
+
+// Like GetDistanceFromUser, but using the precomputed distances if we have them
+func lookUpDistancesFromUser(conn *sqlite.Conn, userID int64, otherUserIDs []int64) (map[int64]int, error) {
+	distances, cached, err := GetCachedDistanceFromUser(conn, userID, otherUserIDs)
+	if err != nil || cached {
+		return distances, err
+	}
+	return GetDistanceFromUser(conn, userID, otherUserIDs)
+}
+
+// A user in a FollowSubgraph
+type GraphUser struct {
+	UserID   int64  `json:"id"`
+	UserName string `json:"name"`
+}
+
+// A follow in a FollowSubgraph: Source follows Target
+type GraphFollow struct {
+	Source int64 `json:"source"`
+	Target int64 `json:"target"`
+}
+
+// Some users and the follows between them. The JSON is shaped for a D3 force-directed
+// graph: links refer to nodes by their id.
+type FollowSubgraph struct {
+	Users   []GraphUser   `json:"nodes"`
+	Follows []GraphFollow `json:"links"`
+}
+
+// Get the users with the given IDs (the ones that exist, anyway), and all of the follows
+// between them.
+func GetFollowSubgraph(conn *sqlite.Conn, userIDs []int64) (*FollowSubgraph, error) {
+	subgraph := &FollowSubgraph{Users: []GraphUser{}, Follows: []GraphFollow{}}
+	userIDsJSON, err := json.Marshal(userIDs)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		select user_id, user_name
+		from user
+		where user_id in (select value from json_each(?))
+		order by user_id`
+	collectUser := func(stmt *sqlite.Stmt) error {
+		subgraph.Users = append(subgraph.Users, GraphUser{UserID: stmt.ColumnInt64(0), UserName: stmt.ColumnText(1)})
+		return nil
+	}
+	if err := sqlitex.Exec(conn, query, collectUser, string(userIDsJSON)); err != nil {
+		return nil, err
+	}
+	query = `
+		select user_id, followed_user_id
+		from user_follow
+		where user_id in (select value from json_each(:userIDs))
+		and followed_user_id in (select value from json_each(:userIDs))
+		order by user_id, followed_user_id`
+	collectFollow := func(stmt *sqlite.Stmt) error {
+		subgraph.Follows = append(subgraph.Follows, GraphFollow{Source: stmt.ColumnInt64(0), Target: stmt.ColumnInt64(1)})
+		return nil
+	}
+	err = exec(conn, query, collectFollow, func(stmt *sqlite.Stmt) error {
+		stmt.SetText(":userIDs", string(userIDsJSON))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subgraph, nil
+}
+
+// A user, and how many people follow them
+type FollowedUser struct {
+	User
+	FollowerCount int64
+}
+
+// The (up to) limit users with the most followers, most-followed first. That's the
+// simplest kind of centrality there is, but it gives people somewhere to start.
+func GetMostFollowedUsers(conn *sqlite.Conn, limit int) ([]FollowedUser, error) {
+	var users []FollowedUser
+	query := `
+		select
+			user.user_id,
+			user.user_name,
+			user.display_name,
+			user.bio,
+			user.avatar_upload_id,
+			count(user_follow.user_id) as follower_count
+		from user
+		left join user_follow on user_follow.followed_user_id = user.user_id
+		group by user.user_id
+		order by follower_count desc, user.user_id
+		limit ?`
+	collect := func(stmt *sqlite.Stmt) error {
+		users = append(users, FollowedUser{
+			User: User{
+				UserID:         stmt.ColumnInt64(0),
+				Name:           stmt.ColumnText(1),
+				DisplayName:    stmt.ColumnText(2),
+				Bio:            stmt.ColumnText(3),
+				AvatarUploadID: stmt.ColumnInt64(4),
+			},
+			FollowerCount: stmt.ColumnInt64(5),
+		})
+		return nil
+	}
+	err := sqlitex.Exec(conn, query, collect, limit)
+	return users, err
+}
+
+// The most users that GetNeighborhood returns, so that someone who follows everyone
+// doesn't get us the whole graph
+const MaxNeighborhoodUsers = 500
+
+// Get the subgraph around userID: them, everyone within depth hops of them (following
+// follows outwards, like GetDistanceFromUser does), and all of the follows between those
+// people. If there are more than MaxNeighborhoodUsers of them, the closest ones win.
+func GetNeighborhood(conn *sqlite.Conn, userID int64, depth int) (*FollowSubgraph, error) {
+	userIDs, err := getUserIDsAround(conn, userID, depth, MaxNeighborhoodUsers)
+	if err != nil {
+		return nil, err
+	}
+	return GetFollowSubgraph(conn, userIDs)
+}
+
+// userID and the IDs of the users within depth hops of them, closest first, up to limit
+// users in total
+func getUserIDsAround(conn *sqlite.Conn, userID int64, depth int, limit int) ([]int64, error) {
+	userIDs := []int64{userID}
+	err := walkFollows(conn, userID, depth, func(otherUserID int64, _ int) bool {
+		if len(userIDs) >= limit {
+			return false
+		}
+		userIDs = append(userIDs, otherUserID)
+		return true
+	})
+	return userIDs, err
+}
@@ -0,0 +1,284 @@
+package entropy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeAllPairsDistances(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+
+	conn := db.Get(context.TODO())
+	defer db.Put(conn)
+
+	// max -> luna -> bird -> cat, and cat follows max back. stranger follows nobody.
+	var ids []int64
+	for _, name := range []string{"max", "luna", "bird", "cat", "stranger"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	maxID, lunaID, birdID, catID, strangerID := ids[0], ids[1], ids[2], ids[3], ids[4]
+	_, err := FollowUser(conn, maxID, lunaID)
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, lunaID, birdID)
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, birdID, catID)
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, catID, maxID)
+	assert.Nil(t, err)
+
+	dists, err := ComputeAllPairsDistances(conn, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dists[[2]int64{maxID, lunaID}])
+	assert.Equal(t, 2, dists[[2]int64{maxID, birdID}])
+	assert.Equal(t, 3, dists[[2]int64{maxID, catID}])
+	assert.Equal(t, 1, dists[[2]int64{catID, maxID}])
+	assert.Equal(t, 3, dists[[2]int64{lunaID, maxID}])
+
+	// Capped by maxDepth: luna -> bird -> cat -> max -> luna would be 4, and we never
+	// include the distance from a user to themselves
+	_, ok := dists[[2]int64{lunaID, lunaID}]
+	assert.False(t, ok)
+	// 4 users, each reaching the other 3
+	assert.Equal(t, 12, len(dists))
+	for key := range dists {
+		assert.NotEqual(t, strangerID, key[0])
+		assert.NotEqual(t, strangerID, key[1])
+	}
+
+	dists, err = ComputeAllPairsDistances(conn, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(dists))
+}
+
+func TestComputeAllPairsDistancesEmptyGraph(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+
+	conn := db.Get(context.TODO())
+	defer db.Put(conn)
+
+	dists, err := ComputeAllPairsDistances(conn, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(dists))
+}
+
+func TestCachedDistancesMatchLive(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+
+	conn := db.Get(context.TODO())
+	defer db.Put(conn)
+
+	// A chain a -> b -> c -> d -> e -> f, plus a shortcut a -> d and a loner
+	var ids []int64
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "loner"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := FollowUser(conn, ids[i], ids[i+1])
+		assert.Nil(t, err)
+	}
+	_, err := FollowUser(conn, ids[0], ids[3])
+	assert.Nil(t, err)
+
+	_, cached, err := GetCachedDistanceFromUser(conn, ids[0], ids)
+	assert.Nil(t, err)
+	assert.False(t, cached, "nothing should be cached before RecomputeUserDistances")
+
+	assert.Nil(t, RecomputeUserDistances(conn))
+
+	for _, userID := range ids {
+		live, err := GetDistanceFromUser(conn, userID, ids)
+		assert.Nil(t, err)
+		fromCache, cached, err := GetCachedDistanceFromUser(conn, userID, ids)
+		assert.Nil(t, err)
+		assert.True(t, cached)
+		assert.Equal(t, live, fromCache, "distances from user %d", userID)
+	}
+
+	// Following someone invalidates the follower's cached distances
+	_, err = FollowUser(conn, ids[6], ids[0])
+	assert.Nil(t, err)
+	_, cached, err = GetCachedDistanceFromUser(conn, ids[6], ids)
+	assert.Nil(t, err)
+	assert.False(t, cached)
+}
+
+func TestGetDistanceFromUserWithMaxDepth(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// A chain of 8 follows, from ids[0] to ids[7]. stranger follows (and is followed by)
+	// nobody, and ids[7] follows fan, which doesn't bring fan any closer to ids[0] than 8.
+	var ids []int64
+	for i := range 8 {
+		user, err := CreateUser(conn, fmt.Sprintf("user%d", i), "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	for i := range len(ids) - 1 {
+		follow(t, conn, ids[i], ids[i+1])
+	}
+	stranger, err := CreateUser(conn, "stranger", "pass")
+	assert.Nil(t, err)
+	fan, err := CreateUser(conn, "fan", "pass")
+	assert.Nil(t, err)
+	follow(t, conn, ids[7], fan.UserID)
+	// A shortcut, so that ids[3] is 2 hops away instead of 3
+	follow(t, conn, ids[0], ids[2])
+
+	otherUserIDs := append(slices.Clone(ids), stranger.UserID, fan.UserID)
+	dists, err := GetDistanceFromUserWithMaxDepth(conn, ids[0], otherUserIDs, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int{
+		ids[1]: 1, ids[2]: 1, ids[3]: 2, ids[4]: 3, ids[5]: 4, ids[6]: 5, ids[7]: 6, fan.UserID: 7,
+	}, dists)
+
+	// Beyond maxDepth looks the same as unreachable
+	dists, err = GetDistanceFromUserWithMaxDepth(conn, ids[0], otherUserIDs, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, dists[ids[6]])
+	_, ok := dists[ids[7]]
+	assert.False(t, ok)
+	_, ok = dists[stranger.UserID]
+	assert.False(t, ok)
+
+	// While GetDistanceFromUser caps everything for distortion
+	capped, err := GetDistanceFromUser(conn, ids[0], otherUserIDs)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, capped[ids[5]])
+	assert.Equal(t, MaxDistortionLevel, capped[ids[7]])
+	assert.Equal(t, MaxDistortionLevel, capped[stranger.UserID])
+}
+
+func TestGetFollowSubgraph(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	var ids []int64
+	for _, name := range []string{"a", "b", "c", "d"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	a, b, c, d := ids[0], ids[1], ids[2], ids[3]
+	follow(t, conn, a, b)
+	follow(t, conn, b, c)
+	follow(t, conn, c, a)
+	follow(t, conn, d, c)
+
+	// Only the follows between the users we asked for
+	subgraph, err := GetFollowSubgraph(conn, []int64{a, b, c, 12345})
+	assert.Nil(t, err)
+	assert.Equal(t, []GraphUser{{a, "a"}, {b, "b"}, {c, "c"}}, subgraph.Users)
+	assert.Equal(t, []GraphFollow{{a, b}, {b, c}, {c, a}}, subgraph.Follows)
+
+	around, err := getUserIDsAround(conn, a, 1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{a, b}, around)
+	around, err = getUserIDsAround(conn, d, 5, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{d, c, a, b}, around)
+	around, err = getUserIDsAround(conn, d, 5, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{d, c}, around)
+
+	empty, err := GetFollowSubgraph(conn, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &FollowSubgraph{Users: []GraphUser{}, Follows: []GraphFollow{}}, empty)
+}
+
+func TestGetNeighborhood(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// a -> b -> c -> d, plus a -> e, e -> b, and d -> a (which closes the loop, but
+	// doesn't make d any closer to a)
+	var ids []int64
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	a, b, c, d, e := ids[0], ids[1], ids[2], ids[3], ids[4]
+	follow(t, conn, a, b)
+	follow(t, conn, b, c)
+	follow(t, conn, c, d)
+	follow(t, conn, a, e)
+	follow(t, conn, e, b)
+	follow(t, conn, d, a)
+
+	neighborhood, err := GetNeighborhood(conn, a, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []GraphUser{{a, "a"}}, neighborhood.Users)
+	assert.Empty(t, neighborhood.Follows)
+
+	neighborhood, err = GetNeighborhood(conn, a, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []GraphUser{{a, "a"}, {b, "b"}, {e, "e"}}, neighborhood.Users)
+	// e -> b is in there too: it's the induced subgraph, not just the follows we walked
+	assert.Equal(t, []GraphFollow{{a, b}, {a, e}, {e, b}}, neighborhood.Follows)
+
+	neighborhood, err = GetNeighborhood(conn, a, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []GraphUser{{a, "a"}, {b, "b"}, {c, "c"}, {e, "e"}}, neighborhood.Users)
+	assert.Equal(t, []GraphFollow{{a, b}, {a, e}, {b, c}, {e, b}}, neighborhood.Follows)
+
+	// Going out from d, everyone is within 3 hops: d -> a -> b -> c
+	neighborhood, err = GetNeighborhood(conn, d, 3)
+	assert.Nil(t, err)
+	assert.Len(t, neighborhood.Users, 5)
+	assert.Len(t, neighborhood.Follows, 6)
+}
+
+func TestGetMostFollowedUsers(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	var ids []int64
+	for _, name := range []string{"a", "b", "c", "d"} {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		ids = append(ids, user.UserID)
+	}
+	a, b, c, d := ids[0], ids[1], ids[2], ids[3]
+	follow(t, conn, a, c)
+	follow(t, conn, b, c)
+	follow(t, conn, d, c)
+	follow(t, conn, a, d)
+	follow(t, conn, c, d)
+	follow(t, conn, c, b)
+
+	users, err := GetMostFollowedUsers(conn, 10)
+	assert.Nil(t, err)
+	var names []string
+	var counts []int64
+	for _, user := range users {
+		names = append(names, user.Name)
+		counts = append(counts, user.FollowerCount)
+	}
+	// Ties go to whoever signed up first
+	assert.Equal(t, []string{"c", "d", "b", "a"}, names)
+	assert.Equal(t, []int64{3, 2, 1, 0}, counts)
+
+	users, err = GetMostFollowedUsers(conn, 2)
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+}
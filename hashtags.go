@@ -0,0 +1,59 @@
+package entropy
+
+import (
+	"encoding/json"
+
+	"crawshaw.io/sqlite"
+)
+
+// Record the post's #hashtags, so that it shows up on their pages (see
+// GetPostsWithHashtag)
+func recordPostHashtags(conn *sqlite.Conn, postID int64, content string) error {
+	tags := postHashtags(content)
+	if len(tags) == 0 {
+		return nil
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	query := `
+		insert into post_hashtag (post_id, hashtag)
+		select :postID, value
+		from json_each(:tags)`
+	return exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":postID", postID)
+		stmt.SetText(":tags", string(tagsJSON))
+		return nil
+	})
+}
+
+// Get the posts with the #hashtag (without the "#"), newest first. Like the other
+// timelines, these need to be decorated (with DecoratePosts) before they're shown.
+func GetPostsWithHashtag(conn *sqlite.Conn, hashtag string, before PostCursor, limit int) ([]Post, error) {
+	posts := make([]Post, 0, limit)
+	query := `
+		select
+			post.post_id,
+			user.user_id,
+			user.user_name,
+			user.display_name,
+			post.created_at,
+			post.content,
+			user.avatar_upload_id
+		from post_hashtag
+		join post using (post_id)
+		join user on user.user_id = post.user_id
+		where post_hashtag.hashtag = :hashtag
+			and (post.created_at, post.post_id) < (:before, :beforeID)
+		order by post.created_at desc, post.post_id desc
+		limit :limit`
+	err := exec(conn, query, collectPosts(&posts), func(stmt *sqlite.Stmt) error {
+		stmt.SetText(":hashtag", hashtag)
+		stmt.SetInt64(":before", before.CreatedAt.UnixMilli())
+		stmt.SetInt64(":beforeID", before.PostID)
+		stmt.SetInt64(":limit", int64(limit))
+		return nil
+	})
+	return posts, err
+}
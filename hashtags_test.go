@@ -0,0 +1,45 @@
+package entropy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostHashtags(t *testing.T) {
+	assert.Equal(t, []string{"news", "café"}, postHashtags("#news and **#café**, and #news again"))
+	assert.Empty(t, postHashtags("a#b https://example.com/#anchor `#not_in_code`"))
+}
+
+func TestGetPostsWithHashtag(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	olderID, err := CreatePost(conn, me.UserID, "#news #news")
+	assert.Nil(t, err)
+	_, err = CreatePost(conn, me.UserID, "no tags here (`#news` is in code)")
+	assert.Nil(t, err)
+	newerID, err := ReplyToPost(conn, olderID, me.UserID, "more #news")
+	assert.Nil(t, err)
+
+	before := PostCursor{CreatedAt: time.Now().Add(time.Hour)}
+	posts, err := GetPostsWithHashtag(conn, "news", before, 10)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 2)
+	assert.Equal(t, newerID, posts[0].PostID)
+	assert.Equal(t, olderID, posts[1].PostID)
+
+	// Paging past the last one
+	posts, err = GetPostsWithHashtag(conn, "news", posts[1].Cursor(), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, posts)
+
+	posts, err = GetPostsWithHashtag(conn, "sports", before, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, posts)
+}
@@ -0,0 +1,65 @@
+package entropy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sends emails. This is where a real email provider (SMTP, SES, ...) would plug in;
+// nothing else needs to know how the mail actually gets sent.
+type Mailer interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// A Mailer that writes emails to Out (or stdout, if Out is nil) instead of sending
+// them. Good for development, where the links in them are handy to click on. It's no
+// good anywhere else, since stdout is where the logs go.
+type LogMailer struct {
+	Out io.Writer
+}
+
+func (m LogMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	out := m.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	_, err := fmt.Fprintf(out, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+	return err
+}
+
+// A Mailer that drops every email, for running without any email provider set up.
+// People can still give an email address, but they won't be able to verify it.
+type DiscardMailer struct{}
+
+func (DiscardMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	return nil
+}
+
+type SentEmail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// A Mailer that keeps every email it's asked to send, so that tests can check them.
+type RecordingMailer struct {
+	mu   sync.Mutex
+	sent []SentEmail
+}
+
+func (m *RecordingMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, SentEmail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// The emails sent so far, oldest first
+func (m *RecordingMailer) Sent() []SentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentEmail(nil), m.sent...)
+}
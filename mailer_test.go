@@ -0,0 +1,31 @@
+package entropy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogMailer(t *testing.T) {
+	var out strings.Builder
+	mailer := LogMailer{Out: &out}
+	err := mailer.Send(t.Context(), "max@example.com", "hello", "is anyone there?")
+	assert.Nil(t, err)
+	assert.Equal(t, "To: max@example.com\nSubject: hello\n\nis anyone there?\n\n", out.String())
+}
+
+func TestDiscardMailer(t *testing.T) {
+	var mailer Mailer = DiscardMailer{}
+	assert.Nil(t, mailer.Send(t.Context(), "max@example.com", "hello", "is anyone there?"))
+}
+
+func TestRecordingMailer(t *testing.T) {
+	var mailer Mailer = &RecordingMailer{}
+	assert.Nil(t, mailer.Send(t.Context(), "a@example.com", "one", "first"))
+	assert.Nil(t, mailer.Send(t.Context(), "b@example.com", "two", "second"))
+	assert.Equal(t, []SentEmail{
+		{To: "a@example.com", Subject: "one", Body: "first"},
+		{To: "b@example.com", Subject: "two", Body: "second"},
+	}, mailer.(*RecordingMailer).Sent())
+}
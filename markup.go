@@ -0,0 +1,261 @@
+package entropy
+
+import (
+	"html/template"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A tiny, safe subset of markdown for user-written text:
+//
+//	**bold**, *italic*, [links](https://example.com), bare https:// URLs, and line breaks.
+//
+// Everything else is HTML-escaped. We never pass user-written HTML through, we only
+// emit tags that we generate ourselves, so there's no sanitizer to get wrong.
+var inlineMarkupPattern = regexp.MustCompile(
+	`\*\*(.+?)\*\*` + // 1: bold
+		`|\*(.+?)\*` + // 2: italic
+		`|\[([^\[\]]+)\]\(([^()\s]+)\)` + // 3, 4: [text](url)
+		`|(https?://[^\s<>"]+)`, // 5: bare URL
+)
+
+// Returns the URL if it's an absolute http(s) URL that's safe to put in an href, and
+// "" otherwise. (No javascript: URLs, please.)
+func safeLinkURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+func writeLink(b *strings.Builder, href string, text string) {
+	b.WriteString(`<a href="`)
+	b.WriteString(template.HTMLEscapeString(href))
+	b.WriteString(`" rel="nofollow noopener noreferrer">`)
+	b.WriteString(text)
+	b.WriteString("</a>")
+}
+
+func renderInlineMarkup(b *strings.Builder, text string) {
+	last := 0
+	for _, m := range inlineMarkupPattern.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(template.HTMLEscapeString(text[last:m[0]]))
+		last = m[1]
+		switch {
+		case m[2] >= 0:
+			b.WriteString("<strong>")
+			renderInlineMarkup(b, text[m[2]:m[3]])
+			b.WriteString("</strong>")
+		case m[4] >= 0:
+			b.WriteString("<em>")
+			renderInlineMarkup(b, text[m[4]:m[5]])
+			b.WriteString("</em>")
+		case m[6] >= 0:
+			linkText := template.HTMLEscapeString(text[m[6]:m[7]])
+			if href := safeLinkURL(text[m[8]:m[9]]); href != "" {
+				writeLink(b, href, linkText)
+			} else {
+				// Not a URL we're willing to link to, so leave the whole thing as text
+				b.WriteString(template.HTMLEscapeString(text[m[0]:m[1]]))
+			}
+		case m[10] >= 0:
+			rawURL := text[m[10]:m[11]]
+			// Trailing punctuation is much more likely to be the end of a sentence
+			// than part of the URL
+			trimmed := strings.TrimRight(rawURL, ".,;:!?")
+			if href := safeLinkURL(trimmed); href != "" {
+				writeLink(b, href, template.HTMLEscapeString(trimmed))
+				b.WriteString(template.HTMLEscapeString(rawURL[len(trimmed):]))
+			} else {
+				b.WriteString(template.HTMLEscapeString(rawURL))
+			}
+		}
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+}
+
+// Render a user's bio, with the limited formatting described above.
+func RenderBio(bio string) template.HTML {
+	var b strings.Builder
+	bio = strings.ReplaceAll(bio, "\r\n", "\n")
+	for i, line := range strings.Split(bio, "\n") {
+		if i > 0 {
+			b.WriteString("<br>")
+		}
+		renderInlineMarkup(&b, line)
+	}
+	return template.HTML(b.String())
+}
+
+// Posts get a different subset: **bold**, *italic*, `inline code`, bare https:// URLs,
+// @mentions, and #hashtags. (No [text](url) links, since the text is the only part of a
+// link that we could distort.)
+//
+// Mentions and hashtags have to start a word, so that emails and URL fragments don't
+// turn into links.
+var postMarkupPattern = regexp.MustCompile(
+	`\*\*(.+?)\*\*` + // 1: bold
+		`|\*(.+?)\*` + // 2: italic
+		"|`([^`]+)`" + // 3: code
+		`|(https?://[^\s<>"]+)` + // 4: bare URL
+		`|\B@([A-Za-z0-9_]+)` + // 5: mention
+		`|\B#([\p{L}\p{N}_]+)`, // 6: hashtag
+)
+
+// The path of the page for a hashtag (without the "#")
+func TagURL(tag string) string {
+	return "/tags/" + url.PathEscape(tag) + "/"
+}
+
+// A piece of a post's content: either a run of plain text, or some formatting around
+// more pieces (or, for code and links, around plain text).
+type postMarkupNode struct {
+	tag      string // "strong", "em", "code" or "a", or "" for plain text
+	marker   string // what the formatting looked like in the post, e.g. "**"
+	text     string // for plain text, code, and links
+	href     string // for links
+	external bool   // whether the link goes off the site
+	userName string // for mentions, who's mentioned
+	hashtag  string // for hashtags, the tag (without the "#")
+	children []postMarkupNode
+}
+
+func parsePostMarkup(text string) []postMarkupNode {
+	var nodes []postMarkupNode
+	last := 0
+	for _, m := range postMarkupPattern.FindAllStringSubmatchIndex(text, -1) {
+		if m[0] > last {
+			nodes = append(nodes, postMarkupNode{text: text[last:m[0]]})
+		}
+		last = m[1]
+		switch {
+		case m[2] >= 0:
+			nodes = append(nodes, postMarkupNode{tag: "strong", marker: "**", children: parsePostMarkup(text[m[2]:m[3]])})
+		case m[4] >= 0:
+			nodes = append(nodes, postMarkupNode{tag: "em", marker: "*", children: parsePostMarkup(text[m[4]:m[5]])})
+		case m[6] >= 0:
+			nodes = append(nodes, postMarkupNode{tag: "code", marker: "`", text: text[m[6]:m[7]]})
+		case m[8] >= 0:
+			// Trailing punctuation is much more likely to be the end of a sentence
+			// than part of the URL
+			rawURL := text[m[8]:m[9]]
+			trimmed := strings.TrimRight(rawURL, ".,;:!?")
+			if href := safeLinkURL(trimmed); href != "" {
+				nodes = append(nodes, postMarkupNode{tag: "a", text: trimmed, href: href, external: true})
+				rawURL = rawURL[len(trimmed):]
+			}
+			if rawURL != "" {
+				nodes = append(nodes, postMarkupNode{text: rawURL})
+			}
+		case m[10] >= 0:
+			userName := text[m[10]:m[11]]
+			nodes = append(nodes, postMarkupNode{tag: "a", text: text[m[0]:m[1]], href: UserURL(userName), userName: userName})
+		case m[12] >= 0:
+			hashtag := text[m[12]:m[13]]
+			nodes = append(nodes, postMarkupNode{tag: "a", text: text[m[0]:m[1]], href: TagURL(hashtag), hashtag: hashtag})
+		}
+	}
+	if last < len(text) {
+		nodes = append(nodes, postMarkupNode{text: text[last:]})
+	}
+	return nodes
+}
+
+// The names of the users that the content @-mentions, without duplicates. Like the
+// links, these don't count inside `code`.
+func mentionedUserNames(content string) []string {
+	var names []string
+	var walk func(nodes []postMarkupNode)
+	walk = func(nodes []postMarkupNode) {
+		for _, node := range nodes {
+			if node.userName != "" && !slices.Contains(names, node.userName) {
+				names = append(names, node.userName)
+			}
+			walk(node.children)
+		}
+	}
+	walk(parsePostMarkup(content))
+	return names
+}
+
+// The content's #hashtags (without the "#"s), without duplicates. Like mentions, these
+// don't count inside `code`.
+func postHashtags(content string) []string {
+	var tags []string
+	var walk func(nodes []postMarkupNode)
+	walk = func(nodes []postMarkupNode) {
+		for _, node := range nodes {
+			if node.hashtag != "" && !slices.Contains(tags, node.hashtag) {
+				tags = append(tags, node.hashtag)
+			}
+			walk(node.children)
+		}
+	}
+	walk(parsePostMarkup(content))
+	return tags
+}
+
+func distortPostMarkup(nodes []postMarkupNode, distortText func(string) string) {
+	for i := range nodes {
+		if nodes[i].text != "" {
+			nodes[i].text = distortText(nodes[i].text)
+		}
+		distortPostMarkup(nodes[i].children, distortText)
+	}
+}
+
+func writePostMarkupHTML(b *strings.Builder, nodes []postMarkupNode) {
+	for _, node := range nodes {
+		text := template.HTMLEscapeString(node.text)
+		switch {
+		case node.tag == "":
+			b.WriteString(text)
+		case node.tag == "a" && node.external:
+			writeLink(b, node.href, text)
+		case node.tag == "a":
+			b.WriteString(`<a href="` + template.HTMLEscapeString(node.href) + `">` + text + "</a>")
+		default:
+			b.WriteString("<" + node.tag + ">" + text)
+			writePostMarkupHTML(b, node.children)
+			b.WriteString("</" + node.tag + ">")
+		}
+	}
+}
+
+// Writes the nodes back out as text, with the formatting markers where they were
+func writePostMarkupText(b *strings.Builder, nodes []postMarkupNode) {
+	for _, node := range nodes {
+		b.WriteString(node.marker)
+		b.WriteString(node.text)
+		writePostMarkupText(b, node.children)
+		b.WriteString(node.marker)
+	}
+}
+
+// Distort the text of a post's content, but not its formatting. Returns the distorted
+// content as text (with the formatting markers intact) and as HTML.
+//
+// The formatting is parsed from the clean content first, so the noise can't break it: a
+// "*" or "#" that distortion puts into the text is just a "*" or a "#". Links keep their
+// clean hrefs, and only their text is distorted.
+func distortPostContent(content string, distortText func(string) string) (string, template.HTML) {
+	nodes := parsePostMarkup(content)
+	if distortText != nil {
+		distortPostMarkup(nodes, distortText)
+	}
+	var text, html strings.Builder
+	writePostMarkupText(&text, nodes)
+	writePostMarkupHTML(&html, nodes)
+	return text.String(), template.HTML(html.String())
+}
+
+// Render a post's content with the formatting described above. distortText (if it's not
+// nil) is applied to the text in between the formatting, after the formatting has been
+// parsed.
+func RenderPostContent(content string, distortText func(string) string) template.HTML {
+	_, html := distortPostContent(content, distortText)
+	return html
+}
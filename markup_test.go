@@ -0,0 +1,126 @@
+package entropy
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderBio(t *testing.T) {
+	var testCases = []struct {
+		bio      string
+		expected string
+	}{
+		{"plain old bio", "plain old bio"},
+		{"**bold** and *italic*", "<strong>bold</strong> and <em>italic</em>"},
+		{"**bold [link](https://example.com)**",
+			`<strong>bold <a href="https://example.com" rel="nofollow noopener noreferrer">link</a></strong>`},
+		{"line one\nline two\r\nline three", "line one<br>line two<br>line three"},
+		{"my [site](https://example.com/a?b=1&c=2)",
+			`my <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">site</a>`},
+		{"see https://example.com.",
+			`see <a href="https://example.com" rel="nofollow noopener noreferrer">https://example.com</a>.`},
+		{"2 * 3 = 6", "2 * 3 = 6"},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, string(RenderBio(testCase.bio)))
+	}
+}
+
+func TestRenderBioIsXSSSafe(t *testing.T) {
+	var testCases = []string{
+		`<script>alert(1)</script>`,
+		`**<script>alert(1)</script>**`,
+		`[click me](javascript:alert(1))`,
+		`[<img src=x onerror=alert(1)>](https://example.com)`,
+		`https://example.com/"><script>alert(1)</script>`,
+		`<a href="javascript:alert(1)">hi</a>`,
+	}
+	for _, bio := range testCases {
+		rendered := string(RenderBio(bio))
+		assert.NotContains(t, rendered, "<script")
+		assert.NotContains(t, rendered, "<img")
+		assert.NotContains(t, rendered, `href="javascript`)
+	}
+	assert.Equal(t, "&lt;script&gt;alert(1)&lt;/script&gt;", string(RenderBio(`<script>alert(1)</script>`)))
+}
+
+func TestRenderPostContent(t *testing.T) {
+	var testCases = []struct {
+		content  string
+		expected string
+	}{
+		{"plain old post", "plain old post"},
+		{"**bold** and *italic*", "<strong>bold</strong> and <em>italic</em>"},
+		{"**bold *and italic* too**", "<strong>bold <em>and italic</em> too</strong>"},
+		{"run `rm -rf *` at *your own risk*", "run <code>rm -rf *</code> at <em>your own risk</em>"},
+		{"2 * 3 = 6", "2 * 3 = 6"},
+		{"**unfinished", "**unfinished"},
+		{"[no links](/here)", "[no links](/here)"},
+		{"<b>hi</b> & **<i>bye</i>**", "&lt;b&gt;hi&lt;/b&gt; &amp; <strong>&lt;i&gt;bye&lt;/i&gt;</strong>"},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, string(RenderPostContent(testCase.content, nil)))
+	}
+}
+
+func TestRenderPostContentDistortsOnlyTheText(t *testing.T) {
+	// The worst case: noise that's all asterisks (except for the spaces, like the real
+	// distortion)
+	allStars := func(text string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return r
+			}
+			return '*'
+		}, text)
+	}
+	assert.Equal(t,
+		"*** <strong>****</strong> <em>*****</em> <code>***</code>",
+		string(RenderPostContent("not **bold** *quite* `rly`", allStars)),
+	)
+
+	text, html := distortPostContent("**hi** there", strings.ToUpper)
+	assert.Equal(t, "**HI** THERE", text)
+	assert.Equal(t, "<strong>HI</strong> THERE", string(html))
+
+	// Noise that looks like HTML is still escaped
+	_, html = distortPostContent("*hi*", func(string) string { return "<script>" })
+	assert.Equal(t, "<em>&lt;script&gt;</em>", string(html))
+}
+
+func TestRenderPostContentLinks(t *testing.T) {
+	var testCases = []struct {
+		content  string
+		expected string
+	}{
+		{"hi @max, see #news at https://example.com/a?b=1&c=2.",
+			`hi <a href="/u/max/">@max</a>, see <a href="/tags/news/">#news</a> at ` +
+				`<a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">https://example.com/a?b=1&amp;c=2</a>.`},
+		{"**#bold** *@italic*", `<strong><a href="/tags/bold/">#bold</a></strong> <em><a href="/u/italic/">@italic</a></em>`},
+		{"#café #1", `<a href="/tags/caf%C3%A9/">#café</a> <a href="/tags/1/">#1</a>`},
+		// Not at the start of a word
+		{"max@example.com and a#b", "max@example.com and a#b"},
+		{"https://example.com/#anchor", `<a href="https://example.com/#anchor" rel="nofollow noopener noreferrer">https://example.com/#anchor</a>`},
+		{"`#not @links`", "<code>#not @links</code>"},
+		{"javascript:alert(1) #", "javascript:alert(1) #"},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, string(RenderPostContent(testCase.content, nil)))
+	}
+}
+
+func TestRenderPostContentNoiseDoesntMakeLinks(t *testing.T) {
+	// Noise that happens to look like a hashtag, a mention, and a URL
+	noise := func(text string) string {
+		return text + " #noise @noise https://noise.example"
+	}
+	html := RenderPostContent("hi #tag", noise)
+	assert.Equal(t,
+		`hi  #noise @noise https://noise.example`+
+			`<a href="/tags/tag/">#tag #noise @noise https://noise.example</a>`,
+		string(html),
+	)
+}
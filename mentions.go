@@ -0,0 +1,66 @@
+package entropy
+
+import (
+	"encoding/json"
+
+	"crawshaw.io/sqlite"
+)
+
+// Record the users that the post @-mentions, so that it shows up in their mentions (see
+// GetMentions). Names that aren't anybody are skipped, and so is the author mentioning
+// themselves.
+func recordPostMentions(conn *sqlite.Conn, postID int64, authorUserID int64, content string) error {
+	names := mentionedUserNames(content)
+	if len(names) == 0 {
+		return nil
+	}
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	query := `
+		insert into post_mention (post_id, mentioned_user_id)
+		select :postID, user_id
+		from user
+		where user_name in (select value from json_each(:names))
+		and user_id != :authorUserID`
+	return exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":postID", postID)
+		stmt.SetText(":names", string(namesJSON))
+		stmt.SetInt64(":authorUserID", authorUserID)
+		return nil
+	})
+}
+
+// Get the posts that @-mention the user, newest first. Like the other timelines, these
+// need to be decorated (with DecoratePosts) before they're shown.
+//
+// TODO: leave out posts from people the user blocked, once there's such a thing as
+// blocking.
+func GetMentions(conn *sqlite.Conn, userID int64, before PostCursor, limit int) ([]Post, error) {
+	posts := make([]Post, 0, limit)
+	query := `
+		select
+			post.post_id,
+			user.user_id,
+			user.user_name,
+			user.display_name,
+			post.created_at,
+			post.content,
+			user.avatar_upload_id
+		from post_mention
+		join post using (post_id)
+		join user on user.user_id = post.user_id
+		where post_mention.mentioned_user_id = :userID
+			and (post.created_at, post.post_id) < (:before, :beforeID)
+		order by post.created_at desc, post.post_id desc
+		limit :limit`
+	err := exec(conn, query, collectPosts(&posts), func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetInt64(":before", before.CreatedAt.UnixMilli())
+		stmt.SetInt64(":beforeID", before.PostID)
+		stmt.SetInt64(":limit", int64(limit))
+		return nil
+	})
+	return posts, err
+}
@@ -0,0 +1,51 @@
+package entropy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMentionedUserNames(t *testing.T) {
+	assert.Equal(t, []string{"max", "someone"}, mentionedUserNames("hi @max and **@someone**, and @max again"))
+	assert.Empty(t, mentionedUserNames("max@example.com `@not_in_code`"))
+}
+
+func TestGetMentions(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	mentionID, err := CreatePost(conn, other.UserID, "hey @me, and @nobody")
+	assert.Nil(t, err)
+	_, err = CreatePost(conn, other.UserID, "not about me (`@me` is in code)")
+	assert.Nil(t, err)
+	_, err = CreatePost(conn, me.UserID, "talking to myself, @me")
+	assert.Nil(t, err)
+	replyID, err := ReplyToPost(conn, mentionID, me.UserID, "@other hi!")
+	assert.Nil(t, err)
+
+	before := PostCursor{CreatedAt: time.Now().Add(time.Hour)}
+	mentions, err := GetMentions(conn, me.UserID, before, 10)
+	assert.Nil(t, err)
+	assert.Len(t, mentions, 1)
+	assert.Equal(t, mentionID, mentions[0].PostID)
+	assert.Equal(t, "other", mentions[0].UserName)
+	assert.Nil(t, DecoratePosts(conn, me, mentions))
+
+	mentions, err = GetMentions(conn, other.UserID, before, 10)
+	assert.Nil(t, err)
+	assert.Len(t, mentions, 1)
+	assert.Equal(t, replyID, mentions[0].PostID)
+
+	// Paging past the last one
+	mentions, err = GetMentions(conn, other.UserID, mentions[0].Cursor(), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, mentions)
+}
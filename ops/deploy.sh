@@ -28,6 +28,7 @@ rsync --progress --checksum ops/entropych.maxhully.net.conf "$server_ssh:/etc/ng
 rsync --progress build/server "$server_ssh:$remote_binary_version"
 rsync --progress build/bots "$server_ssh:/home/entropych/bin/bots"
 rsync --progress build/backfill_avatars "$server_ssh:/home/entropych/bin/backfill_avatars"
+rsync --progress build/recompute_distances "$server_ssh:/home/entropych/bin/recompute_distances"
 # TODO: embed this in the binary, so that it's deployed as part of the single step below
 rsync -rv --progress --exclude=".DS_Store" ./static/ "$server_ssh:/home/entropych/static"
 # shellcheck disable=SC2087
@@ -0,0 +1,93 @@
+package entropy
+
+import (
+	"encoding/json"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// How long a peek at a post lasts
+const DefaultPeekDuration time.Duration = time.Minute * 10
+
+// Let the user see the post with one less level of distortion until ttl from now. Peeking
+// again while the last peek is still active takes off another level (and restarts the
+// clock), so you can gradually decode a post from far away in the follower graph.
+//
+// Returns false if the post doesn't exist.
+func GrantPeek(conn *sqlite.Conn, userID int64, postID int64, ttl time.Duration) (bool, error) {
+	query := "select 1 from post where post_id = ?"
+	exists := false
+	collect := func(stmt *sqlite.Stmt) error {
+		exists = true
+		return nil
+	}
+	if err := sqlitex.Exec(conn, query, collect, postID); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	now := utcNow()
+	query = `
+		insert into post_peek (user_id, post_id, peek_level, expires_at)
+		values (:userID, :postID, 1, :expiresAt)
+		on conflict (user_id, post_id) do update
+		set
+			peek_level = case
+				when expires_at > :now then min(peek_level + 1, :maxLevel)
+				else 1
+			end,
+			expires_at = :expiresAt`
+	err := exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetInt64(":postID", postID)
+		stmt.SetInt64(":expiresAt", now.Add(ttl).Unix())
+		stmt.SetInt64(":now", now.Unix())
+		stmt.SetInt64(":maxLevel", MaxDistortionLevel)
+		return nil
+	})
+	return true, err
+}
+
+// Returns a map from post ID to peek level, for the posts that the user has an active
+// peek at.
+func getActivePeeks(conn *sqlite.Conn, userID int64, posts []Post) (map[int64]int, error) {
+	postIDs := make([]int64, len(posts))
+	for i := range posts {
+		postIDs[i] = posts[i].PostID
+	}
+	postIDsJSON, err := json.Marshal(postIDs)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		select post_id, peek_level
+		from post_peek
+		where user_id = :userID
+			and expires_at > :now
+			and post_id in (select value from json_each(:postIDsJSON))`
+	peeks := make(map[int64]int)
+	collect := func(stmt *sqlite.Stmt) error {
+		peeks[stmt.ColumnInt64(0)] = stmt.ColumnInt(1)
+		return nil
+	}
+	err = exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetInt64(":now", utcNow().Unix())
+		stmt.SetText(":postIDsJSON", string(postIDsJSON))
+		return nil
+	})
+	return peeks, err
+}
+
+// Delete the peeks that have run out. (GrantPeek starts over from scratch after one runs
+// out anyway.) Returns how many were deleted.
+func DeleteExpiredPeeks(conn *sqlite.Conn) (int, error) {
+	query := "delete from post_peek where expires_at <= ?"
+	if err := sqlitex.Exec(conn, query, nil, utcNow().Unix()); err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
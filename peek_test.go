@@ -0,0 +1,96 @@
+package entropy
+
+import (
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantPeek(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	stranger, err := CreateUser(conn, "stranger", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, stranger.UserID, "hello from far away")
+	assert.Nil(t, err)
+
+	getPost := func() Post {
+		post, err := GetPost(conn, postID)
+		assert.Nil(t, err)
+		posts := []Post{*post}
+		assert.Nil(t, DecoratePosts(conn, me, posts))
+		return posts[0]
+	}
+	post := getPost()
+	assert.Equal(t, MaxDistortionLevel, post.DistanceFromUser)
+	assert.Equal(t, 0, post.PeekLevel)
+	assert.True(t, post.CanPeek())
+
+	found, err := GrantPeek(conn, me.UserID, postID, time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	post = getPost()
+	assert.Equal(t, MaxDistortionLevel, post.DistanceFromUser)
+	assert.Equal(t, 1, post.PeekLevel)
+
+	// Peeking again gets you closer, but never all the way
+	for range 2 * MaxDistortionLevel {
+		_, err = GrantPeek(conn, me.UserID, postID, time.Minute)
+		assert.Nil(t, err)
+	}
+	post = getPost()
+	assert.Equal(t, MaxDistortionLevel-1, post.PeekLevel)
+	assert.False(t, post.CanPeek())
+
+	// Once the peek expires, the post goes back to being far away, and peeking starts
+	// over
+	err = sqlitex.Exec(conn, "update post_peek set expires_at = ?", nil, utcNow().Add(-time.Second).Unix())
+	assert.Nil(t, err)
+	post = getPost()
+	assert.Equal(t, 0, post.PeekLevel)
+	_, err = GrantPeek(conn, me.UserID, postID, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, getPost().PeekLevel)
+
+	found, err = GrantPeek(conn, me.UserID, postID+1, time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestDeleteExpiredPeeks(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	stranger, err := CreateUser(conn, "stranger", "pass")
+	assert.Nil(t, err)
+	expiredID, err := CreatePost(conn, stranger.UserID, "peeked at a while ago")
+	assert.Nil(t, err)
+	activeID, err := CreatePost(conn, stranger.UserID, "peeked at just now")
+	assert.Nil(t, err)
+	_, err = GrantPeek(conn, me.UserID, expiredID, -time.Second)
+	assert.Nil(t, err)
+	_, err = GrantPeek(conn, me.UserID, activeID, time.Minute)
+	assert.Nil(t, err)
+
+	deleted, err := DeleteExpiredPeeks(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	posts := []Post{{PostID: expiredID}, {PostID: activeID}}
+	peeks, err := getActivePeeks(conn, me.UserID, posts)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int{activeID: 1}, peeks)
+	count, err := sqlitex.ResultInt(conn.Prep("select count(*) from post_peek"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,47 @@
+package entropy
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Pin the post to the top of the user's profile, in place of whatever was pinned before.
+// The post stays in its usual place in the user's timeline as well: we don't take it out,
+// so that paging through the timeline works the same whether or not there's a pinned post.
+//
+// Returns false if the post doesn't exist or isn't the user's own post.
+func PinPost(conn *sqlite.Conn, userID int64, postID int64) (bool, error) {
+	query := `
+		update user
+		set pinned_post_id = :postID
+		where user_id = :userID
+			and exists (select 1 from post where post_id = :postID and user_id = :userID)`
+	err := exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":userID", userID)
+		stmt.SetInt64(":postID", postID)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return conn.Changes() > 0, nil
+}
+
+// Unpin the post from the user's profile. Does nothing if it isn't the one that's pinned.
+func UnpinPost(conn *sqlite.Conn, userID int64, postID int64) error {
+	query := "update user set pinned_post_id = null where user_id = ? and pinned_post_id = ?"
+	return sqlitex.Exec(conn, query, nil, userID, postID)
+}
+
+// Returns the ID of the post that the user pinned to their profile, or 0 if they haven't
+// pinned anything.
+func GetPinnedPostID(conn *sqlite.Conn, userID int64) (int64, error) {
+	var postID int64
+	collect := func(stmt *sqlite.Stmt) error {
+		postID = stmt.ColumnInt64(0)
+		return nil
+	}
+	query := "select pinned_post_id from user where user_id = ? and pinned_post_id is not null"
+	err := sqlitex.Exec(conn, query, collect, userID)
+	return postID, err
+}
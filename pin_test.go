@@ -0,0 +1,59 @@
+package entropy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinPost(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	myPostID, err := CreatePost(conn, me.UserID, "mine")
+	assert.Nil(t, err)
+	myOtherPostID, err := CreatePost(conn, me.UserID, "also mine")
+	assert.Nil(t, err)
+	theirPostID, err := CreatePost(conn, other.UserID, "theirs")
+	assert.Nil(t, err)
+
+	pinnedID, err := GetPinnedPostID(conn, me.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), pinnedID)
+
+	pinned, err := PinPost(conn, me.UserID, myPostID)
+	assert.Nil(t, err)
+	assert.True(t, pinned)
+	pinnedID, err = GetPinnedPostID(conn, me.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, myPostID, pinnedID)
+
+	// You can't pin other people's posts, or posts that don't exist
+	pinned, err = PinPost(conn, me.UserID, theirPostID)
+	assert.Nil(t, err)
+	assert.False(t, pinned)
+	pinned, err = PinPost(conn, me.UserID, theirPostID+100)
+	assert.Nil(t, err)
+	assert.False(t, pinned)
+	pinnedID, _ = GetPinnedPostID(conn, me.UserID)
+	assert.Equal(t, myPostID, pinnedID)
+
+	// Pinning another post replaces the old one
+	pinned, err = PinPost(conn, me.UserID, myOtherPostID)
+	assert.Nil(t, err)
+	assert.True(t, pinned)
+	// Unpinning a post that isn't pinned does nothing
+	assert.Nil(t, UnpinPost(conn, me.UserID, myPostID))
+	pinnedID, _ = GetPinnedPostID(conn, me.UserID)
+	assert.Equal(t, myOtherPostID, pinnedID)
+
+	assert.Nil(t, UnpinPost(conn, me.UserID, myOtherPostID))
+	pinnedID, _ = GetPinnedPostID(conn, me.UserID)
+	assert.Equal(t, int64(0), pinnedID)
+}
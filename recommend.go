@@ -1,22 +1,91 @@
 package entropy
 
 import (
-	mathrand "math/rand"
+	"fmt"
+	"math/rand/v2"
 	"sort"
-	"time"
 
 	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
 )
 
-func getPostsForLoggedInUser(conn *sqlite.Conn, user *User, before time.Time, limit int) ([]Post, error) {
+// Knobs for GetRecommendedPosts
+type RecommendConfig struct {
+	// The source of randomness for mixing the posts together and distorting them. If
+	// it's nil, we use a freshly seeded one. (Tests can set it to get the same posts
+	// every time.)
+	Rand *rand.Rand
+	// Use this feed mode instead of the user's own setting, if it's not ""
+	FeedMode FeedMode
+}
+
+// How a logged in user's homepage feed is put together
+type FeedMode string
+
+const (
+	// Posts from the people you follow, mixed up with posts from randos (the default)
+	FeedModeChaos FeedMode = "chaos"
+	// Only posts from the people you follow, newest first
+	FeedModeChronological FeedMode = "chronological"
+)
+
+func (m FeedMode) Valid() bool {
+	return m == FeedModeChaos || m == FeedModeChronological
+}
+
+// Returns FeedModeChaos if the user hasn't picked one
+func GetFeedMode(conn *sqlite.Conn, userID int64) (FeedMode, error) {
+	mode := FeedModeChaos
+	collect := func(stmt *sqlite.Stmt) error {
+		mode = FeedMode(stmt.ColumnText(0))
+		return nil
+	}
+	query := "select feed_mode from user where user_id = ? and feed_mode is not null"
+	err := sqlitex.Exec(conn, query, collect, userID)
+	return mode, err
+}
+
+func SetFeedMode(conn *sqlite.Conn, userID int64, mode FeedMode) error {
+	if !mode.Valid() {
+		return fmt.Errorf("invalid feed mode %q", mode)
+	}
+	return sqlitex.Exec(conn, "update user set feed_mode = ? where user_id = ?", nil, string(mode), userID)
+}
+
+// Take the first limit posts, and report whether there were any more after them
+func takePosts(posts []Post, limit int) ([]Post, bool) {
+	if len(posts) > limit {
+		return posts[:limit], true
+	}
+	return posts, false
+}
+
+// Whether the post comes after the cursor, in the order the queries return posts (newest
+// first, with the post ID breaking ties)
+func isBefore(post *Post, cursor PostCursor) bool {
+	if !post.CreatedAt.Equal(cursor.CreatedAt) {
+		return post.CreatedAt.Before(cursor.CreatedAt)
+	}
+	return post.PostID < cursor.PostID
+}
+
+// The returned bool is whether there are more posts left over before the last one.
+//
+// Whichever list we take fewer posts from can have leftovers that are newer than the last
+// post on the page. The next page starts before that post, so those never get shown.
+// (That's the chaos.) They don't count as more posts, either, so the next page is never
+// empty.
+func getPostsForLoggedInUser(conn *sqlite.Conn, rng *rand.Rand, user *User, before PostCursor, limit int) ([]Post, bool, error) {
 	var posts []Post
-	followedPosts, err := GetRecentPostsFromFollowedUsers(conn, user.UserID, before, limit)
+	// We fetch one extra post from each, so that we can tell if there's anything left
+	// over once we've taken limit posts.
+	followedPosts, err := GetRecentPostsFromFollowedUsers(conn, user.UserID, before, limit+1)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	chaosPosts, err := GetRecentPostsFromRandos(conn, user.UserID, before, limit)
+	chaosPosts, err := GetRecentPostsFromRandos(conn, user.UserID, before, limit+1)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	posts = make([]Post, 0, limit)
 	for range limit {
@@ -29,7 +98,7 @@ func getPostsForLoggedInUser(conn *sqlite.Conn, user *User, before time.Time, li
 		} else if len(chaosPosts) == 0 {
 			takeFollow = true
 		} else {
-			takeFollow = mathrand.Float32() > 0.4
+			takeFollow = rng.Float32() > 0.4
 		}
 		if takeFollow {
 			posts = append(posts, followedPosts[0])
@@ -39,26 +108,79 @@ func getPostsForLoggedInUser(conn *sqlite.Conn, user *User, before time.Time, li
 			chaosPosts = chaosPosts[1:]
 		}
 	}
+	// Same order as the queries: newest first, with the post ID breaking ties
 	sort.Slice(posts, func(i, j int) bool {
-		return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		if !posts[i].CreatedAt.Equal(posts[j].CreatedAt) {
+			return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		}
+		return posts[i].PostID > posts[j].PostID
 	})
-	return posts, nil
+	hasMore := false
+	if len(posts) > 0 {
+		// The leftovers are newest first, so only the last of each can be before the page
+		last := posts[len(posts)-1].Cursor()
+		for _, leftovers := range [][]Post{followedPosts, chaosPosts} {
+			if len(leftovers) > 0 && isBefore(&leftovers[len(leftovers)-1], last) {
+				hasMore = true
+			}
+		}
+	}
+	return posts, hasMore, nil
 }
 
 // Get recommended posts, based on the ENTROPYCH, INC. CHAOS RECOMMENDATION ALGORITHM
-func GetRecommendedPosts(conn *sqlite.Conn, user *User, before time.Time, limit int) ([]Post, error) {
+// (unless the user picked FeedModeChronological, or config.FeedMode says otherwise).
+// Logged out, it's everyone's posts, newest first.
+//
+// The returned bool is whether there are more posts before the last one returned (that
+// is, whether there's a next page).
+func GetRecommendedPosts(conn *sqlite.Conn, user *User, before PostCursor, limit int, config RecommendConfig) ([]Post, bool, error) {
+	rng := config.Rand
+	if rng == nil {
+		rng = newRand()
+	}
 	var posts []Post
+	var hasMore bool
 	var err error
 	if user == nil {
-		posts, err = GetRecentPosts(conn, before, limit)
+		posts, err = GetRecentPosts(conn, before, limit+1)
+		posts, hasMore = takePosts(posts, limit)
 	} else {
-		posts, err = getPostsForLoggedInUser(conn, user, before, limit)
+		mode := config.FeedMode
+		if mode == "" {
+			if mode, err = GetFeedMode(conn, user.UserID); err != nil {
+				return nil, false, err
+			}
+		}
+		if mode == FeedModeChronological {
+			posts, err = GetRecentPostsFromFollowedUsers(conn, user.UserID, before, limit+1)
+			posts, hasMore = takePosts(posts, limit)
+		} else {
+			posts, hasMore, err = getPostsForLoggedInUser(conn, rng, user, before, limit)
+		}
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	if err := DecoratePosts(conn, user, posts); err != nil {
-		return nil, err
+	if err := decoratePosts(conn, rng, user, posts); err != nil {
+		return nil, false, err
+	}
+	return posts, hasMore, err
+}
+
+// The fraction of the posts that are from users the logged in user doesn't follow (which
+// is all of them, if nobody's logged in). The posts need to be decorated first, since
+// that's what sets DistanceFromUser.
+func ChaosLevel(posts []Post) float64 {
+	if len(posts) == 0 {
+		return 0
+	}
+	chaos := 0
+	for _, post := range posts {
+		// Your own posts are 0, and the people you follow are 1
+		if post.DistanceFromUser > 1 {
+			chaos++
+		}
 	}
-	return posts, err
+	return float64(chaos) / float64(len(posts))
 }
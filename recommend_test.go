@@ -0,0 +1,233 @@
+package entropy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRecommendedPostsWithFixedSeed(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	friend, err := CreateUser(conn, "friend", "pass")
+	assert.Nil(t, err)
+	rando, err := CreateUser(conn, "rando", "pass")
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+	for i := range 10 {
+		_, err = CreatePost(conn, friend.UserID, fmt.Sprintf("friend post %d", i))
+		assert.Nil(t, err)
+		_, err = CreatePost(conn, rando.UserID, fmt.Sprintf("rando post %d", i))
+		assert.Nil(t, err)
+	}
+
+	recommend := func(seed uint64) []Post {
+		config := RecommendConfig{Rand: rand.New(rand.NewPCG(seed, seed))}
+		posts, _, err := GetRecommendedPosts(conn, me, PostCursor{CreatedAt: time.Now().Add(time.Minute)}, 8, config)
+		assert.Nil(t, err)
+		return posts
+	}
+	first := recommend(42)
+	second := recommend(42)
+	assert.Len(t, first, 8)
+	assert.Equal(t, first, second)
+}
+
+func TestGetRecommendedPostsHasMore(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	friend, err := CreateUser(conn, "friend", "pass")
+	assert.Nil(t, err)
+	rando, err := CreateUser(conn, "rando", "pass")
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+
+	const limit = 6
+	for i := range limit {
+		author := friend
+		if i%2 == 0 {
+			author = rando
+		}
+		_, err = CreatePost(conn, author.UserID, fmt.Sprintf("post %d", i))
+		assert.Nil(t, err)
+	}
+	before := PostCursor{CreatedAt: time.Now().Add(time.Minute)}
+	for _, user := range []*User{nil, me} {
+		// Exactly limit posts: no next page
+		posts, hasMore, err := GetRecommendedPosts(conn, user, before, limit, RecommendConfig{})
+		assert.Nil(t, err)
+		assert.Len(t, posts, limit)
+		assert.False(t, hasMore)
+
+		posts, hasMore, err = GetRecommendedPosts(conn, user, before, limit-1, RecommendConfig{})
+		assert.Nil(t, err)
+		assert.Len(t, posts, limit-1)
+		// Logged in, the post that's left over might be newer than the last one we got,
+		// and then it's skipped. Either way, there's a next page if and only if it has
+		// something on it.
+		if user == nil {
+			assert.True(t, hasMore)
+		}
+		nextPage, _, err := GetRecommendedPosts(conn, user, posts[len(posts)-1].Cursor(), limit, RecommendConfig{})
+		assert.Nil(t, err)
+		assert.Equal(t, hasMore, len(nextPage) > 0)
+	}
+}
+
+func TestGetRecommendedPostsHasMoreSkipsNewerLeftovers(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	friend, err := CreateUser(conn, "friend", "pass")
+	assert.Nil(t, err)
+	rando, err := CreateUser(conn, "rando", "pass")
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+	// The rando's post is older than both of the friend's
+	oldPostID, err := CreatePostWithTime(conn, rando.UserID, "old", time.Unix(1, 0))
+	assert.Nil(t, err)
+	_, err = CreatePostWithTime(conn, friend.UserID, "newer", time.Unix(9, 0))
+	assert.Nil(t, err)
+	_, err = CreatePostWithTime(conn, friend.UserID, "newest", time.Unix(10, 0))
+	assert.Nil(t, err)
+
+	before := PostCursor{CreatedAt: time.Unix(100, 0)}
+	config := RecommendConfig{FeedMode: FeedModeChaos}
+	sawSkip := false
+	for seed := range uint64(50) {
+		config.Rand = rand.New(rand.NewPCG(seed, seed))
+		posts, hasMore, err := GetRecommendedPosts(conn, me, before, 2, config)
+		assert.Nil(t, err)
+		assert.Len(t, posts, 2)
+		if posts[1].PostID == oldPostID {
+			// The newer post got skipped, and there's nothing before the old one
+			sawSkip = true
+			assert.False(t, hasMore)
+		} else {
+			assert.True(t, hasMore)
+		}
+	}
+	assert.True(t, sawSkip)
+}
+
+func TestChaosLevel(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	friend, err := CreateUser(conn, "friend", "pass")
+	assert.Nil(t, err)
+	friendOfFriend, err := CreateUser(conn, "friendOfFriend", "pass")
+	assert.Nil(t, err)
+	rando, err := CreateUser(conn, "rando", "pass")
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, friend.UserID, friendOfFriend.UserID)
+	assert.Nil(t, err)
+
+	// 2 of my own posts and 3 from my friend, but 1 from a friend of a friend and 2
+	// from a rando
+	for i, author := range []*User{me, me, friend, friend, friend, friendOfFriend, rando, rando} {
+		_, err = CreatePost(conn, author.UserID, fmt.Sprintf("post %d", i))
+		assert.Nil(t, err)
+	}
+	before := PostCursor{CreatedAt: time.Now().Add(time.Minute)}
+	posts, _, err := GetRecommendedPosts(conn, me, before, 8, RecommendConfig{})
+	assert.Nil(t, err)
+	assert.Len(t, posts, 8)
+	assert.Equal(t, 3.0/8.0, ChaosLevel(posts))
+
+	// Logged out, it's all chaos
+	posts, _, err = GetRecommendedPosts(conn, nil, before, 8, RecommendConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, ChaosLevel(posts))
+
+	assert.Equal(t, 0.0, ChaosLevel(nil))
+}
+
+func TestFeedModes(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	me, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	friend, err := CreateUser(conn, "friend", "pass")
+	assert.Nil(t, err)
+	rando, err := CreateUser(conn, "rando", "pass")
+	assert.Nil(t, err)
+	_, err = FollowUser(conn, me.UserID, friend.UserID)
+	assert.Nil(t, err)
+	var friendPostIDs []int64
+	for i := range 4 {
+		postID, err := CreatePost(conn, friend.UserID, fmt.Sprintf("friend post %d", i))
+		assert.Nil(t, err)
+		friendPostIDs = append(friendPostIDs, postID)
+		_, err = CreatePost(conn, rando.UserID, fmt.Sprintf("rando post %d", i))
+		assert.Nil(t, err)
+	}
+	before := PostCursor{CreatedAt: time.Now().Add(time.Minute)}
+	authors := func(posts []Post) map[string]int {
+		counts := make(map[string]int)
+		for _, post := range posts {
+			counts[post.UserName]++
+		}
+		return counts
+	}
+
+	// Chaos is the default, and has everyone in it
+	mode, err := GetFeedMode(conn, me.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, FeedModeChaos, mode)
+	posts, hasMore, err := GetRecommendedPosts(conn, me, before, 8, RecommendConfig{})
+	assert.Nil(t, err)
+	assert.False(t, hasMore)
+	assert.Equal(t, map[string]int{"friend": 4, "rando": 4}, authors(posts))
+
+	// Chronological is only the people I follow, newest first
+	assert.Nil(t, SetFeedMode(conn, me.UserID, FeedModeChronological))
+	mode, err = GetFeedMode(conn, me.UserID)
+	assert.Nil(t, err)
+	assert.Equal(t, FeedModeChronological, mode)
+	posts, hasMore, err = GetRecommendedPosts(conn, me, before, 3, RecommendConfig{})
+	assert.Nil(t, err)
+	assert.True(t, hasMore)
+	var postIDs []int64
+	for _, post := range posts {
+		postIDs = append(postIDs, post.PostID)
+	}
+	assert.Equal(t, []int64{friendPostIDs[3], friendPostIDs[2], friendPostIDs[1]}, postIDs)
+
+	// Logged out, it's always everyone's posts, newest first
+	posts, _, err = GetRecommendedPosts(conn, nil, before, 8, RecommendConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"friend": 4, "rando": 4}, authors(posts))
+	assert.Equal(t, rando.UserID, posts[0].UserID)
+
+	assert.NotNil(t, SetFeedMode(conn, me.UserID, FeedMode("bogus")))
+}
@@ -4,6 +4,7 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	mathrand "math/rand"
 	"net/http"
@@ -22,6 +23,7 @@ type Renderer struct {
 	templates        map[string]*template.Template
 	baseTemplateName string
 	bufpool          *bpool.BufferPool
+	staticAssets     *StaticAssets // for the asset func; see UseStaticAssets
 }
 
 func dummyCSRFField() template.HTML {
@@ -67,27 +69,63 @@ func postCallToAction() string {
 }
 
 func (r *Renderer) ExecuteTemplate(w http.ResponseWriter, req *http.Request, name string, data any) error {
-	// We render to a buffer (from the buffer pool) so that we can handle template
-	// execution errors (without sending half a template response first).
-	t := r.templates[name]
-	if t == nil {
-		return fmt.Errorf("ExecuteTemplate: template not found: %v; templates=%+v", name, r.templates)
-	}
-	tclone := template.Must(t.Clone())
+	return r.ExecuteNamed(w, req, name, r.baseTemplateName, data)
+}
+
+// Like ExecuteTemplate, but only executes the {{define}} block called defineName from
+// the template (e.g. for rendering a fragment of a page, rather than the whole layout).
+func (r *Renderer) ExecuteNamed(w io.Writer, req *http.Request, name string, defineName string, data any) error {
 	csrfField := csrf.TemplateField(req)
 	user := GetCurrentUser(req.Context())
-	tclone.Funcs(template.FuncMap{
+	return r.execute(w, name, defineName, template.FuncMap{
 		"csrf_field":   func() template.HTML { return csrfField },
 		"current_user": func() *User { return user },
-	})
+	}, data)
+}
 
+// Execute the {{define}} block called defineName from the template, outside of any HTTP
+// request (for emails, feeds, and so on). Since there's no request, csrf_field renders
+// nothing and current_user is nil.
+func (r *Renderer) ExecuteDefined(w io.Writer, name string, defineName string, data any) error {
+	return r.execute(w, name, defineName, nil, data)
+}
+
+// funcs overrides the template's functions for this execution, if it's not nil.
+func (r *Renderer) execute(w io.Writer, name string, defineName string, funcs template.FuncMap, data any) error {
+	t := r.templates[name]
+	if t == nil {
+		return fmt.Errorf("execute: template not found: %v; templates=%+v", name, r.templates)
+	}
+	// Always execute a clone: html/template won't let us Clone a template after it has
+	// been executed, and we need to clone it to override the funcs.
+	t = template.Must(t.Clone())
+	if funcs != nil {
+		t.Funcs(funcs)
+	}
+
+	// We render to a buffer (from the buffer pool) so that we can handle template
+	// execution errors (without sending half a template response first).
 	buf := r.bufpool.Get()
 	defer r.bufpool.Put(buf)
-	if err := tclone.ExecuteTemplate(buf, r.baseTemplateName, data); err != nil {
+	if err := t.ExecuteTemplate(buf, defineName, data); err != nil {
 		return err
 	}
-	buf.WriteTo(w)
-	return nil
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Make the asset func link to the fingerprinted URLs of these files. Until this is called,
+// it links to their plain URLs.
+func (r *Renderer) UseStaticAssets(assets *StaticAssets) {
+	r.staticAssets = assets
+}
+
+// The asset func, e.g. {{asset "style.css"}}
+func (r *Renderer) assetURL(name string) string {
+	if r.staticAssets == nil {
+		return (&StaticAssets{}).URL(name)
+	}
+	return r.staticAssets.URL(name)
 }
 
 const baseTemplatePath = "templates/base.html"
@@ -121,7 +159,10 @@ func NewRenderer() (*Renderer, error) {
 		"current_user": func() *User { return nil },
 		"post_cta":     postCallToAction,
 		"distort":      DistortContent,
+		"render_bio":   RenderBio,
 		"add":          add,
+		"reactions":    func() []string { return AllowedReactions },
+		"asset":        renderer.assetURL,
 	})
 	template.Must(baseTemplate.ParseFS(templateFS, "templates/components/*.html", baseTemplatePath))
 	// We override this func at execution time
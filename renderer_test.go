@@ -0,0 +1,60 @@
+package entropy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteDefined(t *testing.T) {
+	renderer, err := NewRenderer()
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	data := struct {
+		User         *User
+		Posts        []Post
+		NextPageURL  string
+		FirstPageURL string
+	}{
+		Posts:        []Post{{PostID: 1, UserName: "max", Content: "hello"}},
+		FirstPageURL: "/",
+	}
+	assert.Nil(t, renderer.ExecuteDefined(&buf, "index.html", "posts", data))
+	assert.Contains(t, buf.String(), `<ul class="posts" id="posts">`)
+	assert.Contains(t, buf.String(), "hello")
+	assert.NotContains(t, buf.String(), "<html")
+
+	// Rendering a whole page still works afterwards
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	assert.Nil(t, renderer.ExecuteTemplate(w, r, "index.html", data))
+	assert.Contains(t, w.Body.String(), "<html")
+}
+
+func TestExecuteDefinedErrorsDontWritePartialOutput(t *testing.T) {
+	renderer, err := NewRenderer()
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = renderer.ExecuteDefined(&buf, "index.html", "no_such_define", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buf.Len())
+
+	err = renderer.ExecuteDefined(&buf, "no_such_template.html", "posts", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buf.Len())
+
+	// This fails halfway through, after the opening <ul>, because there's no
+	// FirstPageURL field
+	data := struct {
+		Posts       []Post
+		NextPageURL string
+	}{}
+	err = renderer.ExecuteDefined(&buf, "index.html", "posts", data)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buf.Len())
+}
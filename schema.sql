@@ -1,4 +1,6 @@
-/* All timestamp columns are unix timestamps in UTC */
+/* All timestamp columns are unix timestamps in UTC. They're in seconds, except for
+post.created_at, which is in milliseconds so that posts made in the same second still have an
+order. */
 
 create table if not exists upload (
     upload_id integer primary key,
@@ -15,18 +17,47 @@ create table if not exists user (
     password_salt blob,
     display_name text,
     bio text,
-    avatar_upload_id integer references upload (upload_id)
+    avatar_upload_id integer references upload (upload_id),
+    email text, /* optional */
+    email_verified_at integer, /* unix timestamp, null until the email is verified */
+    pinned_post_id integer references post(post_id), /* shown at the top of their profile */
+    feed_mode text, /* see FeedMode; null means the default */
+    homepage_visited_at integer /* unix timestamp, updated at most once a minute (see RecordHomepageVisit) */
 );
 create unique index if not exists user_user_name_uniq_idx on user (user_name);
 
+create table if not exists email_verification (
+    token text primary key, /* random string we can put in a link */
+    user_id integer not null references user(user_id),
+    email text not null, /* the address that the token was sent to */
+    created_at integer not null, /* unix timestamp */
+    expiration_time integer not null /* unix timestamp */
+);
+
 create table if not exists post (
     post_id integer primary key,
     user_id integer references user(user_id),
-    created_at integer not null, /* unix timestamp */
+    created_at integer not null, /* unix timestamp, in milliseconds */
     content text not null
 );
-create index if not exists post_user_id_idx on post (user_id);
+/* For the timelines, which go newest-first by (created_at, post_id). The post_id is in every index
+anyway, since it's the rowid. */
 create index if not exists post_created_at_idx on post (created_at);
+create index if not exists post_user_id_created_at_idx on post (user_id, created_at);
+
+/* Full-text index of posts, for SearchPosts. It's an external content table, so it doesn't keep
+its own copy of the content, and these triggers keep it in sync with the post table. */
+create virtual table if not exists post_fts using fts5 (content, content='post', content_rowid='post_id');
+create trigger if not exists post_fts_insert after insert on post begin
+    insert into post_fts (rowid, content) values (new.post_id, new.content);
+end;
+create trigger if not exists post_fts_delete after delete on post begin
+    insert into post_fts (post_fts, rowid, content) values ('delete', old.post_id, old.content);
+end;
+create trigger if not exists post_fts_update after update of content on post begin
+    insert into post_fts (post_fts, rowid, content) values ('delete', old.post_id, old.content);
+    insert into post_fts (rowid, content) values (new.post_id, new.content);
+end;
 
 create table if not exists post_reply (
     post_id integer references post(post_id),
@@ -39,8 +70,10 @@ create table if not exists reaction (
     user_id integer not null,
     reacted_at integer not null,
     emoji text not null,
-    primary key (post_id, user_id)
+    primary key (post_id, user_id, emoji)
 );
+/* For a user's activity (see GetUserActivity) */
+create index if not exists reaction_user_id_reacted_at_idx on reaction (user_id, reacted_at);
 
 create table if not exists user_session (
     user_session_id integer primary key,
@@ -60,3 +93,81 @@ create table if not exists user_follow (
     followed_at integer not null, /* unix timestamp */
     primary key (user_id, followed_user_id)
 );
+/* For counting followers (see GetMostFollowedUsers) */
+create index if not exists user_follow_followed_user_id_idx on user_follow (followed_user_id);
+
+/* Distances in the follower graph, precomputed by cmd/recompute_distances (see
+RecomputeUserDistances). Each user whose distances have been computed gets a row with their own
+user_id as other_user_id and distance 0, so that "not computed yet" can be told apart from "far
+away". Distances of MaxDistortionLevel or more aren't stored. */
+create table if not exists user_distance (
+    user_id integer not null references user(user_id),
+    other_user_id integer not null references user(user_id),
+    distance integer not null,
+    primary key (user_id, other_user_id)
+);
+
+/* Someone looking at a post's page (see RecordPostView). A person's views of the same post only
+count once a day, so there's at most one row per post, viewer, and PostViewWindow. */
+create table if not exists post_view (
+    post_id integer not null references post(post_id),
+    viewer_user_id integer not null references user(user_id),
+    viewed_at integer not null /* unix timestamp */
+);
+create index if not exists post_view_post_id_viewer_user_id_idx on post_view (post_id, viewer_user_id, viewed_at);
+/* The views that are too old to matter for deduplicating, rolled up into a count per post (see
+CompactPostViews), so that post_view doesn't grow forever */
+create table if not exists post_view_count (
+    post_id integer primary key references post(post_id),
+    view_count integer not null
+);
+
+/* A user peeking at a far-away post, to see it with less distortion for a little while (see
+GrantPeek). Each peek while the last one is still active takes off another level of distortion. */
+create table if not exists post_peek (
+    user_id integer not null references user(user_id),
+    post_id integer not null references post(post_id),
+    peek_level integer not null, /* how many levels of distortion to take off */
+    expires_at integer not null, /* unix timestamp */
+    primary key (user_id, post_id)
+);
+
+/* A user that a post @-mentions (see GetMentions). These are recorded when the post is created,
+so posts from before this table existed don't have any. */
+create table if not exists post_mention (
+    post_id integer not null references post(post_id),
+    mentioned_user_id integer not null references user(user_id),
+    primary key (post_id, mentioned_user_id)
+);
+create index if not exists post_mention_mentioned_user_id_idx on post_mention (mentioned_user_id);
+
+/* A #hashtag in a post (see GetPostsWithHashtag). Like mentions, these are recorded when the post
+is created, so posts from before this table existed don't have any. */
+create table if not exists post_hashtag (
+    post_id integer not null references post(post_id),
+    hashtag text not null,
+    primary key (post_id, hashtag)
+);
+create index if not exists post_hashtag_hashtag_idx on post_hashtag (hashtag);
+
+/* Where to POST the new posts from the people a user follows (see RegisterWebhook). The secret
+signs each delivery, so the receiver can tell it came from us. */
+create table if not exists webhook (
+    webhook_id integer primary key,
+    user_id integer not null references user(user_id),
+    url text not null,
+    secret text not null,
+    created_at integer not null /* unix timestamp */
+);
+create index if not exists webhook_user_id_idx on webhook (user_id);
+
+/* A post waiting to be sent to a webhook (see GetDueWebhookDeliveries). Rows are deleted once
+they're delivered, or once they've failed WebhookMaxAttempts times. */
+create table if not exists webhook_delivery (
+    webhook_delivery_id integer primary key,
+    webhook_id integer not null references webhook(webhook_id),
+    post_id integer not null references post(post_id),
+    attempts integer not null default 0,
+    next_attempt_at integer not null /* unix timestamp */
+);
+create index if not exists webhook_delivery_next_attempt_at_idx on webhook_delivery (next_attempt_at);
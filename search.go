@@ -0,0 +1,124 @@
+package entropy
+
+import (
+	"slices"
+	"strings"
+
+	"crawshaw.io/sqlite"
+)
+
+// How many of the best full-text matches SearchPosts re-ranks by distance. The closest
+// match from a friend can only beat matches that made it into this set.
+const searchCandidates = 200
+
+// Turn what the user typed into an FTS5 query matching posts with all of the words in it.
+// Each word is quoted, so that FTS5's operators (and any stray punctuation) are just text.
+func ftsQuery(search string) string {
+	words := strings.Fields(search)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+type searchResult struct {
+	post      Post
+	relevance float64 // bigger is better
+}
+
+// Search posts for the words in search. The best matches come first, and matches from
+// authors closer to user in the follower graph are boosted above ones from far away, so
+// that your friends' posts come up first. (If user is nil, it's relevance alone.)
+//
+// The posts aren't decorated.
+func SearchPosts(conn *sqlite.Conn, user *User, search string, limit int) ([]Post, error) {
+	match := ftsQuery(search)
+	if match == "" {
+		return nil, nil
+	}
+	query := `
+		with matches as (
+			select rowid as post_id, rank
+			from post_fts
+			where post_fts match :match
+			order by rank
+			limit :limit
+		)
+		select
+			post_id,
+			user.user_id,
+			user.user_name,
+			user.display_name,
+			post.created_at,
+			post.content,
+			user.avatar_upload_id,
+			matches.rank
+		from matches
+		join post using (post_id)
+		join user using (user_id)
+		order by matches.rank`
+	var posts []Post
+	var results []searchResult
+	collectPost := collectPosts(&posts)
+	collect := func(stmt *sqlite.Stmt) error {
+		if err := collectPost(stmt); err != nil {
+			return err
+		}
+		// bm25() ranks are negative, with the best matches the most negative
+		results = append(results, searchResult{post: posts[len(posts)-1], relevance: -stmt.ColumnFloat(7)})
+		return nil
+	}
+	err := exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetText(":match", match)
+		stmt.SetInt64(":limit", searchCandidates)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		if err := boostSearchResultsByDistance(conn, user, results); err != nil {
+			return nil, err
+		}
+	}
+	slices.SortStableFunc(results, func(a, b searchResult) int {
+		if a.relevance > b.relevance {
+			return -1
+		} else if a.relevance < b.relevance {
+			return 1
+		}
+		return 0
+	})
+	posts = posts[:0]
+	for _, result := range results[:min(limit, len(results))] {
+		posts = append(posts, result.post)
+	}
+	return posts, nil
+}
+
+// Divide each result's relevance by one more than the author's distance from user. Your
+// own posts count as distance 0.
+func boostSearchResultsByDistance(conn *sqlite.Conn, user *User, results []searchResult) error {
+	userIDSet := make(map[int64]bool)
+	for _, result := range results {
+		if result.post.UserID != user.UserID {
+			userIDSet[result.post.UserID] = true
+		}
+	}
+	otherUserIDs := make([]int64, 0, len(userIDSet))
+	for k := range userIDSet {
+		otherUserIDs = append(otherUserIDs, k)
+	}
+	distances, err := lookUpDistancesFromUser(conn, user.UserID, otherUserIDs)
+	if err != nil {
+		return err
+	}
+	for i := range results {
+		distance := 0
+		if results[i].post.UserID != user.UserID {
+			distance = distances[results[i].post.UserID]
+		}
+		results[i].relevance /= float64(1 + distance)
+	}
+	return nil
+}
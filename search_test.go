@@ -0,0 +1,90 @@
+package entropy
+
+import (
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFTSQuery(t *testing.T) {
+	assert.Equal(t, `"hello" "world"`, ftsQuery("  hello world "))
+	assert.Equal(t, `"NOT" "a""b" "c*"`, ftsQuery(`NOT a"b c*`))
+	assert.Equal(t, "", ftsQuery(" "))
+}
+
+func TestSearchPostsBoostsCloseAuthors(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// me -> friend -> friendOfFriend, and stranger is nowhere near me
+	names := []string{"me", "friend", "friendOfFriend", "stranger"}
+	users := make(map[string]*User)
+	for _, name := range names {
+		user, err := CreateUser(conn, name, "pass")
+		assert.Nil(t, err)
+		users[name] = user
+	}
+	follow(t, conn, users["me"].UserID, users["friend"].UserID)
+	follow(t, conn, users["friend"].UserID, users["friendOfFriend"].UserID)
+
+	// The stranger's post is the best match, and was posted first
+	for _, name := range []string{"stranger", "friendOfFriend", "friend"} {
+		content := "I love pickles"
+		if name == "stranger" {
+			content = "pickles pickles pickles"
+		}
+		_, err := CreatePost(conn, users[name].UserID, content)
+		assert.Nil(t, err)
+	}
+	_, err := CreatePost(conn, users["friend"].UserID, "no match here")
+	assert.Nil(t, err)
+
+	posts, err := SearchPosts(conn, users["me"], "pickles", 10)
+	assert.Nil(t, err)
+	var authors []string
+	for _, post := range posts {
+		authors = append(authors, post.UserName)
+	}
+	assert.Equal(t, []string{"friend", "friendOfFriend", "stranger"}, authors)
+
+	// Logged out, it's relevance alone
+	posts, err = SearchPosts(conn, nil, "pickles", 10)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 3)
+	assert.Equal(t, "stranger", posts[0].UserName)
+
+	posts, err = SearchPosts(conn, users["me"], "pickles", 1)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+	assert.Equal(t, "friend", posts[0].UserName)
+
+	// Searching for FTS5 syntax doesn't break anything
+	posts, err = SearchPosts(conn, users["me"], `"pickles AND (`, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, posts)
+}
+
+func TestSearchPostsIndexesOldPosts(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	_, err = CreatePost(conn, user.UserID, "an old post about pickles")
+	assert.Nil(t, err)
+	// Pretend the post is from before there was search
+	assert.Nil(t, sqlitex.ExecScript(conn, "insert into post_fts (post_fts) values ('delete-all'); pragma user_version = 3;"))
+	posts, err := SearchPosts(conn, user, "pickles", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, posts)
+
+	assert.Nil(t, setUpDb(conn))
+	posts, err = SearchPosts(conn, user, "pickles", 10)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"crawshaw.io/sqlite"
@@ -12,24 +12,27 @@ import (
 
 const sessionIdCookieName = "id"
 
-func (session *UserSession) ToCookie() *http.Cookie {
+// The session's cookie. secure should only be false in dev mode, where we serve plain
+// HTTP, and browsers would drop a Secure cookie.
+func (session *UserSession) ToCookie(secure bool) *http.Cookie {
 	return &http.Cookie{
 		Name:     sessionIdCookieName,
 		Value:    hex.EncodeToString(session.SessionPublicID),
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   secure,
 		SameSite: http.SameSiteLaxMode,
 	}
 }
 
-func ClearSessionCookie(w http.ResponseWriter) {
+// Log the user out on their end. secure is the same as for ToCookie.
+func ClearSessionCookie(w http.ResponseWriter, secure bool) {
 	cookie := http.Cookie{
 		Name:     sessionIdCookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   secure,
 		// http.Cookie says this means to expire it now:
 		MaxAge:   -1,
 		SameSite: http.SameSiteStrictMode,
@@ -60,10 +63,16 @@ func getUserIfLoggedIn(conn *sqlite.Conn, r *http.Request) (*User, error) {
 
 // Copied and pasted from cmd/server/main.go
 func errorResponse(w http.ResponseWriter, err error) {
-	log.Printf("sending 500 error: %s", err)
+	slog.Error("sending 500 error", "err", err)
 	http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
 }
 
+// Copied and pasted from cmd/server/main.go
+func serviceUnavailable(w http.ResponseWriter) {
+	slog.Warn("sending 503 error: couldn't get a database connection")
+	http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+}
+
 type userCtxKeyType struct{}
 
 var userCtxKey = userCtxKeyType{}
@@ -72,6 +81,10 @@ var userCtxKey = userCtxKeyType{}
 func WithUserContextMiddleware(db *DB, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		conn := db.GetReadOnly(r.Context())
+		if conn == nil {
+			serviceUnavailable(w)
+			return
+		}
 		defer db.PutReadOnly(conn)
 		user, err := getUserIfLoggedIn(conn, r)
 		if err != nil {
@@ -0,0 +1,81 @@
+package entropy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// A single sitemap can have at most 50,000 URLs in it, so we split that between users
+// and their most recent posts. (If we ever get bigger than that, we'd need a sitemap
+// index.)
+const (
+	sitemapMaxUsers = 10000
+	sitemapMaxPosts = 40000
+)
+
+func writeSitemapURL(w io.Writer, loc string, lastMod time.Time) error {
+	var escaped strings.Builder
+	if err := xml.EscapeText(&escaped, []byte(loc)); err != nil {
+		return err
+	}
+	if lastMod.IsZero() {
+		_, err := fmt.Fprintf(w, "<url><loc>%s</loc></url>\n", escaped.String())
+		return err
+	}
+	_, err := fmt.Fprintf(w, "<url><loc>%s</loc><lastmod>%s</lastmod></url>\n", escaped.String(), lastMod.UTC().Format(time.DateOnly))
+	return err
+}
+
+// Write a sitemap (https://www.sitemaps.org/protocol.html) listing user profiles and
+// recent posts to w. The URLs are written as we read the rows, rather than being
+// collected in memory first.
+//
+// baseURL is the scheme and host to prefix the paths with, e.g.
+// "https://entropych.maxhully.net".
+//
+// TODO: there aren't any private accounts yet. When there are, they need to be left out
+// of here.
+func WriteSitemap(conn *sqlite.Conn, w io.Writer, baseURL string) error {
+	header := xml.Header + `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n"
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	query := `
+		select user.user_name, max(post.created_at)
+		from user
+		left join post using (user_id)
+		group by user.user_id
+		order by user.user_id
+		limit ?`
+	collectUser := func(stmt *sqlite.Stmt) error {
+		var lastMod time.Time
+		if stmt.ColumnType(1) != sqlite.SQLITE_NULL {
+			lastMod = time.UnixMilli(stmt.ColumnInt64(1))
+		}
+		user := User{Name: stmt.ColumnText(0)}
+		return writeSitemapURL(w, user.AbsoluteURL(baseURL), lastMod)
+	}
+	if err := sqlitex.Exec(conn, query, collectUser, sitemapMaxUsers); err != nil {
+		return err
+	}
+	query = `
+		select post_id, created_at
+		from post
+		order by created_at desc
+		limit ?`
+	collectPost := func(stmt *sqlite.Stmt) error {
+		post := Post{PostID: stmt.ColumnInt64(0)}
+		return writeSitemapURL(w, post.AbsoluteURL(baseURL), time.UnixMilli(stmt.ColumnInt64(1)))
+	}
+	if err := sqlitex.Exec(conn, query, collectPost, sitemapMaxPosts); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "</urlset>\n")
+	return err
+}
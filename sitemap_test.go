@@ -0,0 +1,49 @@
+package entropy
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSitemap(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+
+	conn := db.Get(context.TODO())
+	defer db.Put(conn)
+
+	maxUser, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	_, err = CreateUser(conn, "luna&co", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, maxUser.UserID, "hello")
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteSitemap(conn, &buf, "https://entropych.example.com"))
+
+	var sitemap struct {
+		URLs []struct {
+			Loc     string `xml:"loc"`
+			LastMod string `xml:"lastmod"`
+		} `xml:"url"`
+	}
+	assert.Nil(t, xml.Unmarshal(buf.Bytes(), &sitemap))
+	var locs []string
+	for _, u := range sitemap.URLs {
+		locs = append(locs, u.Loc)
+	}
+	assert.Equal(t, []string{
+		"https://entropych.example.com/u/max/",
+		"https://entropych.example.com/u/luna&co/",
+		fmt.Sprintf("https://entropych.example.com/p/%d/", postID),
+	}, locs)
+	assert.NotEqual(t, "", sitemap.URLs[0].LastMod)
+	// luna hasn't posted anything
+	assert.Equal(t, "", sitemap.URLs[1].LastMod)
+}
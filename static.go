@@ -0,0 +1,100 @@
+package entropy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The files under /static/, read into memory when the server starts. Each one is served at
+// its own path (like /static/style.css) and at a fingerprinted path with a hash of its
+// contents in the name (like /static/style.0123456789.css). Templates link to the
+// fingerprinted paths (with the asset func), which can be cached forever, because
+// changing the file changes the path. The plain paths are still there for things that
+// can't know the hash, like the url()s in the CSS, but they have to be revalidated.
+//
+// The zero value has no files in it.
+type StaticAssets struct {
+	files map[string]*staticAsset // by both of their paths, relative to /static/
+	urls  map[string]string       // the fingerprinted URL of each file, by its plain path
+}
+
+type staticAsset struct {
+	contents      []byte
+	etag          string
+	modTime       time.Time
+	fingerprinted bool
+}
+
+// How long browsers can cache the fingerprinted files for
+const staticAssetMaxAge = 365 * 24 * time.Hour
+
+// Read all of the files in fsys and hash them
+func LoadStaticAssets(fsys fs.FS) (*StaticAssets, error) {
+	assets := &StaticAssets{
+		files: make(map[string]*staticAsset),
+		urls:  make(map[string]string),
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(contents)
+		hash := hex.EncodeToString(sum[:5])
+		ext := path.Ext(name)
+		fingerprintedName := strings.TrimSuffix(name, ext) + "." + hash + ext
+		asset := staticAsset{contents: contents, etag: `"` + hash + `"`, modTime: info.ModTime()}
+		assets.files[name] = &asset
+		fingerprinted := asset
+		fingerprinted.fingerprinted = true
+		assets.files[fingerprintedName] = &fingerprinted
+		assets.urls[name] = "/static/" + fingerprintedName
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
+
+// The fingerprinted URL of the file at name (like "style.css"), or its plain URL if
+// there's no such file
+func (s *StaticAssets) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if url, ok := s.urls[name]; ok {
+		return url
+	}
+	return "/static/" + name
+}
+
+// Serve the files, by their paths relative to /static/ (so this goes under
+// http.StripPrefix). Every response has an ETag, so If-None-Match gets a 304.
+func (s *StaticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	asset, ok := s.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", asset.etag)
+	if asset.fingerprinted {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(staticAssetMaxAge.Seconds()))+", immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, asset.modTime, bytes.NewReader(asset.contents))
+}
@@ -47,7 +47,8 @@ class InfiniteScrollElement extends HTMLElement {
 
         let newDoc;
         try {
-            const resp = await fetch(this.href);
+            // Only ask for the fragment with the items in it, not the whole page
+            const resp = await fetch(this.href, { headers: { "HX-Request": "true" } });
             const html = await resp.text();
             const parser = new DOMParser();
             newDoc = parser.parseFromString(html, "text/html");
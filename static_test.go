@@ -0,0 +1,75 @@
+package entropy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticAssets(t *testing.T) {
+	assets, err := LoadStaticAssets(fstest.MapFS{
+		"style.css":        {Data: []byte("body { color: red; }")},
+		"fonts/font.woff2": {Data: []byte("not really a font")},
+	})
+	assert.Nil(t, err)
+	handler := http.StripPrefix("/static", assets)
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	styleURL := assets.URL("style.css")
+	assert.Regexp(t, regexp.MustCompile(`^/static/style\.[0-9a-f]{10}\.css$`), styleURL)
+	assert.Regexp(t, regexp.MustCompile(`^/static/fonts/font\.[0-9a-f]{10}\.woff2$`), assets.URL("/fonts/font.woff2"))
+	assert.Equal(t, "/static/missing.js", assets.URL("missing.js"))
+
+	w := get(styleURL, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body { color: red; }", w.Body.String())
+	assert.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+	etag := w.Header().Get("ETag")
+	assert.True(t, strings.Contains(styleURL, strings.Trim(etag, `"`)), etag)
+
+	w = get(styleURL, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	// The plain path works too, but it has to be revalidated
+	w = get("/static/style.css", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotModified, get("/static/style.css", http.Header{"If-None-Match": {etag}}).Code)
+
+	assert.Equal(t, http.StatusNotFound, get("/static/missing.js", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get("/static/", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get("/static/style.0000000000.css", nil).Code)
+}
+
+func TestAssetTemplateFunc(t *testing.T) {
+	renderer, err := NewRenderer()
+	assert.Nil(t, err)
+	render := func() string {
+		r, _ := http.NewRequest(http.MethodGet, "/about", nil)
+		w := httptest.NewRecorder()
+		assert.Nil(t, renderer.ExecuteTemplate(w, r, "about.html", nil))
+		return w.Body.String()
+	}
+	assert.Contains(t, render(), `href="/static/style.css"`)
+
+	assets, err := LoadStaticAssets(fstest.MapFS{"style.css": {Data: []byte("body {}")}})
+	assert.Nil(t, err)
+	renderer.UseStaticAssets(assets)
+	assert.Contains(t, render(), `href="`+assets.URL("style.css")+`"`)
+}
@@ -0,0 +1,243 @@
+package entropy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Where the contents of uploads are kept. The default, SQLiteStore, keeps them in the
+// upload table itself; other implementations can keep them somewhere else (a directory,
+// S3, ...), as long as they hand out upload IDs.
+//
+// Both methods take a connection, so that saving an upload can be part of the same
+// transaction as whatever refers to it (like a user's avatar_upload_id).
+type UploadStore interface {
+	// Save the contents and return the new upload's ID
+	Put(conn *sqlite.Conn, contentType string, contents []byte) (uploadID int64, err error)
+	// Open the contents of an upload for reading. Returns ErrUploadNotFound if there's
+	// no upload with that ID.
+	Open(conn *sqlite.Conn, uploadID int64) (io.ReadSeekCloser, *UploadInfo, error)
+	// Delete the uploads that nothing refers to anymore (see DeleteOrphanedUploads),
+	// contents and all. Returns how many were deleted.
+	DeleteOrphans(conn *sqlite.Conn) (int, error)
+}
+
+// Delete the upload rows that nothing refers to anymore, like someone's old avatar after
+// they change it, and return their filenames.
+//
+// Anything that refers to uploads has to be accounted for in the query here, or we'll
+// delete uploads that are still in use! Right now that's only user.avatar_upload_id.
+func DeleteOrphanedUploads(conn *sqlite.Conn) (filenames []string, err error) {
+	defer sqlitex.Save(conn)(&err)
+	orphaned := `
+		from upload
+		where upload_id not in (
+			select avatar_upload_id from user where avatar_upload_id is not null
+		)`
+	collect := func(stmt *sqlite.Stmt) error {
+		filenames = append(filenames, stmt.ColumnText(0))
+		return nil
+	}
+	if err = sqlitex.Exec(conn, "select filename"+orphaned, collect); err != nil {
+		return nil, err
+	}
+	if err = sqlitex.Exec(conn, "delete"+orphaned, nil); err != nil {
+		return nil, err
+	}
+	return filenames, nil
+}
+
+// Stores uploads as blobs in the upload table (see SaveUpload and OpenUploadContents).
+type SQLiteStore struct{}
+
+func (SQLiteStore) Put(conn *sqlite.Conn, contentType string, contents []byte) (int64, error) {
+	return SaveUpload(conn, contentType, contents)
+}
+
+func (SQLiteStore) Open(conn *sqlite.Conn, uploadID int64) (io.ReadSeekCloser, *UploadInfo, error) {
+	return OpenUploadContents(conn, uploadID)
+}
+
+func (SQLiteStore) DeleteOrphans(conn *sqlite.Conn) (int, error) {
+	filenames, err := DeleteOrphanedUploads(conn)
+	return len(filenames), err
+}
+
+// Stores the contents of uploads as files in Dir, named after the SHA-256 hash of their
+// contents (so uploading the same file twice only stores it once). The upload table
+// still gets a row for each file, with the metadata but an empty contents blob. Keeping
+// the files out of the database keeps it small, and means something else (like a CDN)
+// can serve the directory directly.
+//
+// Uploads saved by SQLiteStore before switching over to a DirStore can still be opened:
+// we fall back to the blob if it isn't empty.
+type DirStore struct {
+	Dir string
+}
+
+func (s *DirStore) Put(conn *sqlite.Conn, contentType string, contents []byte) (uploadID int64, err error) {
+	exts, err := mime.ExtensionsByType(contentType)
+	if err != nil {
+		return 0, err
+	}
+	if len(exts) == 0 {
+		return 0, fmt.Errorf("no file extension for content type %q", contentType)
+	}
+	hash := sha256.Sum256(contents)
+	filename := hex.EncodeToString(hash[:]) + exts[0]
+
+	defer sqlitex.Save(conn)(&err)
+	query := "select upload_id from upload where filename = ?"
+	collect := func(stmt *sqlite.Stmt) error {
+		uploadID = stmt.ColumnInt64(0)
+		return nil
+	}
+	if err = sqlitex.Exec(conn, query, collect, filename); err != nil {
+		return 0, err
+	}
+	if uploadID != 0 {
+		return uploadID, nil
+	}
+	// The row goes in before the file, so that if writing the file fails, rolling back
+	// the savepoint leaves nothing behind. (If the caller's transaction rolls back later,
+	// the file is left without a row, and DeleteOrphans cleans it up.)
+	query = "insert into upload (filename, created_at, content_type, contents) values (?, ?, ?, zeroblob(0))"
+	if err = sqlitex.Exec(conn, query, nil, filename, utcNow().Unix(), contentType); err != nil {
+		return 0, err
+	}
+	uploadID = conn.LastInsertRowID()
+	if err = s.writeFile(filename, contents); err != nil {
+		return 0, err
+	}
+	return uploadID, nil
+}
+
+// Write the file to a temporary file and then rename it into place, so that nobody ever
+// sees half of a file.
+func (s *DirStore) writeFile(filename string, contents []byte) error {
+	f, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.Dir, filename))
+}
+
+func (s *DirStore) Open(conn *sqlite.Conn, uploadID int64) (io.ReadSeekCloser, *UploadInfo, error) {
+	var info *UploadInfo
+	var filename string
+	var blobSize int64
+	query := "select filename, content_type, created_at, length(contents) from upload where upload_id = ?"
+	collect := func(stmt *sqlite.Stmt) error {
+		filename = stmt.ColumnText(0)
+		info = &UploadInfo{
+			UploadID:    uploadID,
+			ContentType: stmt.ColumnText(1),
+			CreatedAt:   time.Unix(stmt.ColumnInt64(2), 0).UTC(),
+		}
+		blobSize = stmt.ColumnInt64(3)
+		return nil
+	}
+	if err := sqlitex.Exec(conn, query, collect, uploadID); err != nil {
+		return nil, nil, err
+	}
+	if info == nil {
+		return nil, nil, ErrUploadNotFound
+	}
+	if blobSize > 0 {
+		return OpenUploadContents(conn, uploadID)
+	}
+	f, err := os.Open(filepath.Join(s.Dir, filename))
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	info.Size = stat.Size()
+	return f, info, nil
+}
+
+// Deletes the rows first and then the files, so that if removing a file fails, the worst
+// that happens is that it sticks around. (Uploads from before the DirStore don't have
+// files, which is fine.) Then it deletes the files that never got a row, from Puts whose
+// transactions rolled back.
+func (s *DirStore) DeleteOrphans(conn *sqlite.Conn) (int, error) {
+	filenames, err := DeleteOrphanedUploads(conn)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.removeFiles(filenames); err != nil {
+		return len(filenames), err
+	}
+	strays, err := s.strayFiles(conn)
+	if err != nil {
+		return len(filenames), err
+	}
+	return len(filenames) + len(strays), s.removeFiles(strays)
+}
+
+func (s *DirStore) removeFiles(filenames []string) error {
+	for _, filename := range filenames {
+		err := os.Remove(filepath.Join(s.Dir, filename))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// The files in Dir that don't have a row in the upload table. The temporary files that
+// writeFile makes start with a "." and are skipped.
+func (s *DirStore) strayFiles(conn *sqlite.Conn) ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	var strays []string
+	query := `
+		select value
+		from json_each(?)
+		where value not in (select filename from upload)`
+	collect := func(stmt *sqlite.Stmt) error {
+		strays = append(strays, stmt.ColumnText(0))
+		return nil
+	}
+	err = sqlitex.Exec(conn, query, collect, string(namesJSON))
+	return strays, err
+}
@@ -0,0 +1,185 @@
+package entropy
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+// Checks that store round-trips uploads the way UploadStore says it should
+func testUploadStore(t *testing.T, store UploadStore) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	uploadID, err := store.Put(conn, "image/png", []byte("not really a png"))
+	assert.Nil(t, err)
+	assert.Greater(t, uploadID, int64(0))
+
+	contents, info, err := store.Open(conn, uploadID)
+	assert.Nil(t, err)
+	defer contents.Close()
+	assert.Equal(t, uploadID, info.UploadID)
+	assert.Equal(t, "image/png", info.ContentType)
+	assert.EqualValues(t, len("not really a png"), info.Size)
+	assert.False(t, info.CreatedAt.IsZero())
+	b, err := io.ReadAll(contents)
+	assert.Nil(t, err)
+	assert.Equal(t, "not really a png", string(b))
+
+	_, _, err = store.Open(conn, uploadID+1)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testUploadStore(t, SQLiteStore{})
+}
+
+func TestDirStore(t *testing.T) {
+	testUploadStore(t, &DirStore{Dir: t.TempDir()})
+}
+
+func TestDirStoreDeduplicatesByContents(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+	dir := t.TempDir()
+	store := &DirStore{Dir: dir}
+
+	first, err := store.Put(conn, "image/png", []byte("avatar"))
+	assert.Nil(t, err)
+	second, err := store.Put(conn, "image/png", []byte("avatar"))
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+	third, err := store.Put(conn, "image/png", []byte("another avatar"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, third)
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.True(t, strings.HasSuffix(entry.Name(), ".png"))
+	}
+}
+
+func TestDirStoreOpensUploadsFromSQLite(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	// Saved before switching to the DirStore
+	uploadID, err := SQLiteStore{}.Put(conn, "image/png", []byte("old avatar"))
+	assert.Nil(t, err)
+
+	store := &DirStore{Dir: t.TempDir()}
+	contents, info, err := store.Open(conn, uploadID)
+	assert.Nil(t, err)
+	defer contents.Close()
+	assert.Equal(t, "image/png", info.ContentType)
+	b, err := io.ReadAll(contents)
+	assert.Nil(t, err)
+	assert.Equal(t, "old avatar", string(b))
+}
+
+// Checks that changing your avatar and then cleaning up deletes the old one, and only
+// the old one
+func testDeleteOrphans(t *testing.T, store UploadStore) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	_, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	oldAvatarID, err := store.Put(conn, "image/png", []byte("old avatar"))
+	assert.Nil(t, err)
+	assert.Nil(t, UpdateUserProfile(conn, "max", "max", "", oldAvatarID))
+	newAvatarID, err := store.Put(conn, "image/png", []byte("new avatar"))
+	assert.Nil(t, err)
+	assert.Nil(t, UpdateUserProfile(conn, "max", "max", "", newAvatarID))
+	// Someone else with the same avatar as max's new one
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	otherAvatarID, err := store.Put(conn, "image/png", []byte("new avatar"))
+	assert.Nil(t, err)
+	assert.Nil(t, UpdateUserProfile(conn, other.Name, other.Name, "", otherAvatarID))
+
+	deleted, err := store.DeleteOrphans(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	_, _, err = store.Open(conn, oldAvatarID)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	contents, _, err := store.Open(conn, newAvatarID)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(contents)
+	contents.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "new avatar", string(b))
+	_, _, err = store.Open(conn, otherAvatarID)
+	assert.Nil(t, err)
+
+	// Nothing left to delete
+	deleted, err = store.DeleteOrphans(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestSQLiteStoreDeleteOrphans(t *testing.T) {
+	testDeleteOrphans(t, SQLiteStore{})
+}
+
+func TestDirStoreDeleteOrphans(t *testing.T) {
+	dir := t.TempDir()
+	testDeleteOrphans(t, &DirStore{Dir: dir})
+	// The old avatar's file is gone too
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestDirStoreLeavesNothingBehindWhenPutFails(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+	dir := t.TempDir()
+	store := &DirStore{Dir: dir}
+
+	// Writing the file fails, so there's no row either
+	_, err := (&DirStore{Dir: filepath.Join(dir, "missing")}).Put(conn, "image/png", []byte("avatar"))
+	assert.NotNil(t, err)
+	count, err := sqlitex.ResultInt(conn.Prep("select count(*) from upload"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// The caller's transaction rolls back after the file's written, so the file has no
+	// row, and DeleteOrphans cleans it up
+	rolledBack := errors.New("rolled back")
+	err = func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		if _, err = store.Put(conn, "image/png", []byte("avatar")); err != nil {
+			return err
+		}
+		return rolledBack
+	}()
+	assert.ErrorIs(t, err, rolledBack)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	deleted, err := store.DeleteOrphans(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	entries, err = os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,102 @@
+package entropy
+
+import (
+	"encoding/json"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Views of a post by the same person only count once in this long
+const PostViewWindow = 24 * time.Hour
+
+// Count a view of the post's page by viewerUserID. It doesn't count if they wrote the
+// post, or if they already viewed it in the last PostViewWindow. Returns whether it
+// counted.
+//
+// Only logged-in views count: there's no telling logged-out people apart.
+func RecordPostView(conn *sqlite.Conn, postID int64, viewerUserID int64) (bool, error) {
+	now := utcNow()
+	query := `
+		insert into post_view (post_id, viewer_user_id, viewed_at)
+		select post_id, :viewerUserID, :now
+		from post
+		where post_id = :postID
+		and user_id != :viewerUserID
+		and not exists (
+			select 1
+			from post_view
+			where post_id = :postID
+			and viewer_user_id = :viewerUserID
+			and viewed_at > :windowStart
+		)`
+	err := exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":postID", postID)
+		stmt.SetInt64(":viewerUserID", viewerUserID)
+		stmt.SetInt64(":now", now.Unix())
+		stmt.SetInt64(":windowStart", now.Add(-PostViewWindow).Unix())
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return conn.Changes() > 0, nil
+}
+
+// Roll the views that are older than PostViewWindow (which RecordPostView doesn't need
+// anymore) up into post_view_count, and delete them. Returns how many were rolled up.
+func CompactPostViews(conn *sqlite.Conn) (compacted int, err error) {
+	defer sqlitex.Save(conn)(&err)
+	windowStart := utcNow().Add(-PostViewWindow).Unix()
+	query := `
+		insert into post_view_count (post_id, view_count)
+		select post_id, count(*)
+		from post_view
+		where viewed_at <= ?
+		group by 1
+		on conflict (post_id) do update set view_count = view_count + excluded.view_count`
+	if err = sqlitex.Exec(conn, query, nil, windowStart); err != nil {
+		return 0, err
+	}
+	if err = sqlitex.Exec(conn, "delete from post_view where viewed_at <= ?", nil, windowStart); err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
+
+func getViewCountsForPosts(conn *sqlite.Conn, posts []Post) error {
+	query := `
+		select post_id, sum(view_count)
+		from (
+			select post_id, count(*) as view_count
+			from post_view
+			where post_id in (select value from json_each(:postIDsJSON))
+			group by 1
+
+			union all
+
+			select post_id, view_count
+			from post_view_count
+			where post_id in (select value from json_each(:postIDsJSON))
+		)
+		group by 1`
+	postIDs := make([]int64, len(posts))
+	postsByID := make(map[int64]*Post)
+	for i := range posts {
+		postsByID[posts[i].PostID] = &posts[i]
+		postIDs[i] = posts[i].PostID
+	}
+	postIDsJSON, err := json.Marshal(postIDs)
+	if err != nil {
+		return err
+	}
+	collect := func(stmt *sqlite.Stmt) error {
+		postsByID[stmt.ColumnInt64(0)].ViewCount = stmt.ColumnInt(1)
+		return nil
+	}
+	return exec(conn, query, collect, func(stmt *sqlite.Stmt) error {
+		stmt.SetText(":postIDsJSON", string(postIDsJSON))
+		return nil
+	})
+}
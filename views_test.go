@@ -0,0 +1,120 @@
+package entropy
+
+import (
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordPostView(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	author, err := CreateUser(conn, "author", "pass")
+	assert.Nil(t, err)
+	viewer, err := CreateUser(conn, "viewer", "pass")
+	assert.Nil(t, err)
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, author.UserID, "look at me")
+	assert.Nil(t, err)
+
+	viewCount := func() int {
+		post, err := GetPost(conn, postID)
+		assert.Nil(t, err)
+		posts := []Post{*post}
+		assert.Nil(t, DecoratePosts(conn, author, posts))
+		return posts[0].ViewCount
+	}
+
+	counted, err := RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	assert.True(t, counted)
+	// Once per viewer per window
+	counted, err = RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	assert.False(t, counted)
+	// The author looking at their own post doesn't count
+	counted, err = RecordPostView(conn, postID, author.UserID)
+	assert.Nil(t, err)
+	assert.False(t, counted)
+	counted, err = RecordPostView(conn, postID, other.UserID)
+	assert.Nil(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, 2, viewCount())
+
+	// Once the window has passed, the same viewer counts again
+	err = sqlitex.Exec(conn, "update post_view set viewed_at = viewed_at - ?", nil, int64(PostViewWindow.Seconds())+1)
+	assert.Nil(t, err)
+	counted, err = RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, 3, viewCount())
+
+	// Posts that don't exist don't get views
+	counted, err = RecordPostView(conn, postID+1, viewer.UserID)
+	assert.Nil(t, err)
+	assert.False(t, counted)
+}
+
+func TestCompactPostViews(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	author, err := CreateUser(conn, "author", "pass")
+	assert.Nil(t, err)
+	viewer, err := CreateUser(conn, "viewer", "pass")
+	assert.Nil(t, err)
+	postID, err := CreatePost(conn, author.UserID, "look at me")
+	assert.Nil(t, err)
+	viewCount := func() int {
+		post, err := GetPost(conn, postID)
+		assert.Nil(t, err)
+		posts := []Post{*post}
+		assert.Nil(t, DecoratePosts(conn, author, posts))
+		return posts[0].ViewCount
+	}
+	age := func() {
+		err := sqlitex.Exec(conn, "update post_view set viewed_at = viewed_at - ?", nil, int64(PostViewWindow.Seconds())+1)
+		assert.Nil(t, err)
+	}
+
+	// Two old views and a recent one
+	_, err = RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	age()
+	_, err = RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	age()
+	_, err = RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+
+	compacted, err := CompactPostViews(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, compacted)
+	assert.Equal(t, 3, viewCount())
+	// The recent view is still there, so it still dedupes
+	counted, err := RecordPostView(conn, postID, viewer.UserID)
+	assert.Nil(t, err)
+	assert.False(t, counted)
+
+	// Compacting again adds to the rolled-up count
+	age()
+	compacted, err = CompactPostViews(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, compacted)
+	assert.Equal(t, 3, viewCount())
+	var rows int
+	err = sqlitex.Exec(conn, "select count(*) from post_view", func(stmt *sqlite.Stmt) error {
+		rows = stmt.ColumnInt(0)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rows)
+}
@@ -0,0 +1,53 @@
+package entropy
+
+import (
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// We only write down a homepage visit if the last one we wrote down is older than this,
+// so that reloading the homepage isn't a write every time.
+const HomepageVisitDebounce = time.Minute
+
+// Returns when the user last visited the homepage (as of the last time it was
+// recorded), or the zero time if they never have.
+func GetLastHomepageVisit(conn *sqlite.Conn, userID int64) (time.Time, error) {
+	var lastVisit time.Time
+	collect := func(stmt *sqlite.Stmt) error {
+		lastVisit = time.Unix(stmt.ColumnInt64(0), 0).UTC()
+		return nil
+	}
+	query := "select homepage_visited_at from user where user_id = ? and homepage_visited_at is not null"
+	err := sqlitex.Exec(conn, query, collect, userID)
+	return lastVisit, err
+}
+
+// Whether a visit now is worth recording, given the last one that was
+func ShouldRecordHomepageVisit(lastVisit time.Time) bool {
+	return utcNow().Sub(lastVisit) >= HomepageVisitDebounce
+}
+
+func RecordHomepageVisit(conn *sqlite.Conn, userID int64) error {
+	query := "update user set homepage_visited_at = ? where user_id = ?"
+	return sqlitex.Exec(conn, query, nil, utcNow().Unix(), userID)
+}
+
+// Mark the newest post from before lastVisit as the one that a "new posts" divider goes
+// above. (The posts are newest first.) newerAbove is whether there are new posts above
+// these ones, like on the next page of a timeline. We don't mark anything if there aren't
+// any new posts above the divider, or if the user has never visited.
+func MarkLastHomepageVisit(posts []Post, lastVisit time.Time, newerAbove bool) {
+	if lastVisit.IsZero() {
+		return
+	}
+	for i := range posts {
+		if posts[i].CreatedAt.After(lastVisit) {
+			newerAbove = true
+			continue
+		}
+		posts[i].LastVisitDivider = newerAbove
+		return
+	}
+}
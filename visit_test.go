@@ -0,0 +1,75 @@
+package entropy
+
+import (
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordHomepageVisit(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "max", "pass")
+	assert.Nil(t, err)
+	lastVisit, err := GetLastHomepageVisit(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.True(t, lastVisit.IsZero())
+	assert.True(t, ShouldRecordHomepageVisit(lastVisit))
+
+	assert.Nil(t, RecordHomepageVisit(conn, user.UserID))
+	lastVisit, err = GetLastHomepageVisit(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), lastVisit, 2*time.Second)
+	// Not again so soon
+	assert.False(t, ShouldRecordHomepageVisit(lastVisit))
+
+	err = sqlitex.Exec(conn, "update user set homepage_visited_at = homepage_visited_at - 61", nil)
+	assert.Nil(t, err)
+	lastVisit, err = GetLastHomepageVisit(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.True(t, ShouldRecordHomepageVisit(lastVisit))
+}
+
+func TestMarkLastHomepageVisit(t *testing.T) {
+	lastVisit := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	newPosts := func(minutesFromLastVisit ...int) []Post {
+		var posts []Post
+		for _, minutes := range minutesFromLastVisit {
+			posts = append(posts, Post{CreatedAt: lastVisit.Add(time.Duration(minutes) * time.Minute)})
+		}
+		return posts
+	}
+	dividers := func(posts []Post) []bool {
+		var marked []bool
+		for _, post := range posts {
+			marked = append(marked, post.LastVisitDivider)
+		}
+		return marked
+	}
+
+	posts := newPosts(2, 1, -1, -2)
+	MarkLastHomepageVisit(posts, lastVisit, false)
+	assert.Equal(t, []bool{false, false, true, false}, dividers(posts))
+
+	// Nothing new, so no divider, unless there was something new on an earlier page
+	posts = newPosts(-1, -2)
+	MarkLastHomepageVisit(posts, lastVisit, false)
+	assert.Equal(t, []bool{false, false}, dividers(posts))
+	MarkLastHomepageVisit(posts, lastVisit, true)
+	assert.Equal(t, []bool{true, false}, dividers(posts))
+
+	// All new
+	posts = newPosts(2, 1)
+	MarkLastHomepageVisit(posts, lastVisit, false)
+	assert.Equal(t, []bool{false, false}, dividers(posts))
+
+	// Never visited before
+	posts = newPosts(2, -1)
+	MarkLastHomepageVisit(posts, time.Time{}, false)
+	assert.Equal(t, []bool{false, false}, dividers(posts))
+}
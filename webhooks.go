@@ -0,0 +1,317 @@
+package entropy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// A URL that gets sent the new posts from everyone its user follows, for hooking the
+// site up to other things (see SendWebhookDelivery for what gets sent).
+type Webhook struct {
+	WebhookID int64
+	UserID    int64
+	URL       string
+	Secret    string // what the deliveries are signed with, so the receiver can check them
+	CreatedAt time.Time
+}
+
+// How many webhooks one user can have
+const MaxWebhooksPerUser = 5
+
+// Returned by RegisterWebhook
+var (
+	ErrBadWebhookURL   = errors.New("webhook URLs have to be absolute http:// or https:// URLs")
+	ErrTooManyWebhooks = fmt.Errorf("you can't have more than %d webhooks", MaxWebhooksPerUser)
+)
+
+// Add a webhook for the user, with a new random secret
+func RegisterWebhook(conn *sqlite.Conn, userID int64, rawURL string) (webhook *Webhook, err error) {
+	defer sqlitex.Save(conn)(&err)
+	webhookURL := safeLinkURL(rawURL)
+	if webhookURL == "" {
+		return nil, ErrBadWebhookURL
+	}
+	count := 0
+	collect := func(stmt *sqlite.Stmt) error {
+		count = stmt.ColumnInt(0)
+		return nil
+	}
+	if err = sqlitex.Exec(conn, "select count(*) from webhook where user_id = ?", collect, userID); err != nil {
+		return nil, err
+	}
+	if count >= MaxWebhooksPerUser {
+		return nil, ErrTooManyWebhooks
+	}
+	secretBytes := make([]byte, 32)
+	if _, err = rand.Read(secretBytes); err != nil {
+		return nil, err
+	}
+	webhook = &Webhook{
+		UserID:    userID,
+		URL:       webhookURL,
+		Secret:    hex.EncodeToString(secretBytes),
+		CreatedAt: time.Unix(utcNow().Unix(), 0).UTC(),
+	}
+	query := "insert into webhook (user_id, url, secret, created_at) values (?, ?, ?, ?)"
+	if err = sqlitex.Exec(conn, query, nil, userID, webhook.URL, webhook.Secret, webhook.CreatedAt.Unix()); err != nil {
+		return nil, err
+	}
+	webhook.WebhookID = conn.LastInsertRowID()
+	return webhook, nil
+}
+
+// The user's webhooks, oldest first
+func GetWebhooks(conn *sqlite.Conn, userID int64) ([]Webhook, error) {
+	var webhooks []Webhook
+	query := `
+		select webhook_id, user_id, url, secret, created_at
+		from webhook
+		where user_id = ?
+		order by webhook_id`
+	collect := func(stmt *sqlite.Stmt) error {
+		webhooks = append(webhooks, Webhook{
+			WebhookID: stmt.ColumnInt64(0),
+			UserID:    stmt.ColumnInt64(1),
+			URL:       stmt.ColumnText(2),
+			Secret:    stmt.ColumnText(3),
+			CreatedAt: time.Unix(stmt.ColumnInt64(4), 0).UTC(),
+		})
+		return nil
+	}
+	err := sqlitex.Exec(conn, query, collect, userID)
+	return webhooks, err
+}
+
+// Delete one of the user's webhooks, along with anything still waiting to be sent to
+// it. Returns false if they don't have a webhook with that ID.
+func DeleteWebhook(conn *sqlite.Conn, userID int64, webhookID int64) (deleted bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+	query := "delete from webhook where webhook_id = ? and user_id = ?"
+	if err = sqlitex.Exec(conn, query, nil, webhookID, userID); err != nil {
+		return false, err
+	}
+	if conn.Changes() == 0 {
+		return false, nil
+	}
+	err = sqlitex.Exec(conn, "delete from webhook_delivery where webhook_id = ?", nil, webhookID)
+	return err == nil, err
+}
+
+// Queue the new post up for the webhooks of everyone who follows its author
+func queueWebhookDeliveries(conn *sqlite.Conn, postID int64, authorUserID int64) error {
+	query := `
+		insert into webhook_delivery (webhook_id, post_id, next_attempt_at)
+		select webhook.webhook_id, :postID, :now
+		from user_follow
+		join webhook using (user_id)
+		where user_follow.followed_user_id = :authorUserID`
+	return exec(conn, query, nil, func(stmt *sqlite.Stmt) error {
+		stmt.SetInt64(":postID", postID)
+		stmt.SetInt64(":now", utcNow().Unix())
+		stmt.SetInt64(":authorUserID", authorUserID)
+		return nil
+	})
+}
+
+// How many times we try to send a post to a webhook before giving up on it, and how
+// long we wait after the first failed try. The wait doubles after each one after that.
+const (
+	WebhookMaxAttempts  = 5
+	webhookRetryBackoff = 30 * time.Second
+)
+
+// A post to send to a webhook
+type WebhookDelivery struct {
+	WebhookDeliveryID int64
+	WebhookURL        string
+	WebhookSecret     string
+	WebhookUserID     int64
+	Attempts          int  // how many times we've tried to send it already
+	Post              Post // distorted for the webhook's user
+}
+
+// Get the deliveries that are ready to be sent (or tried again), oldest first, with each
+// post distorted for how far its author is from the webhook's user. Each one should be
+// sent with SendWebhookDelivery, and then finished with FinishWebhookDelivery.
+//
+// Nothing stops two callers from getting the same deliveries, so there should only be
+// one thing sending them (the server's dispatcher).
+func GetDueWebhookDeliveries(conn *sqlite.Conn, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	query := `
+		select
+			webhook_delivery.webhook_delivery_id,
+			webhook.url,
+			webhook.secret,
+			webhook.user_id,
+			webhook_delivery.attempts,
+			post.post_id,
+			user.user_id,
+			user.user_name,
+			user.display_name,
+			post.created_at,
+			post.content
+		from webhook_delivery
+		join webhook using (webhook_id)
+		join post using (post_id)
+		join user on user.user_id = post.user_id
+		where webhook_delivery.next_attempt_at <= ?
+		order by webhook_delivery.next_attempt_at, webhook_delivery.webhook_delivery_id
+		limit ?`
+	collect := func(stmt *sqlite.Stmt) error {
+		deliveries = append(deliveries, WebhookDelivery{
+			WebhookDeliveryID: stmt.ColumnInt64(0),
+			WebhookURL:        stmt.ColumnText(1),
+			WebhookSecret:     stmt.ColumnText(2),
+			WebhookUserID:     stmt.ColumnInt64(3),
+			Attempts:          stmt.ColumnInt(4),
+			Post: Post{
+				PostID:          stmt.ColumnInt64(5),
+				UserID:          stmt.ColumnInt64(6),
+				UserName:        stmt.ColumnText(7),
+				UserDisplayName: stmt.ColumnText(8),
+				CreatedAt:       time.UnixMilli(stmt.ColumnInt64(9)).UTC(),
+				Content:         stmt.ColumnText(10),
+			},
+		})
+		return nil
+	}
+	if err := sqlitex.Exec(conn, query, collect, utcNow().Unix(), limit); err != nil {
+		return nil, err
+	}
+	if err := distortWebhookDeliveries(conn, deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Distort each delivery's post the way its webhook's user would see it on the site
+func distortWebhookDeliveries(conn *sqlite.Conn, deliveries []WebhookDelivery) error {
+	authorIDsByUser := make(map[int64][]int64)
+	for i := range deliveries {
+		d := &deliveries[i]
+		authorIDsByUser[d.WebhookUserID] = append(authorIDsByUser[d.WebhookUserID], d.Post.UserID)
+	}
+	distancesByUser := make(map[int64]map[int64]int)
+	for userID, authorIDs := range authorIDsByUser {
+		distances, err := lookUpDistancesFromUser(conn, userID, authorIDs)
+		if err != nil {
+			return err
+		}
+		distancesByUser[userID] = distances
+	}
+	rng := newRand()
+	for i := range deliveries {
+		post := &deliveries[i].Post
+		post.DistanceFromUser = distancesByUser[deliveries[i].WebhookUserID][post.UserID]
+		distortPost(rng, post, post.DistanceFromUser)
+	}
+	return nil
+}
+
+// The JSON body of a webhook delivery. The content is distorted just like it would be for
+// the webhook's user on the site (see GetDueWebhookDeliveries).
+type WebhookPayload struct {
+	PostID      int64     `json:"post_id"`
+	URL         string    `json:"url"`
+	UserName    string    `json:"user_name"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+	Content     string    `json:"content"`
+}
+
+// The header with the signature of a delivery's body
+const WebhookSignatureHeader = "X-Entropych-Signature"
+
+// "sha256=" and then the hex HMAC-SHA256 of the body, like GitHub's webhooks
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check that header (the X-Entropych-Signature of a delivery) is the signature of body
+// with the webhook's secret, for whatever's receiving the webhook. The comparison takes
+// the same time whether or not it matches.
+func VerifyWebhookSignature(secret string, body []byte, header string) bool {
+	hexMAC, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(hexMAC)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// POST the delivery's post to its webhook, as a WebhookPayload, signed with the webhook's
+// secret. Anything but a 2xx response counts as a failure.
+//
+// baseURL is the scheme and host to put in front of the post's URL, e.g.
+// "https://entropych.maxhully.net".
+func SendWebhookDelivery(ctx context.Context, client *http.Client, delivery *WebhookDelivery, baseURL string) error {
+	post := &delivery.Post
+	body, err := json.Marshal(WebhookPayload{
+		PostID:      post.PostID,
+		URL:         post.AbsoluteURL(baseURL),
+		UserName:    post.UserName,
+		DisplayName: post.UserDisplayName,
+		CreatedAt:   post.CreatedAt,
+		Content:     post.Content,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signWebhookBody(delivery.WebhookSecret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read (a little of) the body, so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s returned %s", delivery.WebhookURL, resp.Status)
+	}
+	return nil
+}
+
+// Record how sending the delivery went (sendErr is what SendWebhookDelivery returned).
+// It's done if it worked, or if this was its last try (see WebhookMaxAttempts).
+// Otherwise it's tried again after a while. Returns whether we gave up on it.
+func FinishWebhookDelivery(conn *sqlite.Conn, delivery *WebhookDelivery, sendErr error) (gaveUp bool, err error) {
+	attempts := delivery.Attempts + 1
+	if sendErr == nil || attempts >= WebhookMaxAttempts {
+		query := "delete from webhook_delivery where webhook_delivery_id = ?"
+		return sendErr != nil, sqlitex.Exec(conn, query, nil, delivery.WebhookDeliveryID)
+	}
+	backoff := webhookRetryBackoff << (attempts - 1)
+	query := `
+		update webhook_delivery
+		set attempts = ?, next_attempt_at = ?
+		where webhook_delivery_id = ?`
+	err = sqlitex.Exec(conn, query, nil, attempts, utcNow().Add(backoff).Unix(), delivery.WebhookDeliveryID)
+	return false, err
+}
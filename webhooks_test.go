@@ -0,0 +1,148 @@
+package entropy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterWebhook(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	user, err := CreateUser(conn, "me", "pass")
+	assert.Nil(t, err)
+	for _, badURL := range []string{"", "/relative", "javascript:alert(1)", "ftp://example.com/"} {
+		_, err = RegisterWebhook(conn, user.UserID, badURL)
+		assert.ErrorIs(t, err, ErrBadWebhookURL)
+	}
+
+	webhook, err := RegisterWebhook(conn, user.UserID, "https://example.com/hook")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com/hook", webhook.URL)
+	assert.Len(t, webhook.Secret, 64)
+	for range MaxWebhooksPerUser - 1 {
+		_, err = RegisterWebhook(conn, user.UserID, "https://example.com/another")
+		assert.Nil(t, err)
+	}
+	_, err = RegisterWebhook(conn, user.UserID, "https://example.com/one-too-many")
+	assert.ErrorIs(t, err, ErrTooManyWebhooks)
+
+	webhooks, err := GetWebhooks(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, webhooks, MaxWebhooksPerUser)
+	assert.Equal(t, *webhook, webhooks[0])
+
+	// Someone else can't delete it
+	other, err := CreateUser(conn, "other", "pass")
+	assert.Nil(t, err)
+	deleted, err := DeleteWebhook(conn, other.UserID, webhook.WebhookID)
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	deleted, err = DeleteWebhook(conn, user.UserID, webhook.WebhookID)
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	webhooks, err = GetWebhooks(conn, user.UserID)
+	assert.Nil(t, err)
+	assert.Len(t, webhooks, MaxWebhooksPerUser-1)
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	secret := "s3cret"
+	body := []byte(`{"post_id":1,"content":"hello"}`)
+	signature := signWebhookBody(secret, body)
+	assert.True(t, VerifyWebhookSignature(secret, body, signature))
+
+	assert.False(t, VerifyWebhookSignature(secret, []byte(`{"post_id":1,"content":"goodbye"}`), signature))
+	assert.False(t, VerifyWebhookSignature("wrong secret", body, signature))
+	assert.False(t, VerifyWebhookSignature(secret, body, strings.TrimPrefix(signature, "sha256=")))
+	assert.False(t, VerifyWebhookSignature(secret, body, "sha256=not hex"))
+	assert.False(t, VerifyWebhookSignature(secret, body, ""))
+}
+
+func countWebhookDeliveries(t *testing.T, conn *sqlite.Conn) int {
+	count, err := sqlitex.ResultInt(conn.Prep("select count(*) from webhook_delivery"))
+	assert.Nil(t, err)
+	return count
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	db := setUpTestDB(t)
+	defer db.Close()
+	conn := db.Get(t.Context())
+	defer db.Put(conn)
+
+	author, err := CreateUser(conn, "author", "pass")
+	assert.Nil(t, err)
+	follower, err := CreateUser(conn, "follower", "pass")
+	assert.Nil(t, err)
+	stranger, err := CreateUser(conn, "stranger", "pass")
+	assert.Nil(t, err)
+	follow(t, conn, follower.UserID, author.UserID)
+	webhook, err := RegisterWebhook(conn, follower.UserID, "https://example.com/follower")
+	assert.Nil(t, err)
+	_, err = RegisterWebhook(conn, stranger.UserID, "https://example.com/stranger")
+	assert.Nil(t, err)
+
+	postID, err := CreatePost(conn, author.UserID, "hello followers")
+	assert.Nil(t, err)
+	// The follower posting doesn't send anything to their own webhook
+	_, err = CreatePost(conn, follower.UserID, "hello author")
+	assert.Nil(t, err)
+
+	deliveries, err := GetDueWebhookDeliveries(conn, 10)
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 1)
+	delivery := deliveries[0]
+	assert.Equal(t, webhook.URL, delivery.WebhookURL)
+	assert.Equal(t, webhook.Secret, delivery.WebhookSecret)
+	assert.Equal(t, postID, delivery.Post.PostID)
+	assert.Equal(t, "author", delivery.Post.UserName)
+	assert.Equal(t, 1, delivery.Post.DistanceFromUser)
+	assert.Equal(t, utf8.RuneCountInString("hello followers"), utf8.RuneCountInString(delivery.Post.Content))
+
+	// A failure puts it off until later...
+	sendErr := errors.New("nope")
+	gaveUp, err := FinishWebhookDelivery(conn, &delivery, sendErr)
+	assert.Nil(t, err)
+	assert.False(t, gaveUp)
+	deliveries, err = GetDueWebhookDeliveries(conn, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, deliveries)
+	assert.Equal(t, 1, countWebhookDeliveries(t, conn))
+
+	// ...until the last try
+	delivery.Attempts = WebhookMaxAttempts - 1
+	gaveUp, err = FinishWebhookDelivery(conn, &delivery, sendErr)
+	assert.Nil(t, err)
+	assert.True(t, gaveUp)
+	assert.Equal(t, 0, countWebhookDeliveries(t, conn))
+
+	// The post is distorted for how far the author is when it's sent, not when it was queued
+	_, err = CreatePost(conn, author.UserID, "hello again")
+	assert.Nil(t, err)
+	_, err = UnfollowUser(conn, follower.UserID, author.UserID)
+	assert.Nil(t, err)
+	deliveries, err = GetDueWebhookDeliveries(conn, 10)
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, MaxDistortionLevel, deliveries[0].Post.DistanceFromUser)
+	_, err = FinishWebhookDelivery(conn, &deliveries[0], nil)
+	assert.Nil(t, err)
+	follow(t, conn, follower.UserID, author.UserID)
+
+	// And deleting the webhook deletes what's waiting to be sent to it
+	_, err = CreatePost(conn, author.UserID, "hello again")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countWebhookDeliveries(t, conn))
+	_, err = DeleteWebhook(conn, follower.UserID, webhook.WebhookID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countWebhookDeliveries(t, conn))
+}